@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// Bearer identifies requests that carry an "Authorization: Bearer" token, for
+// scripts and other clients without a browser session. Requests without one
+// are left to Fallback.
+type Bearer struct {
+	// Authenticate returns the user a token belongs to, or an error if it
+	// isn't valid.
+	Authenticate func(ctx context.Context, token string) (*User, error)
+
+	// PathPrefixes, if set, limits where tokens are accepted. Elsewhere the
+	// Authorization header is left alone for Fallback.
+	PathPrefixes []string
+
+	Fallback Provider
+}
+
+var _ Provider = (*Bearer)(nil)
+
+func (b *Bearer) accepts(path string) bool {
+	if len(b.PathPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range b.PathPrefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bearer) Protect(upstream http.Handler) http.Handler {
+	fallback := b.Fallback.Protect(upstream)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		authorization := req.Header.Get("Authorization")
+		scheme, token, _ := strings.Cut(authorization, " ")
+		if !strings.EqualFold(scheme, "Bearer") || !b.accepts(req.URL.Path) {
+			fallback.ServeHTTP(rw, req)
+			return
+		}
+
+		user, err := b.Authenticate(req.Context(), strings.TrimSpace(token))
+		if err != nil {
+			rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		// The token is for us, not for anything we pass the request on to.
+		req.Header.Del("Authorization")
+		upstream.ServeHTTP(rw, req.WithContext(withUser(req.Context(), user)))
+	})
+}
@@ -2,14 +2,18 @@ package auth
 
 import (
 	"context"
+	"encoding/base64"
 	"log"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 
 	"github.com/dghubble/gologin/v2"
 	"github.com/dghubble/gologin/v2/github"
+	oauth2Login "github.com/dghubble/gologin/v2/oauth2"
 	"github.com/dghubble/sessions"
 	"golang.org/x/oauth2"
 	githubOAuth2 "golang.org/x/oauth2/github"
@@ -18,24 +22,178 @@ import (
 const (
 	sessionUserKey  = "githubID"
 	sessionUsername = "githubUsername"
+	sessionToken    = "token"
 )
 
+// Auth keeps people logged in with a session cookie, once they've logged in
+// with one of its Providers.
 type Auth struct {
-	GithubClientID     string
-	GithubClientSecret string
-	GithubRedirectURL  string
+	// Providers are the ways people can log in. Anyone without a session is
+	// sent to log in with the first.
+	Providers []LoginProvider
 
 	SessionName  string
 	SessionStore sessions.Store[string]
-	StateConfig  gologin.CookieConfig
+
+	// Sessions, if set, records sessions on the server, so they expire after
+	// SessionTTL, get a new token every SessionRotateAfter, and can be
+	// revoked. Without it, a session lasts as long as its cookie.
+	Sessions           Sessions
+	SessionTTL         time.Duration
+	SessionRotateAfter time.Duration
 
 	DefaultLoginRedirect  string
 	DefaultLogoutRedirect string
 }
 
+// LoginFunc starts a session for username, once a LoginProvider has
+// established who someone is, and sends them on to redirect, which should be
+// whatever LoginRedirect was when they started logging in.
+type LoginFunc func(rw http.ResponseWriter, req *http.Request, username, redirect string)
+
+// LoginProvider is a way to log in to Auth.
+type LoginProvider interface {
+	// LoginPath is where to send people to log in.
+	LoginPath() string
+
+	// Register adds the provider's routes, which call login once they know
+	// who someone is.
+	Register(router *httprouter.Router, login LoginFunc)
+}
+
+var (
+	_ LoginProvider = (*Github)(nil)
+	_ LoginProvider = (*OIDC)(nil)
+	_ LoginProvider = (*Password)(nil)
+)
+
+// Github logs people in with GitHub, as their GitHub login.
+type Github struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// Endpoint, if set, is a GitHub Enterprise server to log in with
+	// instead of github.com. Its API is expected under /api/v3/.
+	Endpoint *oauth2.Endpoint
+
+	StateConfig gologin.CookieConfig
+}
+
+func (g *Github) LoginPath() string {
+	return "/auth/github/login"
+}
+
+func (g *Github) stateCookie(value string, maxAge int) *http.Cookie {
+	return newStateCookie(g.StateConfig, "substrate-github-state", value, maxAge)
+}
+
+// loginStateHandler is like gologin's StateHandler, but it always starts a
+// new state, which carries where to go once logged in.
+func (g *Github) loginStateHandler(success http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		state, err := randomString()
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		state += "." + base64.RawURLEncoding.EncodeToString([]byte(LoginRedirect(req)))
+		http.SetCookie(rw, g.stateCookie(state, g.StateConfig.MaxAge))
+		success.ServeHTTP(rw, req.WithContext(oauth2Login.WithState(req.Context(), state)))
+	})
+}
+
+// callbackStateHandler gives the callback the state from the cookie, for
+// gologin to check against the one GitHub sends back.
+func (g *Github) callbackStateHandler(success http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		ctx := req.Context()
+		if cookie, err := req.Cookie(g.stateCookie("", 0).Name); err == nil {
+			ctx = oauth2Login.WithState(ctx, cookie.Value)
+		}
+		http.SetCookie(rw, g.stateCookie("", -1))
+		success.ServeHTTP(rw, req.WithContext(ctx))
+	})
+}
+
+func (g *Github) Register(router *httprouter.Router, login LoginFunc) {
+	issueSession := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		githubUser, err := github.UserFromContext(req.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The state was checked already, so it's the one we made.
+		state, _ := oauth2Login.StateFromContext(req.Context())
+		_, encoded, _ := strings.Cut(state, ".")
+		redirect, _ := base64.RawURLEncoding.DecodeString(encoded)
+		login(w, req, *githubUser.Login, string(redirect))
+	})
+
+	oauth2Config := &oauth2.Config{
+		ClientID:     g.ClientID,
+		ClientSecret: g.ClientSecret,
+		RedirectURL:  g.RedirectURL,
+		Endpoint:     githubOAuth2.Endpoint,
+	}
+	callbackHandler := github.CallbackHandler
+	if g.Endpoint != nil {
+		oauth2Config.Endpoint = *g.Endpoint
+		callbackHandler = github.EnterpriseCallbackHandler
+	}
+	router.Handle("GET", "/auth/github/login", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		g.loginStateHandler(github.LoginHandler(oauth2Config, nil)).ServeHTTP(rw, req)
+	})
+	router.Handle("GET", "/auth/github/callback", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		g.callbackStateHandler(callbackHandler(oauth2Config, issueSession, nil)).ServeHTTP(rw, req)
+	})
+}
+
 type User struct {
 	// GithubID       string
 	GithubUsername string
+
+	// Scopes limits what a request made with a token may do. It's nil for
+	// requests made with a session, which may do anything.
+	Scopes []string
+
+	// Spaces, if not nil, are the only spaces a request may use. It's set
+	// for tokens minted for a single spawn.
+	Spaces []string
+
+	// SessionID is the ID of the server-side session the request was made
+	// with, if any.
+	SessionID string
+}
+
+// HasScope reports whether u may do what scope allows.
+func (u *User) HasScope(scope string) bool {
+	if u.Scopes == nil {
+		return true
+	}
+	if scope == "" {
+		return false
+	}
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// CanUseSpace reports whether u may use the space with the given ID at all.
+// It says nothing of their role on it.
+func (u *User) CanUseSpace(spaceID string) bool {
+	if u.Spaces == nil {
+		return true
+	}
+	for _, s := range u.Spaces {
+		if s == spaceID {
+			return true
+		}
+	}
+	return false
 }
 
 var userContextKey = struct{}{}
@@ -45,12 +203,6 @@ func withUser(ctx context.Context, user *User) context.Context {
 }
 
 func UserFromContext(ctx context.Context) (*User, bool) {
-	// HACK hardcode this
-	return &User{
-		GithubUsername: "nobody",
-	}, true
-
-
 	v := ctx.Value(userContextKey)
 	if v != nil {
 		user, ok := v.(*User)
@@ -68,76 +220,118 @@ func (a *Auth) Protect(upstream http.Handler) http.Handler {
 	router.HandleMethodNotAllowed = false
 	router.RedirectFixedPath = false
 
-	issueSession := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		ctx := req.Context()
-		githubUser, err := github.UserFromContext(ctx)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-
+	login := func(w http.ResponseWriter, req *http.Request, username, redirect string) {
 		session := a.SessionStore.New(a.SessionName)
-		// session.Set(sessionUserKey, *githubUser.ID)
-		session.Set(sessionUsername, *githubUser.Login)
+		session.Set(sessionUsername, username)
+		if a.Sessions != nil {
+			token, err := randomString()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			now := time.Now()
+			err = a.Sessions.CreateSession(req.Context(), &Session{
+				User:       username,
+				CreatedAt:  now,
+				ExpiresAt:  now.Add(a.sessionTTL()),
+				RotatedAt:  now,
+				LastSeenAt: now,
+				UserAgent:  req.UserAgent(),
+				RemoteAddr: req.RemoteAddr,
+			}, token)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			session.Set(sessionToken, token)
+		}
 		if err := session.Save(w); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		// TODO read original redirect parameter
-		http.Redirect(w, req, a.DefaultLoginRedirect, http.StatusFound)
-	})
+		http.Redirect(w, req, localRedirect(redirect, a.DefaultLoginRedirect), http.StatusFound)
+	}
 
-	oauth2Config := &oauth2.Config{
-		ClientID:     a.GithubClientID,
-		ClientSecret: a.GithubClientSecret,
-		RedirectURL:  a.GithubRedirectURL,
-		Endpoint:     githubOAuth2.Endpoint,
+	for _, provider := range a.Providers {
+		provider.Register(router, login)
 	}
-	router.Handle("GET", "/auth/github/login", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-		log.Printf("oauth2Config=%#v", oauth2Config)
-		github.StateHandler(a.StateConfig, github.LoginHandler(oauth2Config, nil)).ServeHTTP(rw, req)
-	})
-	router.Handle("GET", "/auth/github/callback", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-		github.StateHandler(a.StateConfig, github.CallbackHandler(oauth2Config, issueSession, nil)).ServeHTTP(rw, req)
-	})
+
 	router.Handle("POST", "/auth/logout", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		if session, err := a.SessionStore.Get(req, a.SessionName); err == nil && a.Sessions != nil {
+			s, _, err := a.Sessions.FindSession(req.Context(), session.Get(sessionToken))
+			if err == nil && s != nil {
+				err = a.Sessions.DeleteSession(req.Context(), s.ID)
+			}
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
 		a.SessionStore.Destroy(rw, a.SessionName)
 		http.Redirect(rw, req, a.DefaultLogoutRedirect, http.StatusFound)
 	})
 
-	router.NotFound = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-		log.Printf("%s %s %s", req.RemoteAddr, req.Method, req.URL.Path)
+	sendToLogin := func(rw http.ResponseWriter, req *http.Request) {
+		if len(a.Providers) == 0 {
+			http.Error(rw, "no way to log in", http.StatusUnauthorized)
+			return
+		}
+		redirect, _ := url.Parse(a.Providers[0].LoginPath())
+		redirectQuery := redirect.Query()
+		redirectQuery.Add("redirect", req.URL.RequestURI())
+		redirect.RawQuery = redirectQuery.Encode()
+
+		// If we're going to redirect, we must be careful to set content-type ahead of time, otherwise golang sends a 406 if accept doesn't accept text/html
+		accept := req.Header.Get("Accept")
+		if accept != "" {
+			rw.Header().Set("Content-Type", accept)
+		}
 
-		cookie := req.Header.Get("Cookie")
-		log.Printf("cookie=%s", cookie)
+		http.Redirect(rw, req, redirect.String(), http.StatusTemporaryRedirect)
+	}
 
+	router.NotFound = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		session, err := a.SessionStore.Get(req, a.SessionName)
 		if err != nil {
 			log.Printf("%s %s %s err=%s", req.RemoteAddr, req.Method, req.URL.Path, err)
-			redirect, _ := url.Parse("/auth/github/login")
-			redirectQuery := redirect.Query()
-			redirectQuery.Add("redirect", req.URL.Path)
-			redirect.RawQuery = redirectQuery.Encode()
-
-			// If we're going to redirect, we must be careful to set content-type ahead of time, otherwise golang sends a 406 if accept doesn't accept text/html
-			accept := req.Header.Get("Accept")
-			if accept != "" {
-				rw.Header().Set("Content-Type", accept)
-			}
-
-			log.Printf("accept=%s", accept)
+			sendToLogin(rw, req)
+			return
+		}
 
-			http.Redirect(rw, req, redirect.String(), http.StatusTemporaryRedirect)
+		username := session.Get(sessionUsername)
+		if username == "" {
+			http.Error(rw, "session has no user", http.StatusUnauthorized)
 			return
 		}
 
-		req = req.WithContext(withUser(req.Context(), &User{
+		user := &User{
 			// GithubID:       session.Get(sessionUserKey),
-			GithubUsername: session.Get(sessionUsername),
-		}))
+			GithubUsername: username,
+		}
+
+		if a.Sessions != nil {
+			s, newToken, err := a.checkSession(req.Context(), session.Get(sessionToken), time.Now())
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if s == nil || s.User != username {
+				a.SessionStore.Destroy(rw, a.SessionName)
+				sendToLogin(rw, req)
+				return
+			}
+			if newToken != "" {
+				session.Set(sessionToken, newToken)
+				if err := session.Save(rw); err != nil {
+					http.Error(rw, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			user.SessionID = s.ID
+		}
 
-		upstream.ServeHTTP(rw, req)
+		upstream.ServeHTTP(rw, req.WithContext(withUser(req.Context(), user)))
 	})
 
 	return router
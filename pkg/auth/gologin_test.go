@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/dghubble/gologin/v2"
+	"github.com/dghubble/sessions"
+	"golang.org/x/oauth2"
+)
+
+// newFakeGithub serves just enough of GitHub's OAuth flow and API to log in as
+// login.
+func newFakeGithub(t *testing.T, login string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oauth/authorize", func(rw http.ResponseWriter, req *http.Request) {
+		redirect, err := url.Parse(req.URL.Query().Get("redirect_uri"))
+		if err != nil {
+			t.Errorf("bad redirect_uri: %s", err)
+			return
+		}
+		q := redirect.Query()
+		q.Set("code", "fake-code")
+		q.Set("state", req.URL.Query().Get("state"))
+		redirect.RawQuery = q.Encode()
+		http.Redirect(rw, req, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/login/oauth/access_token", func(rw http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("bad token request: %s", err)
+			return
+		}
+		if code := req.PostForm.Get("code"); code != "fake-code" {
+			http.Error(rw, "bad code "+code, http.StatusBadRequest)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]string{
+			"access_token": "fake-token",
+			"token_type":   "bearer",
+		})
+	})
+	mux.HandleFunc("/api/v3/user", func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer fake-token" {
+			http.Error(rw, "bad token", http.StatusUnauthorized)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]any{"id": 1, "login": login})
+	})
+	return httptest.NewServer(mux)
+}
+
+func whoami(rw http.ResponseWriter, req *http.Request) {
+	user, ok := UserFromContext(req.Context())
+	if !ok {
+		http.Error(rw, "no user", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(rw, user.GithubUsername)
+}
+
+// newProtectedServer serves whoami behind a, with its providers' redirect URLs
+// pointing back at the server.
+func newProtectedServer(a *Auth) *httptest.Server {
+	server := httptest.NewUnstartedServer(nil)
+	origin := "http://" + server.Listener.Addr().String()
+	for _, provider := range a.Providers {
+		switch provider := provider.(type) {
+		case *Github:
+			provider.RedirectURL = origin + "/auth/github/callback"
+		case *OIDC:
+			provider.RedirectURL = origin + "/auth/" + provider.name() + "/callback"
+		}
+	}
+	server.Config.Handler = a.Protect(http.HandlerFunc(whoami))
+	server.Start()
+	return server
+}
+
+func get(t *testing.T, client *http.Client, u string) (int, string) {
+	t.Helper()
+	resp, err := client.Get(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestGithubLogin(t *testing.T) {
+	github := newFakeGithub(t, "octocat")
+	defer github.Close()
+
+	a := &Auth{
+		Providers: []LoginProvider{&Github{
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+			Endpoint: &oauth2.Endpoint{
+				AuthURL:  github.URL + "/login/oauth/authorize",
+				TokenURL: github.URL + "/login/oauth/access_token",
+			},
+			StateConfig: gologin.DebugOnlyCookieConfig,
+		}},
+
+		SessionName:  "test-session",
+		SessionStore: sessions.NewCookieStore[string](sessions.DebugCookieConfig, []byte("0123456789abcdef0123456789abcdef")),
+
+		DefaultLoginRedirect:  "/whoami",
+		DefaultLogoutRedirect: "/auth/github/login",
+	}
+	server := newProtectedServer(a)
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Jar: jar}
+
+	noRedirects := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	status, _ := get(t, noRedirects, server.URL+"/whoami")
+	if status != http.StatusTemporaryRedirect {
+		t.Fatalf("expected a redirect to log in without a session, got %d", status)
+	}
+
+	status, body := get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || body != "octocat" {
+		t.Fatalf("expected to be logged in as octocat, got %d %q", status, body)
+	}
+
+	// The session is enough from now on.
+	github.Close()
+	status, body = get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || body != "octocat" {
+		t.Fatalf("expected the session to identify octocat, got %d %q", status, body)
+	}
+}
+
+func TestGithubLoginFailure(t *testing.T) {
+	github := newFakeGithub(t, "octocat")
+	defer github.Close()
+
+	a := &Auth{
+		Providers: []LoginProvider{&Github{
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+			Endpoint: &oauth2.Endpoint{
+				AuthURL: github.URL + "/login/oauth/authorize",
+				// Every code is refused here.
+				TokenURL: github.URL + "/nowhere",
+			},
+			StateConfig: gologin.DebugOnlyCookieConfig,
+		}},
+
+		SessionName:  "test-session",
+		SessionStore: sessions.NewCookieStore[string](sessions.DebugCookieConfig, []byte("0123456789abcdef0123456789abcdef")),
+
+		DefaultLoginRedirect: "/whoami",
+	}
+	server := newProtectedServer(a)
+	defer server.Close()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, body := get(t, &http.Client{Jar: jar}, server.URL+"/auth/github/login")
+	if status == http.StatusOK {
+		t.Fatalf("expected login to fail, got %d %q", status, body)
+	}
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Provider establishes who is making each request. Protect only passes a
+// request upstream once it knows the user, who is then available from
+// UserFromContext.
+type Provider interface {
+	Protect(upstream http.Handler) http.Handler
+}
+
+var (
+	_ Provider = (*Auth)(nil)
+	_ Provider = (*TrustedHeader)(nil)
+	_ Provider = (*StaticUser)(nil)
+	_ Provider = (*Tailnet)(nil)
+)
+
+// TrustedHeader takes the user from a header set by an authenticating proxy in
+// front of substrate. Requests without the header are refused.
+type TrustedHeader struct {
+	// Header holds the username, e.g. X-Forwarded-User.
+	Header string
+
+	// TrustedProxies, if set, are the only peers allowed to send requests. Use
+	// it whenever substrate can be reached without going through the proxy,
+	// since anyone who can reach it directly can claim to be anyone.
+	TrustedProxies []*net.IPNet
+}
+
+func (t *TrustedHeader) trusts(remoteAddr string) bool {
+	if len(t.TrustedProxies) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range t.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TrustedHeader) Protect(upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !t.trusts(req.RemoteAddr) {
+			http.Error(rw, "requests must come through the authenticating proxy", http.StatusForbidden)
+			return
+		}
+
+		username := req.Header.Get(t.Header)
+		if username == "" {
+			http.Error(rw, "missing "+t.Header+" header", http.StatusUnauthorized)
+			return
+		}
+
+		req = req.WithContext(withUser(req.Context(), &User{
+			GithubUsername: username,
+		}))
+
+		upstream.ServeHTTP(rw, req)
+	})
+}
+
+// StaticUser treats every request as coming from the same user. It's meant for
+// local development, where there's no one to log in.
+type StaticUser struct {
+	User User
+}
+
+func (s *StaticUser) Protect(upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user := s.User
+		upstream.ServeHTTP(rw, req.WithContext(withUser(req.Context(), &user)))
+	})
+}
+
+// Tailnet takes the user from the tailnet node each request comes from, so
+// anyone on the tailnet is logged in as themselves. Requests that don't come
+// from a user's node are refused.
+type Tailnet struct {
+	// WhoIs returns the login name of the user whose node is on the other end
+	// of a connection from remoteAddr, e.g. alice@example.com.
+	WhoIs func(ctx context.Context, remoteAddr string) (string, error)
+
+	// Usernames maps login names to substrate usernames. Other login names
+	// are used as they are, except that GitHub logins like alice@github
+	// become just the GitHub username.
+	Usernames map[string]string
+}
+
+func (t *Tailnet) username(loginName string) string {
+	if username, ok := t.Usernames[loginName]; ok {
+		return username
+	}
+	if strings.HasSuffix(loginName, "@github") {
+		return strings.TrimSuffix(loginName, "@github")
+	}
+	return loginName
+}
+
+func (t *Tailnet) Protect(upstream http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		loginName, err := t.WhoIs(req.Context(), req.RemoteAddr)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+
+		req = req.WithContext(withUser(req.Context(), &User{
+			GithubUsername: t.username(loginName),
+		}))
+
+		upstream.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,155 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func serve(p Provider, header http.Header, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/whoami", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	rw := httptest.NewRecorder()
+	p.Protect(http.HandlerFunc(whoami)).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestTrustedHeader(t *testing.T) {
+	_, proxies, err := net.ParseCIDR("10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &TrustedHeader{
+		Header:         "X-Forwarded-User",
+		TrustedProxies: []*net.IPNet{proxies},
+	}
+
+	rw := serve(p, http.Header{"X-Forwarded-User": {"alice"}}, "10.1.2.3:5555")
+	if rw.Code != http.StatusOK || rw.Body.String() != "alice" {
+		t.Fatalf("expected alice, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = serve(p, nil, "10.1.2.3:5555")
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a request without the header to be refused, got %d", rw.Code)
+	}
+
+	rw = serve(p, http.Header{"X-Forwarded-User": {"alice"}}, "192.168.1.1:5555")
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("expected a request from outside the proxy to be refused, got %d", rw.Code)
+	}
+}
+
+func TestStaticUser(t *testing.T) {
+	p := &StaticUser{User: User{GithubUsername: "dev"}}
+
+	rw := serve(p, http.Header{"X-Forwarded-User": {"alice"}}, "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "dev" {
+		t.Fatalf("expected dev, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestTailnet(t *testing.T) {
+	p := &Tailnet{
+		WhoIs: func(ctx context.Context, remoteAddr string) (string, error) {
+			switch remoteAddr {
+			case "100.64.0.1:5555":
+				return "alice@github", nil
+			case "100.64.0.2:5555":
+				return "bob@example.com", nil
+			case "100.64.0.3:5555":
+				return "carol@example.com", nil
+			}
+			return "", fmt.Errorf("no node for %s", remoteAddr)
+		},
+		Usernames: map[string]string{"carol@example.com": "carol"},
+	}
+
+	for remoteAddr, expect := range map[string]string{
+		"100.64.0.1:5555": "alice",
+		"100.64.0.2:5555": "bob@example.com",
+		"100.64.0.3:5555": "carol",
+	} {
+		rw := serve(p, http.Header{"X-Forwarded-User": {"mallory"}}, remoteAddr)
+		if rw.Code != http.StatusOK || rw.Body.String() != expect {
+			t.Fatalf("expected %s, got %d %q", expect, rw.Code, rw.Body.String())
+		}
+	}
+
+	rw := serve(p, nil, "192.168.1.1:5555")
+	if rw.Code != http.StatusForbidden {
+		t.Fatalf("expected a request from outside the tailnet to be refused, got %d", rw.Code)
+	}
+}
+
+func TestUserFromContextWithoutUser(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	if user, ok := UserFromContext(req.Context()); ok {
+		t.Fatalf("expected no user, got %#v", user)
+	}
+}
+
+func TestBearer(t *testing.T) {
+	p := &Bearer{
+		Authenticate: func(ctx context.Context, token string) (*User, error) {
+			if token != "good" {
+				return nil, fmt.Errorf("bad token")
+			}
+			return &User{GithubUsername: "bot", Scopes: []string{"read"}}, nil
+		},
+		PathPrefixes: []string{"/whoami"},
+		Fallback:     &StaticUser{User: User{GithubUsername: "dev"}},
+	}
+
+	rw := serve(p, http.Header{"Authorization": {"Bearer good"}}, "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "bot" {
+		t.Fatalf("expected bot, got %d %q", rw.Code, rw.Body.String())
+	}
+
+	rw = serve(p, http.Header{"Authorization": {"Bearer bad"}}, "")
+	if rw.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a bad token to be refused, got %d", rw.Code)
+	}
+
+	rw = serve(p, nil, "")
+	if rw.Code != http.StatusOK || rw.Body.String() != "dev" {
+		t.Fatalf("expected a request without a token to fall back, got %d %q", rw.Code, rw.Body.String())
+	}
+}
+
+func TestUserHasScope(t *testing.T) {
+	session := &User{GithubUsername: "alice"}
+	if !session.HasScope("read") || !session.HasScope("") {
+		t.Fatalf("expected a session to have every scope")
+	}
+
+	token := &User{GithubUsername: "alice", Scopes: []string{"read"}}
+	if !token.HasScope("read") || token.HasScope("spawn") || token.HasScope("") {
+		t.Fatalf("expected a token to have only its own scopes")
+	}
+}
+
+func TestUserCanUseSpace(t *testing.T) {
+	session := &User{GithubUsername: "alice"}
+	if !session.CanUseSpace("sp-1") {
+		t.Fatalf("expected a session to be able to use any space")
+	}
+
+	spawn := &User{GithubUsername: "alice", Spaces: []string{"sp-1"}}
+	if !spawn.CanUseSpace("sp-1") || spawn.CanUseSpace("sp-2") {
+		t.Fatalf("expected a spawn token to use only its own spaces")
+	}
+
+	none := &User{GithubUsername: "alice", Spaces: []string{}}
+	if none.CanUseSpace("sp-1") {
+		t.Fatalf("expected a token with no spaces to use none")
+	}
+}
@@ -0,0 +1,427 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dghubble/gologin/v2"
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/oauth2"
+)
+
+// OIDC logs people in with an OpenID Connect provider, which it finds by
+// discovery from Issuer. It uses the authorization code flow with PKCE and
+// checks the ID token it gets back.
+type OIDC struct {
+	// Name goes in its routes, /auth/<name>/login and /auth/<name>/callback.
+	// It defaults to "oidc".
+	Name string
+
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+
+	// Scopes to ask for. They default to openid, profile and email.
+	Scopes []string
+
+	// UsernameClaims are the ID token claims to take the username from; the
+	// first that's set is used. Only "email", if email_verified is true, and
+	// "sub" can be trusted to be the user's own, so no others are allowed.
+	// They default to email, then sub. Usernames start with Name and a
+	// colon, e.g. "oidc:alice@example.com", so they can never be mistaken
+	// for another provider's users, like GitHub's.
+	UsernameClaims []string
+
+	// StateConfig is for the cookie that holds the state, nonce, PKCE
+	// verifier and where to go afterwards while someone logs in.
+	StateConfig gologin.CookieConfig
+
+	// Client makes requests to the provider. It defaults to
+	// http.DefaultClient.
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func (o *OIDC) name() string {
+	if o.Name == "" {
+		return "oidc"
+	}
+	return o.Name
+}
+
+func (o *OIDC) client() *http.Client {
+	if o.Client == nil {
+		return http.DefaultClient
+	}
+	return o.Client
+}
+
+func (o *OIDC) LoginPath() string {
+	return "/auth/" + o.name() + "/login"
+}
+
+func (o *OIDC) getJSON(ctx context.Context, u string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := o.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// discover fetches the provider's configuration the first time it's needed.
+func (o *OIDC) discover(ctx context.Context) (*oidcDiscovery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.discovery != nil {
+		return o.discovery, nil
+	}
+
+	var d oidcDiscovery
+	err := o.getJSON(ctx, strings.TrimSuffix(o.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, fmt.Errorf("error discovering %s: %w", o.Issuer, err)
+	}
+	if d.Issuer != o.Issuer {
+		return nil, fmt.Errorf("discovered issuer %q doesn't match %q", d.Issuer, o.Issuer)
+	}
+	o.discovery = &d
+	return o.discovery, nil
+}
+
+func (o *OIDC) oauth2Config(d *oidcDiscovery) *oauth2.Config {
+	scopes := o.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "profile", "email"}
+	}
+	return &oauth2.Config{
+		ClientID:     o.ClientID,
+		ClientSecret: o.ClientSecret,
+		RedirectURL:  o.RedirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  d.AuthorizationEndpoint,
+			TokenURL: d.TokenEndpoint,
+		},
+	}
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (o *OIDC) stateCookie(value string, maxAge int) *http.Cookie {
+	return newStateCookie(o.StateConfig, "substrate-"+o.name()+"-state", value, maxAge)
+}
+
+func (o *OIDC) Register(router *httprouter.Router, login LoginFunc) {
+	router.Handle("GET", o.LoginPath(), func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		d, err := o.discover(req.Context())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		var secrets [3]string
+		for i := range secrets {
+			secrets[i], err = randomString()
+			if err != nil {
+				http.Error(rw, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+		redirect := base64.RawURLEncoding.EncodeToString([]byte(LoginRedirect(req)))
+		http.SetCookie(rw, o.stateCookie(strings.Join(append(secrets[:], redirect), "."), o.StateConfig.MaxAge))
+
+		challenge := sha256.Sum256([]byte(verifier))
+		authURL := o.oauth2Config(d).AuthCodeURL(state,
+			oauth2.SetAuthURLParam("nonce", nonce),
+			oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+			oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+		)
+		http.Redirect(rw, req, authURL, http.StatusFound)
+	})
+
+	router.Handle("GET", "/auth/"+o.name()+"/callback", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		cookie, err := req.Cookie(o.stateCookie("", 0).Name)
+		if err != nil {
+			http.Error(rw, "missing login state", http.StatusBadRequest)
+			return
+		}
+		http.SetCookie(rw, o.stateCookie("", -1))
+		secrets := strings.Split(cookie.Value, ".")
+		if len(secrets) != 4 {
+			http.Error(rw, "bad login state", http.StatusBadRequest)
+			return
+		}
+		state, nonce, verifier := secrets[0], secrets[1], secrets[2]
+		redirect, err := base64.RawURLEncoding.DecodeString(secrets[3])
+		if err != nil {
+			http.Error(rw, "bad login state", http.StatusBadRequest)
+			return
+		}
+
+		query := req.URL.Query()
+		if e := query.Get("error"); e != "" {
+			http.Error(rw, "login failed: "+e+" "+query.Get("error_description"), http.StatusUnauthorized)
+			return
+		}
+		if query.Get("state") != state {
+			http.Error(rw, "login state doesn't match", http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), oauth2.HTTPClient, o.client())
+		d, err := o.discover(ctx)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		token, err := o.oauth2Config(d).Exchange(ctx, query.Get("code"), oauth2.SetAuthURLParam("code_verifier", verifier))
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		rawIDToken, ok := token.Extra("id_token").(string)
+		if !ok {
+			http.Error(rw, "no id_token in token response", http.StatusUnauthorized)
+			return
+		}
+		claims, err := o.verify(ctx, d, rawIDToken, nonce, time.Now())
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		username, err := o.username(claims)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		login(rw, req, username, string(redirect))
+	})
+}
+
+func (o *OIDC) usernameClaims() []string {
+	if len(o.UsernameClaims) == 0 {
+		return []string{"email", "sub"}
+	}
+	return o.UsernameClaims
+}
+
+// username picks the username from an ID token's claims, as set by
+// UsernameClaims.
+func (o *OIDC) username(claims map[string]any) (string, error) {
+	for _, claim := range o.usernameClaims() {
+		switch claim {
+		case "email":
+			// Anyone can claim any address they haven't verified.
+			if verified, _ := claims["email_verified"].(bool); !verified {
+				continue
+			}
+		case "sub":
+		default:
+			return "", fmt.Errorf("can't take usernames from the %q claim, only email or sub", claim)
+		}
+		if v, ok := claims[claim].(string); ok && v != "" {
+			return o.name() + ":" + v, nil
+		}
+	}
+	return "", fmt.Errorf("id_token has none of the claims %s", strings.Join(o.usernameClaims(), ", "))
+}
+
+// verify checks the signature and claims of an ID token and returns its
+// claims.
+func (o *OIDC) verify(ctx context.Context, d *oidcDiscovery, rawIDToken, nonce string, now time.Time) (map[string]any, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id_token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed id_token signature: %w", err)
+	}
+
+	key, err := o.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, fmt.Errorf("unsupported id_token alg %q for an RSA key", header.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, fmt.Errorf("bad id_token signature: %w", err)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return nil, fmt.Errorf("unsupported id_token alg %q for an EC key", header.Alg)
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return nil, fmt.Errorf("bad id_token signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if claims["iss"] != d.Issuer {
+		return nil, fmt.Errorf("id_token is from %v, not %s", claims["iss"], d.Issuer)
+	}
+	if !audienceContains(claims["aud"], o.ClientID) {
+		return nil, fmt.Errorf("id_token is for %v, not %s", claims["aud"], o.ClientID)
+	}
+	if azp, ok := claims["azp"]; ok && azp != o.ClientID {
+		return nil, fmt.Errorf("id_token is authorized for %v, not %s", azp, o.ClientID)
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok || !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, fmt.Errorf("id_token has expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, fmt.Errorf("id_token nonce doesn't match")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return fmt.Errorf("malformed id_token: %w", err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("malformed id_token: %w", err)
+	}
+	return nil
+}
+
+func audienceContains(aud any, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []any:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the provider's signing key with the given ID, fetching its keys
+// again if it's not one we know, since providers rotate them.
+func (o *OIDC) key(ctx context.Context, d *oidcDiscovery, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	key, ok := o.keys[kid]
+	o.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := o.getJSON(ctx, d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("error fetching signing keys: %w", err)
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		switch {
+		case k.Kty == "RSA":
+			n, err := base64.RawURLEncoding.DecodeString(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("bad key %s: %w", k.Kid, err)
+			}
+			e, err := base64.RawURLEncoding.DecodeString(k.E)
+			if err != nil {
+				return nil, fmt.Errorf("bad key %s: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("bad key %s: %w", k.Kid, err)
+			}
+			y, err := base64.RawURLEncoding.DecodeString(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("bad key %s: %w", k.Kid, err)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+
+	o.mu.Lock()
+	o.keys = keys
+	o.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("no signing key %q", kid)
+	}
+	return key, nil
+}
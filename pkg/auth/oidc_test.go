@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dghubble/gologin/v2"
+	"github.com/dghubble/sessions"
+)
+
+// mockIssuer is an OpenID Connect provider that logs everyone in with the
+// same claims, signed with key.
+type mockIssuer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PrivateKey
+
+	// claims go in each ID token, on top of the ones the flow needs. mutate,
+	// if set, can then change any of them.
+	claims map[string]any
+	mutate func(claims map[string]any)
+
+	mu        sync.Mutex
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T, claims map[string]any) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockIssuer{t: t, key: key, claims: claims}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/authorize", func(rw http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		if query.Get("code_challenge_method") != "S256" {
+			http.Error(rw, "PKCE is required", http.StatusBadRequest)
+			return
+		}
+		m.mu.Lock()
+		m.nonce = query.Get("nonce")
+		m.challenge = query.Get("code_challenge")
+		m.mu.Unlock()
+
+		redirect, err := url.Parse(query.Get("redirect_uri"))
+		if err != nil {
+			t.Errorf("bad redirect_uri: %s", err)
+			return
+		}
+		q := redirect.Query()
+		q.Set("code", "mock-code")
+		q.Set("state", query.Get("state"))
+		redirect.RawQuery = q.Encode()
+		http.Redirect(rw, req, redirect.String(), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("bad token request: %s", err)
+			return
+		}
+		m.mu.Lock()
+		nonce, challenge := m.nonce, m.challenge
+		m.mu.Unlock()
+
+		verifier := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+		if base64.RawURLEncoding.EncodeToString(verifier[:]) != challenge {
+			http.Error(rw, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		claims := map[string]any{
+			"iss":   m.URL,
+			"aud":   "client-id",
+			"sub":   "1234",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"iat":   time.Now().Unix(),
+			"nonce": nonce,
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		if m.mutate != nil {
+			m.mutate(claims)
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(map[string]any{
+			"access_token": "mock-token",
+			"token_type":   "Bearer",
+			"id_token":     m.sign(m.key, claims),
+		})
+	})
+	mux.HandleFunc("/jwks", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock-key",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	m.Server = httptest.NewServer(mux)
+	return m
+}
+
+func (m *mockIssuer) sign(key *rsa.PrivateKey, claims map[string]any) string {
+	encode := func(v any) string {
+		b, err := json.Marshal(v)
+		if err != nil {
+			m.t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signed := encode(map[string]string{"alg": "RS256", "kid": "mock-key"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		m.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func newOIDCServer(issuer *mockIssuer, usernameClaims ...string) *httptest.Server {
+	return newProtectedServer(&Auth{
+		Providers: []LoginProvider{&OIDC{
+			Issuer:         issuer.URL,
+			ClientID:       "client-id",
+			ClientSecret:   "client-secret",
+			UsernameClaims: usernameClaims,
+			StateConfig:    gologin.DebugOnlyCookieConfig,
+		}},
+
+		SessionName:  "test-session",
+		SessionStore: sessions.NewCookieStore[string](sessions.DebugCookieConfig, []byte("0123456789abcdef0123456789abcdef")),
+
+		DefaultLoginRedirect: "/whoami",
+	})
+}
+
+func newJarClient(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{Jar: jar}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	issuer := newMockIssuer(t, map[string]any{
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"email_verified":     true,
+	})
+	defer issuer.Close()
+
+	server := newOIDCServer(issuer)
+	defer server.Close()
+	status, body := get(t, newJarClient(t), server.URL+"/whoami")
+	if status != http.StatusOK || body != "oidc:alice@example.com" {
+		t.Fatalf("expected to be logged in as oidc:alice@example.com, got %d %q", status, body)
+	}
+
+	bySub := newOIDCServer(issuer, "sub")
+	defer bySub.Close()
+	status, body = get(t, newJarClient(t), bySub.URL+"/whoami")
+	if status != http.StatusOK || body != "oidc:1234" {
+		t.Fatalf("expected to be logged in as oidc:1234, got %d %q", status, body)
+	}
+}
+
+func TestOIDCOnlyTrustsVerifiedEmailOrSub(t *testing.T) {
+	issuer := newMockIssuer(t, map[string]any{
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+		"email_verified":     false,
+	})
+	defer issuer.Close()
+
+	// An unverified email is passed over for sub.
+	server := newOIDCServer(issuer)
+	defer server.Close()
+	status, body := get(t, newJarClient(t), server.URL+"/whoami")
+	if status != http.StatusOK || body != "oidc:1234" {
+		t.Fatalf("expected to be logged in as oidc:1234, got %d %q", status, body)
+	}
+
+	for _, claims := range [][]string{{"email"}, {"preferred_username"}, {"name", "sub"}} {
+		server := newOIDCServer(issuer, claims...)
+		defer server.Close()
+		status, body := get(t, newJarClient(t), server.URL+"/whoami")
+		if status != http.StatusUnauthorized {
+			t.Fatalf("expected login by %v to be refused, got %d %q", claims, status, body)
+		}
+	}
+}
+
+func TestOIDCRejectsBadTokens(t *testing.T) {
+	issuer := newMockIssuer(t, map[string]any{"preferred_username": "alice"})
+	defer issuer.Close()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, mutate := range map[string]func(claims map[string]any){
+		"wrong audience": func(claims map[string]any) { claims["aud"] = "someone-else" },
+		"wrong issuer":   func(claims map[string]any) { claims["iss"] = "https://evil.example.com" },
+		"expired":        func(claims map[string]any) { claims["exp"] = time.Now().Add(-time.Minute).Unix() },
+		"wrong nonce":    func(claims map[string]any) { claims["nonce"] = "replayed" },
+		"no username":    func(claims map[string]any) { delete(claims, "sub") },
+	} {
+		t.Run(name, func(t *testing.T) {
+			issuer.mutate = mutate
+			server := newOIDCServer(issuer)
+			defer server.Close()
+
+			status, body := get(t, newJarClient(t), server.URL+"/whoami")
+			if status != http.StatusUnauthorized {
+				t.Fatalf("expected login to be refused, got %d %q", status, body)
+			}
+		})
+	}
+
+	t.Run("wrong key", func(t *testing.T) {
+		issuer.mutate = nil
+		realKey := issuer.key
+		issuer.key = otherKey
+		defer func() { issuer.key = realKey }()
+
+		// The token is signed with otherKey but the JWKS still has realKey.
+		server := newOIDCServer(issuer)
+		defer server.Close()
+
+		status, body := get(t, newJarClient(t), server.URL+"/whoami")
+		if status != http.StatusUnauthorized {
+			t.Fatalf("expected login to be refused, got %d %q", status, body)
+		}
+	})
+}
+
+func TestOIDCRejectsForgedState(t *testing.T) {
+	issuer := newMockIssuer(t, map[string]any{"preferred_username": "alice"})
+	defer issuer.Close()
+
+	server := newOIDCServer(issuer)
+	defer server.Close()
+
+	status, _ := get(t, newJarClient(t), server.URL+"/auth/oidc/callback?code=mock-code&state=forged")
+	if status != http.StatusBadRequest {
+		t.Fatalf("expected a callback without login state to be refused, got %d", status)
+	}
+}
@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"bufio"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password logs people in with a username and password, checked against
+// bcrypt hashes, for installs that can't reach an identity provider. They're
+// logged in as "password:" and their username, so they can never be mistaken
+// for another provider's users, like GitHub's.
+type Password struct {
+	// Users maps each username to a bcrypt hash of their password.
+	Users map[string][]byte
+}
+
+// ReadPasswordFile reads users for Password from a file of "username:hash"
+// lines, as written by `htpasswd -B`. Blank lines and lines starting with #
+// are skipped.
+func ReadPasswordFile(path string) (map[string][]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parsePasswords(f)
+}
+
+func parsePasswords(r io.Reader) (map[string][]byte, error) {
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		username, hash, ok := strings.Cut(line, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("line %d: expected username:hash", n)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("line %d: %s's password isn't a bcrypt hash: %w", n, username, err)
+		}
+		users[username] = []byte(hash)
+	}
+	return users, scanner.Err()
+}
+
+// passwordMismatchHash is compared against for unknown users, so they take as
+// long to refuse as known ones.
+var passwordMismatchHash, _ = bcrypt.GenerateFromPassword([]byte("not anyone's password"), bcrypt.DefaultCost)
+
+var passwordLoginPage = template.Must(template.New("login").Parse(`<!DOCTYPE html>
+<title>Log in</title>
+<form method="post">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<input type="hidden" name="redirect" value="{{.Redirect}}">
+<label>Username <input name="username" autocomplete="username" required autofocus></label>
+<label>Password <input name="password" type="password" autocomplete="current-password" required></label>
+<button>Log in</button>
+</form>
+`))
+
+type passwordLoginForm struct {
+	Error    string
+	Redirect string
+}
+
+func (p *Password) LoginPath() string {
+	return "/auth/password/login"
+}
+
+func (p *Password) check(username, password string) bool {
+	hash, ok := p.Users[username]
+	if !ok {
+		hash = passwordMismatchHash
+	}
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	return ok && err == nil
+}
+
+func (p *Password) Register(router *httprouter.Router, login LoginFunc) {
+	router.Handle("GET", p.LoginPath(), func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		passwordLoginPage.Execute(rw, passwordLoginForm{Redirect: LoginRedirect(req)})
+	})
+	router.Handle("POST", p.LoginPath(), func(rw http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		username := req.PostFormValue("username")
+		if !p.check(username, req.PostFormValue("password")) {
+			rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+			rw.WriteHeader(http.StatusUnauthorized)
+			passwordLoginPage.Execute(rw, passwordLoginForm{
+				Error:    "Wrong username or password.",
+				Redirect: req.PostFormValue("redirect"),
+			})
+			return
+		}
+		login(rw, req, "password:"+username, req.PostFormValue("redirect"))
+	})
+}
@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/dghubble/sessions"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPasswordLogin(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := parsePasswords(strings.NewReader("# users\n\nalice:" + string(hash) + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := newProtectedServer(&Auth{
+		Providers:            []LoginProvider{&Password{Users: users}},
+		SessionName:          "test-session",
+		SessionStore:         sessions.NewCookieStore[string](sessions.DebugCookieConfig, []byte("0123456789abcdef0123456789abcdef")),
+		DefaultLoginRedirect: "/whoami",
+	})
+	defer server.Close()
+
+	client := newJarClient(t)
+	status, body := get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || !strings.Contains(body, `type="password"`) {
+		t.Fatalf("expected to be sent to the login form, got %d %q", status, body)
+	}
+
+	for _, form := range []url.Values{
+		{"username": {"alice"}, "password": {"wrong"}},
+		{"username": {"bob"}, "password": {"hunter2"}},
+	} {
+		resp, err := client.PostForm(server.URL+"/auth/password/login", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("expected %v to be refused, got %d", form, resp.StatusCode)
+		}
+	}
+
+	resp, err := client.PostForm(server.URL+"/auth/password/login", url.Values{"username": {"alice"}, "password": {"hunter2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	status, body = get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || body != "password:alice" {
+		t.Fatalf("expected to be logged in as password:alice, got %d %q", status, body)
+	}
+}
+
+func TestParsePasswordsRejectsPlaintext(t *testing.T) {
+	if _, err := parsePasswords(strings.NewReader("alice:hunter2\n")); err == nil {
+		t.Fatalf("expected a plaintext password to be refused")
+	}
+}
@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dghubble/gologin/v2"
+)
+
+const (
+	// DefaultSessionTTL is how long a session lasts if Auth.SessionTTL isn't
+	// set.
+	DefaultSessionTTL = 7 * 24 * time.Hour
+
+	// DefaultSessionRotateAfter is how often a session's token changes if
+	// Auth.SessionRotateAfter isn't set.
+	DefaultSessionRotateAfter = time.Hour
+
+	// sessionRotationGrace is how long a session's previous token still
+	// works, for requests that were already on their way when it changed.
+	sessionRotationGrace = time.Minute
+
+	// sessionSeenResolution is how stale a session's LastSeenAt may get, so
+	// using a session doesn't mean a write on every request.
+	sessionSeenResolution = time.Minute
+)
+
+// Session is a login, as recorded on the server. Its cookie holds a token
+// that changes every so often; its ID doesn't, and is safe to show.
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RotatedAt  time.Time `json:"rotated_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+// Sessions records sessions on the server, so they can expire and be revoked.
+type Sessions interface {
+	// CreateSession records s, with token, and sets its ID.
+	CreateSession(ctx context.Context, s *Session, token string) error
+
+	// FindSession returns the session token belongs to, or nil if there's
+	// none. previous is set if token is the one the session was last
+	// rotated away from.
+	FindSession(ctx context.Context, token string) (s *Session, previous bool, err error)
+
+	// RotateSession gives a session newToken in place of token, keeping token
+	// as its previous token. If token isn't the session's current token any
+	// more, because another request rotated it first, it changes nothing
+	// and returns false.
+	RotateSession(ctx context.Context, id, token, newToken string, now time.Time) (rotated bool, err error)
+
+	// TouchSession notes that a session was used.
+	TouchSession(ctx context.Context, id string, now time.Time) error
+
+	// DeleteSession revokes a session.
+	DeleteSession(ctx context.Context, id string) error
+}
+
+func (a *Auth) sessionTTL() time.Duration {
+	if a.SessionTTL == 0 {
+		return DefaultSessionTTL
+	}
+	return a.SessionTTL
+}
+
+func (a *Auth) sessionRotateAfter() time.Duration {
+	if a.SessionRotateAfter == 0 {
+		return DefaultSessionRotateAfter
+	}
+	return a.SessionRotateAfter
+}
+
+// checkSession returns the session token belongs to, if it's still good. If
+// it's time for the session to get a new token, that's returned too.
+func (a *Auth) checkSession(ctx context.Context, token string, now time.Time) (s *Session, newToken string, err error) {
+	s, previous, err := a.Sessions.FindSession(ctx, token)
+	if err != nil || s == nil {
+		return nil, "", err
+	}
+	if !now.Before(s.ExpiresAt) {
+		return nil, "", nil
+	}
+	if previous {
+		if now.Sub(s.RotatedAt) >= sessionRotationGrace {
+			return nil, "", nil
+		}
+		return s, "", nil
+	}
+
+	if now.Sub(s.RotatedAt) >= a.sessionRotateAfter() {
+		newToken, err = randomString()
+		if err != nil {
+			return nil, "", err
+		}
+		rotated, err := a.Sessions.RotateSession(ctx, s.ID, token, newToken, now)
+		if err != nil {
+			return nil, "", err
+		}
+		if !rotated {
+			// Another request got there first, so token should now be the
+			// previous one, which is still good for a while.
+			s, previous, err = a.Sessions.FindSession(ctx, token)
+			if err != nil || s == nil || !previous || now.Sub(s.RotatedAt) >= sessionRotationGrace {
+				return nil, "", err
+			}
+			return s, "", nil
+		}
+		s.RotatedAt = now
+		s.LastSeenAt = now
+		return s, newToken, nil
+	}
+
+	if now.Sub(s.LastSeenAt) >= sessionSeenResolution {
+		if err := a.Sessions.TouchSession(ctx, s.ID, now); err != nil {
+			return nil, "", err
+		}
+		s.LastSeenAt = now
+	}
+	return s, "", nil
+}
+
+// LoginRedirect is where to go once logged in, as asked for by the
+// "redirect" parameter of a request to log in.
+func LoginRedirect(req *http.Request) string {
+	return req.URL.Query().Get("redirect")
+}
+
+// newStateCookie makes a cookie for holding login state, as configured.
+func newStateCookie(config gologin.CookieConfig, defaultName, value string, maxAge int) *http.Cookie {
+	name := config.Name
+	if name == "" {
+		name = defaultName
+	}
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   config.Domain,
+		Path:     config.Path,
+		MaxAge:   maxAge,
+		HttpOnly: config.HTTPOnly,
+		Secure:   config.Secure,
+		SameSite: config.SameSite,
+	}
+}
+
+// localRedirect returns redirect if it's a path on this server, and fallback
+// otherwise, so logging in can't be used to send people elsewhere.
+func localRedirect(redirect, fallback string) string {
+	if !strings.HasPrefix(redirect, "/") || strings.HasPrefix(redirect, "//") || strings.HasPrefix(redirect, "/\\") {
+		return fallback
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return fallback
+	}
+	return redirect
+}
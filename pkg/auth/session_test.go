@@ -0,0 +1,305 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dghubble/gologin/v2"
+	"github.com/dghubble/sessions"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/oauth2"
+)
+
+// memSessions keeps sessions in memory.
+type memSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*Session
+	tokens   map[string]string // token -> id
+	previous map[string]string // previous token -> id
+}
+
+func newMemSessions() *memSessions {
+	return &memSessions{
+		sessions: map[string]*Session{},
+		tokens:   map[string]string{},
+		previous: map[string]string{},
+	}
+}
+
+func (m *memSessions) CreateSession(ctx context.Context, s *Session, token string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s.ID = "ses-" + token[:8]
+	copy := *s
+	m.sessions[s.ID] = &copy
+	m.tokens[token] = s.ID
+	return nil
+}
+
+func (m *memSessions) FindSession(ctx context.Context, token string) (*Session, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, previous := m.tokens[token], false
+	if id == "" {
+		id, previous = m.previous[token], true
+	}
+	s, ok := m.sessions[id]
+	if !ok {
+		return nil, false, nil
+	}
+	copy := *s
+	return &copy, previous, nil
+}
+
+func (m *memSessions) RotateSession(ctx context.Context, id, token, newToken string, now time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.tokens[token] != id {
+		return false, nil
+	}
+	for t, i := range m.previous {
+		if i == id {
+			delete(m.previous, t)
+		}
+	}
+	delete(m.tokens, token)
+	m.previous[token] = id
+	m.tokens[newToken] = id
+	m.sessions[id].RotatedAt = now
+	m.sessions[id].LastSeenAt = now
+	return true, nil
+}
+
+func (m *memSessions) TouchSession(ctx context.Context, id string, now time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[id].LastSeenAt = now
+	return nil
+}
+
+func (m *memSessions) DeleteSession(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+func (m *memSessions) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sessions)
+}
+
+func newPasswordAuth(t *testing.T) *Auth {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Auth{
+		Providers:            []LoginProvider{&Password{Users: map[string][]byte{"alice": hash}}},
+		SessionName:          "test-session",
+		SessionStore:         sessions.NewCookieStore[string](sessions.DebugCookieConfig, []byte("0123456789abcdef0123456789abcdef")),
+		DefaultLoginRedirect: "/whoami",
+	}
+}
+
+func logIn(t *testing.T, client *http.Client, server, redirect string) *http.Response {
+	t.Helper()
+	resp, err := client.PostForm(server+"/auth/password/login", url.Values{
+		"username": {"alice"},
+		"password": {"hunter2"},
+		"redirect": {redirect},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestLoginRedirect(t *testing.T) {
+	server := newProtectedServer(newPasswordAuth(t))
+	defer server.Close()
+	client := newJarClient(t)
+
+	// The redirect goes through the login form.
+	status, body := get(t, client, server.URL+"/gw/lens[data=sp-1]/page?x=1")
+	if status != http.StatusOK || !strings.Contains(body, `value="/gw/lens[data=sp-1]/page?x=1"`) {
+		t.Fatalf("expected the login form to carry the redirect, got %d %q", status, body)
+	}
+
+	resp := logIn(t, client, server.URL, "/gw/lens[data=sp-1]/page?x=1")
+	if got := resp.Request.URL.RequestURI(); got != "/gw/lens%5Bdata=sp-1%5D/page?x=1" && got != "/gw/lens[data=sp-1]/page?x=1" {
+		t.Fatalf("expected to end up back at the deep link, got %s", got)
+	}
+
+	for _, redirect := range []string{"https://evil.example.com/", "//evil.example.com/", "/\\evil.example.com"} {
+		resp := logIn(t, client, server.URL, redirect)
+		if resp.Request.URL.Host != strings.TrimPrefix(server.URL, "http://") || resp.Request.URL.Path != "/whoami" {
+			t.Fatalf("expected %q to be ignored, ended up at %s", redirect, resp.Request.URL)
+		}
+	}
+}
+
+func TestGithubLoginRedirect(t *testing.T) {
+	github := newFakeGithub(t, "octocat")
+	defer github.Close()
+
+	server := newProtectedServer(&Auth{
+		Providers: []LoginProvider{&Github{
+			ClientID:     "client-id",
+			ClientSecret: "client-secret",
+			Endpoint: &oauth2.Endpoint{
+				AuthURL:  github.URL + "/login/oauth/authorize",
+				TokenURL: github.URL + "/login/oauth/access_token",
+			},
+			StateConfig: gologin.DebugOnlyCookieConfig,
+		}},
+		SessionName:          "test-session",
+		SessionStore:         sessions.NewCookieStore[string](sessions.DebugCookieConfig, []byte("0123456789abcdef0123456789abcdef")),
+		DefaultLoginRedirect: "/whoami",
+	})
+	defer server.Close()
+
+	resp, err := newJarClient(t).Get(server.URL + "/deep/link?x=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := resp.Request.URL.RequestURI(); got != "/deep/link?x=1" {
+		t.Fatalf("expected to end up back at the deep link, got %s", got)
+	}
+}
+
+func TestServerSideSessions(t *testing.T) {
+	a := newPasswordAuth(t)
+	store := newMemSessions()
+	a.Sessions = store
+	server := newProtectedServer(a)
+	defer server.Close()
+
+	client := newJarClient(t)
+	logIn(t, client, server.URL, "")
+	status, body := get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || body != "password:alice" || store.count() != 1 {
+		t.Fatalf("expected a session for alice, got %d %q with %d sessions", status, body, store.count())
+	}
+
+	// Revoking the session on the server logs the browser out.
+	for id := range store.sessions {
+		store.DeleteSession(context.Background(), id)
+	}
+	status, body = get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || !strings.Contains(body, `type="password"`) {
+		t.Fatalf("expected to be sent to log in again, got %d %q", status, body)
+	}
+
+	// So does logging out, even if the cookie is kept.
+	logIn(t, client, server.URL, "")
+	cookies := client.Jar.Cookies(mustParseURL(t, server.URL))
+	resp, err := client.Post(server.URL+"/auth/logout", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if store.count() != 0 {
+		t.Fatalf("expected logging out to delete the session")
+	}
+	client.Jar.SetCookies(mustParseURL(t, server.URL), cookies)
+	status, body = get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || !strings.Contains(body, `type="password"`) {
+		t.Fatalf("expected the old cookie not to work, got %d %q", status, body)
+	}
+}
+
+func TestSessionExpiryAndRotation(t *testing.T) {
+	a := newPasswordAuth(t)
+	store := newMemSessions()
+	a.Sessions = store
+	a.SessionRotateAfter = time.Nanosecond
+	server := newProtectedServer(a)
+	defer server.Close()
+
+	client := newJarClient(t)
+	logIn(t, client, server.URL, "")
+	before := client.Jar.Cookies(mustParseURL(t, server.URL))
+
+	// Every request rotates the token now, but the session stays the same.
+	status, body := get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || body != "password:alice" || store.count() != 1 {
+		t.Fatalf("expected the session to survive rotation, got %d %q with %d sessions", status, body, store.count())
+	}
+	after := client.Jar.Cookies(mustParseURL(t, server.URL))
+	if before[0].Value == after[0].Value {
+		t.Fatalf("expected the session cookie to change")
+	}
+
+	// The token from before still works for a little while.
+	stale := newJarClient(t)
+	stale.Jar.SetCookies(mustParseURL(t, server.URL), before)
+	if status, body := get(t, stale, server.URL+"/whoami"); status != http.StatusOK || body != "password:alice" {
+		t.Fatalf("expected the previous token to work during the grace period, got %d %q", status, body)
+	}
+
+	// Once the session expires, it's no good.
+	for _, s := range store.sessions {
+		s.ExpiresAt = time.Now()
+	}
+	status, body = get(t, client, server.URL+"/whoami")
+	if status != http.StatusOK || !strings.Contains(body, `type="password"`) {
+		t.Fatalf("expected an expired session to be refused, got %d %q", status, body)
+	}
+}
+
+func mustParseURL(t *testing.T, s string) *url.URL {
+	u, err := url.Parse(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// racingSessions rotates each session as soon as it's found, as if another
+// request due to rotate it got there first.
+type racingSessions struct {
+	*memSessions
+	racer string
+}
+
+func (r *racingSessions) FindSession(ctx context.Context, token string) (*Session, bool, error) {
+	s, previous, err := r.memSessions.FindSession(ctx, token)
+	if s != nil && !previous {
+		r.memSessions.RotateSession(ctx, s.ID, token, r.racer, time.Now())
+	}
+	return s, previous, err
+}
+
+func TestConcurrentRotationKeepsSession(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := newMemSessions()
+	s := &Session{User: "alice", CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(time.Hour), RotatedAt: now.Add(-2 * time.Hour)}
+	if err := store.CreateSession(ctx, s, "original-token"); err != nil {
+		t.Fatal(err)
+	}
+	a := &Auth{Sessions: &racingSessions{store, "racer-token"}, SessionRotateAfter: time.Hour}
+
+	found, newToken, err := a.checkSession(ctx, "original-token", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found == nil || found.ID != s.ID {
+		t.Fatalf("expected the token that lost the race to still be good, got %v", found)
+	}
+	if newToken != "" {
+		t.Fatalf("expected no second new token, got %q", newToken)
+	}
+	if store.tokens["racer-token"] != s.ID || store.previous["original-token"] != s.ID {
+		t.Fatalf("expected the winner's token to stay current, got %v and previous %v", store.tokens, store.previous)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"time"
 
 	"tailscale.com/client/tailscale"
@@ -117,13 +118,32 @@ func (t *Tailscale) AwaitSocket() error {
 	return fmt.Errorf("socket %s not ready after %d attempts. last error: %w", t.Socket, attempts, err)
 }
 
+// DNSName returns this node's name on the tailnet, e.g.
+// substrate.example.ts.net, without the trailing dot.
 func (t *Tailscale) DNSName(ctx context.Context) (string, error) {
 	status, err := t.Client.StatusWithoutPeers(ctx)
 	if err != nil {
 		return "", fmt.Errorf("error getting tailscale dns name: %w", err)
 	}
 
-	return status.Self.DNSName, nil
+	return strings.TrimSuffix(status.Self.DNSName, "."), nil
+}
+
+// WhoIs returns the login name of the user whose node is on the other end of
+// a connection from remoteAddr, e.g. alice@example.com. Tagged nodes don't
+// act for a user, so they're refused.
+func (t *Tailscale) WhoIs(ctx context.Context, remoteAddr string) (string, error) {
+	who, err := t.Client.WhoIs(ctx, remoteAddr)
+	if err != nil {
+		return "", fmt.Errorf("error looking up %s on the tailnet: %w", remoteAddr, err)
+	}
+	if who.Node == nil || who.UserProfile == nil || who.UserProfile.LoginName == "" {
+		return "", fmt.Errorf("%s isn't a tailnet node", remoteAddr)
+	}
+	if len(who.Node.Tags) > 0 {
+		return "", fmt.Errorf("%s is a tagged node (%s), not a user's", remoteAddr, strings.Join(who.Node.Tags, ", "))
+	}
+	return who.UserProfile.LoginName, nil
 }
 
 func (t *Tailscale) GetCertificate(hi *tls.ClientHelloInfo) (*tls.Certificate, error) {
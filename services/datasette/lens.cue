@@ -5,3 +5,6 @@ name: "datasette"
 #build: args: VERSION: "0.64.1"
 
 spawn: schema: data: type: "space"
+
+// For forms and flash messages.
+cookies: ["ds_csrftoken", "ds_messages"]
@@ -83,12 +83,20 @@ let #Lens = close({
     preview ?: string
   }
 
+  // Cookies the lens's backend may set and be sent. Any others, including
+  // substrate's own, are dropped. Allowed cookies are confined to the
+  // viewspec's path.
+  cookies ?: [...string]
+
   // Configuration for spawn
   spawn?: {
     jamsocket ?: {
       service!: string
       image!: string
       env ?: {[string]: string}
+      // Only accept requests carrying the backend's bearer token. The gateway
+      // adds it, so these backends are only reachable via /gw/.
+      require_bearer_token ?: bool
     }
 
     env ?: {[string]: string}
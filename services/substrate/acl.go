@@ -0,0 +1,286 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ajbouh/substrate/pkg/substratefs"
+)
+
+// Every space has an owner, and may have collaborators who are editors or
+// viewers. Anyone may view a space that isn't private.
+
+type SpaceRole string
+
+const (
+	SpaceRoleOwner  SpaceRole = "owner"
+	SpaceRoleEditor SpaceRole = "editor"
+	SpaceRoleViewer SpaceRole = "viewer"
+)
+
+// CanRead reports whether r may open and fork a space.
+func (r SpaceRole) CanRead() bool {
+	return r == SpaceRoleOwner || r == SpaceRoleEditor || r == SpaceRoleViewer
+}
+
+// CanWrite reports whether r may mount a space read-write.
+func (r SpaceRole) CanWrite() bool {
+	return r == SpaceRoleOwner || r == SpaceRoleEditor
+}
+
+// SpaceAccessDeniedError is returned when a user lacks the role they need on a
+// space.
+type SpaceAccessDeniedError struct {
+	SpaceID string
+	User    string
+	Action  string
+}
+
+func (e *SpaceAccessDeniedError) Error() string {
+	return fmt.Sprintf("%s may not %s space %s", e.User, e.Action, e.SpaceID)
+}
+
+type SpaceCollaborator struct {
+	SpaceID   string    `json:"space"`
+	User      string    `json:"user"`
+	Role      SpaceRole `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+const spaceCollaboratorsTable = "space_collaborators"
+
+// spaceVisibleTo is a predicate on the spaces table for spaces the user in its
+// two placeholders may read.
+const spaceVisibleTo = `(` + spacesTable + `.is_private = 0 OR ` + spacesTable + `.owner = ? OR EXISTS (SELECT 1 FROM "space_collaborators" WHERE space_collaborators.space_id = ` + spacesTable + `.id AND space_collaborators.user = ?))`
+
+// activityVisibleTo is a predicate on the activities table for activities
+// whose spaces the user in its two placeholders may all read.
+const activityVisibleTo = `NOT EXISTS (SELECT 1 FROM "spaces" WHERE instr(` + activitiesTable + `.activityspec, spaces.id) > 0 AND NOT ` + spaceVisibleTo + `)`
+
+// SpaceRole returns user's role on a space. It's empty if they have none, and
+// found is false if there's no such space.
+func (s *Substrate) SpaceRole(ctx context.Context, spaceID, user string) (role SpaceRole, found bool, err error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT owner, is_private, (SELECT role FROM "space_collaborators" WHERE space_id = spaces.id AND user = ?) FROM "spaces" WHERE id = ?`,
+		user, spaceID)
+	if err != nil {
+		return "", false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return "", false, rows.Err()
+	}
+	var owner string
+	var isPrivate bool
+	var collaboratorRole *string
+	if err := rows.Scan(&owner, &isPrivate, &collaboratorRole); err != nil {
+		return "", false, err
+	}
+
+	switch {
+	case user != "" && owner == user:
+		return SpaceRoleOwner, true, nil
+	case collaboratorRole != nil:
+		return SpaceRole(*collaboratorRole), true, nil
+	case !isPrivate:
+		return SpaceRoleViewer, true, nil
+	}
+	return "", true, nil
+}
+
+func (s *Substrate) spaceIsPrivate(ctx context.Context, spaceID string) (bool, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT is_private FROM "spaces" WHERE id = ?`, spaceID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var isPrivate bool
+	if rows.Next() {
+		if err := rows.Scan(&isPrivate); err != nil {
+			return false, err
+		}
+	}
+	return isPrivate, rows.Err()
+}
+
+func (v *SpaceViewRequest) baseSpaceIDs() ([]string, error) {
+	if v.SpaceBaseRef == nil || *v.SpaceBaseRef == "scratch" {
+		return nil, nil
+	}
+	base, err := substratefs.ParseRef(*v.SpaceBaseRef)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing base=%s err=%s", *v.SpaceBaseRef, err)
+	}
+	baseIDs := []string{}
+	if base != nil && base.TipRef != nil {
+		baseIDs = append(baseIDs, base.TipRef.SpaceID.String())
+	}
+	if base != nil && base.CheckpointRef != nil {
+		baseIDs = append(baseIDs, base.CheckpointRef.SpaceID.String())
+	}
+	return baseIDs, nil
+}
+
+// SpaceIDs returns the IDs of the existing spaces v uses: the space it
+// opens, if any, and the one it forks.
+func (v *SpaceViewRequest) SpaceIDs() ([]string, error) {
+	ids, err := v.baseSpaceIDs()
+	if err != nil {
+		return nil, err
+	}
+	if v.SpaceID != "" && v.SpaceID != "scratch" {
+		ids = append(ids, v.SpaceID)
+	}
+	return ids, nil
+}
+
+// CheckSpaceViewAccess returns a SpaceAccessDeniedError if user may not read
+// the space v refers to, or the space it forks. readOnly is set if user may
+// only view the space, so it must be mounted read-only. Spaces we have no
+// record of are left alone.
+func (s *Substrate) CheckSpaceViewAccess(ctx context.Context, user string, v *SpaceViewRequest) (readOnly bool, err error) {
+	if v.SpaceID != "" && v.SpaceID != "scratch" {
+		role, found, err := s.SpaceRole(ctx, v.SpaceID, user)
+		if err != nil {
+			return false, err
+		}
+		if found && !role.CanRead() {
+			return false, &SpaceAccessDeniedError{SpaceID: v.SpaceID, User: user, Action: "open"}
+		}
+		if found && !role.CanWrite() {
+			readOnly = true
+		}
+	}
+
+	baseIDs, err := v.baseSpaceIDs()
+	if err != nil {
+		return false, err
+	}
+	for _, baseID := range baseIDs {
+		role, found, err := s.SpaceRole(ctx, baseID, user)
+		if err != nil {
+			return false, err
+		}
+		if found && !role.CanRead() {
+			return false, &SpaceAccessDeniedError{SpaceID: baseID, User: user, Action: "fork"}
+		}
+	}
+
+	return readOnly, nil
+}
+
+// SpaceViewRequests returns every space view in spec, according to its lens.
+func (s *Substrate) SpaceViewRequests(spec *ActivitySpecRequest) []SpaceViewRequest {
+	lens := s.Lenses[spec.LensName]
+	if lens == nil {
+		return nil
+	}
+
+	views := []SpaceViewRequest{}
+	for viewName, viewReq := range spec.Parameters {
+		switch lens.Spawn.Schema[viewName].Type {
+		case LensSpawnParameterTypeSpace:
+			views = append(views, *viewReq.Space(false))
+		case LensSpawnParameterTypeSpaces:
+			views = append(views, viewReq.Spaces(false)...)
+		}
+	}
+	return views
+}
+
+// AuthorizeActivitySpecRequest checks that user may use every space in spec.
+// If they may only view some of them, it returns a copy of spec with every
+// space mounted read-only, and forceReadOnly set; that's what should be
+// spawned instead. The copy has its own activityspec, so it never shares a
+// backend with a read-write one.
+func (s *Substrate) AuthorizeActivitySpecRequest(ctx context.Context, user string, spec *ActivitySpecRequest) (authorized *ActivitySpecRequest, forceReadOnly bool, err error) {
+	lens := s.Lenses[spec.LensName]
+	if lens == nil {
+		return spec, false, nil
+	}
+
+	views := s.SpaceViewRequests(spec)
+	for i := range views {
+		readOnly, err := s.CheckSpaceViewAccess(ctx, user, &views[i])
+		if err != nil {
+			return nil, false, err
+		}
+		forceReadOnly = forceReadOnly || readOnly
+	}
+	if !forceReadOnly {
+		return spec, false, nil
+	}
+
+	authorized = &ActivitySpecRequest{
+		LensName:   spec.LensName,
+		Parameters: LensSpawnParameterRequests{},
+		Path:       spec.Path,
+	}
+	for viewName, viewReq := range spec.Parameters {
+		switch lens.Spawn.Schema[viewName].Type {
+		case LensSpawnParameterTypeSpace:
+			viewReq = LensSpawnParameterRequest(viewReq.Space(true).Spec())
+		case LensSpawnParameterTypeSpaces:
+			specs := []string{""} // an initial empty value to say this is a "multi"
+			for _, v := range viewReq.Spaces(true) {
+				specs = append(specs, v.Spec())
+			}
+			viewReq = LensSpawnParameterRequest(strings.Join(specs, spaceViewMultiSep))
+		}
+		authorized.Parameters[viewName] = viewReq
+	}
+	return authorized, true, nil
+}
+
+// SetSpaceCollaborator gives a user a role on a space, replacing any role they
+// had.
+func (s *Substrate) SetSpaceCollaborator(ctx context.Context, c *SpaceCollaborator) error {
+	if c.Role != SpaceRoleEditor && c.Role != SpaceRoleViewer {
+		return fmt.Errorf("role must be %q or %q", SpaceRoleEditor, SpaceRoleViewer)
+	}
+	if c.User == "" {
+		return fmt.Errorf("user must not be empty")
+	}
+
+	return s.dbExecContext(ctx, `INSERT INTO "space_collaborators" (space_id, user, role, created_at_us) VALUES (?, ?, ?, ?) ON CONFLICT (space_id, user) DO UPDATE SET role = excluded.role`,
+		c.SpaceID, c.User, c.Role, c.CreatedAt.UnixMicro())
+}
+
+func (s *Substrate) DeleteSpaceCollaborator(ctx context.Context, spaceID, user string) error {
+	return s.dbExecContext(ctx, `DELETE FROM "space_collaborators" WHERE space_id = ? AND user = ?`, spaceID, user)
+}
+
+// ListSpaceCollaborators returns the collaborators on a space, oldest first.
+// The owner isn't included.
+func (s *Substrate) ListSpaceCollaborators(ctx context.Context, spaceID string) ([]*SpaceCollaborator, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT space_id, user, role, created_at_us FROM "space_collaborators" WHERE space_id = ? ORDER BY created_at_us, user`, spaceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*SpaceCollaborator{}
+	for rows.Next() {
+		var o SpaceCollaborator
+		var createdAt int64
+		if err := rows.Scan(&o.SpaceID, &o.User, &o.Role, &createdAt); err != nil {
+			return nil, err
+		}
+		o.CreatedAt = time.UnixMicro(createdAt)
+		results = append(results, &o)
+	}
+
+	return results, rows.Err()
+}
@@ -0,0 +1,123 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSpaceViewAccessFollowsRole(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	writeTestSpace(t, s, "sp-private", "alice", true, 0)
+	writeTestSpace(t, s, "sp-public", "alice", false, 1)
+	if err := s.SetSpaceCollaborator(ctx, &SpaceCollaborator{SpaceID: "sp-private", User: "bob", Role: SpaceRoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSpaceCollaborator(ctx, &SpaceCollaborator{SpaceID: "sp-private", User: "carol", Role: SpaceRoleEditor}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		user     string
+		space    string
+		readOnly bool
+		denied   bool
+	}{
+		{user: "alice", space: "sp-private"},
+		{user: "bob", space: "sp-private", readOnly: true},
+		{user: "carol", space: "sp-private"},
+		{user: "dave", space: "sp-private", denied: true},
+		{user: "", space: "sp-private", denied: true},
+		{user: "dave", space: "sp-public", readOnly: true},
+		{user: "dave", space: "sp-unknown"},
+		{user: "dave", space: "scratch"},
+	} {
+		readOnly, err := s.CheckSpaceViewAccess(ctx, c.user, &SpaceViewRequest{SpaceID: c.space})
+		var denied *SpaceAccessDeniedError
+		if c.denied {
+			if !errors.As(err, &denied) {
+				t.Errorf("expected %q to be denied %s, got %v", c.user, c.space, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expected %q to open %s, got %v", c.user, c.space, err)
+			continue
+		}
+		if readOnly != c.readOnly {
+			t.Errorf("expected %q opening %s to have readOnly=%v, got %v", c.user, c.space, c.readOnly, readOnly)
+		}
+	}
+}
+
+func TestViewersAreForcedReadOnly(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	s.Lenses["files"] = &Lens{
+		Name: "files",
+		Spawn: LensSpawnOptions{
+			Schema: map[string]LensSpawnParameterSchema{
+				"data":  {Type: LensSpawnParameterTypeSpace},
+				"extra": {Type: LensSpawnParameterTypeSpaces},
+				"title": {Type: LensSpawnParameterTypeString},
+			},
+		},
+	}
+	writeTestSpace(t, s, "sp-mine", "alice", true, 0)
+	writeTestSpace(t, s, "sp-shared", "bob", true, 1)
+	writeTestSpace(t, s, "sp-private", "bob", true, 2)
+	if err := s.SetSpaceCollaborator(ctx, &SpaceCollaborator{SpaceID: "sp-shared", User: "alice", Role: SpaceRoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := ParseActivitySpecRequest("files[data=sp-mine;extra=,sp-mine;title=notes]", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, forceReadOnly, err := s.AuthorizeActivitySpecRequest(ctx, "alice", spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forceReadOnly || authorized != spec {
+		t.Errorf("expected alice's own spaces to be left read-write, got %#v", authorized)
+	}
+
+	// A space alice may only view makes the whole activity read-only.
+	spec, err = ParseActivitySpecRequest("files[data=sp-mine;extra=,sp-mine,sp-shared;title=notes]", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, forceReadOnly, err = s.AuthorizeActivitySpecRequest(ctx, "alice", spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forceReadOnly {
+		t.Fatal("expected a viewer to be forced read-only")
+	}
+	if v := authorized.Parameters["data"].Space(false); v.SpaceID != "sp-mine" || !v.ReadOnly {
+		t.Errorf("expected data to be mounted read-only, got %#v", v)
+	}
+	extra := authorized.Parameters["extra"].Spaces(false)
+	if len(extra) != 2 || !extra[0].ReadOnly || !extra[1].ReadOnly {
+		t.Errorf("expected every space in extra to be mounted read-only, got %#v", extra)
+	}
+	if title := authorized.Parameters["title"]; title != "notes" {
+		t.Errorf("expected title to be left alone, got %q", title)
+	}
+	original, _ := spec.ActivitySpec()
+	rewritten, _ := authorized.ActivitySpec()
+	if original == rewritten {
+		t.Errorf("expected the read-only activityspec to differ from %s", original)
+	}
+
+	// A space alice can't see at all is refused outright.
+	spec, err = ParseActivitySpecRequest("files[data=sp-mine;extra=,sp-private]", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var denied *SpaceAccessDeniedError
+	if _, _, err := s.AuthorizeActivitySpecRequest(ctx, "alice", spec); !errors.As(err, &denied) || denied.SpaceID != "sp-private" {
+		t.Errorf("expected alice to be denied sp-private, got %v", err)
+	}
+}
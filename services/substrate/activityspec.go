@@ -80,7 +80,7 @@ func ParseViewRequest(v string, forceReadOnly bool) *SpaceViewRequest {
 		v = strings.TrimSuffix(v, ":ro")
 		readOnly = true
 	}
-	readOnly = forceReadOnly
+	readOnly = readOnly || forceReadOnly
 	if strings.HasPrefix(v, spaceViewForkPrefix) {
 		baseRef := strings.TrimPrefix(v, spaceViewForkPrefix)
 		return &SpaceViewRequest{
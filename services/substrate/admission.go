@@ -0,0 +1,321 @@
+package substrate
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+)
+
+// SpawnQueueFullError is returned by Spawn when the admission queue is full.
+// Callers should respond with 429 and a Retry-After header.
+type SpawnQueueFullError struct {
+	Queued     int
+	RetryAfter time.Duration
+}
+
+func (e *SpawnQueueFullError) Error() string {
+	return fmt.Sprintf("spawn queue is full (%d queued); retry after %s", e.Queued, e.RetryAfter)
+}
+
+// RetryAfterHeader formats RetryAfter as a Retry-After header value, in whole seconds.
+func (e *SpawnQueueFullError) RetryAfterHeader() string {
+	seconds := int64((e.RetryAfter + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// SpawnAdmissionEvent records the state of the spawn queue. It's stored in the
+// events table for spawn-queued, spawn-admitted and spawn-rejected events.
+type SpawnAdmissionEvent struct {
+	TicketID string `json:"ticket_id,omitempty"`
+	Position int    `json:"position,omitempty"`
+	Queued   int    `json:"queued"`
+	Running  int    `json:"running"`
+	WaitedMs int64  `json:"waited_ms,omitempty"`
+}
+
+// QueuedSpawn is a spawn waiting for admission.
+type QueuedSpawn struct {
+	TicketID string    `json:"ticket_id"`
+	User     string    `json:"user"`
+	Lens     string    `json:"lens"`
+	Position int       `json:"position"`
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+type SpawnAdmissionStats struct {
+	MaxConcurrent        int            `json:"max_concurrent"`
+	MaxConcurrentPerUser int            `json:"max_concurrent_per_user"`
+	MaxQueued            int            `json:"max_queued"`
+	Running              int            `json:"running"`
+	RunningByUser        map[string]int `json:"running_by_user"`
+	Queue                []QueuedSpawn  `json:"queue"`
+}
+
+type spawnTicket struct {
+	QueuedSpawn
+
+	admitted chan struct{}
+	element  *list.Element
+}
+
+// SpawnAdmission limits how many spawns run at once, both overall and per user.
+// Spawns over either limit wait in a queue. When a slot frees up, it goes to the
+// oldest waiting spawn whose user has the fewest spawns running, so one busy
+// user can't starve the others.
+type SpawnAdmission struct {
+	mu *sync.Mutex
+
+	// Zero means no limit.
+	maxConcurrent        int
+	maxConcurrentPerUser int
+	maxQueued            int
+	retryAfter           time.Duration
+
+	running       int
+	runningByUser map[string]int
+	queue         *list.List
+}
+
+func NewSpawnAdmission(maxConcurrent, maxConcurrentPerUser, maxQueued int, retryAfter time.Duration) *SpawnAdmission {
+	return &SpawnAdmission{
+		mu:                   &sync.Mutex{},
+		maxConcurrent:        maxConcurrent,
+		maxConcurrentPerUser: maxConcurrentPerUser,
+		maxQueued:            maxQueued,
+		retryAfter:           retryAfter,
+		runningByUser:        map[string]int{},
+		queue:                list.New(),
+	}
+}
+
+func (a *SpawnAdmission) canRunLocked(user string) bool {
+	if a.maxConcurrent > 0 && a.running >= a.maxConcurrent {
+		return false
+	}
+	if a.maxConcurrentPerUser > 0 && a.runningByUser[user] >= a.maxConcurrentPerUser {
+		return false
+	}
+	return true
+}
+
+func (a *SpawnAdmission) startLocked(user string) {
+	a.running++
+	a.runningByUser[user]++
+}
+
+func (a *SpawnAdmission) finish(user string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.running--
+	a.runningByUser[user]--
+	if a.runningByUser[user] <= 0 {
+		delete(a.runningByUser, user)
+	}
+	a.dispatchLocked()
+}
+
+// dispatchLocked admits waiting spawns until no more can run.
+func (a *SpawnAdmission) dispatchLocked() {
+	for {
+		var next *spawnTicket
+		for e := a.queue.Front(); e != nil; e = e.Next() {
+			t := e.Value.(*spawnTicket)
+			if !a.canRunLocked(t.User) {
+				continue
+			}
+			if next == nil || a.runningByUser[t.User] < a.runningByUser[next.User] {
+				next = t
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		a.queue.Remove(next.element)
+		next.element = nil
+		a.startLocked(next.User)
+		close(next.admitted)
+	}
+}
+
+func (a *SpawnAdmission) position(t *spawnTicket) int {
+	position := 1
+	for e := a.queue.Front(); e != nil && e != t.element; e = e.Next() {
+		position++
+	}
+	return position
+}
+
+func (a *SpawnAdmission) snapshotLocked() *SpawnAdmissionEvent {
+	return &SpawnAdmissionEvent{
+		Queued:  a.queue.Len(),
+		Running: a.running,
+	}
+}
+
+// acquire waits until user may spawn and returns a func to call once the spawn
+// is done. If the spawn has to wait, onQueued is called with its place in line
+// and onAdmitted once it's let through.
+func (a *SpawnAdmission) acquire(
+	ctx context.Context,
+	user, lens string,
+	onQueued func(*SpawnAdmissionEvent),
+	onAdmitted func(*SpawnAdmissionEvent),
+	onRejected func(*SpawnAdmissionEvent),
+) (func(), error) {
+	release := func() { a.finish(user) }
+
+	a.mu.Lock()
+	// Anything already waiting that could run has been dispatched, so if this
+	// user is under both limits it can go straight through.
+	if a.canRunLocked(user) {
+		a.startLocked(user)
+		a.mu.Unlock()
+		return release, nil
+	}
+
+	if a.maxQueued > 0 && a.queue.Len() >= a.maxQueued {
+		snapshot := a.snapshotLocked()
+		a.mu.Unlock()
+		onRejected(snapshot)
+		return nil, &SpawnQueueFullError{Queued: snapshot.Queued, RetryAfter: a.retryAfter}
+	}
+
+	t := &spawnTicket{
+		QueuedSpawn: QueuedSpawn{
+			TicketID: "spawnq-" + ulid.Make().String(),
+			User:     user,
+			Lens:     lens,
+			QueuedAt: time.Now(),
+		},
+		admitted: make(chan struct{}),
+	}
+	t.element = a.queue.PushBack(t)
+	queued := a.snapshotLocked()
+	queued.TicketID = t.TicketID
+	queued.Position = a.position(t)
+	a.mu.Unlock()
+
+	onQueued(queued)
+
+	select {
+	case <-t.admitted:
+		a.mu.Lock()
+		admitted := a.snapshotLocked()
+		a.mu.Unlock()
+		admitted.TicketID = t.TicketID
+		admitted.WaitedMs = time.Since(t.QueuedAt).Milliseconds()
+		onAdmitted(admitted)
+		return release, nil
+	case <-ctx.Done():
+		a.mu.Lock()
+		if t.element == nil {
+			// Admitted just as we gave up; hand the slot back.
+			a.mu.Unlock()
+			release()
+		} else {
+			a.queue.Remove(t.element)
+			t.element = nil
+			a.mu.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// Stats returns the current limits, running spawns and queue.
+func (a *SpawnAdmission) Stats() *SpawnAdmissionStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	stats := &SpawnAdmissionStats{
+		MaxConcurrent:        a.maxConcurrent,
+		MaxConcurrentPerUser: a.maxConcurrentPerUser,
+		MaxQueued:            a.maxQueued,
+		Running:              a.running,
+		RunningByUser:        map[string]int{},
+		Queue:                []QueuedSpawn{},
+	}
+	for user, n := range a.runningByUser {
+		stats.RunningByUser[user] = n
+	}
+	position := 1
+	for e := a.queue.Front(); e != nil; e = e.Next() {
+		q := e.Value.(*spawnTicket).QueuedSpawn
+		q.Position = position
+		stats.Queue = append(stats.Queue, q)
+		position++
+	}
+	return stats
+}
+
+// ForUser returns the stats as user may see them: the limits and totals, but
+// only their own running and queued spawns. Queued spawns keep their place in
+// the whole queue.
+func (stats *SpawnAdmissionStats) ForUser(user string) *SpawnAdmissionStats {
+	mine := *stats
+	mine.RunningByUser = map[string]int{}
+	if n, ok := stats.RunningByUser[user]; ok {
+		mine.RunningByUser[user] = n
+	}
+	mine.Queue = []QueuedSpawn{}
+	for _, q := range stats.Queue {
+		if q.User == user {
+			mine.Queue = append(mine.Queue, q)
+		}
+	}
+	return &mine
+}
+
+// admitSpawn waits for req to be admitted, recording any time spent queueing
+// in the events table. With no SpawnAdmission configured every spawn is
+// admitted right away.
+func (s *Substrate) admitSpawn(ctx context.Context, req *SpawnRequest) (func(), error) {
+	if s.Admission == nil {
+		return func() {}, nil
+	}
+
+	activitySpec, _ := req.ActivitySpec.ActivitySpec()
+	writeEvent := func(eventType string, admission *SpawnAdmissionEvent) {
+		err := s.WriteEvent(ctx, &Event{
+			ID:           "ev-" + ulid.Make().String(),
+			Type:         eventType,
+			Timestamp:    time.Now(),
+			RequestID:    RequestIDFromContext(ctx),
+			ActivitySpec: activitySpec,
+			User:         req.User,
+			Lens:         req.ActivitySpec.LensName,
+			Admission:    admission,
+		})
+		if err != nil {
+			LogFromContext(ctx).WithError(err).Warnf("error writing %s event", eventType)
+		}
+	}
+
+	ctx, span := StartSpan(ctx, "substrate.spawn.admit")
+	defer span.Finish()
+
+	release, err := s.Admission.acquire(ctx, req.User, req.ActivitySpec.LensName,
+		func(e *SpawnAdmissionEvent) {
+			span.SetAttribute("queue.position", e.Position)
+			writeEvent("spawn-queued", e)
+		},
+		func(e *SpawnAdmissionEvent) {
+			span.SetAttribute("queue.waited_ms", e.WaitedMs)
+			writeEvent("spawn-admitted", e)
+		},
+		func(e *SpawnAdmissionEvent) {
+			writeEvent("spawn-rejected", e)
+		},
+	)
+	span.SetError(err)
+	return release, err
+}
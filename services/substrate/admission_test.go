@@ -0,0 +1,228 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// pendingSpawn is a spawn waiting on acquire in the background.
+type pendingSpawn struct {
+	queued   chan *SpawnAdmissionEvent
+	admitted chan func()
+	err      chan error
+}
+
+// acquireInBackground acquires a slot for user and returns once it's either
+// running or queued.
+func acquireInBackground(t *testing.T, ctx context.Context, a *SpawnAdmission, user string) *pendingSpawn {
+	t.Helper()
+
+	p := &pendingSpawn{
+		queued:   make(chan *SpawnAdmissionEvent, 1),
+		admitted: make(chan func(), 1),
+		err:      make(chan error, 1),
+	}
+	ready := make(chan struct{}, 1)
+	go func() {
+		release, err := a.acquire(ctx, user, "notebook",
+			func(e *SpawnAdmissionEvent) {
+				p.queued <- e
+				ready <- struct{}{}
+			},
+			func(*SpawnAdmissionEvent) {},
+			func(*SpawnAdmissionEvent) {},
+		)
+		if err != nil {
+			p.err <- err
+		} else {
+			p.admitted <- release
+		}
+		ready <- struct{}{}
+	}()
+
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected %s's spawn to run or queue", user)
+	}
+	return p
+}
+
+// waitAdmitted waits for p to be let through and returns its release func.
+func (p *pendingSpawn) waitAdmitted(t *testing.T) func() {
+	t.Helper()
+
+	select {
+	case release := <-p.admitted:
+		return release
+	case err := <-p.err:
+		t.Fatalf("expected the spawn to be admitted, got %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the spawn to be admitted")
+	}
+	return nil
+}
+
+func (p *pendingSpawn) isWaiting() bool {
+	return len(p.admitted) == 0 && len(p.err) == 0
+}
+
+func TestSpawnAdmissionQueuesAndRejects(t *testing.T) {
+	ctx := context.Background()
+	a := NewSpawnAdmission(1, 0, 1, 1500*time.Millisecond)
+
+	first := acquireInBackground(t, ctx, a, "alice").waitAdmitted(t)
+
+	second := acquireInBackground(t, ctx, a, "bob")
+	if e := <-second.queued; e.Position != 1 || e.Running != 1 || e.Queued != 1 {
+		t.Fatalf("expected bob to be first in line, got %#v", e)
+	}
+
+	var full *SpawnQueueFullError
+	_, err := a.acquire(ctx, "carol", "notebook", func(*SpawnAdmissionEvent) {}, func(*SpawnAdmissionEvent) {}, func(*SpawnAdmissionEvent) {})
+	if !errors.As(err, &full) || full.Queued != 1 || full.RetryAfterHeader() != "2" {
+		t.Fatalf("expected the queue to be full, got %v", err)
+	}
+
+	if stats := a.Stats(); stats.Running != 1 || len(stats.Queue) != 1 || stats.Queue[0].User != "bob" {
+		t.Fatalf("unexpected stats %#v", stats)
+	}
+	if stats := a.Stats().ForUser("alice"); stats.Running != 1 || stats.RunningByUser["alice"] != 1 || len(stats.Queue) != 0 {
+		t.Errorf("expected alice to only see her running spawn, got %#v", stats)
+	}
+	if stats := a.Stats().ForUser("bob"); len(stats.RunningByUser) != 0 || len(stats.Queue) != 1 || stats.Queue[0].Position != 1 {
+		t.Errorf("expected bob to only see his queued spawn, got %#v", stats)
+	}
+
+	first()
+	second.waitAdmitted(t)()
+	if stats := a.Stats(); stats.Running != 0 || len(stats.Queue) != 0 || len(stats.RunningByUser) != 0 {
+		t.Fatalf("expected nothing running or queued, got %#v", stats)
+	}
+}
+
+func TestSpawnAdmissionLimitsEachUser(t *testing.T) {
+	ctx := context.Background()
+	a := NewSpawnAdmission(0, 1, 0, time.Second)
+
+	release := acquireInBackground(t, ctx, a, "alice").waitAdmitted(t)
+	queued := acquireInBackground(t, ctx, a, "alice")
+	<-queued.queued
+
+	// Bob isn't held up by alice's queued spawn.
+	acquireInBackground(t, ctx, a, "bob").waitAdmitted(t)()
+
+	if !queued.isWaiting() {
+		t.Fatalf("expected alice's second spawn to wait for her first")
+	}
+	release()
+	queued.waitAdmitted(t)()
+}
+
+func TestSpawnAdmissionFavorsUsersWithFewerSpawns(t *testing.T) {
+	ctx := context.Background()
+	a := NewSpawnAdmission(2, 0, 0, time.Second)
+
+	alice := acquireInBackground(t, ctx, a, "alice").waitAdmitted(t)
+	acquireInBackground(t, ctx, a, "alice").waitAdmitted(t)
+
+	// Alice queued first, but when her slot frees up it goes to bob, who
+	// has nothing running.
+	aliceAgain := acquireInBackground(t, ctx, a, "alice")
+	<-aliceAgain.queued
+	bob := acquireInBackground(t, ctx, a, "bob")
+	<-bob.queued
+
+	alice()
+	bob.waitAdmitted(t)
+	if !aliceAgain.isWaiting() {
+		t.Fatalf("expected alice's third spawn to wait")
+	}
+}
+
+func TestSpawnAdmissionGivesUpWithContext(t *testing.T) {
+	a := NewSpawnAdmission(1, 0, 0, time.Second)
+
+	release := acquireInBackground(t, context.Background(), a, "alice").waitAdmitted(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiting := acquireInBackground(t, ctx, a, "bob")
+	<-waiting.queued
+	cancel()
+
+	select {
+	case err := <-waiting.err:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected the spawn to be canceled, got %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the spawn to give up")
+	}
+	if stats := a.Stats(); len(stats.Queue) != 0 {
+		t.Fatalf("expected the canceled spawn to leave the queue, got %#v", stats.Queue)
+	}
+
+	release()
+	if stats := a.Stats(); stats.Running != 0 {
+		t.Fatalf("expected nothing running, got %d", stats.Running)
+	}
+}
+
+func TestAdmitSpawnRecordsQueueEvents(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	s.Admission = NewSpawnAdmission(1, 0, 1, time.Second)
+
+	req := &SpawnRequest{ActivitySpec: ActivitySpecRequest{LensName: "notebook"}, User: "alice"}
+	release, err := s.admitSpawn(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan func(), 1)
+	go func() {
+		release, err := s.admitSpawn(ctx, req)
+		if err != nil {
+			t.Error(err)
+			release = func() {}
+		}
+		admitted <- release
+	}()
+
+	// Wait for the second spawn to queue before filling the queue up.
+	waitForEvent(t, s, "spawn-queued")
+	if _, err := s.admitSpawn(ctx, req); err == nil {
+		t.Fatalf("expected the third spawn to be rejected")
+	}
+
+	release()
+	(<-admitted)()
+
+	for _, eventType := range []string{"spawn-queued", "spawn-admitted", "spawn-rejected"} {
+		event := waitForEvent(t, s, eventType)
+		if event.Admission == nil || event.User != "alice" || event.Lens != "notebook" {
+			t.Errorf("unexpected %s event %#v", eventType, event)
+		}
+	}
+}
+
+// waitForEvent waits for an event of the given type to be written.
+func waitForEvent(t *testing.T, s *Substrate, eventType string) *Event {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		events, err := s.ListEvents(context.Background(), &EventListRequest{EventWhere: EventWhere{Type: &eventType}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) > 0 {
+			return events[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected a %s event", eventType)
+	return nil
+}
@@ -0,0 +1,297 @@
+package substrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionSpaceDelete  = "space.delete"
+	AuditActionSpaceRestore = "space.restore"
+	AuditActionSpacePurge   = "space.purge"
+	AuditActionSpacePatch   = "space.patch"
+
+	AuditActionCollaboratorSet    = "space.collaborator.set"
+	AuditActionCollaboratorDelete = "space.collaborator.delete"
+
+	AuditActionCollectionCreate       = "collection.create"
+	AuditActionCollectionPatch        = "collection.patch"
+	AuditActionCollectionReorder      = "collection.reorder"
+	AuditActionCollectionDelete       = "collection.delete"
+	AuditActionCollectionMemberAdd    = "collection.member.add"
+	AuditActionCollectionMemberRemove = "collection.member.remove"
+
+	AuditActionTokenCreate   = "token.create"
+	AuditActionTokenRevoke   = "token.revoke"
+	AuditActionSessionRevoke = "session.revoke"
+
+	AuditActionSpawn = "spawn"
+)
+
+// AuditEntry is one privileged action, as recorded in the audit log. Unlike
+// events, entries can't be changed or removed, and each one's Hash covers
+// its contents and the entry before it.
+type AuditEntry struct {
+	ID        string         `json:"id"`
+	Timestamp time.Time      `json:"ts"`
+	Actor     string         `json:"actor"`
+	Action    string         `json:"action"`
+	Target    string         `json:"target"`
+	Details   map[string]any `json:"details,omitempty"`
+
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+
+	PrevHash string `json:"prev_hash"`
+	Hash     string `json:"hash"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this entry in the list it came from.
+func (e *AuditEntry) Cursor() *Cursor {
+	return e.cursor
+}
+
+type auditClientContextKey struct{}
+
+type auditClient struct {
+	remoteAddr string
+	userAgent  string
+}
+
+// WithAuditClient notes where a request came from, for any audit entries
+// written while handling it.
+func WithAuditClient(ctx context.Context, remoteAddr, userAgent string) context.Context {
+	return context.WithValue(ctx, auditClientContextKey{}, auditClient{remoteAddr, userAgent})
+}
+
+// auditEntryHash hashes an entry's columns, as stored, along with the hash of
+// the entry before it.
+func auditEntryHash(prevHash, id string, ts int64, actor, action, target, details, remoteAddr, userAgent, requestID string) string {
+	b, _ := json.Marshal([]any{prevHash, id, ts, actor, action, target, details, remoteAddr, userAgent, requestID})
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// WriteAuditEntry appends e to the audit log, filling in its ID, timestamp,
+// request details and hashes.
+func (s *Substrate) WriteAuditEntry(ctx context.Context, e *AuditEntry) error {
+	e.ID = "au-" + ulid.Make().String()
+	e.Timestamp = time.Now()
+	e.RequestID = RequestIDFromContext(ctx)
+	if client, ok := ctx.Value(auditClientContextKey{}).(auditClient); ok {
+		e.RemoteAddr = client.remoteAddr
+		e.UserAgent = client.userAgent
+	}
+	if e.Details == nil {
+		e.Details = map[string]any{}
+	}
+	details, err := json.Marshal(e.Details)
+	if err != nil {
+		return err
+	}
+
+	// Finding the last hash and appending to it has to happen as one.
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `SELECT hash FROM "audit_log" ORDER BY seq DESC LIMIT 1`
+	err = tx.QueryRowContext(ctx, q).Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return wrapSQLError(err, q)
+	}
+
+	ts := e.Timestamp.UnixMicro()
+	e.Hash = auditEntryHash(e.PrevHash, e.ID, ts, e.Actor, e.Action, e.Target, string(details), e.RemoteAddr, e.UserAgent, e.RequestID)
+
+	q = `INSERT INTO "audit_log" (id, ts_us, actor, action, target, details, remote_addr, user_agent, request_id, prev_hash, hash) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	values := []any{e.ID, ts, e.Actor, e.Action, e.Target, string(details), e.RemoteAddr, e.UserAgent, e.RequestID, e.PrevHash, e.Hash}
+	if _, err := tx.ExecContext(ctx, q, values...); err != nil {
+		return wrapSQLError(err, q, values...)
+	}
+	return tx.Commit()
+}
+
+// Audit appends e to the audit log. The action it records has already
+// happened by now, so a failure is logged rather than returned.
+func (s *Substrate) Audit(ctx context.Context, e *AuditEntry) {
+	if err := s.WriteAuditEntry(ctx, e); err != nil {
+		LogFromContext(ctx).WithError(err).Warnf("error writing %s audit entry for %s", e.Action, e.Target)
+	}
+}
+
+// IsAdmin reports whether user may manage the gateway.
+func (s *Substrate) IsAdmin(user string) bool {
+	for _, admin := range s.Admins {
+		if admin == user {
+			return true
+		}
+	}
+	return false
+}
+
+// IsAuditor reports whether user may read everyone's audit entries.
+func (s *Substrate) IsAuditor(user string) bool {
+	for _, auditor := range s.Auditors {
+		if auditor == user {
+			return true
+		}
+	}
+	return false
+}
+
+type AuditWhere struct {
+	Actor  *string    `json:"actor,omitempty"`
+	Action *string    `json:"action,omitempty"`
+	Target *string    `json:"target,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+	Until  *time.Time `json:"until,omitempty"`
+}
+
+type AuditListRequest struct {
+	AuditWhere
+	Limit   *Limit
+	OrderBy *OrderBy
+	Cursor  *Cursor
+}
+
+const auditLogTable = "audit_log"
+
+func (q *AuditWhere) AppendWhere(query *Query) {
+	if q.Actor != nil {
+		query.Where = append(query.Where, auditLogTable+".actor = ?")
+		query.WhereValues = append(query.WhereValues, *q.Actor)
+	}
+	if q.Action != nil {
+		query.Where = append(query.Where, auditLogTable+".action = ?")
+		query.WhereValues = append(query.WhereValues, *q.Action)
+	}
+	if q.Target != nil {
+		query.Where = append(query.Where, auditLogTable+".target = ?")
+		query.WhereValues = append(query.WhereValues, *q.Target)
+	}
+	if q.Since != nil {
+		query.Where = append(query.Where, auditLogTable+".ts_us >= ?")
+		query.WhereValues = append(query.WhereValues, q.Since.UnixMicro())
+	}
+	if q.Until != nil {
+		query.Where = append(query.Where, auditLogTable+".ts_us < ?")
+		query.WhereValues = append(query.WhereValues, q.Until.UnixMicro())
+	}
+}
+
+const auditEntryColumns = `seq, id, ts_us, actor, action, target, details, remote_addr, user_agent, request_id, prev_hash, hash`
+
+// scanAuditEntry scans a row of auditEntryColumns. It returns the details as
+// stored too, since that's what the entry's hash covers.
+func scanAuditEntry(scan func(dest ...any) error) (*AuditEntry, string, error) {
+	var o AuditEntry
+	var seq, ts int64
+	var details string
+	err := scan(&seq, &o.ID, &ts, &o.Actor, &o.Action, &o.Target, &details, &o.RemoteAddr, &o.UserAgent, &o.RequestID, &o.PrevHash, &o.Hash)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal([]byte(details), &o.Details); err != nil {
+		return nil, "", err
+	}
+	o.Timestamp = time.UnixMicro(ts)
+	o.cursor = newCursor(seq)
+	return &o, details, nil
+}
+
+func (s *Substrate) ListAuditEntries(ctx context.Context, request *AuditListRequest) ([]*AuditEntry, error) {
+	query := &Query{
+		Select:          []string{auditEntryColumns},
+		FromTablesNamed: map[string]string{auditLogTable: auditLogTable},
+		WherePredicates: map[string]bool{},
+		Limit:           request.Limit,
+		OrderBy:         request.OrderBy,
+		OrderByColumns:  []string{auditLogTable + ".seq"},
+		After:           request.Cursor,
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+
+	request.AppendWhere(query)
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	q, values := query.Render()
+	rows, err := s.dbQueryContext(ctx, q, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*AuditEntry{}
+	for rows.Next() {
+		o, _, err := scanAuditEntry(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, o)
+	}
+
+	return results, rows.Err()
+}
+
+// AuditVerification is the result of checking the audit log's hash chain.
+type AuditVerification struct {
+	Valid   bool `json:"valid"`
+	Entries int  `json:"entries"`
+
+	// Head is the hash of the last entry. Keeping a copy elsewhere means
+	// entries removed from the end can be noticed too.
+	Head string `json:"head,omitempty"`
+
+	// BrokenAt is the first entry whose hash doesn't match, if any.
+	BrokenAt string `json:"broken_at,omitempty"`
+}
+
+// VerifyAuditLog recomputes the audit log's hash chain from the start.
+func (s *Substrate) VerifyAuditLog(ctx context.Context) (*AuditVerification, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT `+auditEntryColumns+` FROM "audit_log" ORDER BY seq`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	v := &AuditVerification{Valid: true}
+	for rows.Next() {
+		o, details, err := scanAuditEntry(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		hash := auditEntryHash(v.Head, o.ID, o.Timestamp.UnixMicro(), o.Actor, o.Action, o.Target, details, o.RemoteAddr, o.UserAgent, o.RequestID)
+		if o.PrevHash != v.Head || o.Hash != hash {
+			v.Valid = false
+			v.BrokenAt = o.ID
+			return v, nil
+		}
+		v.Entries++
+		v.Head = o.Hash
+	}
+
+	return v, rows.Err()
+}
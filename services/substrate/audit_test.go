@@ -0,0 +1,141 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+)
+
+// writeTestAuditLog writes an entry for each target, acting as alice.
+func writeTestAuditLog(t *testing.T, s *Substrate, targets ...string) []*AuditEntry {
+	t.Helper()
+
+	ctx := WithAuditClient(context.Background(), "10.0.0.1:1234", "curl/8.0")
+	entries := []*AuditEntry{}
+	for _, target := range targets {
+		e := &AuditEntry{Actor: "alice", Action: AuditActionSpaceDelete, Target: target, Details: map[string]any{"reason": "cleanup"}}
+		if err := s.WriteAuditEntry(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+func TestAuditLogIsAppendOnly(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	entries := writeTestAuditLog(t, s, "sp-a", "sp-b", "sp-c")
+
+	if entries[0].PrevHash != "" || entries[1].PrevHash != entries[0].Hash || entries[2].PrevHash != entries[1].Hash {
+		t.Fatalf("expected each entry to chain to the one before it, got %#v", entries)
+	}
+	if e := entries[0]; e.RemoteAddr != "10.0.0.1:1234" || e.UserAgent != "curl/8.0" {
+		t.Errorf("expected the client to be recorded, got %q %q", e.RemoteAddr, e.UserAgent)
+	}
+
+	v, err := s.VerifyAuditLog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Valid || v.Entries != 3 || v.Head != entries[2].Hash || v.BrokenAt != "" {
+		t.Fatalf("expected an untouched log to verify, got %#v", v)
+	}
+
+	if _, err := s.DB.ExecContext(ctx, `UPDATE "audit_log" SET actor = 'mallory'`); err == nil {
+		t.Error("expected updating the audit log to fail")
+	}
+	if _, err := s.DB.ExecContext(ctx, `DELETE FROM "audit_log"`); err == nil {
+		t.Error("expected deleting from the audit log to fail")
+	}
+}
+
+func TestAuditVerifyCatchesTampering(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		tamper string
+		broken int
+	}{
+		{name: "changed actor", tamper: `UPDATE "audit_log" SET actor = 'mallory' WHERE target = 'sp-b'`, broken: 1},
+		{name: "changed details", tamper: `UPDATE "audit_log" SET details = '{}' WHERE target = 'sp-c'`, broken: 2},
+		{name: "rehashed entry", tamper: `UPDATE "audit_log" SET hash = 'x' || hash WHERE target = 'sp-a'`, broken: 0},
+		{name: "removed entry", tamper: `DELETE FROM "audit_log" WHERE target = 'sp-b'`, broken: 2},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestSubstrate(t)
+			entries := writeTestAuditLog(t, s, "sp-a", "sp-b", "sp-c", "sp-d")
+
+			// Only someone with direct access to the database can get
+			// past the triggers.
+			for _, q := range []string{`DROP TRIGGER "audit_log_no_update"`, `DROP TRIGGER "audit_log_no_delete"`, c.tamper} {
+				if _, err := s.DB.ExecContext(ctx, q); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			v, err := s.VerifyAuditLog(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Valid || v.BrokenAt != entries[c.broken].ID {
+				t.Errorf("expected verification to break at %s, got %#v", entries[c.broken].ID, v)
+			}
+		})
+	}
+
+	// Removing entries from the end leaves a valid chain, but a different
+	// head.
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	entries := writeTestAuditLog(t, s, "sp-a", "sp-b", "sp-c")
+	for _, q := range []string{`DROP TRIGGER "audit_log_no_delete"`, `DELETE FROM "audit_log" WHERE target = 'sp-c'`} {
+		if _, err := s.DB.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v, err := s.VerifyAuditLog(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Valid || v.Entries != 2 || v.Head == entries[2].Hash {
+		t.Errorf("expected a truncated log to verify with an earlier head, got %#v", v)
+	}
+}
+
+func TestListAuditEntries(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	writeTestAuditLog(t, s, "sp-a", "sp-b", "sp-c")
+	if err := s.WriteAuditEntry(ctx, &AuditEntry{Actor: "bob", Action: AuditActionTokenCreate, Target: "tok-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := "bob"
+	entries, err := s.ListAuditEntries(ctx, &AuditListRequest{AuditWhere: AuditWhere{Actor: &bob}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Target != "tok-1" {
+		t.Errorf("expected only bob's entry, got %#v", entries)
+	}
+
+	action := AuditActionSpaceDelete
+	request := &AuditListRequest{AuditWhere: AuditWhere{Action: &action}, Limit: &Limit{2}}
+	targets := []string{}
+	for {
+		page, err := s.ListAuditEntries(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, e := range page {
+			targets = append(targets, e.Target)
+		}
+		request.Cursor = page[len(page)-1].Cursor()
+	}
+	if len(targets) != 3 || targets[0] != "sp-a" || targets[1] != "sp-b" || targets[2] != "sp-c" {
+		t.Errorf("expected to page through the deletes in order, got %v", targets)
+	}
+}
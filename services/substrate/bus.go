@@ -0,0 +1,267 @@
+package substrate
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+)
+
+// EventNotFoundError is returned when resuming from an event that doesn't exist.
+type EventNotFoundError struct {
+	ID string
+}
+
+func (e *EventNotFoundError) Error() string {
+	return "no such event: " + e.ID
+}
+
+// EventTransport carries events between EventBus instances, e.g. over NATS, so
+// subscribers see events written by any substrate process.
+type EventTransport interface {
+	Publish(event *Event) error
+	Subscribe(deliver func(*Event)) (func(), error)
+	Close() error
+}
+
+// EventSubscription receives events that match its filter. If the subscriber
+// falls too far behind, C is closed and Dropped returns true; clients should
+// resubscribe and resume from the last event they saw.
+type EventSubscription struct {
+	C <-chan *Event
+
+	bus     *EventBus
+	where   EventWhere
+	c       chan *Event
+	dropped bool
+}
+
+// Dropped reports whether the subscription was closed because it fell behind.
+func (sub *EventSubscription) Dropped() bool {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	return sub.dropped
+}
+
+// Close stops delivery and closes C.
+func (sub *EventSubscription) Close() {
+	sub.bus.mu.Lock()
+	defer sub.bus.mu.Unlock()
+	sub.bus.removeLocked(sub)
+}
+
+// EventBus fans out events to subscribers as they're written.
+type EventBus struct {
+	mu          *sync.Mutex
+	subscribers map[*EventSubscription]struct{}
+
+	transport   EventTransport
+	unsubscribe func()
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		mu:          &sync.Mutex{},
+		subscribers: map[*EventSubscription]struct{}{},
+	}
+}
+
+// UseTransport sends published events through t instead of delivering them
+// directly. Events come back to this bus (and any others on t) by way of t.
+func (b *EventBus) UseTransport(t EventTransport) error {
+	unsubscribe, err := t.Subscribe(b.deliver)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.transport = t
+	b.unsubscribe = unsubscribe
+	return nil
+}
+
+// Publish sends event to every matching subscriber. It never blocks on slow
+// subscribers.
+func (b *EventBus) Publish(event *Event) error {
+	b.mu.Lock()
+	t := b.transport
+	b.mu.Unlock()
+
+	if t != nil {
+		return t.Publish(event)
+	}
+	b.deliver(event)
+	return nil
+}
+
+func (b *EventBus) deliver(event *Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		if !sub.where.Match(event) {
+			continue
+		}
+		select {
+		case sub.c <- event:
+		default:
+			sub.dropped = true
+			b.removeLocked(sub)
+		}
+	}
+}
+
+// Subscribe returns a subscription to events matching where. buffer is how many
+// events may be waiting before the subscription is dropped.
+func (b *EventBus) Subscribe(where *EventWhere, buffer int) *EventSubscription {
+	c := make(chan *Event, buffer)
+	sub := &EventSubscription{C: c, bus: b, c: c}
+	if where != nil {
+		sub.where = *where
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[sub] = struct{}{}
+	return sub
+}
+
+func (b *EventBus) removeLocked(sub *EventSubscription) {
+	if _, ok := b.subscribers[sub]; !ok {
+		return
+	}
+	delete(b.subscribers, sub)
+	close(sub.c)
+}
+
+// Close closes every subscription and the transport, if any.
+func (b *EventBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for sub := range b.subscribers {
+		b.removeLocked(sub)
+	}
+	if b.transport == nil {
+		return nil
+	}
+	b.unsubscribe()
+	return b.transport.Close()
+}
+
+// Match reports whether event passes every filter in w.
+func (w *EventWhere) Match(event *Event) bool {
+	if w.Lens != nil && *w.Lens != event.Lens {
+		return false
+	}
+	if w.User != nil && *w.User != event.User {
+		return false
+	}
+	if w.ActivitySpec != nil && *w.ActivitySpec != event.ActivitySpec {
+		return false
+	}
+	if w.Type != nil && *w.Type != event.Type {
+		return false
+	}
+	return true
+}
+
+// VisibleTo reports whether user may see event. Memberships of private
+// collections are only shown to their owner, and private spaces to theirs.
+func (event *Event) VisibleTo(user string) bool {
+	m := event.CollectionMembership
+	if m != nil && !m.IsPublic && m.Owner != user {
+		return false
+	}
+	space := event.Space
+	return space == nil || !space.IsPrivate || space.Owner == user
+}
+
+// EventVisibleTo is like Event.VisibleTo, but also hides events about
+// activities, like spawns, that use a space user may not read.
+func (s *Substrate) EventVisibleTo(ctx context.Context, event *Event, user string) (bool, error) {
+	if !event.VisibleTo(user) {
+		return false, nil
+	}
+	if event.ActivitySpec == "" {
+		return true, nil
+	}
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT 1 FROM "spaces" WHERE instr(?, spaces.id) > 0 AND NOT `+spaceVisibleTo+` LIMIT 1`,
+		event.ActivitySpec, user, user)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	hidden := rows.Next()
+	return !hidden, rows.Err()
+}
+
+// publishEvent hands event to the bus, if there is one. The event is already in
+// the database by now, so a failure here is logged rather than returned.
+func (s *Substrate) publishEvent(ctx context.Context, event *Event) {
+	if s.Bus == nil {
+		return
+	}
+	err := s.Bus.Publish(event)
+	if err != nil {
+		LogFromContext(ctx).WithError(err).Warnf("error publishing %s event", event.Type)
+	}
+}
+
+// writeChangeEvent records a change to a space or collection in the events
+// table, so that it's published and can be replayed like any other event.
+func (s *Substrate) writeChangeEvent(ctx context.Context, event *Event) {
+	event.ID = "ev-" + ulid.Make().String()
+	event.Timestamp = time.Now()
+	event.RequestID = RequestIDFromContext(ctx)
+	err := s.WriteEvent(ctx, event)
+	if err != nil {
+		LogFromContext(ctx).WithError(err).Warnf("error writing %s event", event.Type)
+	}
+}
+
+// EventsAfter returns the events matching where that were written after the
+// event with ID lastEventID, oldest first.
+func (s *Substrate) EventsAfter(ctx context.Context, where *EventWhere, lastEventID string, limit *Limit) ([]*Event, error) {
+	cursor, err := s.eventCursor(ctx, lastEventID)
+	if err != nil {
+		return nil, err
+	}
+	if cursor == nil {
+		return nil, &EventNotFoundError{ID: lastEventID}
+	}
+
+	return s.ListEvents(ctx, &EventListRequest{
+		EventWhere: *where,
+		Limit:      limit,
+		OrderBy:    &OrderBy{Descending: false},
+		Cursor:     cursor,
+	})
+}
+
+func (s *Substrate) eventCursor(ctx context.Context, id string) (*Cursor, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT ts FROM "events" WHERE id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	var ts string
+	if err := rows.Scan(&ts); err != nil {
+		return nil, err
+	}
+	return newCursor(ts, id), nil
+}
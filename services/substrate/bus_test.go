@@ -0,0 +1,162 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestEventBusDeliversMatchingEvents(t *testing.T) {
+	bus := NewEventBus()
+	defer bus.Close()
+
+	lens := "notebook"
+	sub := bus.Subscribe(&EventWhere{Lens: &lens}, 4)
+	all := bus.Subscribe(nil, 4)
+
+	bus.Publish(&Event{ID: "ev-1", Lens: "files"})
+	bus.Publish(&Event{ID: "ev-2", Lens: "notebook"})
+
+	if event := <-sub.C; event.ID != "ev-2" {
+		t.Errorf("expected only ev-2 for lens %s, got %s", lens, event.ID)
+	}
+	for _, want := range []string{"ev-1", "ev-2"} {
+		if event := <-all.C; event.ID != want {
+			t.Errorf("expected %s, got %s", want, event.ID)
+		}
+	}
+
+	sub.Close()
+	if _, ok := <-sub.C; ok {
+		t.Error("expected C to be closed after Close")
+	}
+	if sub.Dropped() {
+		t.Error("a closed subscription shouldn't count as dropped")
+	}
+}
+
+func TestEventBusDropsSlowSubscribers(t *testing.T) {
+	bus := NewEventBus()
+	defer bus.Close()
+
+	slow := bus.Subscribe(nil, 1)
+	fast := bus.Subscribe(nil, 3)
+	for i := 0; i < 3; i++ {
+		// Publish never blocks, however far behind slow is.
+		bus.Publish(&Event{ID: fmt.Sprintf("ev-%d", i)})
+	}
+
+	if !slow.Dropped() {
+		t.Fatal("expected the slow subscriber to be dropped")
+	}
+	if event := <-slow.C; event.ID != "ev-0" {
+		t.Errorf("expected what was buffered before the drop, got %s", event.ID)
+	}
+	if _, ok := <-slow.C; ok {
+		t.Error("expected a dropped subscription's C to be closed")
+	}
+	if fast.Dropped() || len(fast.C) != 3 {
+		t.Errorf("expected the fast subscriber to get all 3 events, got %d", len(fast.C))
+	}
+}
+
+func TestEventsAfterResumesFromLastEventID(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	s.Bus = NewEventBus()
+	defer s.Bus.Close()
+
+	sub := s.Bus.Subscribe(nil, 8)
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		event := &Event{ID: fmt.Sprintf("ev-%d", i), Type: "test", User: "alice", Timestamp: start.Add(time.Duration(i) * time.Second)}
+		if err := s.WriteEvent(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sub.C) != 5 {
+		t.Errorf("expected every written event to be published, got %d", len(sub.C))
+	}
+
+	events, err := s.EventsAfter(ctx, &EventWhere{}, "ev-1", &Limit{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].ID != "ev-2" || events[1].ID != "ev-3" {
+		t.Fatalf("expected ev-2 and ev-3 after ev-1, got %v", eventIDs(events))
+	}
+	events, err = s.EventsAfter(ctx, &EventWhere{}, events[1].ID, &Limit{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != "ev-4" {
+		t.Fatalf("expected ev-4 after ev-3, got %v", eventIDs(events))
+	}
+
+	if _, err := s.EventsAfter(ctx, &EventWhere{}, "ev-missing", nil); err == nil {
+		t.Error("expected an EventNotFoundError resuming from a missing event")
+	}
+}
+
+func eventIDs(events []*Event) []string {
+	ids := []string{}
+	for _, event := range events {
+		ids = append(ids, event.ID)
+	}
+	return ids
+}
+
+func TestEventVisibleTo(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		event *Event
+		user  string
+		want  bool
+	}{
+		{"spawn", &Event{Type: "spawn"}, "bob", true},
+		{"public space", &Event{Space: &Space{Owner: "alice"}}, "bob", true},
+		{"private space, owner", &Event{Space: &Space{Owner: "alice", IsPrivate: true}}, "alice", true},
+		{"private space, other", &Event{Space: &Space{Owner: "alice", IsPrivate: true}}, "bob", false},
+		{"public collection", &Event{CollectionMembership: &CollectionMembership{Owner: "alice", IsPublic: true}}, "bob", true},
+		{"private collection, owner", &Event{CollectionMembership: &CollectionMembership{Owner: "alice"}}, "alice", true},
+		{"private collection, other", &Event{CollectionMembership: &CollectionMembership{Owner: "alice"}}, "bob", false},
+	} {
+		if got := tc.event.VisibleTo(tc.user); got != tc.want {
+			t.Errorf("%s: VisibleTo(%s) = %t, want %t", tc.name, tc.user, got, tc.want)
+		}
+	}
+}
+
+func TestEventVisibleToHidesPrivateActivities(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	writeTestSpace(t, s, "sp-private", "alice", true, 0)
+	writeTestSpace(t, s, "sp-public", "alice", false, 1)
+	if err := s.SetSpaceCollaborator(ctx, &SpaceCollaborator{SpaceID: "sp-private", User: "carol", Role: SpaceRoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+
+	private := &Event{Type: "spawn", User: "alice", Lens: "files", ActivitySpec: "files[data=sp-private;extra=,sp-public]"}
+	public := &Event{Type: "spawn", User: "alice", Lens: "files", ActivitySpec: "files[data=sp-public]"}
+	for _, tc := range []struct {
+		event *Event
+		user  string
+		want  bool
+	}{
+		{private, "alice", true},
+		{private, "carol", true},
+		{private, "bob", false},
+		{private, "", false},
+		{public, "bob", true},
+		{&Event{Type: "spawn", ActivitySpec: "files[data=sp-unknown]"}, "bob", true},
+	} {
+		got, err := s.EventVisibleTo(ctx, tc.event, tc.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("EventVisibleTo(%s, %q) = %t, want %t", tc.event.ActivitySpec, tc.user, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/ajbouh/substrate/services/substrate"
+)
+
+// statusRecorder remembers the status and size of a response. It passes
+// through Flush and Hijack so streaming responses and WebSocket upgrades work.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += int64(n)
+	return n, err
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+func newTracerFromEnvironment() *substrate.Tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); base != "" {
+			endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+		}
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = "substrate"
+	}
+
+	return &substrate.Tracer{
+		ServiceName: serviceName,
+		Endpoint:    endpoint,
+	}
+}
+
+// withAccessLog assigns each request an ID, starts its root span, and writes
+// one structured log line once it completes. The ID ends up in the audit log
+// and in requests to backends, so a client can't choose it; an incoming
+// X-Request-Id is only logged, as client_request_id.
+func withAccessLog(tracer *substrate.Tracer, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		clientRequestID := req.Header.Get(substrate.RequestIDHeader)
+		requestID := substrate.NewRequestID()
+		req.Header.Set(substrate.RequestIDHeader, requestID)
+		rw.Header().Set(substrate.RequestIDHeader, requestID)
+
+		ctx := substrate.WithRequestID(req.Context(), requestID)
+		ctx = substrate.WithAuditClient(ctx, req.RemoteAddr, req.UserAgent())
+		ctx, span := tracer.StartRequestSpan(ctx, req.Method+" "+req.URL.Path, req)
+		span.SetAttribute("http.method", req.Method)
+		span.SetAttribute("http.target", req.URL.Path)
+		span.SetAttribute("http.request_id", requestID)
+		if clientRequestID != "" {
+			span.SetAttribute("http.client_request_id", clientRequestID)
+		}
+
+		rec := &statusRecorder{ResponseWriter: rw}
+		next.ServeHTTP(rec, req.WithContext(ctx))
+
+		span.SetAttribute("http.status_code", rec.status)
+		span.Finish()
+
+		fields := logrus.Fields{
+			"request_id": requestID,
+			"trace_id":   span.TraceID.String(),
+			"remote":     req.RemoteAddr,
+			"method":     req.Method,
+			"path":       req.URL.Path,
+			"status":     rec.status,
+			"bytes":      rec.bytes,
+			"duration":   time.Since(start).String(),
+			"user_agent": req.UserAgent(),
+		}
+		if clientRequestID != "" {
+			fields["client_request_id"] = clientRequestID
+		}
+		logrus.WithFields(fields).Info("access")
+	})
+}
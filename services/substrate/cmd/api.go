@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"mime"
@@ -12,6 +14,7 @@ import (
 	"time"
 
 	"github.com/julienschmidt/httprouter"
+	ulid "github.com/oklog/ulid/v2"
 
 	form "github.com/go-playground/form/v4"
 
@@ -85,6 +88,76 @@ func getValueAsIntPtr(query url.Values, key string) *int {
 	return nil
 }
 
+func getValueAsTimePtr(query url.Values, key string) (*time.Time, error) {
+	if query.Has(key) {
+		t, err := time.Parse(time.RFC3339, query.Get(key))
+		if err != nil {
+			return nil, fmt.Errorf("%s must be an RFC 3339 time: %w", key, err)
+		}
+		return &t, nil
+	}
+	return nil, nil
+}
+
+// listPage is one page of a list endpoint. Like search results, the body has
+// the items in results and the cursor for the next page, if there may be one,
+// in next_cursor. The cursor also goes in the X-Next-Cursor header and a Link
+// header with rel="next".
+type listPage struct {
+	Results    any               `json:"results"`
+	NextCursor *substrate.Cursor `json:"next_cursor,omitempty"`
+}
+
+type cursored interface {
+	Cursor() *substrate.Cursor
+}
+
+// newListPage returns a page of items. A full page might not be the last one,
+// so it gets a cursor for the page after it.
+func newListPage[T cursored](items []T, limit *substrate.Limit) *listPage {
+	if items == nil {
+		items = []T{}
+	}
+	page := &listPage{Results: items}
+	if limit != nil && len(items) > 0 && len(items) >= limit.Limit {
+		page.NextCursor = items[len(items)-1].Cursor()
+	}
+	return page
+}
+
+const maxListLimit = 1000
+
+// getListParams reads the limit, cursor and descending query parameters shared
+// by list endpoints. defaultLimit of 0 means no limit.
+func getListParams(query url.Values, defaultLimit int, defaultDescending bool) (*substrate.Limit, *substrate.Cursor, *substrate.OrderBy, error) {
+	var limit *substrate.Limit
+	if defaultLimit > 0 {
+		limit = &substrate.Limit{Limit: defaultLimit}
+	}
+	if query.Has("limit") {
+		l := getValueAsIntPtr(query, "limit")
+		if l == nil || *l <= 0 || *l > maxListLimit {
+			return nil, nil, nil, fmt.Errorf("limit must be between 1 and %d", maxListLimit)
+		}
+		limit = substrate.LimitFromPtr(l)
+	}
+
+	cursor, err := substrate.CursorFromPtr(getValueAsStringPtr(query, "cursor"))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if cursor != nil && limit == nil {
+		return nil, nil, nil, fmt.Errorf("cursor requires a limit")
+	}
+
+	orderBy := &substrate.OrderBy{Descending: defaultDescending}
+	if descending := getValueAsBoolPtr(query, "descending"); descending != nil {
+		orderBy.Descending = *descending
+	}
+
+	return limit, cursor, orderBy, nil
+}
+
 func readRequestBody(req *http.Request, v interface{}) (int, error) {
 	var err error
 	switch {
@@ -116,19 +189,117 @@ func stringPtr(s string) *string {
 	return &s
 }
 
-func newApiHandler(s *substrate.Substrate) http.Handler {
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+// requiredScope is the scope an API token needs to use a route. Routes with no
+// scope are only available to browser sessions.
+func requiredScope(method, route string) string {
+	switch {
+	case strings.HasPrefix(route, "/api/v1/tokens"), strings.HasPrefix(route, "/api/v1/sessions"), strings.HasPrefix(route, "/api/v1/gateway"):
+		return ""
+	case method == "GET":
+		return substrate.TokenScopeReadSpaces
+	case method == "POST" && (route == "/api/v1/activities" || route == "/api/v1/spaces"):
+		return substrate.TokenScopeSpawn
+	case strings.HasPrefix(route, "/api/v1/collections/"):
+		return substrate.TokenScopeWriteCollections
+	}
+	return ""
+}
+
+// spaceLimitedRoutes are the routes a token limited to some spaces, like one
+// minted for a spawned backend, may use. Each checks the spaces it's given.
+var spaceLimitedRoutes = map[string]bool{
+	"GET /api/v1/lenses":                                    true,
+	"GET /api/v1/lenses/:lens":                              true,
+	"GET /api/v1/spaces/:space":                             true,
+	"POST /api/v1/spaces":                                   true,
+	"POST /api/v1/activities":                               true,
+	"POST /api/v1/collections/:owner/:name/spaces":          true,
+	"DELETE /api/v1/collections/:owner/:name/spaces/:space": true,
+}
+
+// checkTokenSpaces returns a SpaceAccessDeniedError if user is limited to some
+// spaces and views use any others.
+func checkTokenSpaces(user *auth.User, views ...substrate.SpaceViewRequest) error {
+	for _, v := range views {
+		ids, err := v.SpaceIDs()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if !user.CanUseSpace(id) {
+				return &substrate.SpaceAccessDeniedError{SpaceID: id, User: user.GithubUsername, Action: "use"}
+			}
+		}
+	}
+	return nil
+}
+
+func newApiHandler(s *substrate.Substrate, gw *substrate.Gateway) http.Handler {
 	router := httprouter.New()
 
 	handleRaw := func(method, route string, f func(rw http.ResponseWriter, req *http.Request, p httprouter.Params)) {
+		scope := requiredScope(method, route)
+		g := func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+			if user, ok := auth.UserFromContext(req.Context()); ok {
+				jsonrw := newJSONResponseWriter(rw)
+				switch {
+				case !user.HasScope(scope) && scope == "":
+					jsonrw(nil, http.StatusForbidden, fmt.Errorf("%s %s is not available with an API token", method, route))
+					return
+				case !user.HasScope(scope):
+					jsonrw(nil, http.StatusForbidden, fmt.Errorf("%s %s needs a token with the %q scope", method, route, scope))
+					return
+				case user.Spaces != nil && !spaceLimitedRoutes[method+" "+route]:
+					jsonrw(nil, http.StatusForbidden, fmt.Errorf("%s %s is not available with a token limited to some spaces", method, route))
+					return
+				case p.ByName("space") != "" && !user.CanUseSpace(p.ByName("space")):
+					jsonrw(nil, http.StatusNotFound, fmt.Errorf("no such space: %s", p.ByName("space")))
+					return
+				}
+			}
+			f(rw, req, p)
+		}
 		// register below / and /gw/substrate/
-		router.Handle(method, route, f)
-		router.Handle(method, "/gw/substrate"+route, f)
+		router.Handle(method, route, g)
+		router.Handle(method, "/gw/substrate"+route, g)
 	}
 
 	handle := func(method, route string, f func(req *http.Request, p httprouter.Params) (interface{}, int, error)) {
 		handleRaw(method, route, func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+			v, status, err := f(req, p)
+			if page, ok := v.(*listPage); ok {
+				if page.NextCursor != nil {
+					next := *req.URL
+					query := next.Query()
+					query.Set("cursor", page.NextCursor.String())
+					next.RawQuery = query.Encode()
+					rw.Header().Set("X-Next-Cursor", page.NextCursor.String())
+					rw.Header().Set("Link", "<"+next.RequestURI()+`>; rel="next"`)
+				}
+			}
+			var full *substrate.SpawnQueueFullError
+			var trashed *substrate.SpaceTrashedError
+			var collectionExists *substrate.CollectionExistsError
+			var collectionNotFound *substrate.CollectionNotFoundError
+			var readOnly *substrate.ReadOnlyCollectionError
+			var accessDenied *substrate.SpaceAccessDeniedError
+			switch {
+			case errors.As(err, &full):
+				rw.Header().Set("Retry-After", full.RetryAfterHeader())
+				status = http.StatusTooManyRequests
+			case errors.As(err, &trashed), errors.As(err, &collectionExists), errors.As(err, &readOnly):
+				status = http.StatusConflict
+			case errors.As(err, &collectionNotFound):
+				status = http.StatusNotFound
+			case errors.As(err, &accessDenied):
+				status = http.StatusForbidden
+			}
 			jsonrw := newJSONResponseWriter(rw)
-			jsonrw(f(req, p))
+			jsonrw(v, status, err)
 		})
 	}
 
@@ -146,10 +317,66 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		ForceReadOnly bool   `json:"force_read_only"`
 	}
 
+	// activityURL returns the URL a browser should use to reach a spawned backend.
+	// Backends that require a bearer token are routed through the gateway, which
+	// adds the token itself, so it never appears in a browser-visible URL.
+	activityURL := func(ctx context.Context, sres *substrate.SpawnResult, user string, forceReadOnly bool) (string, error) {
+		if sres.BearerToken == nil {
+			u, _ := sres.URL(substrate.ProvisionerHeaderAuthenticationMode)
+			return u.String(), nil
+		}
+
+		activitySpec, path, err := sres.GatewayPath()
+		if err != nil {
+			return "", err
+		}
+		cacheKey := substrate.GatewayCacheKey(activitySpec, user, forceReadOnly)
+		factory, err := s.MakeProvisionerFromSpawn(func(fmt string, values ...any) {
+			log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
+		}, sres, user, forceReadOnly)
+		if err != nil {
+			return "", err
+		}
+		gw.Seed(ctx, cacheKey, factory)
+
+		return s.Origin + path, nil
+	}
+
+	// audit records a privileged action taken by the requesting user.
+	audit := func(req *http.Request, action, target string, details map[string]any) {
+		var actor string
+		if user, ok := auth.UserFromContext(req.Context()); ok {
+			actor = user.GithubUsername
+		}
+		s.Audit(req.Context(), &substrate.AuditEntry{
+			Actor:   actor,
+			Action:  action,
+			Target:  target,
+			Details: details,
+		})
+	}
+
+	// spaceRole returns the requesting user's role on a space. Spaces they can't
+	// read at all are reported as missing, so private spaces stay hidden.
+	spaceRole := func(req *http.Request, spaceID string) (substrate.SpaceRole, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return "", http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+		role, found, err := s.SpaceRole(req.Context(), spaceID, user.GithubUsername)
+		if err != nil {
+			return "", http.StatusInternalServerError, err
+		}
+		if !found || !role.CanRead() {
+			return "", http.StatusNotFound, fmt.Errorf("no such space: %s", spaceID)
+		}
+		return role, http.StatusOK, nil
+	}
+
 	handle("POST", "/api/v1/activities", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
 		user, ok := auth.UserFromContext(req.Context())
 		if !ok {
-			return nil, http.StatusBadRequest, fmt.Errorf("user not available in context")
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
 		}
 
 		r := &ActivityRequest{}
@@ -167,6 +394,16 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, http.StatusBadRequest, err
 		}
+		if err := checkTokenSpaces(user, s.SpaceViewRequests(views)...); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+
+		// Viewers get their own read-only activity, so they never resume one
+		// that can write.
+		views, forceReadOnly, err := s.AuthorizeActivitySpecRequest(req.Context(), user.GithubUsername, views)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
 
 		if !r.ForceSpawn {
 			activityspec, concrete := views.ActivitySpec()
@@ -174,9 +411,12 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 				return nil, http.StatusBadRequest, fmt.Errorf("activityspec must be concrete to be used with resume")
 			}
 
+			// Only resume the user's own backend, which has their token, and
+			// was spawned with the same access they have now.
 			events, err := s.ListEvents(req.Context(), &substrate.EventListRequest{
 				EventWhere: substrate.EventWhere{
 					ActivitySpec: &activityspec,
+					User:         &user.GithubUsername,
 					Type:         stringPtr("spawn"),
 				},
 				OrderBy: &substrate.OrderBy{Descending: true},
@@ -186,8 +426,6 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 				return nil, http.StatusInternalServerError, err
 			}
 
-			fmt.Printf("events: %#v\n", events)
-
 			if len(events) > 0 {
 				event := events[0]
 				backendStatus, err := s.JamsocketClient.Status(req.Context(), event.JamsocketSpawn.Response.Name)
@@ -196,45 +434,87 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 				}
 
 				if backendStatus.State.IsReady() || backendStatus.State.IsPending() {
+					requiresToken, err := s.BackendRequiresBearerToken(req.Context(), event.JamsocketSpawn.Response.Name)
+					if err != nil {
+						return nil, http.StatusInternalServerError, err
+					}
+
 					sres, err := event.SpawnResult()
 					if err != nil {
 						// Is this right? Or should we respawn?
 						return nil, http.StatusInternalServerError, err
 					}
 
-					u, _ := sres.URL(substrate.ProvisionerCookieAuthenticationMode)
+					var u string
+					if requiresToken {
+						// Only the gateway still has the backend's token. If
+						// its entry is gone, it spawns a new backend.
+						var path string
+						_, path, err = sres.GatewayPath()
+						u = s.Origin + path
+					} else {
+						u, err = activityURL(req.Context(), sres, user.GithubUsername, forceReadOnly)
+					}
+					if err != nil {
+						return nil, http.StatusInternalServerError, err
+					}
 
 					return &ActivityResult{
-						URL: u.String(),
+						URL:             u,
 						Status:          backendStatus,
 						StatusStreamURL: statusStreamURLPrefix + event.JamsocketSpawn.Response.Name + "/status/stream",
 						ActivitySpec:    event.ActivitySpec,
 					}, http.StatusOK, nil
 				}
+				if backendStatus.State.IsGone() {
+					if err := s.DeleteBackendBearerToken(req.Context(), event.JamsocketSpawn.Response.Name); err != nil {
+						return nil, http.StatusInternalServerError, err
+					}
+				}
 			}
 		}
 
 		sres, err := s.Spawn(req.Context(), &substrate.SpawnRequest{
-			User:         user.GithubUsername,
-			ActivitySpec: *views,
+			User:          user.GithubUsername,
+			ActivitySpec:  *views,
+			ForceReadOnly: r.ForceReadOnly || forceReadOnly,
 		})
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
 
-		u, _ := sres.URL(substrate.ProvisionerCookieAuthenticationMode)
+		u, err := activityURL(req.Context(), sres, user.GithubUsername, forceReadOnly)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
 		return &ActivityResult{
-			URL: u.String(),
+			URL:             u,
 			Status:          nil,
 			StatusStreamURL: statusStreamURLPrefix + sres.Name + "/status/stream",
 			ActivitySpec:    sres.ActivitySpec,
 		}, http.StatusOK, nil
 	})
 
+	handle("GET", "/api/v1/spawns/queue", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if s.Admission == nil {
+			return nil, http.StatusNotFound, fmt.Errorf("spawn admission control is not enabled")
+		}
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+		// Only admins see everyone's spawns.
+		stats := s.Admission.Stats()
+		if !s.IsAdmin(user.GithubUsername) {
+			stats = stats.ForUser(user.GithubUsername)
+		}
+		return stats, http.StatusOK, nil
+	})
+
 	handle("POST", "/api/v1/spaces", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
 		user, ok := auth.UserFromContext(req.Context())
 		if !ok {
-			return nil, http.StatusBadRequest, fmt.Errorf("user not available in context")
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
 		}
 
 		// TODO should we allow setting an alias here?
@@ -244,6 +524,18 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 			return nil, status, err
 		}
 
+		if err := checkTokenSpaces(user, *r); err != nil {
+			return nil, http.StatusForbidden, err
+		}
+		// Viewers may open a space, but only read-only.
+		readOnly, err := s.CheckSpaceViewAccess(req.Context(), user.GithubUsername, r)
+		if err != nil {
+			return nil, authorizationErrorStatus(err), err
+		}
+		if readOnly {
+			r.ReadOnly = true
+		}
+
 		alias := ""
 		view, err := s.ResolveSpaceView(r, user.GithubUsername, alias)
 		if err != nil {
@@ -303,7 +595,7 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 	handle("DELETE", "/api/v1/spaces/:space", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
 		user, ok := auth.UserFromContext(req.Context())
 		if !ok {
-			return nil, http.StatusBadRequest, fmt.Errorf("user not available in context")
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
 		}
 
 		w := p.ByName("space")
@@ -333,21 +625,148 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
+		audit(req, substrate.AuditActionSpaceDelete, ws.ID, nil)
+
+		gw.Flush(req.Context(), &substrate.GatewayEntryWhere{SpaceID: &ws.ID})
+
+		return nil, http.StatusOK, nil
+	})
+
+	handle("POST", "/api/v1/spaces/:space/restore", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		w := p.ByName("space")
+		result, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
+			SpaceWhere: substrate.SpaceWhere{
+				ID:      &w,
+				Deleted: boolPtr(true),
+			},
+			Limit: &substrate.Limit{
+				Limit: 1,
+			},
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(result) == 0 {
+			return nil, http.StatusNotFound, nil
+		}
+		ws := result[0]
+
+		if ws.Owner != user.GithubUsername {
+			return nil, http.StatusUnauthorized, fmt.Errorf("only the owner of the space can restore it")
+		}
+
+		err = s.RestoreSpace(req.Context(), &substrate.SpaceWhere{
+			ID: &ws.ID,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		audit(req, substrate.AuditActionSpaceRestore, ws.ID, nil)
+
+		ws.DeletedAt = nil
+		return ws, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/trash", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		limit, cursor, orderBy, err := getListParams(req.URL.Query(), 0, false)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		result, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
+			SpaceWhere: substrate.SpaceWhere{
+				Owner:   stringPtr(user.GithubUsername),
+				Deleted: boolPtr(true),
+			},
+			Limit:   limit,
+			Cursor:  cursor,
+			OrderBy: orderBy,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return newListPage(result, limit), http.StatusOK, nil
+	})
+
+	// Permanently delete a space that's already in the trash.
+	handle("DELETE", "/api/v1/trash/:space", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		w := p.ByName("space")
+		result, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
+			SpaceWhere: substrate.SpaceWhere{
+				ID:      &w,
+				Deleted: boolPtr(true),
+			},
+			Limit: &substrate.Limit{
+				Limit: 1,
+			},
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(result) == 0 {
+			return nil, http.StatusNotFound, nil
+		}
+		ws := result[0]
+
+		if ws.Owner != user.GithubUsername {
+			return nil, http.StatusUnauthorized, fmt.Errorf("only the owner of the space can purge it")
+		}
+
+		err = s.PurgeSpace(req.Context(), &substrate.SpaceWhere{
+			ID: &ws.ID,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		audit(req, substrate.AuditActionSpacePurge, ws.ID, nil)
 
 		return nil, http.StatusOK, nil
 	})
 
 	handle("PATCH", "/api/v1/spaces/:space", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
-		r := &substrate.SpaceListingPatch{}
+		r := &struct {
+			substrate.SpaceListingPatch
+			Owner *string `json:"owner,omitempty"`
+		}{}
 		status, err := readRequestBody(req, &r)
 		if err != nil {
 			return nil, status, err
 		}
+		if r.Owner != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("the owner of a space can't be changed")
+		}
+
 		r.ID = p.ByName("space")
-		err = s.PatchSpace(req.Context(), r)
+		role, status, err := spaceRole(req, r.ID)
+		if err != nil {
+			return nil, status, err
+		}
+		if role != substrate.SpaceRoleOwner {
+			return nil, http.StatusUnauthorized, fmt.Errorf("only the owner of the space can change it")
+		}
+
+		err = s.PatchSpace(req.Context(), &r.SpaceListingPatch)
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
+		audit(req, substrate.AuditActionSpacePatch, r.ID, map[string]any{"patch": r.SpaceListingPatch})
+		if r.IsPrivate != nil {
+			gw.Flush(req.Context(), &substrate.GatewayEntryWhere{SpaceID: &r.ID})
+		}
 
 		return nil, http.StatusOK, nil
 	})
@@ -394,12 +813,24 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 	})
 
 	handle("GET", "/api/v1/activities", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
 		query := req.URL.Query()
+		limit, cursor, orderBy, err := getListParams(query, 0, false)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
 		activities, err := s.ListActivities(req.Context(), &substrate.ActivityListRequest{
 			ActivityWhere: substrate.ActivityWhere{
-				Lens: getValueAsStringPtr(query, "lens"),
+				Lens:      getValueAsStringPtr(query, "lens"),
+				VisibleTo: &user.GithubUsername,
 			},
-			Limit: substrate.LimitFromPtr(getValueAsIntPtr(query, "limit")),
+			Limit:   limit,
+			Cursor:  cursor,
+			OrderBy: orderBy,
 		})
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
@@ -417,17 +848,24 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 			})
 		}
 
-		return list, http.StatusOK, nil
+		page := newListPage(activities, limit)
+		page.Results = list
+		return page, http.StatusOK, nil
 	})
 
 	handle("GET", "/api/v1/activities/*activityspec", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
 		activityspec := strings.TrimPrefix(p.ByName("activityspec"), "/")
 		activity, err := substrate.ParseActivitySpecRequest(activityspec, false)
 		if err != nil {
 			return nil, http.StatusBadRequest, err
 		}
 
-		spaces, _, err := s.ResolveConcreteLensSpawnParameterRequests(req.Context(), activity.LensName, activity.Parameters, false)
+		spaces, _, err := s.ResolveConcreteLensSpawnParameterRequests(req.Context(), user.GithubUsername, activity.LensName, activity.Parameters, false)
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
@@ -441,14 +879,18 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 	handle("GET", "/api/v1/spaces/:space", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
 		user, ok := auth.UserFromContext(req.Context())
 		if !ok {
-			return nil, http.StatusBadRequest, fmt.Errorf("user not available in context")
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
 		}
 
 		w := p.ByName("space")
+		if _, status, err := spaceRole(req, w); err != nil {
+			return nil, status, err
+		}
 		result, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
 			SpaceWhere: substrate.SpaceWhere{
 				ID: &w,
 			},
+			IncludeDeleted: true,
 			SelectNestedCollections: &substrate.CollectionMembershipWhere{
 				Owner: stringPtr(user.GithubUsername),
 			},
@@ -465,81 +907,347 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		return result[0], http.StatusOK, nil
 	})
 
-	handle("GET", "/api/v1/lenses", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
-		lenses, err := s.AllLenses(req.Context())
-		if err != nil {
-			return nil, http.StatusInternalServerError, err
+	handle("GET", "/api/v1/spaces/:space/lineage", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
 		}
 
-		return lenses, http.StatusOK, nil
-	})
-
-	handle("GET", "/api/v1/spaces", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
 		query := req.URL.Query()
-		result, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
-			SpaceWhere: substrate.SpaceWhere{
-				Owner:        getValueAsStringPtr(query, "owner"),
-				ForkedFromID: getValueAsStringPtr(query, "forked_from"),
-			},
-			SelectNestedCollections: &substrate.CollectionMembershipWhere{
-				Owner:      getValueAsStringPtr(query, "collection_owner"),
-				Name:       getValueAsStringPtr(query, "collection_name"),
-				NamePrefix: getValueAsStringPtr(query, "collection_prefix"),
-				LensSpec:   getValueAsStringPtr(query, "collection_lensspec"),
-				IsPublic:   getValueAsBoolPtr(query, "collection_public"),
-			},
+		lineage, err := s.SpaceLineage(req.Context(), &substrate.SpaceLineageRequest{
+			SpaceID:         p.ByName("space"),
+			User:            user.GithubUsername,
+			AncestorDepth:   getValueAsIntPtr(query, "ancestors"),
+			DescendantDepth: getValueAsIntPtr(query, "descendants"),
 		})
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
-		return result, http.StatusOK, nil
+		if lineage == nil {
+			return nil, http.StatusNotFound, nil
+		}
+		return lineage, http.StatusOK, nil
 	})
 
-	// List all collections for an owner
-	handle("GET", "/api/v1/collections/:owner", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
-		query := req.URL.Query()
-		result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
-			CollectionMembershipWhere: substrate.CollectionMembershipWhere{
-				Owner: stringPtr(p.ByName("owner")),
-			},
-			Limit: substrate.LimitFromPtr(getValueAsIntPtr(query, "limit")),
-		})
+	handle("GET", "/api/v1/spaces/:space/collaborators", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		spaceID := p.ByName("space")
+		if _, status, err := spaceRole(req, spaceID); err != nil {
+			return nil, status, err
+		}
+		collaborators, err := s.ListSpaceCollaborators(req.Context(), spaceID)
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
-		return result, http.StatusOK, nil
+		return collaborators, http.StatusOK, nil
 	})
 
-	// Get specific collection (or list of collections with given prefix) for an owner
-	handle("GET", "/api/v1/collections/:owner/:name", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
-		query := req.URL.Query()
-		name := p.ByName("name")
-		var nameP *string
-		var prefixP *string
-		if strings.HasSuffix(name, "*") {
-			prefixP = stringPtr(strings.TrimSuffix(name, "*"))
-		} else {
-			nameP = &name
-		}
-		result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
-			CollectionMembershipWhere: substrate.CollectionMembershipWhere{
-				Owner:      stringPtr(p.ByName("owner")),
-				Name:       nameP,
-				NamePrefix: prefixP,
-			},
-			Limit: substrate.LimitFromPtr(getValueAsIntPtr(query, "limit")),
-		})
+	handle("PUT", "/api/v1/spaces/:space/collaborators/:user", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		spaceID := p.ByName("space")
+		role, status, err := spaceRole(req, spaceID)
 		if err != nil {
-			return nil, http.StatusInternalServerError, err
+			return nil, status, err
 		}
-		if len(result) == 0 {
-			return nil, http.StatusNotFound, nil
+		if role != substrate.SpaceRoleOwner {
+			return nil, http.StatusUnauthorized, fmt.Errorf("only the owner of the space can share it")
 		}
-		return result[0], http.StatusOK, nil
+
+		r := &struct {
+			Role substrate.SpaceRole `json:"role" form:"role"`
+		}{}
+		status, err = readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+
+		collaborator := &substrate.SpaceCollaborator{
+			SpaceID:   spaceID,
+			User:      p.ByName("user"),
+			Role:      r.Role,
+			CreatedAt: time.Now(),
+		}
+		err = s.SetSpaceCollaborator(req.Context(), collaborator)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		audit(req, substrate.AuditActionCollaboratorSet, spaceID, map[string]any{"user": collaborator.User, "role": collaborator.Role})
+
+		// Backends may have been spawned under the old role.
+		gw.Flush(req.Context(), &substrate.GatewayEntryWhere{SpaceID: &spaceID})
+
+		return collaborator, http.StatusOK, nil
+	})
+
+	handle("DELETE", "/api/v1/spaces/:space/collaborators/:user", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		spaceID := p.ByName("space")
+		role, status, err := spaceRole(req, spaceID)
+		if err != nil {
+			return nil, status, err
+		}
+		if role != substrate.SpaceRoleOwner {
+			return nil, http.StatusUnauthorized, fmt.Errorf("only the owner of the space can unshare it")
+		}
+
+		err = s.DeleteSpaceCollaborator(req.Context(), spaceID, p.ByName("user"))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		audit(req, substrate.AuditActionCollaboratorDelete, spaceID, map[string]any{"user": p.ByName("user")})
+
+		gw.Flush(req.Context(), &substrate.GatewayEntryWhere{SpaceID: &spaceID})
+
+		return nil, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/search", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		query := req.URL.Query()
+		q := query.Get("q")
+		if strings.TrimSpace(q) == "" {
+			return nil, http.StatusBadRequest, fmt.Errorf("q is required")
+		}
+
+		limit := getValueAsIntPtr(query, "limit")
+		if limit != nil && (*limit <= 0 || *limit > 100) {
+			return nil, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and 100")
+		}
+		cursor, err := substrate.CursorFromPtr(getValueAsStringPtr(query, "cursor"))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		result, err := s.Search(req.Context(), &substrate.SearchRequest{
+			Query:  q,
+			User:   user.GithubUsername,
+			Kinds:  query["kind"],
+			Limit:  substrate.LimitFromPtr(limit),
+			Cursor: cursor,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return result, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/lenses", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		lenses, err := s.AllLenses(req.Context())
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		return lenses, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/spaces", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		query := req.URL.Query()
+		limit, cursor, orderBy, err := getListParams(query, 0, false)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		result, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
+			SpaceWhere: substrate.SpaceWhere{
+				Owner:        getValueAsStringPtr(query, "owner"),
+				ForkedFromID: getValueAsStringPtr(query, "forked_from"),
+				VisibleTo:    &user.GithubUsername,
+			},
+			Limit:   limit,
+			Cursor:  cursor,
+			OrderBy: orderBy,
+			SelectNestedCollections: &substrate.CollectionMembershipWhere{
+				Owner:      getValueAsStringPtr(query, "collection_owner"),
+				Name:       getValueAsStringPtr(query, "collection_name"),
+				NamePrefix: getValueAsStringPtr(query, "collection_prefix"),
+				LensSpec:   getValueAsStringPtr(query, "collection_lensspec"),
+				IsPublic:   getValueAsBoolPtr(query, "collection_public"),
+			},
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return newListPage(result, limit), http.StatusOK, nil
+	})
+
+	// List all collections for an owner
+	handle("GET", "/api/v1/collections/:owner", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		limit, cursor, orderBy, err := getListParams(req.URL.Query(), 0, false)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
+			CollectionMembershipWhere: substrate.CollectionMembershipWhere{
+				Owner: stringPtr(p.ByName("owner")),
+			},
+			Limit:   limit,
+			Cursor:  cursor,
+			OrderBy: orderBy,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return newListPage(result, limit), http.StatusOK, nil
+	})
+
+	// requireCollectionOwner only lets the owner of the collection in the route
+	// change it.
+	requireCollectionOwner := func(req *http.Request, p httprouter.Params) (int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+		if user.GithubUsername != p.ByName("owner") {
+			return http.StatusUnauthorized, fmt.Errorf("only the owner of a collection can change it")
+		}
+		return http.StatusOK, nil
+	}
+
+	// Get specific collection (or list of collections with given prefix) for an owner
+	handle("GET", "/api/v1/collections/:owner/:name", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		name := p.ByName("name")
+		if strings.HasSuffix(name, "*") {
+			limit, cursor, orderBy, err := getListParams(req.URL.Query(), 0, false)
+			if err != nil {
+				return nil, http.StatusBadRequest, err
+			}
+			result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
+				CollectionMembershipWhere: substrate.CollectionMembershipWhere{
+					Owner:      stringPtr(p.ByName("owner")),
+					NamePrefix: stringPtr(strings.TrimSuffix(name, "*")),
+				},
+				Limit:   limit,
+				Cursor:  cursor,
+				OrderBy: orderBy,
+			})
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			return newListPage(result, limit), http.StatusOK, nil
+		}
+
+		result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
+			CollectionMembershipWhere: substrate.CollectionMembershipWhere{
+				Owner: stringPtr(p.ByName("owner")),
+				Name:  &name,
+			},
+			Limit: &substrate.Limit{Limit: 1},
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(result) == 0 {
+			return nil, http.StatusNotFound, nil
+		}
+		return result[0], http.StatusOK, nil
+	})
+
+	// Create a collection. Members are added with the lenses and spaces routes,
+	// unless it's a smart collection, whose members are the spaces its query
+	// matches.
+	handle("POST", "/api/v1/collections/:owner/:name", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+
+		r := struct {
+			Label      string                `json:"label"`
+			IsPublic   bool                  `json:"public,omitempty"`
+			Attributes map[string]any        `json:"attributes,omitempty"`
+			Query      *substrate.SpaceQuery `json:"query,omitempty"`
+		}{}
+		status, err := readRequestBody(req, &r)
+		if err != nil {
+			return nil, status, err
+		}
+
+		err = s.CreateCollection(req.Context(), &substrate.Collection{
+			Owner:      p.ByName("owner"),
+			Name:       p.ByName("name"),
+			Label:      r.Label,
+			IsPublic:   r.IsPublic,
+			Attributes: r.Attributes,
+			Query:      r.Query,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		audit(req, substrate.AuditActionCollectionCreate, p.ByName("owner")+"/"+p.ByName("name"), map[string]any{"public": r.IsPublic, "query": r.Query})
+		return nil, http.StatusCreated, nil
+	})
+
+	// Rename a collection, or change its label, attributes or visibility
+	handle("PATCH", "/api/v1/collections/:owner/:name", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+
+		r := &substrate.CollectionPatch{}
+		status, err := readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+		r.Owner = p.ByName("owner")
+		r.Name = p.ByName("name")
+
+		err = s.PatchCollection(req.Context(), r)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		audit(req, substrate.AuditActionCollectionPatch, r.Owner+"/"+r.Name, map[string]any{"patch": r})
+		return nil, http.StatusOK, nil
+	})
+
+	// Delete a collection and all its memberships
+	handle("DELETE", "/api/v1/collections/:owner/:name", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+
+		err := s.DeleteCollection(req.Context(), p.ByName("owner"), p.ByName("name"))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		audit(req, substrate.AuditActionCollectionDelete, p.ByName("owner")+"/"+p.ByName("name"), nil)
+		return nil, http.StatusOK, nil
+	})
+
+	// Set the order of a collection's members
+	handle("PUT", "/api/v1/collections/:owner/:name/order", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+
+		r := struct {
+			Members []*substrate.CollectionMemberRef `json:"members"`
+		}{}
+		status, err := readRequestBody(req, &r)
+		if err != nil {
+			return nil, status, err
+		}
+
+		err = s.ReorderCollection(req.Context(), p.ByName("owner"), p.ByName("name"), r.Members)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		audit(req, substrate.AuditActionCollectionReorder, p.ByName("owner")+"/"+p.ByName("name"), map[string]any{"members": r.Members})
+		return nil, http.StatusOK, nil
 	})
 
 	// Attach a lens to a collection
 	handle("POST", "/api/v1/collections/:owner/:name/lenses", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+		if err := s.CheckCollectionMembersWritable(req.Context(), p.ByName("owner"), p.ByName("name")); err != nil {
+			return nil, http.StatusConflict, err
+		}
+
 		r := struct {
 			LensSpec   string         `json:"lensspec"`
 			IsPublic   bool           `json:"public,omitempty"`
@@ -565,11 +1273,19 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
+		audit(req, substrate.AuditActionCollectionMemberAdd, p.ByName("owner")+"/"+p.ByName("name"), map[string]any{"lensspec": r.LensSpec})
 		return nil, http.StatusOK, nil
 	})
 
 	// Add a space to a collection
 	handle("POST", "/api/v1/collections/:owner/:name/spaces", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+		if err := s.CheckCollectionMembersWritable(req.Context(), p.ByName("owner"), p.ByName("name")); err != nil {
+			return nil, http.StatusConflict, err
+		}
+
 		r := struct {
 			SpaceID    string         `json:"space"`
 			IsPublic   bool           `json:"public,omitempty"`
@@ -579,6 +1295,13 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, status, err
 		}
+		if user, ok := auth.UserFromContext(req.Context()); ok && !user.CanUseSpace(r.SpaceID) {
+			return nil, http.StatusNotFound, fmt.Errorf("no such space: %s", r.SpaceID)
+		}
+		// Only spaces the owner can read may be collected.
+		if _, status, err := spaceRole(req, r.SpaceID); err != nil {
+			return nil, status, err
+		}
 		err = s.WriteCollectionMembership(req.Context(), &substrate.CollectionMembership{
 			Owner:      p.ByName("owner"),
 			Name:       p.ByName("name"),
@@ -589,11 +1312,18 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
+		audit(req, substrate.AuditActionCollectionMemberAdd, p.ByName("owner")+"/"+p.ByName("name"), map[string]any{"space": r.SpaceID})
 		return nil, http.StatusOK, nil
 	})
 
 	// Remove a space from a collection
 	handle("DELETE", "/api/v1/collections/:owner/:name/spaces/:space", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+		if err := s.CheckCollectionMembersWritable(req.Context(), p.ByName("owner"), p.ByName("name")); err != nil {
+			return nil, http.StatusConflict, err
+		}
 		err := s.DeleteCollectionMembership(req.Context(), &substrate.CollectionMembershipWhere{
 			Owner:   stringPtr(p.ByName("owner")),
 			Name:    stringPtr(p.ByName("name")),
@@ -602,11 +1332,18 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
+		audit(req, substrate.AuditActionCollectionMemberRemove, p.ByName("owner")+"/"+p.ByName("name"), map[string]any{"space": p.ByName("space")})
 		return nil, http.StatusOK, nil
 	})
 
 	// Remove a lens from a collection
 	handle("DELETE", "/api/v1/collections/:owner/:name/lenses/:lensspec", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := requireCollectionOwner(req, p); err != nil {
+			return nil, status, err
+		}
+		if err := s.CheckCollectionMembersWritable(req.Context(), p.ByName("owner"), p.ByName("name")); err != nil {
+			return nil, http.StatusConflict, err
+		}
 		err := s.DeleteCollectionMembership(req.Context(), &substrate.CollectionMembershipWhere{
 			Owner:    stringPtr(p.ByName("owner")),
 			Name:     stringPtr(p.ByName("name")),
@@ -615,80 +1352,805 @@ func newApiHandler(s *substrate.Substrate) http.Handler {
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
+		audit(req, substrate.AuditActionCollectionMemberRemove, p.ByName("owner")+"/"+p.ByName("name"), map[string]any{"lensspec": p.ByName("lensspec")})
 		return nil, http.StatusOK, nil
 	})
 
-	handle("GET", "/api/v1/collections/:owner/:name/spaces", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
-		query := req.URL.Query()
+	// listCollectionMembers lists a page of the members of the collection in
+	// the route, or the first one matching its name if it ends with "*".
+	listCollectionMembers := func(req *http.Request, p httprouter.Params, where substrate.CollectionMembershipWhere) (interface{}, int, error) {
+		limit, cursor, orderBy, err := getListParams(req.URL.Query(), 0, false)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
 
+		where.Owner = stringPtr(p.ByName("owner"))
 		name := p.ByName("name")
-		var nameP *string
-		var prefixP *string
 		if strings.HasSuffix(name, "*") {
-			prefixP = stringPtr(strings.TrimSuffix(name, "*"))
+			where.NamePrefix = stringPtr(strings.TrimSuffix(name, "*"))
 		} else {
-			nameP = &name
+			where.Name = &name
 		}
-		result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
-			CollectionMembershipWhere: substrate.CollectionMembershipWhere{
-				Owner:      stringPtr(p.ByName("owner")),
-				NamePrefix: prefixP,
-				Name:       nameP,
-				HasSpaceID: true,
-			},
-			Limit: substrate.LimitFromPtr(getValueAsIntPtr(query, "limit")),
+		result, err := s.ListCollectionMembers(req.Context(), &substrate.CollectionMemberListQuery{
+			CollectionMembershipWhere: where,
+			Limit:                     limit,
+			Cursor:                    cursor,
+			OrderBy:                   orderBy,
 		})
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
-		if len(result) == 0 {
-			return []*substrate.CollectionMember{}, http.StatusOK, nil
-		}
-		return result[0].Members, http.StatusOK, nil
+		return newListPage(result, limit), http.StatusOK, nil
+	}
+
+	handle("GET", "/api/v1/collections/:owner/:name/spaces", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		return listCollectionMembers(req, p, substrate.CollectionMembershipWhere{HasSpaceID: true})
 	})
 
 	handle("GET", "/api/v1/collections/:owner/:name/lensspecs", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
-		query := req.URL.Query()
-
-		name := p.ByName("name")
-		var nameP *string
-		var prefixP *string
-		if strings.HasSuffix(name, "*") {
-			prefixP = stringPtr(strings.TrimSuffix(name, "*"))
-		} else {
-			nameP = &name
-		}
-		result, err := s.ListCollections(req.Context(), &substrate.CollectionListQuery{
-			CollectionMembershipWhere: substrate.CollectionMembershipWhere{
-				Owner:       stringPtr(p.ByName("owner")),
-				NamePrefix:  prefixP,
-				Name:        nameP,
-				HasLensSpec: true,
-			},
-			Limit: substrate.LimitFromPtr(getValueAsIntPtr(query, "limit")),
-		})
-		if err != nil {
-			return nil, http.StatusInternalServerError, err
-		}
-		if len(result) == 0 {
-			return []*substrate.CollectionMember{}, http.StatusOK, nil
-		}
-		return result[0].Members, http.StatusOK, nil
+		return listCollectionMembers(req, p, substrate.CollectionMembershipWhere{HasLensSpec: true})
 	})
 
 	handle("GET", "/api/v1/events", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		var username string
+		if user, ok := auth.UserFromContext(req.Context()); ok {
+			username = user.GithubUsername
+		}
+
 		query := req.URL.Query()
+		// The events table only grows, so always page it, newest first.
+		limit, cursor, orderBy, err := getListParams(query, 100, true)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
 		result, err := s.ListEvents(req.Context(), &substrate.EventListRequest{
 			EventWhere: substrate.EventWhere{
 				User:         getValueAsStringPtr(query, "user"),
+				Lens:         getValueAsStringPtr(query, "lens"),
+				Type:         getValueAsStringPtr(query, "type"),
 				ActivitySpec: getValueAsStringPtr(query, "activityspec"),
 			},
-			Limit: substrate.LimitFromPtr(getValueAsIntPtr(query, "limit")),
+			Limit:   limit,
+			Cursor:  cursor,
+			OrderBy: orderBy,
 		})
 		if err != nil {
 			return nil, http.StatusInternalServerError, err
 		}
-		return result, http.StatusOK, nil
+
+		// Filter the same way the stream does. The page's cursor still comes
+		// from everything read, so hidden events are skipped, not lost.
+		page := newListPage(result, limit)
+		visible := []*substrate.Event{}
+		for _, event := range result {
+			ok, err := s.EventVisibleTo(req.Context(), event, username)
+			if err != nil {
+				return nil, http.StatusInternalServerError, err
+			}
+			if ok {
+				visible = append(visible, event)
+			}
+		}
+		page.Results = visible
+		return page, http.StatusOK, nil
+	})
+
+	// Stream events as they're written. To resume, send the ID of the last event
+	// seen as Last-Event-ID (or the last_event_id parameter) and everything since
+	// then is replayed from the events table before live events.
+	handleRaw("GET", "/api/v1/events/stream", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		ctx := req.Context()
+		if s.Bus == nil {
+			http.Error(rw, "event stream not available", http.StatusServiceUnavailable)
+			return
+		}
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			http.Error(rw, "can't stream events without response writer supporting http.Flusher", http.StatusInternalServerError)
+			return
+		}
+
+		var username string
+		if user, ok := auth.UserFromContext(ctx); ok {
+			username = user.GithubUsername
+		}
+
+		query := req.URL.Query()
+		where := &substrate.EventWhere{
+			User:         getValueAsStringPtr(query, "user"),
+			Lens:         getValueAsStringPtr(query, "lens"),
+			Type:         getValueAsStringPtr(query, "type"),
+			ActivitySpec: getValueAsStringPtr(query, "activityspec"),
+		}
+		// viewspec is the name this parameter used to have.
+		if where.ActivitySpec == nil {
+			where.ActivitySpec = getValueAsStringPtr(query, "viewspec")
+		}
+
+		lastEventID := req.Header.Get("Last-Event-ID")
+		if lastEventID == "" {
+			lastEventID = query.Get("last_event_id")
+		}
+
+		// Subscribe before replaying so events written in between aren't missed.
+		// Any that are also replayed are skipped when they arrive live.
+		sub := s.Bus.Subscribe(where, 256)
+		defer sub.Close()
+
+		replayed := map[string]bool{}
+		var replay []*substrate.Event
+		for after := lastEventID; after != ""; {
+			events, err := s.EventsAfter(ctx, where, after, &substrate.Limit{Limit: 500})
+			if err != nil {
+				var notFound *substrate.EventNotFoundError
+				if errors.As(err, &notFound) {
+					http.Error(rw, err.Error(), http.StatusNotFound)
+				} else {
+					http.Error(rw, err.Error(), http.StatusInternalServerError)
+				}
+				return
+			}
+			after = ""
+			if len(events) > 0 {
+				after = events[len(events)-1].ID
+			}
+			for _, event := range events {
+				replayed[event.ID] = true
+				replay = append(replay, event)
+			}
+		}
+
+		header := rw.Header()
+		header.Set("Content-Type", "text/event-stream")
+		header.Set("Cache-Control", "no-cache")
+		header.Set("Connection", "keep-alive")
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		send := func(event *substrate.Event) bool {
+			visible, err := s.EventVisibleTo(ctx, event, username)
+			if err != nil {
+				log.Printf("error checking event visibility: %s event=%s", err, event.ID)
+				return false
+			}
+			if !visible {
+				return true
+			}
+			b, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("error marshaling event: %s event=%#v", err, event)
+				return false
+			}
+			_, err = fmt.Fprintf(rw, "id: %s\ndata: %s\n\n", event.ID, string(b))
+			if err != nil {
+				return false
+			}
+			flusher.Flush()
+			return true
+		}
+
+		for _, event := range replay {
+			if !send(event) {
+				return
+			}
+		}
+
+		// Comments keep idle connections from being closed by proxies.
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-keepalive.C:
+				fmt.Fprint(rw, ": keepalive\n\n")
+				flusher.Flush()
+			case event, ok := <-sub.C:
+				if !ok {
+					// Dropped for falling behind. The client will reconnect
+					// with Last-Event-ID and catch up from the events table.
+					return
+				}
+				if replayed[event.ID] {
+					delete(replayed, event.ID)
+					continue
+				}
+				if !send(event) {
+					return
+				}
+			}
+		}
+	})
+
+	// Reactions and comments are about a space or an activity, given as the
+	// space or activityspec parameter.
+	type FeedbackRequest struct {
+		SpaceID      string  `json:"space" form:"space"`
+		ActivitySpec string  `json:"activityspec" form:"activityspec"`
+		Reaction     string  `json:"reaction" form:"reaction"`
+		Body         string  `json:"body" form:"body"`
+		Parent       *string `json:"parent,omitempty" form:"parent"`
+	}
+
+	// activityAccess checks that the requesting user may read every space an
+	// activity uses. Activities they can't read are reported as missing, like
+	// private spaces are.
+	activityAccess := func(req *http.Request, activitySpec string) (int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+		asr, err := substrate.ParseActivitySpecRequest(activitySpec, false)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		views := s.SpaceViewRequests(asr)
+		for i := range views {
+			if _, err := s.CheckSpaceViewAccess(req.Context(), user.GithubUsername, &views[i]); err != nil {
+				var denied *substrate.SpaceAccessDeniedError
+				if errors.As(err, &denied) {
+					return http.StatusNotFound, fmt.Errorf("no such activity: %s", activitySpec)
+				}
+				return http.StatusInternalServerError, err
+			}
+		}
+		return http.StatusOK, nil
+	}
+
+	// feedbackAccess checks that the requesting user may read the space and
+	// activity feedback is about, whichever are given.
+	feedbackAccess := func(req *http.Request, spaceID, activitySpec *string) (int, error) {
+		if spaceID != nil {
+			if _, status, err := spaceRole(req, *spaceID); err != nil {
+				return status, err
+			}
+		}
+		if activitySpec != nil {
+			if status, err := activityAccess(req, *activitySpec); err != nil {
+				return status, err
+			}
+		}
+		return http.StatusOK, nil
+	}
+
+	// checkFeedbackTarget makes sure the space or activity exists, the user may
+	// read it, and the space isn't in the trash.
+	checkFeedbackTarget := func(req *http.Request, user, spaceID, activitySpec string) (int, error) {
+		if (spaceID == "") == (activitySpec == "") {
+			return http.StatusBadRequest, fmt.Errorf("must give exactly one of space or activityspec")
+		}
+		if spaceID != "" {
+			spaces, err := s.ListSpaces(req.Context(), &substrate.SpaceListQuery{
+				SpaceWhere: substrate.SpaceWhere{ID: &spaceID, VisibleTo: &user},
+				Limit:      &substrate.Limit{Limit: 1},
+			})
+			if err != nil {
+				return http.StatusInternalServerError, err
+			}
+			if len(spaces) == 0 {
+				return http.StatusNotFound, fmt.Errorf("no such space: %s", spaceID)
+			}
+			return http.StatusOK, nil
+		}
+		if status, err := activityAccess(req, activitySpec); err != nil {
+			return status, err
+		}
+		activities, err := s.ListActivities(req.Context(), &substrate.ActivityListRequest{
+			ActivityWhere: substrate.ActivityWhere{ActivitySpec: &activitySpec, VisibleTo: &user},
+			Limit:         &substrate.Limit{Limit: 1},
+		})
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if len(activities) == 0 {
+			return http.StatusNotFound, fmt.Errorf("no such activity: %s", activitySpec)
+		}
+		return http.StatusOK, nil
+	}
+
+	handle("GET", "/api/v1/reactions", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		query := req.URL.Query()
+		where := &substrate.ReactionWhere{
+			SpaceID:      getValueAsStringPtr(query, "space"),
+			ActivitySpec: getValueAsStringPtr(query, "activityspec"),
+			Author:       getValueAsStringPtr(query, "author"),
+		}
+		if where.SpaceID == nil && where.ActivitySpec == nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("must give space or activityspec")
+		}
+		if status, err := feedbackAccess(req, where.SpaceID, where.ActivitySpec); err != nil {
+			return nil, status, err
+		}
+		reactions, err := s.ListReactions(req.Context(), where)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return reactions, http.StatusOK, nil
+	})
+
+	handle("POST", "/api/v1/reactions", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		r := &FeedbackRequest{}
+		status, err := readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+		status, err = checkFeedbackTarget(req, user.GithubUsername, r.SpaceID, r.ActivitySpec)
+		if err != nil {
+			return nil, status, err
+		}
+
+		reaction := &substrate.Reaction{
+			SpaceID:      r.SpaceID,
+			ActivitySpec: r.ActivitySpec,
+			Author:       user.GithubUsername,
+			Reaction:     r.Reaction,
+			CreatedAt:    time.Now(),
+		}
+		err = s.WriteReaction(req.Context(), reaction)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return reaction, http.StatusCreated, nil
+	})
+
+	// Take back one of your own reactions.
+	handle("DELETE", "/api/v1/reactions", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		query := req.URL.Query()
+		where := &substrate.ReactionWhere{
+			SpaceID:      getValueAsStringPtr(query, "space"),
+			ActivitySpec: getValueAsStringPtr(query, "activityspec"),
+			Reaction:     getValueAsStringPtr(query, "reaction"),
+			Author:       &user.GithubUsername,
+		}
+		if (where.SpaceID == nil) == (where.ActivitySpec == nil) || where.Reaction == nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("must give reaction and exactly one of space or activityspec")
+		}
+		err := s.DeleteReaction(req.Context(), where)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return nil, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/comments", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		query := req.URL.Query()
+		limit, cursor, orderBy, err := getListParams(query, 0, false)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		where := substrate.CommentWhere{
+			SpaceID:      getValueAsStringPtr(query, "space"),
+			ActivitySpec: getValueAsStringPtr(query, "activityspec"),
+			Author:       getValueAsStringPtr(query, "author"),
+			ParentID:     getValueAsStringPtr(query, "parent"),
+		}
+		if where.SpaceID == nil && where.ActivitySpec == nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("must give space or activityspec")
+		}
+		if status, err := feedbackAccess(req, where.SpaceID, where.ActivitySpec); err != nil {
+			return nil, status, err
+		}
+		comments, err := s.ListComments(req.Context(), &substrate.CommentListRequest{
+			CommentWhere: where,
+			Limit:        limit,
+			Cursor:       cursor,
+			OrderBy:      orderBy,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return newListPage(comments, limit), http.StatusOK, nil
+	})
+
+	handle("POST", "/api/v1/comments", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		r := &FeedbackRequest{}
+		status, err := readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+		status, err = checkFeedbackTarget(req, user.GithubUsername, r.SpaceID, r.ActivitySpec)
+		if err != nil {
+			return nil, status, err
+		}
+
+		comment := &substrate.Comment{
+			ID:           "cmt-" + ulid.Make().String(),
+			SpaceID:      r.SpaceID,
+			ActivitySpec: r.ActivitySpec,
+			Author:       user.GithubUsername,
+			ParentID:     r.Parent,
+			Body:         r.Body,
+			CreatedAt:    time.Now(),
+		}
+		err = s.WriteComment(req.Context(), comment)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return comment, http.StatusCreated, nil
+	})
+
+	handle("PATCH", "/api/v1/comments/:comment", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		r := &FeedbackRequest{}
+		status, err := readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+
+		id := p.ByName("comment")
+		comments, err := s.ListComments(req.Context(), &substrate.CommentListRequest{
+			CommentWhere: substrate.CommentWhere{ID: &id},
+			Limit:        &substrate.Limit{Limit: 1},
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(comments) == 0 {
+			return nil, http.StatusNotFound, nil
+		}
+		if comments[0].Author != user.GithubUsername {
+			return nil, http.StatusUnauthorized, fmt.Errorf("only the author of a comment can edit it")
+		}
+
+		err = s.EditComment(req.Context(), id, r.Body, time.Now())
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return nil, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/comments/:comment/revisions", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		id := p.ByName("comment")
+		comments, err := s.ListComments(req.Context(), &substrate.CommentListRequest{
+			CommentWhere: substrate.CommentWhere{ID: &id},
+			Limit:        &substrate.Limit{Limit: 1},
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if len(comments) == 0 {
+			return nil, http.StatusNotFound, nil
+		}
+		var spaceID, activitySpec *string
+		if comments[0].SpaceID != "" {
+			spaceID = &comments[0].SpaceID
+		}
+		if comments[0].ActivitySpec != "" {
+			activitySpec = &comments[0].ActivitySpec
+		}
+		if status, err := feedbackAccess(req, spaceID, activitySpec); err != nil {
+			return nil, status, err
+		}
+
+		revisions, err := s.CommentRevisions(req.Context(), id)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return revisions, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/notifications", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		query := req.URL.Query()
+		limit, cursor, orderBy, err := getListParams(query, 100, true)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		result, err := s.ListNotifications(req.Context(), &substrate.NotificationListRequest{
+			NotificationWhere: substrate.NotificationWhere{
+				User:   &user.GithubUsername,
+				Unread: getValueAsBoolPtr(query, "unread"),
+			},
+			Limit:   limit,
+			Cursor:  cursor,
+			OrderBy: orderBy,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return newListPage(result, limit), http.StatusOK, nil
+	})
+
+	type NotificationsReadRequest struct {
+		// IDs of the notifications to mark read. If empty, marks them all read.
+		IDs []string `json:"ids" form:"ids"`
+	}
+
+	handle("POST", "/api/v1/notifications/read", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		r := &NotificationsReadRequest{}
+		status, err := readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+
+		where := &substrate.NotificationWhere{User: &user.GithubUsername}
+		if len(r.IDs) > 0 {
+			where.IDs = r.IDs
+		}
+		err = s.MarkNotificationsRead(req.Context(), where)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return nil, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/tokens", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		tokens, err := s.ListAPITokens(req.Context(), user.GithubUsername)
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return tokens, http.StatusOK, nil
+	})
+
+	handle("POST", "/api/v1/tokens", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		r := &struct {
+			Name      string     `json:"name" form:"name"`
+			Scopes    []string   `json:"scopes" form:"scopes"`
+			ExpiresAt *time.Time `json:"expires_at" form:"expires_at"`
+		}{}
+		status, err := readRequestBody(req, r)
+		if err != nil {
+			return nil, status, err
+		}
+
+		t := &substrate.APIToken{
+			User:      user.GithubUsername,
+			Name:      r.Name,
+			Scopes:    r.Scopes,
+			CreatedAt: time.Now(),
+			ExpiresAt: r.ExpiresAt,
+		}
+		token, err := s.CreateAPIToken(req.Context(), t)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		audit(req, substrate.AuditActionTokenCreate, t.ID, map[string]any{"name": t.Name, "scopes": t.Scopes, "expires_at": t.ExpiresAt})
+
+		// This is the only time the token is shown.
+		return struct {
+			*substrate.APIToken
+			Token string `json:"token"`
+		}{
+			APIToken: t,
+			Token:    token,
+		}, http.StatusCreated, nil
+	})
+
+	handle("DELETE", "/api/v1/tokens/:token", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		revoked, err := s.RevokeAPIToken(req.Context(), user.GithubUsername, p.ByName("token"))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if !revoked {
+			return nil, http.StatusNotFound, nil
+		}
+		audit(req, substrate.AuditActionTokenRevoke, p.ByName("token"), nil)
+		return nil, http.StatusOK, nil
+	})
+
+	handle("GET", "/api/v1/sessions", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		sessions, err := s.ListSessions(req.Context(), user.GithubUsername, time.Now())
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+
+		type session struct {
+			*substrate.Session
+			Current bool `json:"current"`
+		}
+		results := make([]session, 0, len(sessions))
+		for _, o := range sessions {
+			results = append(results, session{Session: o, Current: o.ID == user.SessionID})
+		}
+		return results, http.StatusOK, nil
+	})
+
+	handle("DELETE", "/api/v1/sessions/:session", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		revoked, err := s.RevokeSession(req.Context(), user.GithubUsername, p.ByName("session"))
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		if !revoked {
+			return nil, http.StatusNotFound, nil
+		}
+		audit(req, substrate.AuditActionSessionRevoke, p.ByName("session"), nil)
+		return nil, http.StatusOK, nil
+	})
+
+	// auditWhere reads the audit log filters from req. Only auditors may see
+	// entries for actions other users took.
+	auditWhere := func(req *http.Request) (*substrate.AuditWhere, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+
+		query := req.URL.Query()
+		where := &substrate.AuditWhere{
+			Actor:  getValueAsStringPtr(query, "actor"),
+			Action: getValueAsStringPtr(query, "action"),
+			Target: getValueAsStringPtr(query, "target"),
+		}
+		var err error
+		if where.Since, err = getValueAsTimePtr(query, "since"); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if where.Until, err = getValueAsTimePtr(query, "until"); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+
+		if !s.IsAuditor(user.GithubUsername) {
+			if where.Actor != nil && *where.Actor != user.GithubUsername {
+				return nil, http.StatusForbidden, fmt.Errorf("only auditors can see other users' actions")
+			}
+			where.Actor = &user.GithubUsername
+		}
+		return where, http.StatusOK, nil
+	}
+
+	handle("GET", "/api/v1/audit", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		where, status, err := auditWhere(req)
+		if err != nil {
+			return nil, status, err
+		}
+		limit, cursor, orderBy, err := getListParams(req.URL.Query(), 100, true)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		result, err := s.ListAuditEntries(req.Context(), &substrate.AuditListRequest{
+			AuditWhere: *where,
+			Limit:      limit,
+			Cursor:     cursor,
+			OrderBy:    orderBy,
+		})
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return newListPage(result, limit), http.StatusOK, nil
+	})
+
+	// Export every matching audit entry, oldest first, as JSON lines.
+	handleRaw("GET", "/api/v1/audit/export", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		where, status, err := auditWhere(req)
+		if err != nil {
+			newJSONResponseWriter(rw)(nil, status, err)
+			return
+		}
+
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		rw.Header().Set("Content-Disposition", `attachment; filename="audit.jsonl"`)
+		enc := json.NewEncoder(rw)
+		limit := &substrate.Limit{Limit: maxListLimit}
+		var cursor *substrate.Cursor
+		for {
+			page, err := s.ListAuditEntries(req.Context(), &substrate.AuditListRequest{
+				AuditWhere: *where,
+				Limit:      limit,
+				Cursor:     cursor,
+			})
+			if err != nil {
+				// The response may already be under way, so all we can do is
+				// stop early.
+				substrate.LogFromContext(req.Context()).WithError(err).Warn("error exporting audit log")
+				return
+			}
+			for _, entry := range page {
+				if err := enc.Encode(entry); err != nil {
+					return
+				}
+			}
+			if len(page) < limit.Limit {
+				return
+			}
+			cursor = page[len(page)-1].Cursor()
+		}
+	})
+
+	handle("GET", "/api/v1/audit/verify", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return nil, http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+		if !s.IsAuditor(user.GithubUsername) {
+			return nil, http.StatusForbidden, fmt.Errorf("only auditors can verify the audit log")
+		}
+
+		result, err := s.VerifyAuditLog(req.Context())
+		if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return result, http.StatusOK, nil
+	})
+
+	// checkAdmin returns an error status unless the requesting user is an admin.
+	checkAdmin := func(req *http.Request) (int, error) {
+		user, ok := auth.UserFromContext(req.Context())
+		if !ok {
+			return http.StatusUnauthorized, fmt.Errorf("user not available in context")
+		}
+		if !s.IsAdmin(user.GithubUsername) {
+			return http.StatusForbidden, fmt.Errorf("only admins can manage the gateway")
+		}
+		return http.StatusOK, nil
+	}
+
+	handle("GET", "/api/v1/gateway/stats", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := checkAdmin(req); err != nil {
+			return nil, status, err
+		}
+		return gw.Stats(req.Context()), http.StatusOK, nil
+	})
+
+	// Flush cached provisioners for a lens and/or a space. With no filters, flushes everything.
+	handle("DELETE", "/api/v1/gateway/provisioners", func(req *http.Request, p httprouter.Params) (interface{}, int, error) {
+		if status, err := checkAdmin(req); err != nil {
+			return nil, status, err
+		}
+		query := req.URL.Query()
+		flushed := gw.Flush(req.Context(), &substrate.GatewayEntryWhere{
+			Lens:    getValueAsStringPtr(query, "lens"),
+			SpaceID: getValueAsStringPtr(query, "space"),
+		})
+		return struct {
+			Flushed int `json:"flushed"`
+		}{
+			Flushed: flushed,
+		}, http.StatusOK, nil
 	})
 
 	return router
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/substrate/pkg/auth"
+	"github.com/ajbouh/substrate/services/substrate"
+)
+
+// newTestSubstrate returns a Substrate backed by a fresh, fully migrated
+// database.
+func newTestSubstrate(t *testing.T) *substrate.Substrate {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", t.TempDir()+"/substrate.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+
+	if err := substrate.Migrate(context.Background(), db, func(string, ...any) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &substrate.Substrate{
+		DB:     db,
+		Mu:     &sync.RWMutex{},
+		Lenses: map[string]*substrate.Lens{},
+	}
+}
+
+// serveAs makes a request to h as user, with body sent as JSON if it's set.
+func serveAs(h http.Handler, user, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if body != "" {
+		req = httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+	}
+	rw := httptest.NewRecorder()
+	provider := &auth.StaticUser{User: auth.User{GithubUsername: user}}
+	provider.Protect(h).ServeHTTP(rw, req)
+	return rw
+}
+
+func TestSpawnTokenRoutes(t *testing.T) {
+	s := newTestSubstrate(t)
+	for _, id := range []string{"sp-spawned", "sp-other"} {
+		if err := s.WriteSpace(context.Background(), &substrate.Space{ID: id, Owner: "alice", Alias: id, CreatedAt: time.Now(), IsPrivate: true}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rw := serveAs(newApiHandler(s, nil), "alice", "POST", "/api/v1/collections/alice/stuff", `{"label":"Stuff"}`); rw.Code != http.StatusCreated {
+		t.Fatalf("creating a collection = %d: %s", rw.Code, rw.Body)
+	}
+
+	provider := &auth.Bearer{
+		Authenticate: func(ctx context.Context, token string) (*auth.User, error) {
+			return &auth.User{GithubUsername: "alice", Scopes: substrate.SpawnTokenScopes, Spaces: []string{"sp-spawned"}}, nil
+		},
+		Fallback: &auth.StaticUser{User: auth.User{GithubUsername: "alice"}},
+	}
+	h := provider.Protect(newApiHandler(s, nil))
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/api/v1/tokens", "", http.StatusForbidden},
+		{"POST", "/api/v1/tokens", "", http.StatusForbidden},
+		{"GET", "/api/v1/sessions", "", http.StatusForbidden},
+		{"GET", "/api/v1/spaces", "", http.StatusForbidden},
+		{"GET", "/api/v1/spaces/sp-other", "", http.StatusNotFound},
+		{"POST", "/api/v1/spaces", `{"space":"sp-other"}`, http.StatusForbidden},
+		{"POST", "/api/v1/collections/alice/stuff", `{"label":"More"}`, http.StatusForbidden},
+		{"POST", "/api/v1/collections/alice/stuff/spaces", `{"space":"sp-other"}`, http.StatusNotFound},
+		{"POST", "/api/v1/collections/alice/stuff/spaces", `{"space":"sp-spawned"}`, http.StatusOK},
+		{"DELETE", "/api/v1/collections/alice/stuff/spaces/sp-other", "", http.StatusNotFound},
+		{"DELETE", "/api/v1/collections/alice/stuff/spaces/sp-spawned", "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer sbt_spawn")
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, req)
+		if rw.Code != tc.want {
+			t.Errorf("%s %s with a spawn token = %d, want %d: %s", tc.method, tc.path, rw.Code, tc.want, rw.Body)
+		}
+	}
+}
+
+func TestGatewayNeedsAdmin(t *testing.T) {
+	s := &substrate.Substrate{Lenses: map[string]*substrate.Lens{}, Admins: []string{"root"}}
+	gw := substrate.NewGateway(0, 0)
+
+	for _, tc := range []struct {
+		user string
+		want int
+	}{
+		{"alice", http.StatusForbidden},
+		{"root", http.StatusOK},
+	} {
+		provider := &auth.StaticUser{User: auth.User{GithubUsername: tc.user}}
+		h := provider.Protect(newApiHandler(s, gw))
+		for _, req := range []*http.Request{
+			httptest.NewRequest("GET", "/api/v1/gateway/stats", nil),
+			httptest.NewRequest("DELETE", "/api/v1/gateway/provisioners", nil),
+		} {
+			rw := httptest.NewRecorder()
+			h.ServeHTTP(rw, req)
+			if rw.Code != tc.want {
+				t.Errorf("%s %s as %s = %d, want %d: %s", req.Method, req.URL.Path, tc.user, rw.Code, tc.want, rw.Body)
+			}
+		}
+	}
+}
+
+func TestFeedbackNeedsSpaceAccess(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	s.Lenses["files"] = &substrate.Lens{
+		Name: "files",
+		Spawn: substrate.LensSpawnOptions{
+			Schema: map[string]substrate.LensSpawnParameterSchema{"data": {Type: substrate.LensSpawnParameterTypeSpace}},
+		},
+	}
+
+	now := time.Now()
+	if err := s.WriteSpace(ctx, &substrate.Space{ID: "sp-private", Owner: "alice", Alias: "private", CreatedAt: now, IsPrivate: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteActivity(ctx, &substrate.Activity{ActivitySpec: "files[data=sp-private]", Lens: "files", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteComment(ctx, &substrate.Comment{ID: "cmt-1", SpaceID: "sp-private", Author: "alice", Body: "note to self", CreatedAt: now}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EditComment(ctx, "cmt-1", "edited note to self", now); err != nil {
+		t.Fatal(err)
+	}
+
+	h := newApiHandler(s, nil)
+	for _, tc := range []struct {
+		method, path, body string
+		owner              int
+	}{
+		{"GET", "/api/v1/comments?space=sp-private", "", http.StatusOK},
+		{"GET", "/api/v1/comments?activityspec=files[data=sp-private]", "", http.StatusOK},
+		{"GET", "/api/v1/comments/cmt-1/revisions", "", http.StatusOK},
+		{"GET", "/api/v1/reactions?space=sp-private", "", http.StatusOK},
+		{"GET", "/api/v1/reactions?activityspec=files[data=sp-private]", "", http.StatusOK},
+		{"POST", "/api/v1/comments", `{"space":"sp-private","body":"hi"}`, http.StatusCreated},
+		{"POST", "/api/v1/comments", `{"activityspec":"files[data=sp-private]","body":"hi"}`, http.StatusCreated},
+		{"POST", "/api/v1/reactions", `{"space":"sp-private","reaction":"+1"}`, http.StatusCreated},
+		{"POST", "/api/v1/reactions", `{"activityspec":"files[data=sp-private]","reaction":"+1"}`, http.StatusCreated},
+	} {
+		// Bob can't tell the space or its activity exist.
+		if rw := serveAs(h, "bob", tc.method, tc.path, tc.body); rw.Code != http.StatusNotFound {
+			t.Errorf("%s %s %s as bob = %d, want %d: %s", tc.method, tc.path, tc.body, rw.Code, http.StatusNotFound, rw.Body)
+		}
+		if rw := serveAs(h, "alice", tc.method, tc.path, tc.body); rw.Code != tc.owner {
+			t.Errorf("%s %s %s as alice = %d, want %d: %s", tc.method, tc.path, tc.body, rw.Code, tc.owner, rw.Body)
+		}
+	}
+}
+
+func TestListsHaveNextCursorInTheirBody(t *testing.T) {
+	s := newTestSubstrate(t)
+	now := time.Now()
+	for i, id := range []string{"sp-a", "sp-b", "sp-c"} {
+		if err := s.WriteSpace(context.Background(), &substrate.Space{ID: id, Owner: "alice", Alias: id, CreatedAt: now.Add(time.Duration(i) * time.Second)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newApiHandler(s, nil)
+
+	ids := []string{}
+	path := "/api/v1/spaces?owner=alice&limit=2"
+	for path != "" {
+		rw := serveAs(h, "alice", "GET", path, "")
+		if rw.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", path, rw.Code, rw.Body)
+		}
+		page := struct {
+			Results []struct {
+				ID string `json:"space"`
+			} `json:"results"`
+			NextCursor string `json:"next_cursor"`
+		}{}
+		if err := json.Unmarshal(rw.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.NextCursor != rw.Header().Get("X-Next-Cursor") {
+			t.Errorf("next_cursor %q doesn't match X-Next-Cursor %q", page.NextCursor, rw.Header().Get("X-Next-Cursor"))
+		}
+		for _, r := range page.Results {
+			ids = append(ids, r.ID)
+		}
+		path = ""
+		if page.NextCursor != "" {
+			path = "/api/v1/spaces?owner=alice&limit=2&cursor=" + page.NextCursor
+		}
+	}
+	if strings.Join(ids, " ") != "sp-a sp-b sp-c" {
+		t.Errorf("paging through spaces gave %v", ids)
+	}
+}
+
+func TestEventStreamTakesActivitySpec(t *testing.T) {
+	s := newTestSubstrate(t)
+	s.Bus = substrate.NewEventBus()
+	now := time.Now()
+	for i, e := range []*substrate.Event{
+		{ID: "ev-1", ActivitySpec: "files[data=sp-a]"},
+		{ID: "ev-2", ActivitySpec: "files[data=sp-b]"},
+		{ID: "ev-3", ActivitySpec: "files[data=sp-a]"},
+	} {
+		e.Type, e.User, e.Lens, e.Timestamp = "spawn", "alice", "files", now.Add(time.Duration(i)*time.Second)
+		if err := s.WriteEvent(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newApiHandler(s, nil)
+
+	for _, param := range []string{"activityspec", "viewspec"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		req := httptest.NewRequest("GET", "/api/v1/events/stream?last_event_id=ev-1&"+param+"=files[data=sp-a]", nil).WithContext(ctx)
+		rw := httptest.NewRecorder()
+		(&auth.StaticUser{User: auth.User{GithubUsername: "alice"}}).Protect(h).ServeHTTP(rw, req)
+		cancel()
+
+		body := rw.Body.String()
+		if !strings.Contains(body, "id: ev-3") || strings.Contains(body, "id: ev-2") {
+			t.Errorf("expected streaming with %s to only replay ev-3, got %d %s", param, rw.Code, body)
+		}
+	}
+}
+
+func TestCollectionsOnlyChangeForTheirOwner(t *testing.T) {
+	s := newTestSubstrate(t)
+	if err := s.WriteSpace(context.Background(), &substrate.Space{ID: "sp-a", Owner: "alice", Alias: "a", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteSpace(context.Background(), &substrate.Space{ID: "sp-bob", Owner: "bob", Alias: "bob", CreatedAt: time.Now(), IsPrivate: true}); err != nil {
+		t.Fatal(err)
+	}
+	h := newApiHandler(s, nil)
+
+	for _, tc := range []struct {
+		user, method, path, body string
+		want                     int
+	}{
+		{"alice", "POST", "/api/v1/collections/alice/papers", `{"label":"Papers"}`, http.StatusCreated},
+		{"alice", "POST", "/api/v1/collections/alice/papers", `{"label":"Papers"}`, http.StatusConflict},
+		{"alice", "POST", "/api/v1/collections/alice/papers/spaces", `{"space":"sp-a"}`, http.StatusOK},
+		{"alice", "POST", "/api/v1/collections/alice/papers/spaces", `{"space":"sp-bob"}`, http.StatusNotFound},
+
+		{"bob", "POST", "/api/v1/collections/alice/other", `{"label":"Other"}`, http.StatusUnauthorized},
+		{"bob", "PATCH", "/api/v1/collections/alice/papers", `{"public":true}`, http.StatusUnauthorized},
+		{"bob", "PUT", "/api/v1/collections/alice/papers/order", `{"members":[{"space":"sp-a"}]}`, http.StatusUnauthorized},
+		{"bob", "POST", "/api/v1/collections/alice/papers/spaces", `{"space":"sp-a"}`, http.StatusUnauthorized},
+		{"bob", "DELETE", "/api/v1/collections/alice/papers/spaces/sp-a", "", http.StatusUnauthorized},
+		{"bob", "DELETE", "/api/v1/collections/alice/papers", "", http.StatusUnauthorized},
+
+		{"alice", "PUT", "/api/v1/collections/alice/papers/order", `{"members":[{"space":"sp-a"}]}`, http.StatusOK},
+		{"alice", "PATCH", "/api/v1/collections/alice/papers", `{"name":"preprints"}`, http.StatusOK},
+		{"alice", "GET", "/api/v1/collections/alice/papers", "", http.StatusNotFound},
+		{"alice", "GET", "/api/v1/collections/alice/preprints", "", http.StatusOK},
+		{"alice", "DELETE", "/api/v1/collections/alice/preprints", "", http.StatusOK},
+		{"alice", "DELETE", "/api/v1/collections/alice/preprints", "", http.StatusNotFound},
+	} {
+		if rw := serveAs(h, tc.user, tc.method, tc.path, tc.body); rw.Code != tc.want {
+			t.Errorf("%s %s %s as %s = %d, want %d: %s", tc.method, tc.path, tc.body, tc.user, rw.Code, tc.want, rw.Body)
+		}
+	}
+
+	entries, err := s.ListAuditEntries(context.Background(), &substrate.AuditListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := []string{}
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	want := []string{
+		substrate.AuditActionCollectionCreate,
+		substrate.AuditActionCollectionMemberAdd,
+		substrate.AuditActionCollectionReorder,
+		substrate.AuditActionCollectionPatch,
+		substrate.AuditActionCollectionDelete,
+	}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Errorf("audit log has %v, want %v", actions, want)
+	}
+}
+
+func TestRequestIDsAreNotTakenFromClients(t *testing.T) {
+	s := newTestSubstrate(t)
+	provider := &auth.StaticUser{User: auth.User{GithubUsername: "alice"}}
+	h := withAccessLog(&substrate.Tracer{}, provider.Protect(newApiHandler(s, nil)))
+
+	req := httptest.NewRequest("POST", "/api/v1/collections/alice/papers", strings.NewReader(`{"label":"Papers"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(substrate.RequestIDHeader, "forged")
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	if rw.Code != http.StatusCreated {
+		t.Fatalf("creating a collection = %d: %s", rw.Code, rw.Body)
+	}
+
+	requestID := rw.Header().Get(substrate.RequestIDHeader)
+	if requestID == "" || requestID == "forged" {
+		t.Errorf("expected a request ID made by substrate, got %q", requestID)
+	}
+	entries, err := s.ListAuditEntries(context.Background(), &substrate.AuditListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].RequestID != requestID {
+		t.Errorf("expected the audit entry to have request ID %q, got %#v", requestID, entries)
+	}
+}
+
+func TestEventsHideSpawnsOfPrivateSpaces(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	now := time.Now()
+	if err := s.WriteSpace(ctx, &substrate.Space{ID: "sp-private", Owner: "alice", Alias: "private", CreatedAt: now, IsPrivate: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteEvent(ctx, &substrate.Event{ID: "ev-1", Type: "spawn", Timestamp: now, User: "alice", Lens: "files", ActivitySpec: "files[data=sp-private]"}); err != nil {
+		t.Fatal(err)
+	}
+	h := newApiHandler(s, nil)
+
+	if rw := serveAs(h, "alice", "GET", "/api/v1/events", ""); rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "sp-private") {
+		t.Errorf("expected alice to see her spawn, got %d %s", rw.Code, rw.Body)
+	}
+	if rw := serveAs(h, "bob", "GET", "/api/v1/events", ""); rw.Code != http.StatusOK || strings.Contains(rw.Body.String(), "sp-private") {
+		t.Errorf("expected bob not to see alice's spawn, got %d %s", rw.Code, rw.Body)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"log"
+	"os"
 
 	"github.com/ajbouh/substrate/pkg/sqliteuri"
 	"github.com/ajbouh/substrate/services/substrate"
@@ -11,7 +13,7 @@ import (
 	_ "github.com/mattn/go-sqlite3"
 )
 
-func newDB() (*sql.DB, error) {
+func openDB() (*sql.DB, error) {
 	dburi := sqliteuri.URI{
 		FileName: mustGetenv("SUBSTRATE_DB"),
 		URIOptions: sqliteuri.URIOptions{
@@ -27,7 +29,16 @@ func newDB() (*sql.DB, error) {
 
 	db.SetMaxOpenConns(1)
 
-	err = substrate.CreateTables(context.Background(), db)
+	return db, nil
+}
+
+func newDB() (*sql.DB, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+
+	err = substrate.Migrate(context.Background(), db, log.Printf)
 	if err != nil {
 		defer db.Close()
 		return nil, err
@@ -35,3 +46,26 @@ func newDB() (*sql.DB, error) {
 
 	return db, nil
 }
+
+// checkMigrations lists any migrations that haven't been applied to the
+// database and exits non-zero if there are some.
+func checkMigrations() {
+	db, err := openDB()
+	if err != nil {
+		log.Fatalf("error opening db: %s", err)
+	}
+	defer db.Close()
+
+	pending, err := substrate.PendingMigrations(context.Background(), db)
+	if err != nil {
+		log.Fatalf("error checking migrations: %s", err)
+	}
+
+	for _, m := range pending {
+		fmt.Printf("pending: %s\n", m.Name)
+	}
+	if len(pending) > 0 {
+		os.Exit(1)
+	}
+	fmt.Println("no pending migrations")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -13,10 +14,18 @@ import (
 	"github.com/ajbouh/substrate/services/substrate"
 )
 
+// authorizationErrorStatus is the status to report an error from
+// AuthorizeActivitySpecRequest with.
+func authorizationErrorStatus(err error) int {
+	var denied *substrate.SpaceAccessDeniedError
+	if errors.As(err, &denied) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
 func newLazyProxyHandler(sub *substrate.Substrate, gw *substrate.Gateway, api http.Handler) ([]string, func(rw http.ResponseWriter, req *http.Request, p httprouter.Params)) {
 	return []string{"/gw/:viewspec", "/gw/:viewspec/*rest"}, func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-		log.Printf("%s %s %s", req.RemoteAddr, req.Method, req.URL.String())
-
 		viewspec := p.ByName("viewspec")
 		if viewspec == "substrate" {
 			api.ServeHTTP(rw, req)
@@ -26,26 +35,17 @@ func newLazyProxyHandler(sub *substrate.Substrate, gw *substrate.Gateway, api ht
 		user, ok := auth.UserFromContext(req.Context())
 		if !ok {
 			jsonrw := newJSONResponseWriter(rw)
-			jsonrw(nil, http.StatusBadRequest, fmt.Errorf("user not available in context"))
+			jsonrw(nil, http.StatusUnauthorized, fmt.Errorf("user not available in context"))
 			return
 		}
 
 		rest := p.ByName("rest")
 
-		cookies := req.Cookies()
-		req.Header.Del("Cookie")
-
-		// TODO check entitlements and only put cookies back if we *must*
-		for _, cookie := range cookies {
-			if cookie.Domain == "" { // constrain cookie to the given host
-				cookie.Domain = req.Host
-			}
-
-			s := cookie.String()
-			fmt.Printf("keeping cookie: %s\n", s)
-			req.Header.Add("Set-Cookie", s)
+		// The path the lens is served under, as the browser sees it.
+		lensPath := req.URL.EscapedPath()
+		if i := strings.Index(strings.TrimPrefix(lensPath, "/gw/"), "/"); i >= 0 {
+			lensPath = lensPath[:len("/gw/")+i]
 		}
-		fmt.Printf("req.header: %#v", req.Header)
 
 		// Strip prefix
 		req.Host = ""
@@ -63,20 +63,38 @@ func newLazyProxyHandler(sub *substrate.Substrate, gw *substrate.Gateway, api ht
 			return
 		}
 
-		cacheKey, concrete := views.ActivitySpec()
+		// Check on every request, since the backend may already be running
+		// for someone else. Viewers get a read-only backend of their own.
+		views, forceReadOnly, err := sub.AuthorizeActivitySpecRequest(req.Context(), user.GithubUsername, views)
+		if err != nil {
+			jsonrw := newJSONResponseWriter(rw)
+			jsonrw(nil, authorizationErrorStatus(err), err)
+			return
+		}
+
+		activitySpec, concrete := views.ActivitySpec()
 		if !concrete {
 			jsonrw := newJSONResponseWriter(rw)
 			jsonrw(nil, http.StatusBadRequest, fmt.Errorf("viewspec must be concrete"))
 			return
 		}
 
-		gw.ProvisionReverseProxy(cacheKey, func() substrate.ProvisionFunc {
-			return sub.MakeProvisioner(func(fmt string, values ...any) {
-				log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
-			}, &substrate.SpawnRequest{
-				User:         user.GithubUsername,
-				ActivitySpec: *views,
-			})
-		}).ServeHTTP(rw, req)
+		lens, err := sub.ResolveLens(req.Context(), views.LensName)
+		if err != nil {
+			jsonrw := newJSONResponseWriter(rw)
+			jsonrw(nil, http.StatusInternalServerError, err)
+			return
+		}
+		cookies := substrate.NewLensCookiePolicy(lens, lensPath)
+		cookies.FilterRequest(req)
+
+		cacheKey := substrate.GatewayCacheKey(activitySpec, user.GithubUsername, forceReadOnly)
+		gw.ProvisionReverseProxy(cacheKey, sub.MakeProvisioner(func(fmt string, values ...any) {
+			log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
+		}, &substrate.SpawnRequest{
+			User:          user.GithubUsername,
+			ActivitySpec:  *views,
+			ForceReadOnly: forceReadOnly,
+		}), cookies.FilterResponse).ServeHTTP(rw, req)
 	}
 }
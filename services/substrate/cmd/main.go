@@ -3,16 +3,20 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 
 	"github.com/ajbouh/substrate/pkg/jamsocket"
@@ -37,7 +41,41 @@ func mustGetenvAsInt(name string) int {
 	return i
 }
 
+func getenv(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return fallback
+}
+
+func getenvAsInt(name string, fallback int) int {
+	if os.Getenv(name) == "" {
+		return fallback
+	}
+	return mustGetenvAsInt(name)
+}
+
+func getenvAsDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s not a duration: %s", v, err)
+	}
+	return d
+}
+
 func main() {
+	checkMigrationsFlag := flag.Bool("check-migrations", false, "list pending database migrations and exit; exits 1 if any are pending")
+	flag.Parse()
+
+	if *checkMigrationsFlag {
+		checkMigrations()
+		return
+	}
+
 	debug := os.Getenv("DEBUG")
 	if ok, _ := strconv.ParseBool(debug); ok {
 		logrus.SetLevel(logrus.DebugLevel)
@@ -94,6 +132,16 @@ func main() {
 		DB:     db,
 		Mu:     &sync.RWMutex{},
 		Origin: os.Getenv("ORIGIN"),
+		Admission: substrate.NewSpawnAdmission(
+			getenvAsInt("SUBSTRATE_SPAWN_MAX_CONCURRENT", 8),
+			getenvAsInt("SUBSTRATE_SPAWN_MAX_CONCURRENT_PER_USER", 2),
+			getenvAsInt("SUBSTRATE_SPAWN_MAX_QUEUED", 64),
+			getenvAsDuration("SUBSTRATE_SPAWN_RETRY_AFTER", 10*time.Second),
+		),
+		Bus:           substrate.NewEventBus(),
+		SpawnTokenTTL: getenvAsDuration("SUBSTRATE_SPAWN_TOKEN_TTL", 12*time.Hour),
+		Auditors:      strings.Fields(strings.ReplaceAll(os.Getenv("SUBSTRATE_AUDITORS"), ",", " ")),
+		Admins:        strings.Fields(strings.ReplaceAll(os.Getenv("SUBSTRATE_ADMINS"), ",", " ")),
 	}
 
 	natsServer, natsCoords, err := startNatsServer(ctx, &NatsConfig{
@@ -111,6 +159,16 @@ func main() {
 
 	fmt.Printf("natsCoords: %#v\n", natsCoords)
 
+	eventsConn, err := nats.Connect(natsCoords.ClientURL, nats.UserInfo(natsCoords.Username, natsCoords.Password))
+	if err != nil {
+		log.Fatalf("error connecting to nats: %s", err)
+	}
+	err = sub.Bus.UseTransport(substrate.NewNATSEventTransport(eventsConn, getenv("SUBSTRATE_EVENTS_NATS_SUBJECT", "substrate.events")))
+	if err != nil {
+		log.Fatalf("error subscribing to events: %s", err)
+	}
+	defer sub.Bus.Close()
+
 	err = startPlaneController(ctx, &PlaneControllerConfig{
 		RustLog:       "debug",
 		RustBacktrace: "full",
@@ -153,12 +211,12 @@ func main() {
 		AcmeAdminEmail: "paul@driftingin.space",
 		AcmeServer:     "https://acme-v02.api.letsencrypt.org/directory",
 
-		DataDir:       mustGetenv("PLANE_DATA_DIR"),
-		ClusterDomain: mustGetenv("PLANE_CLUSTER_DOMAIN"),
-		DroneIP:       mustGetenv("PLANE_AGENT__IP"),
-		DockerSocket:  mustGetenv("PLANE_AGENT__DOCKER__CONNECTION__SOCKET"),
-		DockerBinds:   binds,
-		DockerExtraHosts:   extraHosts,
+		DataDir:          mustGetenv("PLANE_DATA_DIR"),
+		ClusterDomain:    mustGetenv("PLANE_CLUSTER_DOMAIN"),
+		DroneIP:          mustGetenv("PLANE_AGENT__IP"),
+		DockerSocket:     mustGetenv("PLANE_AGENT__DOCKER__CONNECTION__SOCKET"),
+		DockerBinds:      binds,
+		DockerExtraHosts: extraHosts,
 
 		HTTPPort: droneProxyPort,
 
@@ -179,7 +237,33 @@ func main() {
 		Addr: ":" + port,
 	}
 
-	server.Handler = newHTTPHandler(sub)
+	ts, err := startTailnet(ctx, sub, server)
+	if err != nil {
+		log.Fatalf("error starting tailscale: %s", err)
+	}
+
+	tracer := newTracerFromEnvironment()
+	server.Handler = withAccessLog(tracer, newHTTPHandler(ctx, sub, ts))
+
+	// On SIGINT or SIGTERM, finish the requests in flight and send the spans
+	// they leave queued before exiting.
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		log.Printf("shutting down on %s", <-signals)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), getenvAsDuration("SUBSTRATE_SHUTDOWN_TIMEOUT", 10*time.Second))
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("error shutting down server: %s", err)
+		}
+		if err := tracer.Shutdown(shutdownCtx); err != nil {
+			log.Printf("error sending queued spans: %s", err)
+		}
+	}()
 
 	binaryPath, _ := os.Executable()
 	if binaryPath == "" {
@@ -188,8 +272,12 @@ func main() {
 	log.Printf("%s listening on %q", filepath.Base(binaryPath), server.Addr)
 
 	if server.TLSConfig == nil {
-		log.Fatal(server.ListenAndServe())
+		err = server.ListenAndServe()
 	} else {
-		log.Fatal(server.ListenAndServeTLS("", ""))
+		err = server.ListenAndServeTLS("", "")
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
+	<-stopped
 }
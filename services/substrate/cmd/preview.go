@@ -44,11 +44,21 @@ func newPreviewHandler(s *substrate.Substrate, gw *substrate.Gateway) func(rw ht
 		user, ok := auth.UserFromContext(req.Context())
 		if !ok {
 			jsonrw := newJSONResponseWriter(rw)
-			jsonrw(nil, http.StatusBadRequest, fmt.Errorf("user not available in context"))
+			jsonrw(nil, http.StatusUnauthorized, fmt.Errorf("user not available in context"))
 			return
 		}
 
-		cacheKey, concrete := activityspec.ActivitySpec()
+		authorized, forceReadOnly, err := s.AuthorizeActivitySpecRequest(req.Context(), user.GithubUsername, activityspec)
+		if err != nil {
+			newJSONResponseWriter(rw)(nil, authorizationErrorStatus(err), err)
+			return
+		}
+
+		// Leave the path out of the cache key so it matches the key /gw/ uses
+		// for the same backend.
+		backendspec := *authorized
+		backendspec.Path = ""
+		activitySpec, concrete := backendspec.ActivitySpec()
 		if !concrete {
 			jsonrw := newJSONResponseWriter(rw)
 			jsonrw(nil, http.StatusBadRequest, fmt.Errorf("activityspec must be concrete"))
@@ -56,19 +66,19 @@ func newPreviewHandler(s *substrate.Substrate, gw *substrate.Gateway) func(rw ht
 		}
 
 		if preview == nil {
-			newJSONResponseWriter(rw)(nil, http.StatusInternalServerError, fmt.Errorf("could not resolve preview activity for: %s", cacheKey))
+			newJSONResponseWriter(rw)(nil, http.StatusInternalServerError, fmt.Errorf("could not resolve preview activity for: %s", activitySpec))
 			return
 		}
 
-		gw.ProvisionRedirector(cacheKey, func() substrate.ProvisionFunc {
-			return s.MakeProvisioner(func(fmt string, values ...any) {
-				log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
-			}, &substrate.SpawnRequest{
-				User:         user.GithubUsername,
-				ActivitySpec: *activityspec,
-				Ephemeral:    true,
-			})
-		}, func(targetFunc substrate.AuthenticatedURLJoinerFunc) (int, string, error) {
+		cacheKey := substrate.GatewayCacheKey(activitySpec, user.GithubUsername, forceReadOnly)
+		gw.ProvisionRedirector(cacheKey, s.MakeProvisioner(func(fmt string, values ...any) {
+			log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
+		}, &substrate.SpawnRequest{
+			User:          user.GithubUsername,
+			ActivitySpec:  *authorized,
+			Ephemeral:     true,
+			ForceReadOnly: forceReadOnly,
+		}), func(targetFunc substrate.AuthenticatedURLJoinerFunc) (int, string, error) {
 			var previewPathSuffix string
 			if preview.Activity.Request != nil && preview.Activity.Request.Path != "" {
 				previewPathSuffix += "/" + strings.TrimPrefix(preview.Activity.Request.Path, "/")
@@ -91,11 +101,16 @@ func newPreviewHandler(s *substrate.Substrate, gw *substrate.Gateway) func(rw ht
 
 			previewSuffixURL, _ := url.Parse(previewPathSuffix)
 
-			target, _ := targetFunc(previewSuffixURL, substrate.ProvisionerCookieAuthenticationMode)
+			target, header := targetFunc(previewSuffixURL, substrate.ProvisionerHeaderAuthenticationMode)
+			if header != nil {
+				// The backend needs credentials that we can't hand to the browser,
+				// so send it through the gateway instead.
+				return http.StatusFound, s.Origin + "/gw/" + activitySpec + previewPathSuffix, nil
+			}
 
 			// fmt.Printf("oldtarget=%s\n", target)
 			// target.Path, target.RawPath = substrate.JoinURLPath(target, previewSuffixURL)
-			fmt.Printf("newtarget=%s\n", target)
+			substrate.LogFromContext(req.Context()).WithField("target", target.String()).Debug("preview redirect")
 
 			return http.StatusFound, target.String(), nil
 		}).ServeHTTP(rw, req)
@@ -157,9 +172,6 @@ func newPreviewHandler(s *substrate.Substrate, gw *substrate.Gateway) func(rw ht
 			return
 		}
 
-
-
-
 		// TODO sort by priority
 
 		activityspec.LensName = preview.LensName
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ajbouh/substrate/pkg/auth"
 	"github.com/ajbouh/substrate/services/substrate"
@@ -13,8 +19,6 @@ import (
 	"github.com/rs/cors"
 )
 
-type AllowOriginFunc func(origin string) bool
-
 var methods []string = []string{
 	"GET",
 	"DELETE",
@@ -25,15 +29,26 @@ var methods []string = []string{
 	"OPTIONS",
 }
 
-func newHTTPHandler(s *substrate.Substrate) http.Handler {
+// tailnetNode is substrate's node on a tailnet, when it's serving on one.
+type tailnetNode interface {
+	// WhoIs returns the login name of the user whose node remoteAddr is.
+	WhoIs(ctx context.Context, remoteAddr string) (string, error)
+}
+
+func newHTTPHandler(ctx context.Context, s *substrate.Substrate, ts tailnetNode) http.Handler {
 	router := httprouter.New()
 
-	gw := substrate.NewGateway()
+	gw := substrate.NewGateway(
+		getenvAsInt("SUBSTRATE_GATEWAY_CACHE_SIZE", 256),
+		getenvAsDuration("SUBSTRATE_GATEWAY_CACHE_TTL", 30*time.Minute),
+	)
+	gw.MaxReplayBodyBytes = int64(getenvAsInt("SUBSTRATE_GATEWAY_MAX_REPLAY_BODY_BYTES", substrate.DefaultMaxReplayBodyBytes))
+	go gw.Run(ctx)
 
 	previewHandler := newPreviewHandler(s, gw)
 	router.Handle("GET", "/preview/*rest", previewHandler)
 
-	uiRoutes, uiHandler, allowOriginFunc := newUIHandler(s, gw)
+	uiRoutes, uiHandler, uiOrigins := newUIHandler(s, gw)
 	router.Handle("GET", "/@fs/*rest", uiHandler) // HACK for SvelteKit
 	for _, uiRoute := range uiRoutes {
 		for _, method := range methods {
@@ -41,12 +56,7 @@ func newHTTPHandler(s *substrate.Substrate) http.Handler {
 		}
 	}
 
-	apiHandler0 := cors.New(cors.Options{
-		AllowCredentials: true,
-		AllowOriginFunc:  allowOriginFunc,
-		// Enable Debugging for testing, consider disabling in production
-		Debug: true,
-	}).Handler(newApiHandler(s))
+	apiHandler0 := newCORSHandler(newCORSPolicy(s, uiOrigins), newApiHandler(s, gw))
 	apiHandler := func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
 		apiHandler0.ServeHTTP(rw, req)
 	}
@@ -61,43 +71,242 @@ func newHTTPHandler(s *substrate.Substrate) http.Handler {
 		}
 	}
 
-	if os.Getenv("GIHUB_CLIENT_ID") == "" {
-		fmt.Printf("Disabling authentication\n")
-		router.Handle("GET", "/", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-			http.Redirect(rw, req, "/ui/", http.StatusTemporaryRedirect)
-		})
+	router.Handle("GET", "/", func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
+		http.Redirect(rw, req, "/ui/", http.StatusTemporaryRedirect)
+	})
 
-		return router
+	provider, err := newAuthProvider(s, ts)
+	if err != nil {
+		log.Fatalf("error configuring authentication: %s", err)
 	}
 
-	githubRedirectURL := s.Origin + "/auth/github/callback"
-	fmt.Printf("Origin=%s\n", githubRedirectURL)
+	// Personal API tokens work on the API, whichever way browsers log in.
+	provider = &auth.Bearer{
+		Authenticate: func(ctx context.Context, token string) (*auth.User, error) {
+			t, err := s.AuthenticateAPIToken(ctx, token, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			return &auth.User{GithubUsername: t.User, Scopes: t.Scopes, Spaces: t.Spaces}, nil
+		},
+		PathPrefixes: []string{"/api/", "/gw/substrate/"},
+		Fallback:     provider,
+	}
+	return provider.Protect(router)
+}
 
-	return (&auth.Auth{
-		GithubClientID:     os.Getenv("GITHUB_CLIENT_ID"),
-		GithubClientSecret: os.Getenv("GITHUB_CLIENT_SECRET"),
-		GithubRedirectURL:  githubRedirectURL,
+// newCORSPolicy trusts substrate's origin, the UI's, and any listed in
+// SUBSTRATE_CORS_ORIGINS (comma-separated). Lens UIs on plane hostnames under
+// SUBSTRATE_CORS_LENS_DOMAIN (default PLANE_CLUSTER_DOMAIN, "none" for none)
+// may make requests too, but without credentials.
+func newCORSPolicy(s *substrate.Substrate, uiOrigins []string) *substrate.CORSPolicy {
+	policy := &substrate.CORSPolicy{
+		LensDomain: getenv("SUBSTRATE_CORS_LENS_DOMAIN", os.Getenv("PLANE_CLUSTER_DOMAIN")),
+		LensPort:   os.Getenv("PLANE_PROXY__HTTP_PORT"),
+	}
+	if policy.LensDomain == "none" {
+		policy.LensDomain = ""
+	}
+	if s.Origin != "" {
+		policy.TrustedOrigins = append(policy.TrustedOrigins, s.Origin)
+	}
+	policy.TrustedOrigins = append(policy.TrustedOrigins, uiOrigins...)
+	for _, origin := range strings.Fields(strings.ReplaceAll(os.Getenv("SUBSTRATE_CORS_ORIGINS"), ",", " ")) {
+		if substrate.NormalizeOrigin(origin) == "" {
+			log.Fatalf("bad SUBSTRATE_CORS_ORIGINS: %q isn't an http or https origin", origin)
+		}
+		policy.TrustedOrigins = append(policy.TrustedOrigins, origin)
+	}
+	return policy
+}
 
-		SessionName: "substrate-github-app",
+// newCORSHandler applies policy to requests for next. Credentials are only
+// allowed for trusted origins; lens origins have to send a token instead.
+// Set SUBSTRATE_CORS_DEBUG to log each decision.
+func newCORSHandler(policy *substrate.CORSPolicy, next http.Handler) http.Handler {
+	debug, _ := strconv.ParseBool(os.Getenv("SUBSTRATE_CORS_DEBUG"))
+	exposedHeaders := []string{"X-Next-Cursor", "Link", "Retry-After"}
+
+	trusted := cors.New(cors.Options{
+		AllowCredentials: true,
+		AllowOriginFunc:  policy.IsTrusted,
+		AllowedMethods:   methods,
+		AllowedHeaders:   []string{"Content-Type", "Authorization", "X-Requested-With"},
+		ExposedHeaders:   exposedHeaders,
+		Debug:            debug,
+	}).Handler(next)
+	lens := cors.New(cors.Options{
+		AllowOriginFunc: policy.IsLens,
+		AllowedMethods:  methods,
+		AllowedHeaders:  []string{"Content-Type", "Authorization", "X-Requested-With"},
+		ExposedHeaders:  exposedHeaders,
+		Debug:           debug,
+	}).Handler(next)
+
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		if !policy.IsTrusted(origin) && policy.IsLens(origin) {
+			lens.ServeHTTP(rw, req)
+			return
+		}
+		trusted.ServeHTTP(rw, req)
+	})
+}
+
+// newAuthProvider picks how users are identified from SUBSTRATE_AUTH: "header"
+// to trust a header set by an authenticating proxy, "tailscale" to trust the
+// tailnet node a request comes from, "dev" to treat everyone as one user, or
+// any of "github", "oidc" and "password", comma-separated, to log in with
+// those. It defaults to "tailscale" when serving on a tailnet and "github" if
+// GITHUB_CLIENT_ID is set. Otherwise it must be set, so a misconfigured
+// deployment fails to start rather than running without authentication.
+func newAuthProvider(s *substrate.Substrate, ts tailnetNode) (auth.Provider, error) {
+	mode := os.Getenv("SUBSTRATE_AUTH")
+	if mode == "" {
+		switch {
+		case ts != nil:
+			mode = "tailscale"
+		case os.Getenv("GITHUB_CLIENT_ID") != "":
+			mode = "github"
+		default:
+			return nil, fmt.Errorf(`SUBSTRATE_AUTH isn't set and there's no GITHUB_CLIENT_ID; set SUBSTRATE_AUTH=dev to run without authentication`)
+		}
+	}
+
+	switch mode {
+	case "dev":
+		username := getenv("SUBSTRATE_DEV_USER", "dev")
+		log.Printf("authentication disabled, everyone is %s", username)
+		return &auth.StaticUser{User: auth.User{GithubUsername: username}}, nil
+	case "header":
+		var proxies []*net.IPNet
+		for _, cidr := range strings.Fields(strings.ReplaceAll(os.Getenv("SUBSTRATE_AUTH_TRUSTED_PROXIES"), ",", " ")) {
+			_, n, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("bad SUBSTRATE_AUTH_TRUSTED_PROXIES: %w", err)
+			}
+			proxies = append(proxies, n)
+		}
+		return &auth.TrustedHeader{
+			Header:         getenv("SUBSTRATE_AUTH_HEADER", "X-Forwarded-User"),
+			TrustedProxies: proxies,
+		}, nil
+	case "tailscale":
+		if ts == nil {
+			return nil, fmt.Errorf("SUBSTRATE_AUTH is tailscale but TAILSCALE_AUTHKEY isn't set")
+		}
+		usernames := map[string]string{}
+		for _, pair := range strings.Fields(strings.ReplaceAll(os.Getenv("SUBSTRATE_TAILSCALE_USERS"), ",", " ")) {
+			loginName, username, ok := strings.Cut(pair, "=")
+			if !ok || loginName == "" || username == "" {
+				return nil, fmt.Errorf("bad SUBSTRATE_TAILSCALE_USERS: %q isn't login=username", pair)
+			}
+			usernames[loginName] = username
+		}
+		return &auth.Tailnet{
+			WhoIs:     ts.WhoIs,
+			Usernames: usernames,
+		}, nil
+	}
+
+	// Every cookie substrate sets for itself starts with
+	// substrate.SubstrateCookiePrefix, so none of them are passed to lenses.
+
+	// state param cookies require HTTPS by default; disable for localhost development
+	// stateConfig := gologin.DebugOnlyCookieConfig
+	stateConfig := gologin.CookieConfig{
+		Name:     substrate.SubstrateCookiePrefix + "login-state",
+		Path:     "/",
+		MaxAge:   600, // 10 min
+		HTTPOnly: true,
+		Secure:   true, // HTTPS only
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	var providers []auth.LoginProvider
+	for _, name := range strings.Split(mode, ",") {
+		switch strings.TrimSpace(name) {
+		case "github":
+			providers = append(providers, &auth.Github{
+				ClientID:     mustGetenv("GITHUB_CLIENT_ID"),
+				ClientSecret: mustGetenv("GITHUB_CLIENT_SECRET"),
+				RedirectURL:  s.Origin + "/auth/github/callback",
+				StateConfig:  stateConfig,
+			})
+		case "oidc":
+			oidcStateConfig := stateConfig
+			oidcStateConfig.Name = substrate.SubstrateCookiePrefix + "oidc-state"
+			providers = append(providers, &auth.OIDC{
+				Issuer:         mustGetenv("OIDC_ISSUER"),
+				ClientID:       mustGetenv("OIDC_CLIENT_ID"),
+				ClientSecret:   os.Getenv("OIDC_CLIENT_SECRET"),
+				RedirectURL:    s.Origin + "/auth/oidc/callback",
+				Scopes:         strings.Fields(os.Getenv("OIDC_SCOPES")),
+				UsernameClaims: strings.Fields(strings.ReplaceAll(os.Getenv("OIDC_USERNAME_CLAIMS"), ",", " ")),
+				StateConfig:    oidcStateConfig,
+			})
+		case "password":
+			users, err := auth.ReadPasswordFile(mustGetenv("SUBSTRATE_PASSWORD_FILE"))
+			if err != nil {
+				return nil, fmt.Errorf("bad SUBSTRATE_PASSWORD_FILE: %w", err)
+			}
+			providers = append(providers, &auth.Password{Users: users})
+		default:
+			return nil, fmt.Errorf("unknown SUBSTRATE_AUTH %q", mode)
+		}
+	}
+
+	return &auth.Auth{
+		Providers: providers,
+
+		SessionName: substrate.SubstrateCookiePrefix + "github-app",
 		SessionStore: sessions.NewCookieStore[string](
 			sessions.DefaultCookieConfig,
 			// sessions.DebugCookieConfig,
 			[]byte(mustGetenv("SESSION_SECRET")),
 			nil,
 		),
-		// state param cookies require HTTPS by default; disable for localhost development
-		// StateConfig: gologin.DebugOnlyCookieConfig,
-		StateConfig: gologin.CookieConfig{
-			Name:     "gologin-temporary-cookie",
-			Path:     "/",
-			MaxAge:   600, // 10 min
-			HTTPOnly: true,
-			Secure:   true, // HTTPS only
-			SameSite: http.SameSiteLaxMode,
-		},
+
+		Sessions:           &authSessions{s},
+		SessionTTL:         getenvAsDuration("SUBSTRATE_SESSION_TTL", auth.DefaultSessionTTL),
+		SessionRotateAfter: getenvAsDuration("SUBSTRATE_SESSION_ROTATE_AFTER", auth.DefaultSessionRotateAfter),
 
 		DefaultLoginRedirect:  "/ui/",
-		DefaultLogoutRedirect: "/auth/github/login",
-	}).Protect(router)
+		DefaultLogoutRedirect: providers[0].LoginPath(),
+	}, nil
+}
+
+// authSessions keeps login sessions in substrate's database.
+type authSessions struct {
+	s *substrate.Substrate
+}
+
+func (a *authSessions) CreateSession(ctx context.Context, s *auth.Session, token string) error {
+	o := substrate.Session(*s)
+	if err := a.s.CreateSession(ctx, &o, token); err != nil {
+		return err
+	}
+	s.ID = o.ID
+	return nil
+}
+
+func (a *authSessions) FindSession(ctx context.Context, token string) (*auth.Session, bool, error) {
+	o, previous, err := a.s.FindSession(ctx, token)
+	if err != nil || o == nil {
+		return nil, false, err
+	}
+	s := auth.Session(*o)
+	return &s, previous, nil
+}
+
+func (a *authSessions) RotateSession(ctx context.Context, id, token, newToken string, now time.Time) (bool, error) {
+	return a.s.RotateSession(ctx, id, token, newToken, now)
+}
+
+func (a *authSessions) TouchSession(ctx context.Context, id string, now time.Time) error {
+	return a.s.TouchSession(ctx, id, now)
+}
 
+func (a *authSessions) DeleteSession(ctx context.Context, id string) error {
+	return a.s.DeleteSession(ctx, id)
 }
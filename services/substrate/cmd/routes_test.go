@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ajbouh/substrate/pkg/auth"
+	"github.com/ajbouh/substrate/services/substrate"
+)
+
+func TestAuthProviderNeedsExplicitDev(t *testing.T) {
+	s := &substrate.Substrate{}
+	t.Setenv("SUBSTRATE_AUTH", "")
+	t.Setenv("GITHUB_CLIENT_ID", "")
+
+	if provider, err := newAuthProvider(s, nil); err == nil {
+		t.Fatalf("expected an error without SUBSTRATE_AUTH, got %T", provider)
+	}
+
+	t.Setenv("SUBSTRATE_AUTH", "dev")
+	provider, err := newAuthProvider(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := provider.(*auth.StaticUser); !ok {
+		t.Fatalf("expected SUBSTRATE_AUTH=dev to give a StaticUser, got %T", provider)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build tailscale
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+
+	"github.com/ajbouh/substrate/pkg/tailscale"
+	"github.com/ajbouh/substrate/services/substrate"
+)
+
+// startTailnet joins the tailnet if TAILSCALE_AUTHKEY is set, and has server
+// use TLS with the tailnet's certificate for this node's name there. It
+// returns nil if there's no tailnet to join.
+func startTailnet(ctx context.Context, sub *substrate.Substrate, server *http.Server) (tailnetNode, error) {
+	ts, ok := tailscale.NewFromEnvironment()
+	if !ok {
+		return nil, nil
+	}
+
+	err := ts.Start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dnsName, err := ts.DNSName(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if sub.Origin == "" {
+		sub.Origin = "https://" + dnsName
+	}
+	server.TLSConfig = &tls.Config{GetCertificate: ts.GetCertificate}
+	return ts, nil
+}
@@ -0,0 +1,21 @@
+//go:build !tailscale
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/ajbouh/substrate/services/substrate"
+)
+
+// startTailnet refuses to start if TAILSCALE_AUTHKEY is set, since tailscale
+// support is only built with -tags tailscale.
+func startTailnet(ctx context.Context, sub *substrate.Substrate, server *http.Server) (tailnetNode, error) {
+	if os.Getenv("TAILSCALE_AUTHKEY") != "" {
+		return nil, fmt.Errorf("TAILSCALE_AUTHKEY is set, but this build doesn't support tailscale; build with -tags tailscale")
+	}
+	return nil, nil
+}
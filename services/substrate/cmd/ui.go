@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
@@ -13,51 +14,62 @@ import (
 	"github.com/ajbouh/substrate/services/substrate"
 )
 
-func newUIHandler(sub *substrate.Substrate, gw *substrate.Gateway) ([]string, func(rw http.ResponseWriter, req *http.Request, p httprouter.Params), AllowOriginFunc) {
-	var allowOriginFunc AllowOriginFunc
+// newUIHandler returns the routes for the UI, its handler, and the origins it's
+// served from other than substrate's own.
+func newUIHandler(sub *substrate.Substrate, gw *substrate.Gateway) ([]string, func(rw http.ResponseWriter, req *http.Request, p httprouter.Params), []string) {
+	var uiOrigins []string
 	var upstream http.Handler
 	externalUIHandler := os.Getenv("EXTERNAL_UI_HANDLER")
 	if externalUIHandler != "" {
 		externalUIHandlerTarget, err := url.Parse(externalUIHandler)
 		if err != nil {
-			log.Fatalf("invalid EXTERNAL_UI_HANDLER %q: %w", externalUIHandler, err)
+			log.Fatalf("invalid EXTERNAL_UI_HANDLER %q: %s", externalUIHandler, err)
 		}
 		upstream = httputil.NewSingleHostReverseProxy(externalUIHandlerTarget)
-		allowOriginFunc = func(origin string) bool {
-			return origin == "http://"+externalUIHandlerTarget.Host
-		}
+		uiOrigins = []string{"http://" + externalUIHandlerTarget.Host}
 	} else {
 
 		uiLens := "ui"
 
-		cacheKey := uiLens
 		upstream = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-			gw.ProvisionReverseProxy(cacheKey, func() substrate.ProvisionFunc {
-				return sub.MakeProvisioner(func(fmt string, values ...any) {
-					log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
-				}, &substrate.SpawnRequest{
-					ActivitySpec: substrate.ActivitySpecRequest{
-						LensName: uiLens,
-					},
-				})
-			}).ServeHTTP(rw, req)
+			user, ok := auth.UserFromContext(req.Context())
+			if !ok {
+				jsonrw := newJSONResponseWriter(rw)
+				jsonrw(nil, http.StatusUnauthorized, fmt.Errorf("user not available in context"))
+				return
+			}
+
+			lens, err := sub.ResolveLens(req.Context(), uiLens)
+			if err != nil {
+				jsonrw := newJSONResponseWriter(rw)
+				jsonrw(nil, http.StatusInternalServerError, err)
+				return
+			}
+			// The UI backend sees the whole path, so its cookies need no
+			// path of their own.
+			cookies := substrate.NewLensCookiePolicy(lens, "")
+			cookies.FilterRequest(req)
+
+			cacheKey := substrate.GatewayCacheKey(uiLens, user.GithubUsername, false)
+			gw.ProvisionReverseProxy(cacheKey, sub.MakeProvisioner(func(fmt string, values ...any) {
+				log.Printf(fmt+" cacheKey=%s", append(values, cacheKey)...)
+			}, &substrate.SpawnRequest{
+				User: user.GithubUsername,
+				ActivitySpec: substrate.ActivitySpecRequest{
+					LensName: uiLens,
+				},
+			}), cookies.FilterResponse).ServeHTTP(rw, req)
 		})
-		allowOriginFunc = func(origin string) bool {
-			// panic("CORS origin check for UI backends not yet implemented")
-			// TODO actually implement
-			return true
-		}
 	}
 
 	return []string{"/ui", "/ui/*rest"},
 		func(rw http.ResponseWriter, req *http.Request, p httprouter.Params) {
-			log.Printf("%s %s %s", req.RemoteAddr, req.Method, req.URL.String())
-
 			// We are keeping the leading /ui for simplicity...
 			req.Host = ""
+			req.Header.Del("Substrate-Github-Username")
 			if user, ok := auth.UserFromContext(req.Context()); ok {
 				req.Header.Set("Substrate-Github-Username", user.GithubUsername)
 			}
 			upstream.ServeHTTP(rw, req)
-		}, allowOriginFunc
+		}, uiOrigins
 }
@@ -0,0 +1,369 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A collection's label, attributes and visibility live on its root
+// membership, the one with neither a space nor a lensspec.
+
+const CollectionLabelAttribute = "system:ui:label"
+
+type CollectionExistsError struct {
+	Owner string
+	Name  string
+}
+
+func (e *CollectionExistsError) Error() string {
+	return fmt.Sprintf("collection %s/%s already exists", e.Owner, e.Name)
+}
+
+type CollectionNotFoundError struct {
+	Owner string
+	Name  string
+}
+
+func (e *CollectionNotFoundError) Error() string {
+	return fmt.Sprintf("no such collection: %s/%s", e.Owner, e.Name)
+}
+
+// CollectionPatch changes a collection. Nil fields are left alone. Attributes,
+// if set, replaces all of the collection's attributes except its label and
+// query.
+type CollectionPatch struct {
+	Owner string `json:"-"`
+	Name  string `json:"-"`
+
+	NewName    *string        `json:"name,omitempty"`
+	Label      *string        `json:"label,omitempty"`
+	IsPublic   *bool          `json:"public,omitempty"`
+	Attributes map[string]any `json:"attributes,omitempty"`
+
+	// Query replaces the query of a smart collection. A collection with
+	// members can't be made into one.
+	Query *SpaceQuery `json:"query,omitempty"`
+}
+
+// CollectionMemberRef picks out one member of a collection.
+type CollectionMemberRef struct {
+	SpaceID  string `json:"space,omitempty"`
+	LensSpec string `json:"lensspec,omitempty"`
+}
+
+// sortCollectionMembers puts members with a position first, in order, then the
+// rest oldest first.
+func sortCollectionMembers(members []*CollectionMember) {
+	sort.SliceStable(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		switch {
+		case a.Position != nil && b.Position != nil:
+			return *a.Position < *b.Position
+		case a.Position != nil:
+			return true
+		case b.Position != nil:
+			return false
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+}
+
+// CollectionMemberListQuery lists the members of the first collection
+// matching CollectionMembershipWhere's owner, name and name prefix. HasSpaceID
+// and HasLensSpec pick which members.
+type CollectionMemberListQuery struct {
+	CollectionMembershipWhere
+	Limit   *Limit
+	OrderBy *OrderBy
+	Cursor  *Cursor
+}
+
+// collectionMemberPosition orders members with a position before the rest,
+// as sortCollectionMembers does.
+const collectionMemberPosition = `coalesce(json_extract(` + collectionMembershipsTable + `.membership, '$.position'), 9223372036854775807)`
+
+// ListCollectionMembers lists the members of a collection in the order
+// sortCollectionMembers puts them, a page at a time. The members of a smart
+// collection are the spaces its query matches, oldest first. It returns no
+// members if there's no such collection.
+func (s *Substrate) ListCollectionMembers(ctx context.Context, request *CollectionMemberListQuery) ([]*CollectionMember, error) {
+	collections, err := s.listCollections(ctx, &CollectionListQuery{
+		CollectionMembershipWhere: CollectionMembershipWhere{
+			Owner:      request.Owner,
+			Name:       request.Name,
+			NamePrefix: request.NamePrefix,
+		},
+		Limit: &Limit{1},
+	})
+	if err != nil || len(collections) == 0 {
+		return []*CollectionMember{}, err
+	}
+	c := collections[0]
+
+	if c.Query != nil {
+		if request.HasLensSpec {
+			return []*CollectionMember{}, nil
+		}
+		return s.listSmartCollectionMembers(ctx, c, request.Limit, request.OrderBy, request.Cursor)
+	}
+
+	spaceIDColumn := `coalesce(` + collectionMembershipsTable + `.space_id, '')`
+	lensSpecColumn := `coalesce(` + collectionMembershipsTable + `.lensspec, '')`
+	query := &Query{
+		Select:          []string{collectionMembershipsTable + ".membership", collectionMemberPosition, collectionMembershipsTable + ".created_at_us", spaceIDColumn, lensSpecColumn},
+		FromTablesNamed: map[string]string{collectionMembershipsTable: collectionMembershipsTable},
+		WherePredicates: map[string]bool{},
+		// Skip the root, which isn't a member.
+		Where:          []string{`(` + spaceIDColumn + ` != '' OR ` + lensSpecColumn + ` != '')`},
+		OrderByColumns: []string{collectionMemberPosition, collectionMembershipsTable + ".created_at_us", spaceIDColumn, lensSpecColumn},
+		OrderBy:        request.OrderBy,
+		After:          request.Cursor,
+		Limit:          request.Limit,
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	where := &CollectionMembershipWhere{
+		Owner:       &c.Owner,
+		Name:        &c.Name,
+		HasSpaceID:  request.HasSpaceID,
+		HasLensSpec: request.HasLensSpec,
+	}
+	where.AppendWhere(query)
+
+	q, values := query.Render()
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, q, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*CollectionMember{}
+	for rows.Next() {
+		var o CollectionMember
+		var b []byte
+		var position, createdAt int64
+		var spaceID, lensSpec string
+		if err := rows.Scan(&b, &position, &createdAt, &spaceID, &lensSpec); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &o); err != nil {
+			return nil, err
+		}
+		o.cursor = newCursor(position, createdAt, spaceID, lensSpec)
+		results = append(results, &o)
+	}
+	return results, rows.Err()
+}
+
+func (s *Substrate) getCollection(ctx context.Context, owner, name string) (*Collection, error) {
+	collections, err := s.ListCollections(ctx, &CollectionListQuery{
+		CollectionMembershipWhere: CollectionMembershipWhere{Owner: &owner, Name: &name},
+		Limit:                     &Limit{1},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(collections) == 0 {
+		return nil, nil
+	}
+	return collections[0], nil
+}
+
+func (s *Substrate) writeCollectionRoot(ctx context.Context, c *Collection, createdAt time.Time) error {
+	return s.WriteCollectionMembership(ctx, &CollectionMembership{
+		Owner:      c.Owner,
+		Name:       c.Name,
+		CreatedAt:  createdAt,
+		IsPublic:   c.IsPublic,
+		Attributes: c.Attributes,
+	})
+}
+
+// CreateCollection creates a collection with c's label, attributes and
+// visibility. Members are added separately. A collection that so far only
+// exists because it has members gets its root; one that already has a root
+// is a CollectionExistsError.
+func (s *Substrate) CreateCollection(ctx context.Context, c *Collection) error {
+	existing, err := s.getCollection(ctx, c.Owner, c.Name)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Root != nil {
+		return &CollectionExistsError{Owner: c.Owner, Name: c.Name}
+	}
+	if existing != nil && c.Query != nil {
+		return fmt.Errorf("collection %s/%s already has members, so it can't be defined by a query", c.Owner, c.Name)
+	}
+	if c.Query != nil {
+		if err := c.Query.validate(); err != nil {
+			return err
+		}
+	}
+
+	attributes := map[string]any{}
+	for k, v := range c.Attributes {
+		attributes[k] = v
+	}
+	if c.Label != "" {
+		attributes[CollectionLabelAttribute] = c.Label
+	}
+	if c.Query != nil {
+		attributes[CollectionQueryAttribute] = c.Query
+	}
+
+	return s.writeCollectionRoot(ctx, &Collection{
+		Owner:      c.Owner,
+		Name:       c.Name,
+		IsPublic:   c.IsPublic,
+		Attributes: attributes,
+	}, time.Now())
+}
+
+func (s *Substrate) PatchCollection(ctx context.Context, patch *CollectionPatch) error {
+	c, err := s.getCollection(ctx, patch.Owner, patch.Name)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return &CollectionNotFoundError{Owner: patch.Owner, Name: patch.Name}
+	}
+
+	if patch.Query != nil {
+		if err := patch.Query.validate(); err != nil {
+			return err
+		}
+		if c.Query == nil && len(c.Members) > 0 {
+			return fmt.Errorf("collection %s/%s has members, so it can't be defined by a query", c.Owner, c.Name)
+		}
+	}
+
+	if patch.Label != nil || patch.IsPublic != nil || patch.Attributes != nil || patch.Query != nil {
+		createdAt := time.Now()
+		if c.Root != nil {
+			createdAt = c.Root.CreatedAt
+		}
+
+		attributes := map[string]any{}
+		if patch.Attributes != nil {
+			for k, v := range patch.Attributes {
+				attributes[k] = v
+			}
+			for _, k := range []string{CollectionLabelAttribute, CollectionQueryAttribute} {
+				if v, ok := c.Attributes[k]; ok {
+					attributes[k] = v
+				}
+			}
+		} else {
+			for k, v := range c.Attributes {
+				attributes[k] = v
+			}
+		}
+		if patch.Label != nil {
+			attributes[CollectionLabelAttribute] = *patch.Label
+		}
+		if patch.Query != nil {
+			attributes[CollectionQueryAttribute] = patch.Query
+		}
+		c.Attributes = attributes
+
+		if patch.IsPublic != nil {
+			c.IsPublic = *patch.IsPublic
+		}
+
+		err = s.writeCollectionRoot(ctx, c, createdAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	if patch.NewName != nil && *patch.NewName != patch.Name {
+		if *patch.NewName == "" {
+			return fmt.Errorf("collection name must not be empty")
+		}
+		existing, err := s.getCollection(ctx, patch.Owner, *patch.NewName)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return &CollectionExistsError{Owner: patch.Owner, Name: *patch.NewName}
+		}
+
+		err = s.dbExecContext(ctx, `UPDATE "collection_memberships" SET collection_name = ?, membership = json_set(membership, '$.name', ?) WHERE collection_owner = ? AND collection_name = ?`,
+			*patch.NewName, *patch.NewName, patch.Owner, patch.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteCollection removes a collection and all of its memberships. The
+// spaces and lenses in it are untouched.
+func (s *Substrate) DeleteCollection(ctx context.Context, owner, name string) error {
+	c, err := s.getCollection(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return &CollectionNotFoundError{Owner: owner, Name: name}
+	}
+
+	return s.DeleteCollectionMembership(ctx, &CollectionMembershipWhere{Owner: &owner, Name: &name})
+}
+
+// ReorderCollection puts the given members first, in the given order. Any
+// members left out keep their current order after them.
+func (s *Substrate) ReorderCollection(ctx context.Context, owner, name string, order []*CollectionMemberRef) error {
+	c, err := s.getCollection(ctx, owner, name)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return &CollectionNotFoundError{Owner: owner, Name: name}
+	}
+	if c.Query != nil {
+		return &ReadOnlyCollectionError{Owner: owner, Name: name}
+	}
+
+	current := map[CollectionMemberRef]bool{}
+	for _, m := range c.Members {
+		current[CollectionMemberRef{SpaceID: m.SpaceID, LensSpec: m.LensSpec}] = true
+	}
+
+	refs := []CollectionMemberRef{}
+	seen := map[CollectionMemberRef]bool{}
+	for _, ref := range order {
+		if !current[*ref] {
+			return fmt.Errorf("not a member of %s/%s: space=%q lensspec=%q", owner, name, ref.SpaceID, ref.LensSpec)
+		}
+		if seen[*ref] {
+			return fmt.Errorf("member listed twice: space=%q lensspec=%q", ref.SpaceID, ref.LensSpec)
+		}
+		seen[*ref] = true
+		refs = append(refs, *ref)
+	}
+	for _, m := range c.Members {
+		ref := CollectionMemberRef{SpaceID: m.SpaceID, LensSpec: m.LensSpec}
+		if !seen[ref] {
+			refs = append(refs, ref)
+		}
+	}
+
+	for position, ref := range refs {
+		err := s.dbExecContext(ctx, `UPDATE "collection_memberships" SET membership = json_set(membership, '$.position', ?) WHERE collection_owner = ? AND collection_name = ? AND space_id = ? AND lensspec = ?`,
+			position, owner, name, ref.SpaceID, ref.LensSpec)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// pageCollectionMembers lists every member a page at a time, passing each
+// cursor through its string form as the API does.
+func pageCollectionMembers(t *testing.T, s *Substrate, where CollectionMembershipWhere, pageSize int) []string {
+	t.Helper()
+
+	var ids []string
+	var cursor *Cursor
+	for {
+		members, err := s.ListCollectionMembers(context.Background(), &CollectionMemberListQuery{
+			CollectionMembershipWhere: where,
+			Limit:                     &Limit{pageSize},
+			Cursor:                    cursor,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range members {
+			ids = append(ids, m.SpaceID+m.LensSpec)
+		}
+		if len(members) < pageSize {
+			return ids
+		}
+		cursor, err = ParseCursor(members[len(members)-1].Cursor().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCollectionMembersPageInCollectionOrder(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "stuff"}); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	for i, id := range []string{"sp-a", "sp-b", "sp-c"} {
+		writeTestSpace(t, s, id, "alice", false, time.Duration(i)*time.Second)
+		err := s.WriteCollectionMembership(ctx, &CollectionMembership{Owner: "alice", Name: "stuff", SpaceID: id, CreatedAt: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := s.WriteCollectionMembership(ctx, &CollectionMembership{Owner: "alice", Name: "stuff", LensSpec: "notebook", CreatedAt: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spaces := CollectionMembershipWhere{Owner: stringPtr("alice"), Name: stringPtr("stuff"), HasSpaceID: true}
+	if got, want := pageCollectionMembers(t, s, spaces, 2), []string{"sp-a", "sp-b", "sp-c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected members oldest first, got %v", got)
+	}
+
+	// Positions come first, and pages follow them too.
+	if err := s.ReorderCollection(ctx, "alice", "stuff", []*CollectionMemberRef{{SpaceID: "sp-c"}, {LensSpec: "notebook"}, {SpaceID: "sp-a"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pageCollectionMembers(t, s, spaces, 2), []string{"sp-c", "sp-a", "sp-b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected members in their new order, got %v", got)
+	}
+	lensSpecs := CollectionMembershipWhere{Owner: stringPtr("alice"), NamePrefix: stringPtr("stu"), HasLensSpec: true}
+	if got, want := pageCollectionMembers(t, s, lensSpecs, 2), []string{"notebook"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected only the lensspec member, got %v", got)
+	}
+
+	// Pages agree with the whole collection.
+	c, err := s.getCollection(ctx, "alice", "stuff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var all []string
+	for _, m := range c.Members {
+		all = append(all, m.SpaceID+m.LensSpec)
+	}
+	if got, want := pageCollectionMembers(t, s, CollectionMembershipWhere{Owner: stringPtr("alice"), Name: stringPtr("stuff")}, 1), all; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected pages to match the collection's members %v, got %v", want, got)
+	}
+}
+
+func TestSmartCollectionMembersPage(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	for i, id := range []string{"sp-a", "sp-b", "sp-c"} {
+		writeTestSpace(t, s, id, "alice", false, time.Duration(i)*time.Second)
+	}
+	writeTestSpace(t, s, "sp-bob", "bob", false, time.Hour)
+	err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "mine", Query: &SpaceQuery{Owner: stringPtr("alice")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	where := CollectionMembershipWhere{Owner: stringPtr("alice"), Name: stringPtr("mine"), HasSpaceID: true}
+	if got, want := pageCollectionMembers(t, s, where, 2), []string{"sp-a", "sp-b", "sp-c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the spaces the query matches, got %v", got)
+	}
+	where = CollectionMembershipWhere{Owner: stringPtr("alice"), Name: stringPtr("mine"), HasLensSpec: true}
+	if got := pageCollectionMembers(t, s, where, 2); len(got) != 0 {
+		t.Errorf("expected a smart collection to have no lensspecs, got %v", got)
+	}
+}
+
+func TestCollectionLifecycle(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	start := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "papers", Label: "Papers", Attributes: map[string]any{"tag": "paper"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exists *CollectionExistsError
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "papers"}); !errors.As(err, &exists) {
+		t.Fatalf("expected creating it again to fail, got %v", err)
+	}
+	for i, id := range []string{"sp-a", "sp-b"} {
+		writeTestSpace(t, s, id, "alice", false, time.Duration(i)*time.Second)
+		err := s.WriteCollectionMembership(ctx, &CollectionMembership{Owner: "alice", Name: "papers", SpaceID: id, CreatedAt: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c, err := s.getCollection(ctx, "alice", "papers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "Papers" || c.Attributes["tag"] != "paper" || c.IsPublic || len(c.Members) != 2 {
+		t.Fatalf("unexpected collection %#v", c)
+	}
+
+	// Replacing the attributes keeps the label. Renaming takes the members
+	// along.
+	public, label, name := true, "Preprints", "preprints"
+	err = s.PatchCollection(ctx, &CollectionPatch{Owner: "alice", Name: "papers", IsPublic: &public, Attributes: map[string]any{"tag": "preprint"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PatchCollection(ctx, &CollectionPatch{Owner: "alice", Name: "papers", NewName: &name, Label: &label})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.getCollection(ctx, "alice", "papers"); err != nil || c != nil {
+		t.Fatalf("expected the old name to be gone, got %v, %v", c, err)
+	}
+	c, err = s.getCollection(ctx, "alice", "preprints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Label != "Preprints" || c.Attributes["tag"] != "preprint" || !c.IsPublic || len(c.Members) != 2 {
+		t.Fatalf("unexpected collection after patching %#v", c)
+	}
+
+	var notFound *CollectionNotFoundError
+	if err := s.PatchCollection(ctx, &CollectionPatch{Owner: "alice", Name: "papers", Label: &label}); !errors.As(err, &notFound) {
+		t.Fatalf("expected patching a missing collection to fail, got %v", err)
+	}
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "other"}); err != nil {
+		t.Fatal(err)
+	}
+	other := "other"
+	if err := s.PatchCollection(ctx, &CollectionPatch{Owner: "alice", Name: "preprints", NewName: &other}); !errors.As(err, &exists) {
+		t.Fatalf("expected renaming onto another collection to fail, got %v", err)
+	}
+
+	for _, order := range [][]*CollectionMemberRef{
+		{{SpaceID: "sp-nope"}},
+		{{SpaceID: "sp-a"}, {SpaceID: "sp-a"}},
+	} {
+		if err := s.ReorderCollection(ctx, "alice", "preprints", order); err == nil {
+			t.Errorf("expected reordering with %v to fail", order)
+		}
+	}
+
+	// Deleting a collection leaves its spaces alone.
+	if err := s.DeleteCollection(ctx, "alice", "preprints"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := s.getCollection(ctx, "alice", "preprints"); err != nil || c != nil {
+		t.Fatalf("expected the collection to be gone, got %v, %v", c, err)
+	}
+	if err := s.DeleteCollection(ctx, "alice", "preprints"); !errors.As(err, &notFound) {
+		t.Fatalf("expected deleting it again to fail, got %v", err)
+	}
+	spaces, err := s.ListSpaces(ctx, &SpaceListQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spaces) != 2 {
+		t.Fatalf("expected both spaces to be left, got %d", len(spaces))
+	}
+}
+
+func TestImplicitCollectionHasDefaultLabel(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+
+	// Collections that only exist through their members have no root, and
+	// so no label attribute.
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+	err := s.WriteCollectionMembership(ctx, &CollectionMembership{Owner: "alice", Name: "user:starred", SpaceID: "sp-a", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.getCollection(ctx, "alice", "user:starred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Root != nil || c.Label != "Starred" || len(c.Members) != 1 {
+		t.Fatalf("unexpected collection %#v", c)
+	}
+
+	// Creating it gives it a root, keeping its members.
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "user:starred", Label: "Stars"}); err != nil {
+		t.Fatal(err)
+	}
+	c, err = s.getCollection(ctx, "alice", "user:starred")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Root == nil || c.Label != "Stars" || len(c.Members) != 1 {
+		t.Fatalf("unexpected collection once created %#v", c)
+	}
+}
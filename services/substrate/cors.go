@@ -0,0 +1,66 @@
+package substrate
+
+import (
+	"net/url"
+	"strings"
+)
+
+// CORSPolicy decides which other origins a browser may call substrate's API
+// from. Trusted origins act as whoever is logged in, so they get credentials.
+// Lens UIs served straight from their plane backend only get to make requests
+// that carry their own token.
+type CORSPolicy struct {
+	// TrustedOrigins may make requests with the user's cookies, e.g.
+	// substrate's own origin and any external UI.
+	TrustedOrigins []string
+
+	// LensDomain is the cluster domain plane serves backends under, so
+	// backend "abc" is at abc.<LensDomain>. Empty means no lens origins.
+	LensDomain string
+
+	// LensPort is the port plane's proxy serves backends on. Origins with no
+	// port are allowed too.
+	LensPort string
+}
+
+// NormalizeOrigin returns origin as browsers send it in the Origin header:
+// lowercase scheme and host, and no path. It returns "" if origin isn't an
+// http or https URL.
+func NormalizeOrigin(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// IsTrusted reports whether origin may make credentialed requests.
+func (p *CORSPolicy) IsTrusted(origin string) bool {
+	origin = NormalizeOrigin(origin)
+	if origin == "" {
+		return false
+	}
+	for _, trusted := range p.TrustedOrigins {
+		if NormalizeOrigin(trusted) == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// IsLens reports whether origin is a plane backend's, and so may make
+// requests without credentials.
+func (p *CORSPolicy) IsLens(origin string) bool {
+	if p.LensDomain == "" {
+		return false
+	}
+	u, err := url.Parse(NormalizeOrigin(origin))
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if port := u.Port(); port != "" && port != p.LensPort {
+		return false
+	}
+	backend := strings.TrimSuffix(u.Hostname(), "."+strings.ToLower(p.LensDomain))
+	return backend != u.Hostname() && backend != "" && !strings.Contains(backend, ".")
+}
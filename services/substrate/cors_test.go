@@ -0,0 +1,42 @@
+package substrate
+
+import "testing"
+
+func TestCORSPolicy(t *testing.T) {
+	p := &CORSPolicy{
+		TrustedOrigins: []string{"https://substrate.example.com", "http://localhost:5173/"},
+		LensDomain:     "my.local-ip.co",
+		LensPort:       "2281",
+	}
+
+	for _, c := range []struct {
+		origin  string
+		trusted bool
+		lens    bool
+	}{
+		{"https://substrate.example.com", true, false},
+		{"HTTPS://Substrate.Example.com", true, false},
+		{"http://localhost:5173", true, false},
+		{"https://substrate.example.com.evil.com", false, false},
+		{"http://substrate.example.com", false, false},
+		{"https://abc123.my.local-ip.co", false, true},
+		{"https://abc123.my.local-ip.co:2281", false, true},
+		{"https://abc123.my.local-ip.co:8080", false, false},
+		{"https://a.b.my.local-ip.co", false, false},
+		{"https://my.local-ip.co", false, false},
+		{"https://evilmy.local-ip.co", false, false},
+		{"null", false, false},
+		{"", false, false},
+	} {
+		if got := p.IsTrusted(c.origin); got != c.trusted {
+			t.Errorf("expected IsTrusted(%q) to be %v", c.origin, c.trusted)
+		}
+		if got := p.IsLens(c.origin); got != c.lens {
+			t.Errorf("expected IsLens(%q) to be %v", c.origin, c.lens)
+		}
+	}
+
+	if (&CORSPolicy{}).IsLens("https://abc123.my.local-ip.co") {
+		t.Errorf("expected no lens origins without a lens domain")
+	}
+}
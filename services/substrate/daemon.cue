@@ -53,8 +53,41 @@ environment: {
 
   EXTERNAL_UI_HANDLER ?: string
 
-  // TAILSCALE_HOSTNAME ?: string
-  // TAILSCALE_STATE_DIR ?: string
+  SUBSTRATE_CORS_ORIGINS ?: string
+  SUBSTRATE_CORS_LENS_DOMAIN ?: string
+  SUBSTRATE_CORS_DEBUG ?: string
+
+  OTEL_EXPORTER_OTLP_ENDPOINT ?: string
+  OTEL_SERVICE_NAME ?: string
+
+  SUBSTRATE_SPAWN_MAX_CONCURRENT ?: string
+  SUBSTRATE_SPAWN_MAX_CONCURRENT_PER_USER ?: string
+  SUBSTRATE_SPAWN_MAX_QUEUED ?: string
+  SUBSTRATE_SPAWN_RETRY_AFTER ?: string
+  SUBSTRATE_SPAWN_TOKEN_TTL ?: string
+  SUBSTRATE_AUDITORS ?: string
+  SUBSTRATE_ADMINS ?: string
+
+  SUBSTRATE_EVENTS_NATS_SUBJECT ?: string
+
+  // "header", "tailscale", "dev", or a comma-separated list of "github", "oidc" and "password"
+  SUBSTRATE_AUTH ?: string
+  SUBSTRATE_AUTH_HEADER ?: string
+  SUBSTRATE_AUTH_TRUSTED_PROXIES ?: string
+  SUBSTRATE_PASSWORD_FILE ?: string
+  SUBSTRATE_SESSION_TTL ?: string
+  SUBSTRATE_SESSION_ROTATE_AFTER ?: string
+  OIDC_ISSUER ?: string
+  OIDC_CLIENT_ID ?: string
+  OIDC_CLIENT_SECRET ?: string
+  OIDC_SCOPES ?: string
+  OIDC_USERNAME_CLAIMS ?: string
+  SUBSTRATE_DEV_USER ?: string
+
+  TAILSCALE_AUTHKEY ?: string
+  TAILSCALE_HOSTNAME ?: string
+  TAILSCALE_STATE_DIR ?: string
+  SUBSTRATE_TAILSCALE_USERS ?: string
 
   // RUST_LOG: string | *"info,sqlx=warn,rustls=off"
   // RUST_LOG: "info,bollard::docker=debug,sqlx=warn,rustls=off"
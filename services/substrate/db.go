@@ -2,9 +2,9 @@ package substrate
 
 import (
 	"context"
-	"database/sql"
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/url"
 	"strings"
 	"time"
@@ -13,43 +13,37 @@ import (
 	"github.com/ajbouh/substrate/pkg/substratefs"
 )
 
-func CreateTables(ctx context.Context, db *sql.DB) error {
-	tables := []string{
-		createActivitiesTable,
-		createEventsTable,
-		createSpacesTable,
-		createCollectionMembershipsTable,
-	}
-
-	for _, table := range tables {
-		_, err := db.ExecContext(ctx, table)
-		if err != nil {
-			return wrapSQLError(err, table)
-		}
-	}
-	return nil
-}
-
 const activitiesTable = "activities"
 
-// DROP TABLE IF EXISTS "activities";
-const createActivitiesTable = `CREATE TABLE IF NOT EXISTS "activities" (activityspec TEXT, owner TEXT, created_at_us INTEGER, lens TEXT, PRIMARY KEY (activityspec));`
-
 type ActivityWhere struct {
 	ActivitySpec *string `json:"activityspec,omitempty"`
 	Lens         *string `json:"lens,omitempty"`
+
+	// VisibleTo selects activities whose spaces the given user may all read.
+	VisibleTo *string `json:"-"`
 }
 
 type ActivityListRequest struct {
 	ActivityWhere
 	Limit   *Limit
 	OrderBy *OrderBy
+	Cursor  *Cursor
 }
 
 type Activity struct {
 	ActivitySpec string    `json:"activityspec"`
 	CreatedAt    time.Time `json:"created_at"`
 	Lens         string    `json:"lens"`
+
+	Reactions    map[string]int `json:"reactions"`
+	CommentCount int            `json:"comment_count"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this activity in the list it came from.
+func (a *Activity) Cursor() *Cursor {
+	return a.cursor
 }
 
 func (s *Substrate) WriteActivity(ctx context.Context, Activity *Activity) error {
@@ -69,6 +63,11 @@ func (q *ActivityWhere) AppendWhere(query *Query) bool {
 		query.WhereValues = append(query.WhereValues, *q.ActivitySpec)
 		modified = true
 	}
+	if q.VisibleTo != nil {
+		query.Where = append(query.Where, activityVisibleTo)
+		query.WhereValues = append(query.WhereValues, *q.VisibleTo, *q.VisibleTo)
+		modified = true
+	}
 
 	if modified {
 		query.FromTablesNamed[activitiesTable] = activitiesTable
@@ -78,12 +77,16 @@ func (q *ActivityWhere) AppendWhere(query *Query) bool {
 
 func (s *Substrate) ListActivities(ctx context.Context, request *ActivityListRequest) ([]*Activity, error) {
 	query := &Query{
-		Select:          []string{`activityspec`, `created_at_us`, `lens`},
+		Select:          append([]string{`activityspec`, `created_at_us`, `lens`}, feedbackCountSelects("activityspec", activitiesTable+".activityspec")...),
 		FromTablesNamed: map[string]string{activitiesTable: activitiesTable},
 		WherePredicates: map[string]bool{},
 		Limit:           request.Limit,
 		OrderBy:         request.OrderBy,
-		OrderByColumn:   activitiesTable + ".created_at_us",
+		OrderByColumns:  []string{activitiesTable + ".created_at_us", activitiesTable + ".activityspec"},
+		After:           request.Cursor,
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
 	}
 
 	request.AppendWhere(query)
@@ -103,11 +106,17 @@ func (s *Substrate) ListActivities(ctx context.Context, request *ActivityListReq
 
 		var o Activity
 		var createdAt int64
-		err := rows.Scan(&o.ActivitySpec, &createdAt, &o.Lens)
+		var reactionCounts []byte
+		err := rows.Scan(&o.ActivitySpec, &createdAt, &o.Lens, &reactionCounts, &o.CommentCount)
+		if err != nil {
+			return nil, err
+		}
+		o.Reactions, err = scanReactionCounts(reactionCounts)
 		if err != nil {
 			return nil, err
 		}
 		o.CreatedAt = time.UnixMicro(createdAt)
+		o.cursor = newCursor(createdAt, o.ActivitySpec)
 
 		results = append(results, &o)
 	}
@@ -118,8 +127,8 @@ func (s *Substrate) ListActivities(ctx context.Context, request *ActivityListReq
 type SpaceListingPatch struct {
 	ID string `json:"id"`
 
-	Owner *string `json:"owner,omitempty"`
-	Alias *string `json:"alias,omitempty"`
+	Alias     *string `json:"alias,omitempty"`
+	IsPrivate *bool   `json:"private,omitempty"`
 }
 
 type SpaceWhere struct {
@@ -129,16 +138,36 @@ type SpaceWhere struct {
 	ForkedFromID  *string
 	ForkedFromRef *string
 
+	// Deleted selects spaces that are (or aren't) in the trash.
+	Deleted *bool
+
+	IsPrivate *bool
+
+	// VisibleTo selects spaces the given user may read.
+	VisibleTo *string
+
+	CreatedAfter *time.Time
+
 	CollectionMembership *CollectionMembershipWhere
+
+	// HasMemberships selects spaces with a matching membership for each
+	// entry. Unlike CollectionMembership it doesn't join, so each space
+	// appears once.
+	HasMemberships []*CollectionMembershipWhere
 }
 
 type SpaceListQuery struct {
 	SpaceWhere
 
+	// ListSpaces leaves out spaces in the trash unless IncludeDeleted is set
+	// or SpaceWhere.Deleted says otherwise.
+	IncludeDeleted bool
+
 	SelectNestedCollections *CollectionMembershipWhere
 
 	Limit   *Limit
 	OrderBy *OrderBy
+	Cursor  *Cursor
 }
 
 type Space struct {
@@ -146,12 +175,23 @@ type Space struct {
 	Alias string `json:"alias"`
 	ID    string `json:"space"`
 
-	CreatedAt     time.Time `json:"created_at"`
-	ForkedFromID  *string   `json:"forked_from_id,omitempty"`
-	ForkedFromRef *string   `json:"forked_from_ref,omitempty"`
-
+	CreatedAt     time.Time  `json:"created_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	ForkedFromID  *string    `json:"forked_from_id,omitempty"`
+	ForkedFromRef *string    `json:"forked_from_ref,omitempty"`
+	IsPrivate     bool       `json:"private"`
 
 	Memberships []*SpaceCollectionMembership `json:"memberships"`
+
+	Reactions    map[string]int `json:"reactions"`
+	CommentCount int            `json:"comment_count"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this space in the list it came from.
+func (s *Space) Cursor() *Cursor {
+	return s.cursor
 }
 
 type SpaceCollectionMembership struct {
@@ -166,7 +206,6 @@ type SpaceCollectionMembership struct {
 	IsPublic   bool           `json:"public"`
 }
 
-
 type EventWhere struct {
 	ActivitySpec *string `json:"viewspec,omitempty"`
 	User         *string `json:"user,omitempty"`
@@ -178,6 +217,7 @@ type EventListRequest struct {
 	EventWhere
 	Limit   *Limit
 	OrderBy *OrderBy
+	Cursor  *Cursor
 }
 
 type JamsocketSpawnEvent struct {
@@ -188,19 +228,28 @@ type JamsocketSpawnEvent struct {
 type Event struct {
 	JamsocketSpawn  *JamsocketSpawnEvent   `json:"jamsocket_spawn,omitempty"`
 	JamsocketStatus *jamsocket.StatusEvent `json:"jamsocket_status,omitempty"`
+	Admission       *SpawnAdmissionEvent   `json:"admission,omitempty"`
+
+	Space                *Space                `json:"space,omitempty"`
+	CollectionMembership *CollectionMembership `json:"collection_membership,omitempty"`
 
-	ID           string `json:"id"`
-	ActivitySpec string `json:"viewspec,omitempty"`
-	User      string    `json:"user"`
-	Lens      string    `json:"lens"`
-	Type      string    `json:"type"`
-	Timestamp time.Time `json:"ts"`
+	ID           string    `json:"id"`
+	RequestID    string    `json:"request_id,omitempty"`
+	ActivitySpec string    `json:"viewspec,omitempty"`
+	User         string    `json:"user"`
+	Lens         string    `json:"lens"`
+	Type         string    `json:"type"`
+	Timestamp    time.Time `json:"ts"`
+
+	cursor *Cursor
 }
 
-const eventsTable = "events"
+// Cursor returns the position of this event in the list it came from.
+func (e *Event) Cursor() *Cursor {
+	return e.cursor
+}
 
-// DROP TABLE IF EXISTS "events";
-const createEventsTable = `CREATE TABLE IF NOT EXISTS "events" (id TEXT, viewspec TEXT, ts TEXT, type TEXT, user TEXT, lens TEXT, event TEXT, PRIMARY KEY (id));`
+const eventsTable = "events"
 
 func (s *Substrate) WriteEvent(ctx context.Context, event *Event) error {
 	b, err := json.Marshal(event)
@@ -208,8 +257,14 @@ func (s *Substrate) WriteEvent(ctx context.Context, event *Event) error {
 		return err
 	}
 
-	return s.dbExecContext(ctx, `INSERT INTO "events" (id, viewspec, ts, type, user, lens, event) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+	err = s.dbExecContext(ctx, `INSERT INTO "events" (id, viewspec, ts, type, user, lens, event) VALUES (?, ?, ?, ?, ?, ?, ?)`,
 		event.ID, event.ActivitySpec, event.Timestamp, event.Type, event.User, event.Lens, string(b))
+	if err != nil {
+		return err
+	}
+
+	s.publishEvent(ctx, event)
+	return nil
 }
 
 func (q *EventWhere) AppendWhere(query *Query) bool {
@@ -243,12 +298,16 @@ func (q *EventWhere) AppendWhere(query *Query) bool {
 
 func (s *Substrate) ListEvents(ctx context.Context, request *EventListRequest) ([]*Event, error) {
 	query := &Query{
-		Select:          []string{`event`},
+		Select:          []string{`event`, eventsTable + `.ts`, eventsTable + `.id`},
 		FromTablesNamed: map[string]string{eventsTable: eventsTable},
 		WherePredicates: map[string]bool{},
 		Limit:           request.Limit,
 		OrderBy:         request.OrderBy,
-		OrderByColumn:   eventsTable + ".ts",
+		OrderByColumns:  []string{eventsTable + ".ts", eventsTable + ".id"},
+		After:           request.Cursor,
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
 	}
 
 	request.AppendWhere(query)
@@ -266,7 +325,8 @@ func (s *Substrate) ListEvents(ctx context.Context, request *EventListRequest) (
 	results := []*Event{}
 	for rows.Next() {
 		var b []byte
-		err := rows.Scan(&b)
+		var ts, id string
+		err := rows.Scan(&b, &ts, &id)
 		if err != nil {
 			return nil, err
 		}
@@ -275,12 +335,17 @@ func (s *Substrate) ListEvents(ctx context.Context, request *EventListRequest) (
 		if err != nil {
 			return nil, err
 		}
+		o.cursor = newCursor(ts, id)
 		results = append(results, &o)
 	}
 
 	return results, rows.Err()
 }
 
+// SpawnResult reconstructs the result of a spawn event. Events never include the
+// backend's bearer token, and substrate doesn't keep it, so a backend that
+// requires one (see BackendRequiresBearerToken) can only be reached through
+// the gateway entry it was spawned for.
 func (e *Event) SpawnResult() (*SpawnResult, error) {
 	asr, err := ParseActivitySpecRequest(e.ActivitySpec, false)
 	if err != nil {
@@ -301,21 +366,72 @@ func (e *Event) SpawnResult() (*SpawnResult, error) {
 		Name:         e.JamsocketSpawn.Response.Name,
 		ActivitySpec: e.ActivitySpec,
 
-		urlJoiner: MakeJoiner(u, e.JamsocketSpawn.Response.BearerToken),
+		urlJoiner: MakeJoiner(u, nil),
 		pathURL:   pathURL,
 
-		BackendURL:  e.JamsocketSpawn.Response.URL,
-		Path:        asr.Path,
-		BearerToken: e.JamsocketSpawn.Response.BearerToken,
+		BackendURL: e.JamsocketSpawn.Response.URL,
+		Path:       asr.Path,
 	}, nil
 }
 
+// Bearer tokens live apart from events, in backend_tokens, and only as hashes,
+// so they are never returned by the API or found in the database.
+func (s *Substrate) WriteBackendBearerToken(ctx context.Context, backend, token string) error {
+	return s.dbExecContext(ctx, `INSERT INTO "backend_tokens" (backend, token_hash) VALUES (?, ?) ON CONFLICT DO UPDATE SET token_hash=excluded.token_hash`,
+		backend, hashAPIToken(token))
+}
+
+// BackendRequiresBearerToken reports whether backend was spawned with a bearer
+// token.
+func (s *Substrate) BackendRequiresBearerToken(ctx context.Context, backend string) (bool, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT 1 FROM "backend_tokens" WHERE backend = ?`, backend)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	return rows.Next(), rows.Err()
+}
+
+// DeleteBackendBearerToken forgets backend's token, once the backend is gone.
+func (s *Substrate) DeleteBackendBearerToken(ctx context.Context, backend string) error {
+	return s.dbExecContext(ctx, `DELETE FROM "backend_tokens" WHERE backend = ?`, backend)
+}
+
 const spacesTable = "spaces"
-const createSpacesTable = `CREATE TABLE IF NOT EXISTS "spaces" (id TEXT, owner TEXT, alias TEXT, created_at_us INTEGER, deleted_at_us TEXT, initial_lens TEXT, forked_from_id TEXT, forked_from_ref TEXT, PRIMARY KEY (id), FOREIGN KEY (forked_from_id) REFERENCES spaces(id));`
 
 func (s *Substrate) WriteSpace(ctx context.Context, space *Space) error {
-	return s.dbExecContext(ctx, `INSERT INTO "spaces" (id, owner, alias, created_at_us, forked_from_id, forked_from_ref) VALUES (?, ?, ?, ?, ?, ?)`,
-		space.ID, space.Owner, space.Alias, space.CreatedAt.UnixMicro(), space.ForkedFromID, space.ForkedFromRef)
+	// Forks of a private space start out private too.
+	if space.ForkedFromID != nil && !space.IsPrivate {
+		isPrivate, err := s.spaceIsPrivate(ctx, *space.ForkedFromID)
+		if err != nil {
+			return err
+		}
+		space.IsPrivate = isPrivate
+	}
+
+	err := s.dbExecContext(ctx, `INSERT INTO "spaces" (id, owner, alias, created_at_us, forked_from_id, forked_from_ref, is_private) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		space.ID, space.Owner, space.Alias, space.CreatedAt.UnixMicro(), space.ForkedFromID, space.ForkedFromRef, space.IsPrivate)
+	if err != nil {
+		return err
+	}
+
+	s.writeChangeEvent(ctx, &Event{
+		Type:  "space-created",
+		User:  space.Owner,
+		Space: space,
+	})
+	if space.ForkedFromID != nil {
+		s.notifySpaceOwner(ctx, *space.ForkedFromID, &Notification{
+			Type:   NotificationTypeSpaceForked,
+			Actor:  space.Owner,
+			ForkID: space.ID,
+		})
+	}
+	return nil
 }
 
 func (w *CollectionMembershipWhere) AppendWhere(query *Query) bool {
@@ -380,6 +496,18 @@ func (w *CollectionMembershipWhere) AppendWhere(query *Query) bool {
 		modified = true
 	}
 
+	for k, v := range w.Attributes {
+		query.Where = append(query.Where, "json_extract("+collectionMembershipsTable+".membership, ?) = ?")
+		query.WhereValues = append(query.WhereValues, `$.attributes."`+k+`"`, v)
+		modified = true
+	}
+
+	if w.VisibleTo != nil {
+		query.Where = append(query.Where, "("+collectionMembershipsTable+".is_public OR "+collectionMembershipsTable+".collection_owner = ?)")
+		query.WhereValues = append(query.WhereValues, *w.VisibleTo)
+		modified = true
+	}
+
 	if modified {
 		query.FromTablesNamed[collectionMembershipsTable] = collectionMembershipsTable
 	}
@@ -410,6 +538,41 @@ func (w *SpaceWhere) AppendWhere(query *Query) bool {
 		query.Where = append(query.Where, spacesTable+".forked_from_ref = ?")
 		query.WhereValues = append(query.WhereValues, *w.ForkedFromRef)
 	}
+	if w.Deleted != nil {
+		if *w.Deleted {
+			query.Where = append(query.Where, spacesTable+".deleted_at_us IS NOT NULL")
+		} else {
+			query.Where = append(query.Where, spacesTable+".deleted_at_us IS NULL")
+		}
+	}
+
+	if w.IsPrivate != nil {
+		query.Where = append(query.Where, spacesTable+".is_private = ?")
+		query.WhereValues = append(query.WhereValues, *w.IsPrivate)
+	}
+	if w.VisibleTo != nil {
+		query.Where = append(query.Where, spaceVisibleTo)
+		query.WhereValues = append(query.WhereValues, *w.VisibleTo, *w.VisibleTo)
+	}
+
+	if w.CreatedAfter != nil {
+		query.Where = append(query.Where, spacesTable+".created_at_us > ?")
+		query.WhereValues = append(query.WhereValues, w.CreatedAfter.UnixMicro())
+	}
+
+	for _, membership := range w.HasMemberships {
+		exists := &Query{
+			Select:          []string{"1"},
+			FromTablesNamed: map[string]string{collectionMembershipsTable: collectionMembershipsTable},
+			WherePredicates: map[string]bool{
+				collectionMembershipsTable + ".space_id = " + spacesTable + ".id": true,
+			},
+		}
+		membership.AppendWhere(exists)
+		existsQuery, existsValues := exists.Render()
+		query.Where = append(query.Where, "EXISTS ("+existsQuery+")")
+		query.WhereValues = append(query.WhereValues, existsValues...)
+	}
 
 	if w.CollectionMembership != nil {
 		if w.CollectionMembership.AppendWhere(query) {
@@ -428,36 +591,145 @@ func (w *SpaceWhere) AppendWhere(query *Query) bool {
 func (s *Substrate) PatchSpace(ctx context.Context, patch *SpaceListingPatch) error {
 	set := []string{}
 	values := []any{}
-	if patch.Owner != nil {
-		set = append(set, `owner = ?`)
-		values = append(values, *patch.Owner)
-	}
 	if patch.Alias != nil {
 		// TODO need to update substratefs entry too!
 		set = append(set, `alias = ?`)
 		values = append(values, *patch.Alias)
 	}
+	if patch.IsPrivate != nil {
+		set = append(set, `is_private = ?`)
+		values = append(values, *patch.IsPrivate)
+	}
+	if len(set) == 0 {
+		return nil
+	}
 	query := []string{
 		`UPDATE "spaces" SET`, strings.Join(set, ", "), "WHERE id = ?",
 	}
 	values = append(values, patch.ID)
 
-	return s.dbExecContext(ctx, strings.Join(query, ""), values...)
+	return s.dbExecContext(ctx, strings.Join(query, " "), values...)
+}
+
+// SpaceTrashedError is returned when spawning against a space that's in the
+// trash. The space must be restored or purged first.
+type SpaceTrashedError struct {
+	SpaceID string
+}
+
+func (e *SpaceTrashedError) Error() string {
+	return fmt.Sprintf("space %s is in the trash; restore it to use it", e.SpaceID)
+}
+
+func (s *Substrate) setSpaceDeletedAt(ctx context.Context, deletedAt *int64, request *SpaceWhere) error {
+	query := &Query{
+		Preamble:        []string{`UPDATE "spaces" SET deleted_at_us = ?`},
+		FromTablesNamed: map[string]string{},
+		WherePredicates: map[string]bool{},
+	}
+	if request.AppendWhere(query) {
+		return fmt.Errorf("can't filter space updates by collection membership")
+	}
+	query.FromTablesNamed = nil
+
+	q, values := query.Render()
+	return s.dbExecContext(ctx, q, append([]any{deletedAt}, values...)...)
 }
 
+// DeleteSpace moves the matching spaces to the trash. They're hidden from
+// ListSpaces and can't be spawned against until they're restored.
 func (s *Substrate) DeleteSpace(ctx context.Context, request *SpaceWhere) error {
+	now := time.Now().UnixMicro()
+	return s.setSpaceDeletedAt(ctx, &now, request)
+}
+
+// RestoreSpace takes the matching spaces back out of the trash.
+func (s *Substrate) RestoreSpace(ctx context.Context, request *SpaceWhere) error {
+	return s.setSpaceDeletedAt(ctx, nil, request)
+}
+
+// PurgeSpace permanently removes the matching spaces and their collection
+// memberships.
+func (s *Substrate) PurgeSpace(ctx context.Context, request *SpaceWhere) error {
 	query := &Query{
-		Preamble:        []string{`DELETE`},
+		Select:          []string{spacesTable + ".id"},
 		FromTablesNamed: map[string]string{spacesTable: spacesTable},
 		WherePredicates: map[string]bool{},
 	}
 	request.AppendWhere(query)
+	ids, values := query.Render()
 
-	q, values := query.Render()
-	return s.dbExecContext(ctx, q, values...)
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Everything that refers to the spaces goes first, since the spaces rows
+	// are what select it. Forks lose their link to the purged space, so
+	// lineage starts from them instead.
+	statements := []string{}
+	for _, table := range []string{collectionMembershipsTable, reactionsTable, commentsTable, spaceCollaboratorsTable, notificationsTable} {
+		statements = append(statements, `DELETE FROM "`+table+`" WHERE space_id IN (`+ids+`)`)
+	}
+	statements = append(statements,
+		`UPDATE "spaces" SET forked_from_id = NULL WHERE forked_from_id IN (`+ids+`)`,
+		`DELETE FROM "spaces" WHERE id IN (`+ids+`)`,
+	)
+	for _, q := range statements {
+		if _, err := tx.ExecContext(ctx, q, values...); err != nil {
+			return wrapSQLError(err, q, values...)
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *Substrate) ResolveConcreteLensSpawnParameterRequests(ctx context.Context, lensName string, request LensSpawnParameterRequests, forceReadOnly bool) ([]*Space, LensSpawnParameters, error) {
+// CheckSpaceViewRequest returns a SpaceTrashedError if v refers to a space,
+// directly or as the base of a fork, that is in the trash.
+func (s *Substrate) CheckSpaceViewRequest(ctx context.Context, v *SpaceViewRequest) error {
+	spaceIDs := []string{}
+	if v.SpaceID != "" && v.SpaceID != "scratch" {
+		spaceIDs = append(spaceIDs, v.SpaceID)
+	}
+	if v.SpaceBaseRef != nil && *v.SpaceBaseRef != "scratch" {
+		base, err := substratefs.ParseRef(*v.SpaceBaseRef)
+		if err != nil {
+			return fmt.Errorf("error parsing base=%s err=%s", *v.SpaceBaseRef, err)
+		}
+		if base != nil && base.TipRef != nil {
+			spaceIDs = append(spaceIDs, base.TipRef.SpaceID.String())
+		}
+		if base != nil && base.CheckpointRef != nil {
+			spaceIDs = append(spaceIDs, base.CheckpointRef.SpaceID.String())
+		}
+	}
+
+	for _, spaceID := range spaceIDs {
+		spaceID := spaceID
+		trashed, err := s.ListSpaces(ctx, &SpaceListQuery{
+			Limit: &Limit{1},
+			SpaceWhere: SpaceWhere{
+				ID:      &spaceID,
+				Deleted: boolPtr(true),
+			},
+		})
+		if err != nil {
+			return err
+		}
+		if len(trashed) > 0 {
+			return &SpaceTrashedError{SpaceID: spaceID}
+		}
+	}
+
+	return nil
+}
+
+// ResolveConcreteLensSpawnParameterRequests resolves the spaces in request as
+// user would see them. Spaces user may only view are resolved read-only.
+func (s *Substrate) ResolveConcreteLensSpawnParameterRequests(ctx context.Context, user, lensName string, request LensSpawnParameterRequests, forceReadOnly bool) ([]*Space, LensSpawnParameters, error) {
 	lens := s.Lenses[lensName]
 	if lens == nil {
 		lenses := []string{}
@@ -482,6 +754,14 @@ func (s *Substrate) ResolveConcreteLensSpawnParameterRequests(ctx context.Contex
 			if space.SpaceID == "" {
 				return nil, nil, fmt.Errorf("all space selections must have a concrete id")
 			}
+			if err := s.CheckSpaceViewRequest(ctx, space); err != nil {
+				return nil, nil, err
+			}
+			readOnly, err := s.CheckSpaceViewAccess(ctx, user, space)
+			if err != nil {
+				return nil, nil, err
+			}
+			space.ReadOnly = space.ReadOnly || readOnly
 			view, err := s.ResolveSpaceView(space, "", "")
 			if err != nil {
 				return nil, nil, err
@@ -495,6 +775,14 @@ func (s *Substrate) ResolveConcreteLensSpawnParameterRequests(ctx context.Contex
 				if m.SpaceID == "" {
 					return nil, nil, fmt.Errorf("all space selections must have a concrete id")
 				}
+				if err := s.CheckSpaceViewRequest(ctx, &m); err != nil {
+					return nil, nil, err
+				}
+				readOnly, err := s.CheckSpaceViewAccess(ctx, user, &m)
+				if err != nil {
+					return nil, nil, err
+				}
+				m.ReadOnly = m.ReadOnly || readOnly
 
 				view, err := s.ResolveSpaceView(&m, "", "")
 				if err != nil {
@@ -531,13 +819,17 @@ func (s *Substrate) ResolveConcreteLensSpawnParameterRequests(ctx context.Contex
 
 func (s *Substrate) ListSpaces(ctx context.Context, request *SpaceListQuery) ([]*Space, error) {
 	query := &Query{
-		Select:          []string{"id", "owner", "alias", "created_at_us", "forked_from_id", "forked_from_ref"},
+		Select:          append([]string{"id", "owner", "alias", "created_at_us", "deleted_at_us", "forked_from_id", "forked_from_ref", "is_private"}, feedbackCountSelects("space_id", spacesTable+".id")...),
 		FromTablesNamed: map[string]string{spacesTable: spacesTable},
 		WherePredicates: map[string]bool{},
-		OrderByColumn:   "created_at",
+		OrderByColumns:  []string{spacesTable + ".created_at_us", spacesTable + ".id"},
 		OrderBy:         request.OrderBy,
+		After:           request.Cursor,
 		Limit:           request.Limit,
 	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
 	if request.SelectNestedCollections != nil {
 		rootAlias := "root"
 		nested := &Query{
@@ -573,7 +865,11 @@ func (s *Substrate) ListSpaces(ctx context.Context, request *SpaceListQuery) ([]
 	} else {
 		query.Select = append(query.Select, "null as collections")
 	}
-	request.AppendWhere(query)
+	where := request.SpaceWhere
+	if where.Deleted == nil && !request.IncludeDeleted {
+		where.Deleted = boolPtr(false)
+	}
+	where.AppendWhere(query)
 
 	q, values := query.Render()
 
@@ -593,12 +889,23 @@ func (s *Substrate) ListSpaces(ctx context.Context, request *SpaceListQuery) ([]
 	for rows.Next() {
 		var o Space
 		var createdAt int64
+		var deletedAt *int64
+		var reactionCounts []byte
 		var collectionsJSONB []byte
-		err := rows.Scan(&o.ID, &o.Owner, &o.Alias, &createdAt, &o.ForkedFromID, &o.ForkedFromRef, &collectionsJSONB)
+		err := rows.Scan(&o.ID, &o.Owner, &o.Alias, &createdAt, &deletedAt, &o.ForkedFromID, &o.ForkedFromRef, &o.IsPrivate, &reactionCounts, &o.CommentCount, &collectionsJSONB)
+		if err != nil {
+			return nil, err
+		}
+		o.Reactions, err = scanReactionCounts(reactionCounts)
 		if err != nil {
 			return nil, err
 		}
 		o.CreatedAt = time.UnixMicro(createdAt)
+		o.cursor = newCursor(createdAt, o.ID)
+		if deletedAt != nil {
+			t := time.UnixMicro(*deletedAt)
+			o.DeletedAt = &t
+		}
 
 		if collectionsJSONB != nil {
 			// memberships := []*CollectionMembership{}
@@ -651,9 +958,6 @@ func (s *Substrate) ListSpaces(ctx context.Context, request *SpaceListQuery) ([]
 
 const collectionMembershipsTable = "collection_memberships"
 
-// DROP TABLE IF EXISTS "collection_memberships";
-const createCollectionMembershipsTable = `CREATE TABLE IF NOT EXISTS "collection_memberships" (collection_owner TEXT, collection_name TEXT, space_id TEXT, lensspec TEXT, created_at_us INTEGER, updated_at_us INTEGER, deleted_at_us INTEGER, membership TEXT, is_public INTEGER, PRIMARY KEY (collection_owner, collection_name, space_id, lensspec), FOREIGN KEY (space_id) REFERENCES space(id));`
-
 type Collection struct {
 	Owner string `json:"owner"`
 	Name  string `json:"name"`
@@ -662,10 +966,21 @@ type Collection struct {
 	Attributes map[string]any `json:"attributes"`
 	IsPublic   bool           `json:"public"`
 
+	// Query is set for smart collections, whose members are the spaces it
+	// matches.
+	Query *SpaceQuery `json:"query,omitempty"`
+
 	Root *CollectionMember `json:"-"`
 
 	// TODO make this a separate list of lenses and spaces
 	Members []*CollectionMember `json:"members"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this collection in the list it came from.
+func (c *Collection) Cursor() *Cursor {
+	return c.cursor
 }
 
 func findAndRemoveRootMember(members []*CollectionMember) (*CollectionMember, []*CollectionMember) {
@@ -692,9 +1007,20 @@ func (c *Collection) normalize() {
 	var label string
 	if c.Root != nil {
 		c.Attributes = c.Root.Attributes
+		if c.Attributes == nil {
+			c.Attributes = map[string]any{}
+		}
 		c.IsPublic = c.Root.IsPublic
 
-		label = c.Attributes["system:ui:label"].(string)
+		label, _ = c.Attributes[CollectionLabelAttribute].(string)
+
+		if q, ok := c.Attributes[CollectionQueryAttribute]; ok {
+			var err error
+			c.Query, err = parseSpaceQuery(q)
+			if err != nil {
+				log.Printf("ignoring invalid query for collection %s/%s: %s", c.Owner, c.Name, err)
+			}
+		}
 	} else {
 		c.Attributes = map[string]any{}
 
@@ -714,7 +1040,7 @@ func (c *Collection) normalize() {
 	}
 	c.Label = label
 
-	fmt.Printf("collection.normalize() %#v\n", c)
+	sortCollectionMembers(c.Members)
 }
 
 type CollectionMember struct {
@@ -724,8 +1050,16 @@ type CollectionMember struct {
 	// DeletedAt time.Time
 	// UpdatedAt time.Time
 	IsPublic bool `json:"public"`
+	Position *int `json:"position,omitempty"`
 
 	Attributes map[string]any `json:"attributes,omitempty"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this member in the list it came from.
+func (m *CollectionMember) Cursor() *Cursor {
+	return m.cursor
 }
 
 type CollectionMembership struct {
@@ -738,6 +1072,7 @@ type CollectionMembership struct {
 	// DeletedAt time.Time
 	// UpdatedAt time.Time
 	IsPublic bool `json:"public"`
+	Position *int `json:"position,omitempty"`
 
 	Attributes map[string]any `json:"attributes,omitempty"`
 }
@@ -754,11 +1089,18 @@ type CollectionMembershipWhere struct {
 	HasLensSpec bool
 	Lens        *string
 	LensSpec    *string
+
+	// Attributes matches memberships with all of these attribute values.
+	Attributes map[string]any
+	// VisibleTo limits memberships to public ones and those owned by the user.
+	VisibleTo *string
 }
 
 type CollectionListQuery struct {
 	CollectionMembershipWhere
-	Limit *Limit
+	Limit   *Limit
+	OrderBy *OrderBy
+	Cursor  *Cursor
 }
 
 type CollectionMembershipListQuery struct {
@@ -767,14 +1109,38 @@ type CollectionMembershipListQuery struct {
 	OrderBy *OrderBy
 }
 
+// ListCollections lists collections and their members. The members of smart
+// collections are the results of their queries.
 func (s *Substrate) ListCollections(ctx context.Context, request *CollectionListQuery) ([]*Collection, error) {
+	collections, err := s.listCollections(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	// This takes the lock again, so it has to wait until listCollections is done.
+	for _, c := range collections {
+		err := s.resolveSmartCollection(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return collections, nil
+}
+
+func (s *Substrate) listCollections(ctx context.Context, request *CollectionListQuery) ([]*Collection, error) {
 	query := &Query{
 		Preamble:        []string{`SELECT DISTINCT collection_memberships.collection_owner, collection_memberships.collection_name, json_group_array(json(collection_memberships.membership))`},
 		FromTablesNamed: map[string]string{collectionMembershipsTable: collectionMembershipsTable},
 		WherePredicates: map[string]bool{},
 		GroupBy:         []string{collectionMembershipsTable + ".collection_owner", collectionMembershipsTable + ".collection_name"},
+		OrderByColumns:  []string{collectionMembershipsTable + ".collection_owner", collectionMembershipsTable + ".collection_name"},
+		OrderBy:         request.OrderBy,
+		After:           request.Cursor,
 		Limit:           request.Limit,
 	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
 	request.AppendWhere(query)
 
 	q, values := query.Render()
@@ -798,6 +1164,7 @@ func (s *Substrate) ListCollections(ctx context.Context, request *CollectionList
 		if err != nil {
 			return nil, err
 		}
+		o.cursor = newCursor(o.Owner, o.Name)
 		if collectionsJSONB != nil {
 			err = json.Unmarshal(collectionsJSONB, &o.Members)
 			if err != nil {
@@ -820,8 +1187,27 @@ func (s *Substrate) WriteCollectionMembership(ctx context.Context, membership *C
 		return err
 	}
 
-	return s.dbExecContext(ctx, `INSERT INTO "collection_memberships" (collection_owner, collection_name, space_id, lensspec, created_at_us, is_public, membership) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO UPDATE SET collection_owner=excluded.collection_owner, collection_name=excluded.collection_name, space_id=excluded.space_id, lensspec=excluded.lensspec, is_public=excluded.is_public, membership=excluded.membership`,
+	err = s.dbExecContext(ctx, `INSERT INTO "collection_memberships" (collection_owner, collection_name, space_id, lensspec, created_at_us, is_public, membership) VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT DO UPDATE SET collection_owner=excluded.collection_owner, collection_name=excluded.collection_name, space_id=excluded.space_id, lensspec=excluded.lensspec, is_public=excluded.is_public, membership=CASE WHEN json_extract(excluded.membership, '$.position') IS NULL THEN json_set(excluded.membership, '$.position', json_extract(collection_memberships.membership, '$.position')) ELSE excluded.membership END`,
 		membership.Owner, membership.Name, membership.SpaceID, membership.LensSpec, membership.CreatedAt.UnixMicro(), membership.IsPublic, string(b))
+	if err != nil {
+		return err
+	}
+
+	s.writeChangeEvent(ctx, &Event{
+		Type:                 "collection-membership-written",
+		User:                 membership.Owner,
+		CollectionMembership: membership,
+	})
+	// System collections are bookkeeping, not someone choosing the space.
+	if membership.SpaceID != "" && membership.Owner != "system" {
+		s.notifySpaceOwner(ctx, membership.SpaceID, &Notification{
+			Type:            NotificationTypeSpaceCollected,
+			Actor:           membership.Owner,
+			CollectionOwner: membership.Owner,
+			CollectionName:  membership.Name,
+		})
+	}
+	return nil
 }
 
 func (s *Substrate) DeleteCollectionMembership(ctx context.Context, request *CollectionMembershipWhere) error {
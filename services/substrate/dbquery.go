@@ -1,8 +1,11 @@
 package substrate
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"log"
 	"strings"
@@ -16,6 +19,8 @@ func wrapSQLError(err error, sql string, values ...interface{}) error {
 	return fmt.Errorf("error with sql: `%s`: (%#v): %w", sql, values, err)
 }
 
+// dbExecContext runs query, logging it. Values are left out of the log, as
+// some are secrets or their hashes.
 func (s *Substrate) dbExecContext(ctx context.Context, query string, values ...any) error {
 	s.Mu.Lock()
 	defer s.Mu.Unlock()
@@ -23,7 +28,7 @@ func (s *Substrate) dbExecContext(ctx context.Context, query string, values ...a
 	start := time.Now()
 	var err error
 	defer func() {
-		log.Printf("sql=`%s` values=%#v time=%s err=%s", query, values, time.Since(start), err)
+		log.Printf("sql=`%s` values=%d time=%s err=%s", query, len(values), time.Since(start), err)
 	}()
 
 	_, err = s.DB.ExecContext(ctx, query, values...)
@@ -38,7 +43,7 @@ func (s *Substrate) dbQueryContext(ctx context.Context, query string, values ...
 	start := time.Now()
 	var err error
 	defer func() {
-		log.Printf("sql=`%s` values=%#v time=%s err=%s", query, values, time.Since(start), err)
+		log.Printf("sql=`%s` values=%d time=%s err=%s", query, len(values), time.Since(start), err)
 	}()
 
 	r, err := s.DB.QueryContext(ctx, query, values...)
@@ -56,12 +61,81 @@ func (r *Limit) Slice() []string {
 	return nil
 }
 
-func (r *OrderBy) Slice(orderBy string) []string {
+func (r *OrderBy) Slice(orderBy []string) []string {
+	if len(orderBy) == 0 {
+		return nil
+	}
+
+	direction := "ASC"
 	if r != nil && r.Descending {
-		return []string{`ORDER BY`, orderBy, `DESC`}
+		direction = "DESC"
 	}
+	columns := make([]string, 0, len(orderBy))
+	for _, column := range orderBy {
+		columns = append(columns, column+" "+direction)
+	}
+	return []string{`ORDER BY`, strings.Join(columns, ", ")}
+}
 
-	return nil
+// Cursor is an opaque position in a list. It holds the order-by values of the
+// last row of a page; the next page starts after it.
+type Cursor struct {
+	values []any
+}
+
+func newCursor(values ...any) *Cursor {
+	return &Cursor{values: values}
+}
+
+func (c *Cursor) String() string {
+	b, _ := json.Marshal(c.values)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (c *Cursor) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	var values []any
+	if err := d.Decode(&values); err != nil {
+		return nil, fmt.Errorf("invalid cursor: %w", err)
+	}
+
+	// Keep integers as integers so they compare correctly with INTEGER columns.
+	for i, v := range values {
+		if n, ok := v.(json.Number); ok {
+			if integer, err := n.Int64(); err == nil {
+				values[i] = integer
+			} else if float, err := n.Float64(); err == nil {
+				values[i] = float
+			}
+		}
+	}
+
+	return &Cursor{values: values}, nil
+}
+
+func CursorFromPtr(s *string) (*Cursor, error) {
+	if s == nil {
+		return nil, nil
+	}
+	return ParseCursor(*s)
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func stringPtr(s string) *string {
+	return &s
 }
 
 type Limit struct {
@@ -99,9 +173,22 @@ type Query struct {
 	LeftJoin        []string
 	GroupBy         []string
 
-	Limit         *Limit
-	OrderByColumn string
-	OrderBy       *OrderBy
+	Limit *Limit
+
+	// OrderByColumns orders results in the direction of OrderBy. The columns
+	// together must be unique so the order is stable and After is exact.
+	OrderByColumns []string
+	OrderBy        *OrderBy
+
+	// After skips to the rows that come after the cursor in OrderByColumns order.
+	After *Cursor
+}
+
+func (q *Query) validate() error {
+	if q.After != nil && len(q.After.values) != len(q.OrderByColumns) {
+		return fmt.Errorf("invalid cursor for this list")
+	}
+	return nil
 }
 
 func (q *Query) Render() (string, []any) {
@@ -127,16 +214,26 @@ func (q *Query) Render() (string, []any) {
 		where = append(where, pred)
 	}
 	where = append(where, q.Where...)
+	whereValues := q.WhereValues
+	if q.After != nil && len(q.After.values) == len(q.OrderByColumns) {
+		comparison := ">"
+		if q.OrderBy != nil && q.OrderBy.Descending {
+			comparison = "<"
+		}
+		placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(q.OrderByColumns)), ", ")
+		where = append(where, "("+strings.Join(q.OrderByColumns, ", ")+") "+comparison+" ("+placeholders+")")
+		whereValues = append(append([]any{}, whereValues...), q.After.values...)
+	}
 	if len(where) > 0 {
 		all = append(all, "WHERE", strings.Join(where, " AND "))
-		values = append(values, q.WhereValues...)
+		values = append(values, whereValues...)
 	}
 
 	if len(q.GroupBy) > 0 {
 		all = append(all, "GROUP BY", strings.Join(q.GroupBy, ", "))
 	}
 
-	all = append(all, q.OrderBy.Slice(q.OrderByColumn)...)
+	all = append(all, q.OrderBy.Slice(q.OrderByColumns)...)
 	all = append(all, q.Limit.Slice()...)
 
 	return strings.Join(all, " "), values
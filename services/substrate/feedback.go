@@ -0,0 +1,338 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Reactions and comments are about either a space or an activity. Exactly one
+// of SpaceID and ActivitySpec is set on each.
+
+type Reaction struct {
+	SpaceID      string    `json:"space,omitempty"`
+	ActivitySpec string    `json:"activityspec,omitempty"`
+	Author       string    `json:"author"`
+	Reaction     string    `json:"reaction"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type ReactionWhere struct {
+	SpaceID      *string
+	ActivitySpec *string
+	Author       *string
+	Reaction     *string
+}
+
+type Comment struct {
+	ID           string     `json:"id"`
+	SpaceID      string     `json:"space,omitempty"`
+	ActivitySpec string     `json:"activityspec,omitempty"`
+	Author       string     `json:"author"`
+	ParentID     *string    `json:"parent,omitempty"`
+	Body         string     `json:"body"`
+	CreatedAt    time.Time  `json:"created_at"`
+	EditedAt     *time.Time `json:"edited_at,omitempty"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this comment in the list it came from.
+func (c *Comment) Cursor() *Cursor {
+	return c.cursor
+}
+
+type CommentWhere struct {
+	ID           *string
+	SpaceID      *string
+	ActivitySpec *string
+	Author       *string
+	ParentID     *string
+}
+
+type CommentListRequest struct {
+	CommentWhere
+	Limit   *Limit
+	OrderBy *OrderBy
+	Cursor  *Cursor
+}
+
+// CommentRevision is a body a comment had before it was edited.
+type CommentRevision struct {
+	Body       string    `json:"body"`
+	WrittenAt  time.Time `json:"written_at"`
+	ReplacedAt time.Time `json:"replaced_at"`
+}
+
+const reactionsTable = "reactions"
+const commentsTable = "comments"
+
+const maxReactionLength = 32
+const maxCommentLength = 10000
+
+// nullIfEmpty stores empty targets as NULL, so the CHECK constraint on each
+// table can tell which one is set.
+func nullIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func checkFeedbackTarget(spaceID, activitySpec string) error {
+	if (spaceID == "") == (activitySpec == "") {
+		return fmt.Errorf("must be about exactly one of a space or an activity")
+	}
+	return nil
+}
+
+// feedbackCountSelects returns columns with the reaction counts, as a JSON
+// object, and the comment count for the space or activity in column.
+func feedbackCountSelects(targetColumn, column string) []string {
+	return []string{
+		`(SELECT json_group_object(reaction, n) FROM (SELECT reaction, count(*) AS n FROM "reactions" WHERE reactions.` + targetColumn + ` = ` + column + ` GROUP BY reaction)) AS reaction_counts`,
+		`(SELECT count(*) FROM "comments" WHERE comments.` + targetColumn + ` = ` + column + `) AS comment_count`,
+	}
+}
+
+func scanReactionCounts(b []byte) (map[string]int, error) {
+	counts := map[string]int{}
+	if b == nil {
+		return counts, nil
+	}
+	err := json.Unmarshal(b, &counts)
+	return counts, err
+}
+
+func (w *ReactionWhere) AppendWhere(query *Query) bool {
+	modified := false
+	if w.SpaceID != nil {
+		query.Where = append(query.Where, reactionsTable+".space_id = ?")
+		query.WhereValues = append(query.WhereValues, *w.SpaceID)
+		modified = true
+	}
+	if w.ActivitySpec != nil {
+		query.Where = append(query.Where, reactionsTable+".activityspec = ?")
+		query.WhereValues = append(query.WhereValues, *w.ActivitySpec)
+		modified = true
+	}
+	if w.Author != nil {
+		query.Where = append(query.Where, reactionsTable+".author = ?")
+		query.WhereValues = append(query.WhereValues, *w.Author)
+		modified = true
+	}
+	if w.Reaction != nil {
+		query.Where = append(query.Where, reactionsTable+".reaction = ?")
+		query.WhereValues = append(query.WhereValues, *w.Reaction)
+		modified = true
+	}
+	return modified
+}
+
+// WriteReaction adds a reaction. Reacting the same way twice is a no-op.
+func (s *Substrate) WriteReaction(ctx context.Context, r *Reaction) error {
+	if err := checkFeedbackTarget(r.SpaceID, r.ActivitySpec); err != nil {
+		return err
+	}
+	if r.Reaction == "" || len(r.Reaction) > maxReactionLength {
+		return fmt.Errorf("reaction must be 1 to %d bytes", maxReactionLength)
+	}
+
+	return s.dbExecContext(ctx, `INSERT INTO "reactions" (space_id, activityspec, author, reaction, created_at_us) VALUES (?, ?, ?, ?, ?) ON CONFLICT DO NOTHING`,
+		nullIfEmpty(r.SpaceID), nullIfEmpty(r.ActivitySpec), r.Author, r.Reaction, r.CreatedAt.UnixMicro())
+}
+
+func (s *Substrate) DeleteReaction(ctx context.Context, request *ReactionWhere) error {
+	query := &Query{
+		Preamble:        []string{`DELETE`},
+		FromTablesNamed: map[string]string{reactionsTable: reactionsTable},
+		WherePredicates: map[string]bool{},
+	}
+	if !request.AppendWhere(query) {
+		return fmt.Errorf("refusing to delete every reaction")
+	}
+
+	q, values := query.Render()
+	return s.dbExecContext(ctx, q, values...)
+}
+
+func (s *Substrate) ListReactions(ctx context.Context, request *ReactionWhere) ([]*Reaction, error) {
+	query := &Query{
+		Select:          []string{"coalesce(space_id, '')", "coalesce(activityspec, '')", "author", "reaction", "created_at_us"},
+		FromTablesNamed: map[string]string{reactionsTable: reactionsTable},
+		WherePredicates: map[string]bool{},
+		OrderByColumns:  []string{reactionsTable + ".created_at_us", reactionsTable + ".author", reactionsTable + ".reaction"},
+	}
+	request.AppendWhere(query)
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	q, values := query.Render()
+	rows, err := s.dbQueryContext(ctx, q, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*Reaction{}
+	for rows.Next() {
+		var o Reaction
+		var createdAt int64
+		err := rows.Scan(&o.SpaceID, &o.ActivitySpec, &o.Author, &o.Reaction, &createdAt)
+		if err != nil {
+			return nil, err
+		}
+		o.CreatedAt = time.UnixMicro(createdAt)
+		results = append(results, &o)
+	}
+
+	return results, rows.Err()
+}
+
+func (w *CommentWhere) AppendWhere(query *Query) bool {
+	modified := false
+	if w.ID != nil {
+		query.Where = append(query.Where, commentsTable+".id = ?")
+		query.WhereValues = append(query.WhereValues, *w.ID)
+		modified = true
+	}
+	if w.SpaceID != nil {
+		query.Where = append(query.Where, commentsTable+".space_id = ?")
+		query.WhereValues = append(query.WhereValues, *w.SpaceID)
+		modified = true
+	}
+	if w.ActivitySpec != nil {
+		query.Where = append(query.Where, commentsTable+".activityspec = ?")
+		query.WhereValues = append(query.WhereValues, *w.ActivitySpec)
+		modified = true
+	}
+	if w.Author != nil {
+		query.Where = append(query.Where, commentsTable+".author = ?")
+		query.WhereValues = append(query.WhereValues, *w.Author)
+		modified = true
+	}
+	if w.ParentID != nil {
+		query.Where = append(query.Where, commentsTable+".parent_id = ?")
+		query.WhereValues = append(query.WhereValues, *w.ParentID)
+		modified = true
+	}
+	return modified
+}
+
+// WriteComment adds a comment. A reply must be about the same space or
+// activity as the comment it replies to.
+func (s *Substrate) WriteComment(ctx context.Context, c *Comment) error {
+	if err := checkFeedbackTarget(c.SpaceID, c.ActivitySpec); err != nil {
+		return err
+	}
+	if c.Body == "" || len(c.Body) > maxCommentLength {
+		return fmt.Errorf("comment must be 1 to %d bytes", maxCommentLength)
+	}
+
+	if c.ParentID != nil {
+		parents, err := s.ListComments(ctx, &CommentListRequest{
+			CommentWhere: CommentWhere{ID: c.ParentID},
+			Limit:        &Limit{1},
+		})
+		if err != nil {
+			return err
+		}
+		if len(parents) == 0 {
+			return fmt.Errorf("no such comment to reply to: %s", *c.ParentID)
+		}
+		if parents[0].SpaceID != c.SpaceID || parents[0].ActivitySpec != c.ActivitySpec {
+			return fmt.Errorf("reply must be about the same thing as comment %s", *c.ParentID)
+		}
+	}
+
+	return s.dbExecContext(ctx, `INSERT INTO "comments" (id, space_id, activityspec, author, parent_id, body, created_at_us) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, nullIfEmpty(c.SpaceID), nullIfEmpty(c.ActivitySpec), c.Author, c.ParentID, c.Body, c.CreatedAt.UnixMicro())
+}
+
+// EditComment replaces the body of a comment. The old body is kept as a
+// revision.
+func (s *Substrate) EditComment(ctx context.Context, id, body string, editedAt time.Time) error {
+	if body == "" || len(body) > maxCommentLength {
+		return fmt.Errorf("comment must be 1 to %d bytes", maxCommentLength)
+	}
+
+	return s.dbExecContext(ctx, `UPDATE "comments" SET body = ?, edited_at_us = ? WHERE id = ? AND body != ?`,
+		body, editedAt.UnixMicro(), id, body)
+}
+
+// ListComments returns comments oldest first by default. Replies are in the
+// same list; use ParentID to put threads together.
+func (s *Substrate) ListComments(ctx context.Context, request *CommentListRequest) ([]*Comment, error) {
+	query := &Query{
+		Select:          []string{"id", "coalesce(space_id, '')", "coalesce(activityspec, '')", "author", "parent_id", "body", "created_at_us", "edited_at_us"},
+		FromTablesNamed: map[string]string{commentsTable: commentsTable},
+		WherePredicates: map[string]bool{},
+		Limit:           request.Limit,
+		OrderBy:         request.OrderBy,
+		OrderByColumns:  []string{commentsTable + ".created_at_us", commentsTable + ".id"},
+		After:           request.Cursor,
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	request.AppendWhere(query)
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	q, values := query.Render()
+	rows, err := s.dbQueryContext(ctx, q, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*Comment{}
+	for rows.Next() {
+		var o Comment
+		var createdAt int64
+		var editedAt *int64
+		err := rows.Scan(&o.ID, &o.SpaceID, &o.ActivitySpec, &o.Author, &o.ParentID, &o.Body, &createdAt, &editedAt)
+		if err != nil {
+			return nil, err
+		}
+		o.CreatedAt = time.UnixMicro(createdAt)
+		if editedAt != nil {
+			t := time.UnixMicro(*editedAt)
+			o.EditedAt = &t
+		}
+		o.cursor = newCursor(createdAt, o.ID)
+		results = append(results, &o)
+	}
+
+	return results, rows.Err()
+}
+
+// CommentRevisions returns the earlier bodies of a comment, oldest first.
+func (s *Substrate) CommentRevisions(ctx context.Context, id string) ([]*CommentRevision, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT body, written_at_us, replaced_at_us FROM "comment_revisions" WHERE comment_id = ? ORDER BY replaced_at_us, rowid`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*CommentRevision{}
+	for rows.Next() {
+		var o CommentRevision
+		var writtenAt, replacedAt int64
+		err := rows.Scan(&o.Body, &writtenAt, &replacedAt)
+		if err != nil {
+			return nil, err
+		}
+		o.WrittenAt = time.UnixMicro(writtenAt)
+		o.ReplacedAt = time.UnixMicro(replacedAt)
+		results = append(results, &o)
+	}
+
+	return results, rows.Err()
+}
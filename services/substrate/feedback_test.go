@@ -0,0 +1,130 @@
+package substrate
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReactions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	spaceID, bob := "sp-a", "bob"
+
+	writeTestSpace(t, s, spaceID, "alice", false, 0)
+	for _, r := range []*Reaction{
+		{SpaceID: spaceID, Author: "bob", Reaction: "+1"},
+		{SpaceID: spaceID, Author: "bob", Reaction: "+1"},
+		{SpaceID: spaceID, Author: "carol", Reaction: "+1"},
+		{SpaceID: spaceID, Author: "carol", Reaction: "tada"},
+	} {
+		r.CreatedAt = time.Now()
+		if err := s.WriteReaction(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Reacting the same way twice only counts once.
+	reactions, err := s.ListReactions(ctx, &ReactionWhere{SpaceID: &spaceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 3 {
+		t.Fatalf("expected 3 reactions, got %d", len(reactions))
+	}
+
+	for _, r := range []*Reaction{
+		{Author: "bob", Reaction: "+1"},
+		{SpaceID: spaceID, ActivitySpec: "files[data=sp-a]", Author: "bob", Reaction: "+1"},
+		{SpaceID: spaceID, Author: "bob"},
+		{SpaceID: spaceID, Author: "bob", Reaction: strings.Repeat("x", maxReactionLength+1)},
+	} {
+		if err := s.WriteReaction(ctx, r); err == nil {
+			t.Errorf("expected reaction %#v to be refused", r)
+		}
+	}
+
+	if err := s.DeleteReaction(ctx, &ReactionWhere{}); err == nil {
+		t.Fatalf("expected deleting every reaction to be refused")
+	}
+	if err := s.DeleteReaction(ctx, &ReactionWhere{SpaceID: &spaceID, Author: &bob}); err != nil {
+		t.Fatal(err)
+	}
+	reactions, err = s.ListReactions(ctx, &ReactionWhere{SpaceID: &spaceID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 2 {
+		t.Fatalf("expected carol's 2 reactions to be left, got %d", len(reactions))
+	}
+}
+
+func TestCommentThreadsAndRevisions(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	spaceID := "sp-a"
+
+	writeTestSpace(t, s, spaceID, "alice", false, 0)
+	writeTestSpace(t, s, "sp-b", "alice", false, time.Second)
+
+	created := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	top := &Comment{ID: "cmt-1", SpaceID: spaceID, Author: "bob", Body: "nice", CreatedAt: created}
+	if err := s.WriteComment(ctx, top); err != nil {
+		t.Fatal(err)
+	}
+	reply := &Comment{ID: "cmt-2", SpaceID: spaceID, Author: "alice", ParentID: &top.ID, Body: "thanks", CreatedAt: created.Add(time.Second)}
+	if err := s.WriteComment(ctx, reply); err != nil {
+		t.Fatal(err)
+	}
+
+	missing := "cmt-nope"
+	for _, c := range []*Comment{
+		{ID: "cmt-3", SpaceID: "sp-b", Author: "bob", ParentID: &top.ID, Body: "elsewhere"},
+		{ID: "cmt-4", SpaceID: spaceID, Author: "bob", ParentID: &missing, Body: "to nothing"},
+		{ID: "cmt-5", SpaceID: spaceID, Author: "bob"},
+		{ID: "cmt-6", Author: "bob", Body: "about nothing"},
+	} {
+		if err := s.WriteComment(ctx, c); err == nil {
+			t.Errorf("expected comment %s to be refused", c.ID)
+		}
+	}
+
+	comments, err := s.ListComments(ctx, &CommentListRequest{CommentWhere: CommentWhere{SpaceID: &spaceID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 2 || comments[0].ID != "cmt-1" || comments[1].ParentID == nil || *comments[1].ParentID != "cmt-1" {
+		t.Fatalf("expected the comment and its reply, oldest first, got %v", comments)
+	}
+
+	// Each edit keeps the body it replaced. Saving the same body isn't an edit.
+	edited := created.Add(time.Minute)
+	for i, body := range []string{"very nice", "very nice", "very, very nice"} {
+		if err := s.EditComment(ctx, top.ID, body, edited.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.EditComment(ctx, top.ID, "", edited); err == nil {
+		t.Fatalf("expected an empty body to be refused")
+	}
+
+	revisions, err := s.CommentRevisions(ctx, top.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 || revisions[0].Body != "nice" || revisions[1].Body != "very nice" {
+		t.Fatalf("expected the 2 earlier bodies, got %v", revisions)
+	}
+	if !revisions[0].WrittenAt.Equal(created) || !revisions[0].ReplacedAt.Equal(edited) {
+		t.Fatalf("unexpected times on the first revision %#v", revisions[0])
+	}
+
+	comments, err = s.ListComments(ctx, &CommentListRequest{CommentWhere: CommentWhere{ID: &top.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comments[0].Body != "very, very nice" || comments[0].EditedAt == nil {
+		t.Fatalf("expected the latest body, marked edited, got %#v", comments[0])
+	}
+}
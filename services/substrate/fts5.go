@@ -0,0 +1,8 @@
+//go:build !sqlite_fts5
+
+package substrate
+
+// The search index needs sqlite's fts5, which go-sqlite3 only includes when
+// built with -tags sqlite_fts5. Without it, migrating would fail at startup,
+// so refuse to build instead.
+var _ = substrate_must_be_built_with_tags_sqlite_fts5
@@ -2,16 +2,20 @@ package substrate
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
 )
 
 // lazily boot machine
@@ -34,33 +38,85 @@ type AuthenticatedURLJoinerFunc func(u *url.URL, mode ProvisionerAuthenticationM
 
 type ProvisionFunc func(context.Context) (AuthenticatedURLJoinerFunc, bool, func(error), error)
 
-type doomedReadCloser struct {
-	r   io.Reader
-	err error
-}
+// DefaultMaxReplayBodyBytes is the largest request body the gateway will buffer
+// so that it can replay the request against a new backend.
+const DefaultMaxReplayBodyBytes = 1 << 20
+
+// isReplayable reports whether req may safely be sent to more than one backend.
+// Only idempotent requests with no body, or a body of known length no larger
+// than maxBodyBytes, qualify. Everything else (uploads, chunked bodies, POSTs)
+// is streamed straight through and never retried.
+func isReplayable(req *http.Request, maxBodyBytes int64) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
 
-func (d *doomedReadCloser) Close() error {
-	return nil
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return true
+	}
+
+	return req.ContentLength > 0 && req.ContentLength <= maxBodyBytes
 }
 
-func (d *doomedReadCloser) Read(b []byte) (int, error) {
-	n, err := d.r.Read(b)
-	if errors.Is(err, io.EOF) {
-		return n, d.err
+// bufferRequestBody reads req.Body into memory and sets req.GetBody so the
+// request can be replayed. req must be replayable.
+func bufferRequestBody(req *http.Request, maxBodyBytes int64) error {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		req.Body = http.NoBody
+		req.GetBody = func() (io.ReadCloser, error) {
+			return http.NoBody, nil
+		}
+		return nil
 	}
 
-	return n, nil
+	b, err := ioutil.ReadAll(io.LimitReader(req.Body, maxBodyBytes+1))
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	if int64(len(b)) > maxBodyBytes {
+		return fmt.Errorf("request body larger than %d bytes", maxBodyBytes)
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(b)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return nil
 }
 
 func newBadGatewayHandler(err error) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		if err != nil {
-			fmt.Printf("err=%s\n", err)
+			LogFromContext(req.Context()).WithError(err).Warn("bad gateway")
 		}
 		rw.WriteHeader(http.StatusBadGateway)
 	})
 }
 
+// newProvisionErrorHandler reports a failure to provision a backend. A full
+// spawn queue is reported as 429 so clients back off and retry, and a trashed
+// space as 409; anything else is a bad gateway.
+func newProvisionErrorHandler(err error, errs ...error) http.Handler {
+	var full *SpawnQueueFullError
+	if errors.As(err, &full) {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			LogFromContext(req.Context()).WithError(err).Warn("spawn rejected")
+			rw.Header().Set("Retry-After", full.RetryAfterHeader())
+			http.Error(rw, full.Error(), http.StatusTooManyRequests)
+		})
+	}
+	var trashed *SpaceTrashedError
+	if errors.As(err, &trashed) {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			http.Error(rw, trashed.Error(), http.StatusConflict)
+		})
+	}
+	return newBadGatewayHandler(join(append([]error{err}, errs...)...))
+}
+
 func provisioningRedirector(
 	provision ProvisionFunc,
 	redirector func(targetFunc AuthenticatedURLJoinerFunc) (int, string, error),
@@ -68,7 +124,7 @@ func provisioningRedirector(
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
 		targetFunc, fresh, cleanup, err := provision(req.Context())
 		if err != nil {
-			newBadGatewayHandler(err).ServeHTTP(rw, req)
+			newProvisionErrorHandler(err).ServeHTTP(rw, req)
 			return
 		}
 
@@ -87,9 +143,16 @@ func provisioningRedirector(
 	})
 }
 
+// provisioningReverseProxy proxies req to a provisioned backend. Replayable
+// requests (see isReplayable) are buffered and retried against a fresh backend
+// up to ttl times. All other requests, including WebSocket upgrades with a
+// body and chunked uploads, are streamed without buffering and are not retried.
+// If modifyResponse is set, it's applied to each response from the backend.
 func provisioningReverseProxy(
 	provision ProvisionFunc,
 	ttl int,
+	maxReplayBodyBytes int64,
+	modifyResponse func(*http.Response) error,
 	errs []error,
 ) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
@@ -99,13 +162,28 @@ func provisioningReverseProxy(
 			return
 		}
 
+		// Only buffer on the first attempt; retries already have GetBody.
+		if req.GetBody == nil && isReplayable(req, maxReplayBodyBytes) {
+			if err := bufferRequestBody(req, maxReplayBodyBytes); err != nil {
+				http.Error(rw, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		replayable := req.GetBody != nil
+
 		targetFunc, fresh, cleanup, err := provision(req.Context())
 		if err != nil {
-			errs = append([]error{err}, errs...)
-			newBadGatewayHandler(join(errs...)).ServeHTTP(rw, req)
+			newProvisionErrorHandler(err, errs...).ServeHTTP(rw, req)
 			return
 		}
 
+		ctx, span := StartSpan(req.Context(), "gateway.proxy")
+		span.SetAttribute("ttl", ttl)
+		span.SetAttribute("fresh", fresh)
+		span.SetAttribute("replayable", replayable)
+		defer span.Finish()
+		req = req.WithContext(ctx)
+
 		var originalURL url.URL = *req.URL
 
 		proxy := &httputil.ReverseProxy{
@@ -125,46 +203,48 @@ func provisioningReverseProxy(
 					req.Header.Set("User-Agent", "")
 				}
 
-				if req.GetBody == nil {
-					// Copy req.Body so we can replay it if needed!
-					if req.Body == nil {
-						req.GetBody = func() (io.ReadCloser, error) {
-							return nil, nil
-						}
-					} else {
-						b, err := ioutil.ReadAll(req.Body)
-						req.GetBody = func() (io.ReadCloser, error) {
-							if err != nil {
-								return &doomedReadCloser{bytes.NewReader(b), err}, nil
-							} else {
-								return ioutil.NopCloser(bytes.NewReader(b)), nil
-							}
-						}
-					}
-				}
-				req.Body, err = req.GetBody()
-				if err != nil {
-					req.Body = &doomedReadCloser{bytes.NewReader([]byte{}), err}
+				if req.GetBody != nil {
+					// Start from the beginning of the buffered body, in case this is a retry.
+					req.Body, _ = req.GetBody()
 				}
 
-				log.Printf("%s %s %s -> %s", req.RemoteAddr, req.Method, originalURL.String(), req.URL.String())
+				InjectTraceHeaders(req.Context(), req.Header)
+
+				LogFromContext(req.Context()).WithFields(logrus.Fields{
+					"remote":     req.RemoteAddr,
+					"method":     req.Method,
+					"url":        originalURL.String(),
+					"target":     req.URL.String(),
+					"replayable": replayable,
+				}).Debug("proxying")
 			},
 
 			// If ModifyResponse returns an error, ErrorHandler is called with its error value. If ErrorHandler is nil, its default
 			// implementation is used.
 			ModifyResponse: func(res *http.Response) error {
+				span.SetAttribute("http.status_code", res.StatusCode)
+
 				// If we see a 503, log it and return an error.
 				if res.StatusCode == 503 {
-					fmt.Printf("bad upstream status=%d target=%s url=%s fresh=%#v response=%#v\n", res.StatusCode, targetFunc, req.URL, fresh, res)
+					LogFromContext(req.Context()).WithFields(logrus.Fields{
+						"status": res.StatusCode,
+						"url":    req.URL.String(),
+						"fresh":  fresh,
+					}).Warn("bad upstream status")
 					return fmt.Errorf("bad upstream status=%d", res.StatusCode)
 				}
 
+				if modifyResponse != nil {
+					return modifyResponse(res)
+				}
 				return nil
 			},
 
 			// ErrorHandler is an optional function that handles errors reaching the backend or errors from ModifyResponse.
 			// If nil, the default is to log the provided error and return a 502 Status Bad Gateway response.
 			ErrorHandler: func(rw http.ResponseWriter, req *http.Request, err error) {
+				span.SetError(err)
+
 				ttlDecrement := 1
 				switch {
 				case errors.Is(err, context.Canceled):
@@ -176,6 +256,12 @@ func provisioningReverseProxy(
 					cleanup(err)
 				}
 
+				if !replayable {
+					// Some or all of the body may already have been sent, so we can't retry.
+					newBadGatewayHandler(join(append([]error{err}, errs...)...)).ServeHTTP(rw, req)
+					return
+				}
+
 				// Reset the URL for the request
 				req.Host = ""
 				req.URL = &originalURL
@@ -190,6 +276,8 @@ func provisioningReverseProxy(
 				provisioningReverseProxy(
 					provision,
 					nextTTL,
+					maxReplayBodyBytes,
+					modifyResponse,
 					append([]error{err}, errs...),
 				).ServeHTTP(rw, req)
 			},
@@ -198,40 +286,364 @@ func provisioningReverseProxy(
 	})
 }
 
+// ProvisionerFactory creates the ProvisionFunc for a single gateway cache entry.
+// ctx is cancelled when the entry is evicted. invalidate drops the entry early,
+// for example once its backend has reached a gone state.
+type ProvisionerFactory func(ctx context.Context, invalidate func(reason error)) ProvisionFunc
+
+type GatewayEntryWhere struct {
+	Lens    *string `json:"lens,omitempty"`
+	SpaceID *string `json:"space,omitempty"`
+}
+
+type GatewayStats struct {
+	Entries    int `json:"entries"`
+	MaxEntries int `json:"max_entries"`
+
+	TTL time.Duration `json:"ttl"`
+
+	Hits          int64 `json:"hits"`
+	Misses        int64 `json:"misses"`
+	Spawns        int64 `json:"spawns"`
+	Evictions     int64 `json:"evictions"`
+	Invalidations int64 `json:"invalidations"`
+}
+
+type gatewayEntry struct {
+	key      string
+	lens     string
+	spaceIDs []string
+
+	provision ProvisionFunc
+	cancel    context.CancelFunc
+	lastUsed  time.Time
+	element   *list.Element
+
+	// invalidated is set once the entry's backend is gone. Guarded by the
+	// gateway's mu.
+	invalidated bool
+}
+
+func (e *gatewayEntry) matches(w *GatewayEntryWhere) bool {
+	if w.Lens != nil && *w.Lens != e.lens {
+		return false
+	}
+	if w.SpaceID != nil {
+		for _, spaceID := range e.spaceIDs {
+			if spaceID == *w.SpaceID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Gateway caches provisioners by user and viewspec; see GatewayCacheKey.
+// Entries are evicted when the cache exceeds maxEntries (least recently used
+// first), when they have not been used for ttl, when their backend is gone, or
+// when explicitly flushed. Run must be running for idle entries to expire.
 type Gateway struct {
-	mu           *sync.Mutex
-	provisioners map[string]ProvisionFunc
+	// MaxReplayBodyBytes bounds the request bodies buffered for retries.
+	MaxReplayBodyBytes int64
+
+	mu *sync.Mutex
+
+	maxEntries int
+	ttl        time.Duration
+
+	entries map[string]*gatewayEntry
+	lru     *list.List
+
+	stats GatewayStats
+
+	now func() time.Time
 }
 
-func NewGateway() *Gateway {
+// NewGateway returns a Gateway. A maxEntries or ttl of zero disables that
+// eviction policy.
+func NewGateway(maxEntries int, ttl time.Duration) *Gateway {
 	return &Gateway{
-		mu:           &sync.Mutex{},
-		provisioners: map[string]ProvisionFunc{},
+		MaxReplayBodyBytes: DefaultMaxReplayBodyBytes,
+
+		mu:         &sync.Mutex{},
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[string]*gatewayEntry{},
+		lru:        list.New(),
+		now:        time.Now,
+	}
+}
+
+// maxGatewaySweepInterval bounds how long an expired entry can outlive its
+// ttl when nothing else looks at the cache.
+const maxGatewaySweepInterval = time.Minute
+
+// Run evicts expired entries as they expire, even if the gateway sits idle,
+// until ctx is done. Then it evicts every entry, so nothing the entries hold
+// on to outlives the gateway.
+func (r *Gateway) Run(ctx context.Context) {
+	defer r.Flush(ctx, &GatewayEntryWhere{})
+
+	if r.ttl <= 0 {
+		<-ctx.Done()
+		return
+	}
+
+	interval := r.ttl / 2
+	if interval > maxGatewaySweepInterval {
+		interval = maxGatewaySweepInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.sweep(ctx)
+		}
 	}
 }
 
-func (r *Gateway) ProvisionReverseProxy(cacheKey string, makeProvisioner func() ProvisionFunc) http.Handler {
+func (r *Gateway) sweep(ctx context.Context) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	fn := r.provisioners[cacheKey]
-	if fn == nil {
-		fn = makeProvisioner()
-		r.provisioners[cacheKey] = fn
+	r.evictExpired(ctx, r.now())
+}
+
+// GatewayCacheKey returns the key the gateway caches user's backend for
+// activitySpec under. A backend carries the spawn token and mount access of
+// the user it was spawned for, so users never share one, and neither do
+// read-only and read-write uses of the same activityspec.
+func GatewayCacheKey(activitySpec, user string, readOnly bool) string {
+	access := "rw"
+	if readOnly {
+		access = "ro"
 	}
+	return url.QueryEscape(user) + ":" + access + ":" + activitySpec
+}
 
-	return provisioningReverseProxy(fn, 2, nil)
+// gatewayCacheKeyActivitySpec returns the activityspec part of a key from
+// GatewayCacheKey.
+func gatewayCacheKeyActivitySpec(cacheKey string) string {
+	parts := strings.SplitN(cacheKey, ":", 3)
+	if len(parts) < 3 {
+		return cacheKey
+	}
+	return parts[2]
 }
 
-func (r *Gateway) ProvisionRedirector(cacheKey string, makeProvisioner func() ProvisionFunc, redirector func(targetFunc AuthenticatedURLJoinerFunc) (int, string, error)) http.Handler {
+// spaceIDsForCacheKey extracts every space (or fork base) mentioned in the given
+// cache key's activityspec so entries can be flushed by space.
+func spaceIDsForCacheKey(cacheKey string) (string, []string) {
+	asr, err := ParseActivitySpecRequest(gatewayCacheKeyActivitySpec(cacheKey), false)
+	if err != nil {
+		return "", nil
+	}
+
+	spaceIDs := []string{}
+	for _, param := range asr.Parameters {
+		for _, v := range param.Spaces(false) {
+			switch {
+			case v.SpaceBaseRef != nil:
+				spaceIDs = append(spaceIDs, *v.SpaceBaseRef)
+			case v.SpaceID != "":
+				spaceIDs = append(spaceIDs, v.SpaceID)
+			}
+		}
+	}
+
+	return asr.LensName, spaceIDs
+}
+
+// must hold r.mu
+func (r *Gateway) evict(e *gatewayEntry) {
+	delete(r.entries, e.key)
+	r.lru.Remove(e.element)
+	e.cancel()
+}
+
+// must hold r.mu
+func (r *Gateway) evictExpired(ctx context.Context, now time.Time) {
+	for {
+		back := r.lru.Back()
+		if back == nil {
+			return
+		}
+		e := back.Value.(*gatewayEntry)
+
+		expired := r.ttl > 0 && now.Sub(e.lastUsed) > r.ttl
+		overfull := r.maxEntries > 0 && r.lru.Len() > r.maxEntries
+		if !expired && !overfull {
+			return
+		}
+
+		LogFromContext(ctx).WithFields(logrus.Fields{
+			"key":      e.key,
+			"expired":  expired,
+			"overfull": overfull,
+		}).Info("gateway evict")
+		r.evict(e)
+		r.stats.Evictions++
+	}
+}
+
+func (r *Gateway) lookup(ctx context.Context, cacheKey string, makeProvisioner ProvisionerFactory) ProvisionFunc {
+	r.mu.Lock()
+	provision, ok := r.hitLocked(cacheKey, r.now())
+	r.mu.Unlock()
+	if ok {
+		return provision
+	}
+
+	return r.insert(ctx, cacheKey, makeProvisioner)
+}
+
+// Seed creates a cache entry for cacheKey unless there already is one. Use it
+// with MakeProvisionerFromSpawn to route a backend spawned elsewhere through
+// the gateway.
+func (r *Gateway) Seed(ctx context.Context, cacheKey string, makeProvisioner ProvisionerFactory) {
+	r.mu.Lock()
+	_, ok := r.entries[cacheKey]
+	r.mu.Unlock()
+	if ok {
+		return
+	}
+
+	r.insert(ctx, cacheKey, makeProvisioner)
+}
+
+// hitLocked returns the provisioner of the live entry for cacheKey, if there
+// is one. An expired entry is evicted.
+//
+// must hold r.mu
+func (r *Gateway) hitLocked(cacheKey string, now time.Time) (ProvisionFunc, bool) {
+	e, ok := r.entries[cacheKey]
+	if !ok {
+		return nil, false
+	}
+	if r.ttl <= 0 || now.Sub(e.lastUsed) <= r.ttl {
+		r.stats.Hits++
+		e.lastUsed = now
+		r.lru.MoveToFront(e.element)
+		return e.provision, true
+	}
+	r.evict(e)
+	r.stats.Evictions++
+	return nil, false
+}
+
+// insert makes a new entry for cacheKey. makeProvisioner may start watching a
+// backend over the network, so it's called without r.mu held, and an entry
+// someone else inserted meanwhile wins over the new one.
+func (r *Gateway) insert(ctx context.Context, cacheKey string, makeProvisioner ProvisionerFactory) ProvisionFunc {
+	entryCtx, cancel := context.WithCancel(context.Background())
+	e := &gatewayEntry{
+		key:    cacheKey,
+		cancel: cancel,
+	}
+	e.lens, e.spaceIDs = spaceIDsForCacheKey(cacheKey)
+	e.provision = makeProvisioner(entryCtx, func(reason error) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		e.invalidated = true
+		// Only remove the entry if it hasn't already been replaced.
+		if r.entries[cacheKey] != e {
+			return
+		}
+		LogFromContext(ctx).WithError(reason).WithField("key", cacheKey).Info("gateway invalidate")
+		r.evict(e)
+		r.stats.Invalidations++
+	})
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if provision, ok := r.hitLocked(cacheKey, now); ok {
+		cancel()
+		return provision
+	}
+
+	r.stats.Misses++
+
+	// The backend may already be gone before the entry was ever cached.
+	if e.invalidated {
+		cancel()
+		return e.provision
+	}
+
+	e.lastUsed = now
+	e.element = r.lru.PushFront(e)
+	r.entries[cacheKey] = e
+
+	r.evictExpired(ctx, now)
+
+	return e.provision
+}
+
+// provisioner looks up the cache entry on every call, so retries after an
+// invalidation provision a fresh backend.
+func (r *Gateway) provisioner(cacheKey string, makeProvisioner ProvisionerFactory) ProvisionFunc {
+	return func(ctx context.Context) (AuthenticatedURLJoinerFunc, bool, func(error), error) {
+		ctx, span := StartSpan(ctx, "gateway.provision")
+		defer span.Finish()
+		span.SetAttribute("cache_key", cacheKey)
+
+		joiner, fresh, cleanup, err := r.lookup(ctx, cacheKey, makeProvisioner)(ctx)
+		span.SetAttribute("fresh", fresh)
+		span.SetError(err)
+		if err == nil && fresh {
+			r.mu.Lock()
+			r.stats.Spawns++
+			r.mu.Unlock()
+		}
+		return joiner, fresh, cleanup, err
+	}
+}
+
+// ProvisionReverseProxy proxies to the backend for cacheKey, provisioning it
+// if need be. If modifyResponse is set, it's applied to each response from the
+// backend.
+func (r *Gateway) ProvisionReverseProxy(cacheKey string, makeProvisioner ProvisionerFactory, modifyResponse func(*http.Response) error) http.Handler {
+	return provisioningReverseProxy(r.provisioner(cacheKey, makeProvisioner), 2, r.MaxReplayBodyBytes, modifyResponse, nil)
+}
+
+func (r *Gateway) ProvisionRedirector(cacheKey string, makeProvisioner ProvisionerFactory, redirector func(targetFunc AuthenticatedURLJoinerFunc) (int, string, error)) http.Handler {
+	return provisioningRedirector(r.provisioner(cacheKey, makeProvisioner), redirector)
+}
+
+// Flush evicts every entry matching w and returns the number evicted.
+func (r *Gateway) Flush(ctx context.Context, w *GatewayEntryWhere) int {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	fn := r.provisioners[cacheKey]
-	if fn == nil {
-		fn = makeProvisioner()
-		r.provisioners[cacheKey] = fn
+	flushed := 0
+	for _, e := range r.entries {
+		if e.matches(w) {
+			LogFromContext(ctx).WithField("key", e.key).Info("gateway flush")
+			r.evict(e)
+			flushed++
+		}
 	}
+	r.stats.Evictions += int64(flushed)
+
+	return flushed
+}
+
+func (r *Gateway) Stats(ctx context.Context) GatewayStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.evictExpired(ctx, r.now())
 
-	return provisioningRedirector(fn, redirector)
+	stats := r.stats
+	stats.Entries = len(r.entries)
+	stats.MaxEntries = r.maxEntries
+	stats.TTL = r.ttl
+	return stats
 }
@@ -0,0 +1,388 @@
+package substrate
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testGateway returns a Gateway whose clock only moves when the test says so,
+// and a factory that records the context of every entry it makes.
+type testGateway struct {
+	*Gateway
+
+	clock       time.Time
+	contexts    map[string]context.Context
+	invalidates map[string]func(error)
+}
+
+func newTestGateway(maxEntries int, ttl time.Duration) *testGateway {
+	g := &testGateway{
+		Gateway:     NewGateway(maxEntries, ttl),
+		clock:       time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC),
+		contexts:    map[string]context.Context{},
+		invalidates: map[string]func(error){},
+	}
+	g.now = func() time.Time { return g.clock }
+	return g
+}
+
+func (g *testGateway) use(cacheKey string) {
+	g.lookup(context.Background(), cacheKey, func(ctx context.Context, invalidate func(error)) ProvisionFunc {
+		g.contexts[cacheKey] = ctx
+		g.invalidates[cacheKey] = invalidate
+		return func(context.Context) (AuthenticatedURLJoinerFunc, bool, func(error), error) {
+			return func(u *url.URL, mode ProvisionerAuthenticationMode) (*url.URL, http.Header) { return u, nil }, false, func(error) {}, nil
+		}
+	})
+}
+
+func (g *testGateway) evicted(cacheKey string) bool {
+	return g.contexts[cacheKey].Err() != nil
+}
+
+func (g *testGateway) cached(cacheKey string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	_, ok := g.entries[cacheKey]
+	return ok
+}
+
+func TestGatewayEvictsLeastRecentlyUsed(t *testing.T) {
+	g := newTestGateway(2, 0)
+	a := GatewayCacheKey("notebook[data=sp-a]", "alice", false)
+	b := GatewayCacheKey("notebook[data=sp-b]", "alice", false)
+	c := GatewayCacheKey("notebook[data=sp-c]", "alice", false)
+
+	g.use(a)
+	g.use(b)
+	g.use(a)
+	g.use(c)
+
+	if g.cached(b) || !g.evicted(b) {
+		t.Errorf("expected %s, the least recently used, to be evicted", b)
+	}
+	if !g.cached(a) || !g.cached(c) {
+		t.Errorf("expected %s and %s to stay cached", a, c)
+	}
+	if stats := g.Stats(context.Background()); stats.Entries != 2 || stats.Evictions != 1 || stats.Hits != 1 || stats.Misses != 3 {
+		t.Errorf("unexpected stats %#v", stats)
+	}
+}
+
+func TestGatewayExpiresIdleEntries(t *testing.T) {
+	g := newTestGateway(0, time.Minute)
+	a := GatewayCacheKey("notebook[data=sp-a]", "alice", false)
+	b := GatewayCacheKey("notebook[data=sp-b]", "alice", false)
+
+	g.use(a)
+	g.clock = g.clock.Add(40 * time.Second)
+	g.use(b)
+	g.clock = g.clock.Add(40 * time.Second)
+
+	// Nothing else touches the cache; the sweep alone reclaims a.
+	g.sweep(context.Background())
+	if g.cached(a) || !g.evicted(a) {
+		t.Errorf("expected %s to expire", a)
+	}
+	if !g.cached(b) {
+		t.Errorf("expected %s to stay cached", b)
+	}
+}
+
+func TestGatewayRunFlushesWhenDone(t *testing.T) {
+	g := newTestGateway(0, time.Minute)
+	a := GatewayCacheKey("notebook[data=sp-a]", "alice", false)
+	g.use(a)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		g.Run(ctx)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	if g.cached(a) || !g.evicted(a) {
+		t.Errorf("expected %s to be evicted once the gateway stopped", a)
+	}
+}
+
+func TestGatewayInvalidatesGoneBackends(t *testing.T) {
+	g := newTestGateway(0, 0)
+	a := GatewayCacheKey("notebook[data=sp-a]", "alice", false)
+
+	g.use(a)
+	invalidate := g.invalidates[a]
+	invalidate(errors.New("backend is gone"))
+	if g.cached(a) || !g.evicted(a) {
+		t.Fatalf("expected %s to be invalidated", a)
+	}
+
+	// A late invalidation for the old entry leaves its replacement alone.
+	g.use(a)
+	invalidate(errors.New("backend is gone"))
+	if !g.cached(a) {
+		t.Errorf("expected the new entry for %s to stay cached", a)
+	}
+	if stats := g.Stats(context.Background()); stats.Invalidations != 1 {
+		t.Errorf("expected 1 invalidation, got %#v", stats)
+	}
+}
+
+func TestGatewayProvisionsWithoutLocking(t *testing.T) {
+	g := NewGateway(0, 0)
+	a := GatewayCacheKey("notebook[data=sp-a]", "alice", false)
+
+	// The first factory blocks, as if it were waiting on its backend's status
+	// stream, until a second lookup of the same key has finished.
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var blocked context.Context
+	go func() {
+		g.lookup(context.Background(), a, func(ctx context.Context, invalidate func(error)) ProvisionFunc {
+			blocked = ctx
+			close(started)
+			<-release
+			return nil
+		})
+		close(release)
+	}()
+	<-started
+
+	var cached context.Context
+	done := make(chan struct{})
+	go func() {
+		g.Stats(context.Background())
+		g.lookup(context.Background(), a, func(ctx context.Context, invalidate func(error)) ProvisionFunc {
+			cached = ctx
+			return nil
+		})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("gateway stayed locked while an entry was provisioned")
+	}
+	release <- struct{}{}
+	<-release
+
+	if blocked.Err() == nil || cached.Err() != nil {
+		t.Error("expected the entry inserted first to win")
+	}
+	if stats := g.Stats(context.Background()); stats.Entries != 1 || stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("unexpected stats %#v", stats)
+	}
+}
+
+func TestGatewayFlush(t *testing.T) {
+	g := newTestGateway(0, 0)
+	notebookA := GatewayCacheKey("notebook[data=sp-a]", "alice", false)
+	notebookAViewer := GatewayCacheKey("notebook[data=sp-a]", "bob", true)
+	notebookB := GatewayCacheKey("notebook[data=sp-b]", "alice", false)
+	filesA := GatewayCacheKey("files[data=sp-a]", "alice", false)
+	for _, key := range []string{notebookA, notebookAViewer, notebookB, filesA} {
+		g.use(key)
+	}
+
+	lens := "files"
+	if n := g.Flush(context.Background(), &GatewayEntryWhere{Lens: &lens}); n != 1 || g.cached(filesA) {
+		t.Errorf("flushing lens %s flushed %d entries", lens, n)
+	}
+
+	space := "sp-a"
+	if n := g.Flush(context.Background(), &GatewayEntryWhere{SpaceID: &space}); n != 2 || g.cached(notebookA) || g.cached(notebookAViewer) {
+		t.Errorf("flushing space %s flushed %d entries", space, n)
+	}
+	if !g.cached(notebookB) {
+		t.Errorf("expected %s to stay cached", notebookB)
+	}
+
+	if n := g.Flush(context.Background(), &GatewayEntryWhere{}); n != 1 || g.cached(notebookB) {
+		t.Errorf("flushing everything flushed %d entries", n)
+	}
+}
+
+// provisionBackends returns a ProvisionFunc that hands out backends in turn,
+// repeating the last one, and counts how many it has handed out.
+func provisionBackends(backends ...string) (ProvisionFunc, *int) {
+	var provisioned int
+	return func(context.Context) (AuthenticatedURLJoinerFunc, bool, func(error), error) {
+		i := provisioned
+		if i >= len(backends) {
+			i = len(backends) - 1
+		}
+		provisioned++
+		target, _ := url.Parse(backends[i])
+		joiner := func(u *url.URL, mode ProvisionerAuthenticationMode) (*url.URL, http.Header) {
+			return target.ResolveReference(&url.URL{Path: u.Path, RawQuery: u.RawQuery}), nil
+		}
+		return joiner, false, func(error) {}, nil
+	}, &provisioned
+}
+
+// deadBackend returns the URL of a backend that refuses connections.
+func deadBackend() string {
+	backend := httptest.NewServer(http.NotFoundHandler())
+	backend.Close()
+	return backend.URL
+}
+
+// echoBackend replies with the body of each request it gets.
+func echoBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b, _ := ioutil.ReadAll(req.Body)
+		rw.Write(b)
+	}))
+}
+
+func TestProxyRetriesSmallIdempotentRequests(t *testing.T) {
+	backend := echoBackend()
+	defer backend.Close()
+
+	provision, provisioned := provisionBackends(deadBackend(), backend.URL)
+	proxy := provisioningReverseProxy(provision, 2, 16, nil, nil)
+
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("PUT", "/file", strings.NewReader("hello")))
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello" {
+		t.Fatalf("expected the body to be replayed to the second backend, got %d %q", rec.Code, rec.Body.String())
+	}
+	if *provisioned != 2 {
+		t.Fatalf("expected 2 backends to be provisioned, got %d", *provisioned)
+	}
+}
+
+func TestProxyNeverRetriesUnreplayableRequests(t *testing.T) {
+	backend := echoBackend()
+	defer backend.Close()
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest("POST", "/run", strings.NewReader("hello")),
+		httptest.NewRequest("PUT", "/file", strings.NewReader(strings.Repeat("x", 17))),
+	} {
+		provision, provisioned := provisionBackends(deadBackend(), backend.URL)
+		proxy := provisioningReverseProxy(provision, 2, 16, nil, nil)
+
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadGateway || *provisioned != 1 {
+			t.Errorf("expected %s %s to fail without a retry, got %d after %d backends", req.Method, req.URL, rec.Code, *provisioned)
+		}
+	}
+
+	// Bodies too big to buffer still reach a working backend intact.
+	provision, _ := provisionBackends(backend.URL)
+	proxy := provisioningReverseProxy(provision, 2, 16, nil, nil)
+	body := strings.Repeat("x", 1024)
+	rec := httptest.NewRecorder()
+	proxy.ServeHTTP(rec, httptest.NewRequest("PUT", "/file", strings.NewReader(body)))
+	if rec.Code != http.StatusOK || rec.Body.String() != body {
+		t.Fatalf("expected the whole body to be proxied, got %d with %d bytes", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestProxyStreamsChunkedBodies(t *testing.T) {
+	// The backend signals once it has the first chunk, which the client
+	// waits for before sending the rest. A proxy that buffered the body
+	// would never let it through.
+	firstChunk := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		b := make([]byte, len("part1"))
+		if _, err := io.ReadFull(req.Body, b); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		close(firstChunk)
+		rest, _ := ioutil.ReadAll(req.Body)
+		fmt.Fprintf(rw, "%s%s", b, rest)
+	}))
+	defer backend.Close()
+
+	provision, _ := provisionBackends(backend.URL)
+	proxy := httptest.NewServer(provisioningReverseProxy(provision, 2, DefaultMaxReplayBodyBytes, nil, nil))
+	defer proxy.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("part1"))
+		select {
+		case <-firstChunk:
+			pw.Write([]byte("part2"))
+			pw.Close()
+		case <-time.After(5 * time.Second):
+			pw.CloseWithError(errors.New("backend never saw the first chunk"))
+		}
+	}()
+
+	res, err := http.Post(proxy.URL+"/upload", "application/octet-stream", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(b) != "part1part2" {
+		t.Fatalf("expected the chunked body to stream through, got %d %q", res.StatusCode, b)
+	}
+}
+
+func TestProxyPassesWebSocketUpgrades(t *testing.T) {
+	// The backend upgrades the connection and then echoes a line back.
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Upgrade") != "websocket" {
+			http.Error(rw, "expected an upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := rw.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+		line, _ := buf.ReadString('\n')
+		buf.WriteString(line)
+		buf.Flush()
+	}))
+	defer backend.Close()
+
+	provision, _ := provisionBackends(backend.URL)
+	proxy := httptest.NewServer(provisioningReverseProxy(provision, 2, DefaultMaxReplayBodyBytes, nil, nil))
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: substrate\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the upgrade to be proxied, got %d", res.StatusCode)
+	}
+
+	fmt.Fprintf(conn, "ping\n")
+	line, err := r.ReadString('\n')
+	if err != nil || line != "ping\n" {
+		t.Fatalf("expected ping to be echoed over the upgraded connection, got %q, %v", line, err)
+	}
+}
@@ -9,7 +9,10 @@ require (
 	github.com/go-playground/form/v4 v4.2.0
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.16
+	github.com/nats-io/nats-server/v2 v2.9.20
+	github.com/nats-io/nats.go v1.27.0
 	github.com/oklog/ulid/v2 v2.1.0
+	github.com/pelletier/go-toml/v2 v2.1.0
 	github.com/rs/cors v1.8.3
 	github.com/sirupsen/logrus v1.9.0
 )
@@ -34,10 +37,8 @@ require (
 	github.com/minio/highwayhash v1.0.2 // indirect
 	github.com/mitchellh/go-ps v1.0.0 // indirect
 	github.com/nats-io/jwt/v2 v2.4.1 // indirect
-	github.com/nats-io/nats-server/v2 v2.9.20 // indirect
 	github.com/nats-io/nkeys v0.4.4 // indirect
 	github.com/nats-io/nuid v1.0.1 // indirect
-	github.com/pelletier/go-toml/v2 v2.1.0 // indirect
 	github.com/x448/float16 v0.8.4 // indirect
 	go4.org/mem v0.0.0-20210711025021-927187094b94 // indirect
 	go4.org/netipx v0.0.0-20220725152314-7e7bdc8411bf // indirect
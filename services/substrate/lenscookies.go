@@ -0,0 +1,85 @@
+package substrate
+
+import (
+	"net/http"
+	"strings"
+)
+
+// SubstrateCookiePrefix starts the name of every cookie substrate sets for
+// itself, like its session cookie. They never pass to or from a lens.
+const SubstrateCookiePrefix = "substrate-"
+
+// LensCookiePolicy decides which cookies pass between a browser and a lens's
+// backend. The browser and every lens share substrate's origin, so without it
+// a backend would see the substrate session and could set cookies for the
+// rest of the site.
+type LensCookiePolicy struct {
+	// Allow is the names of the cookies the lens may set and be sent. Any
+	// other cookie is dropped in both directions.
+	Allow []string
+
+	// Path is the escaped path the lens is served under, e.g.
+	// "/gw/<viewspec>". Cookies set by the backend are confined to it, so
+	// each viewspec gets cookies of its own.
+	Path string
+}
+
+// NewLensCookiePolicy returns the policy for lens, served under path.
+func NewLensCookiePolicy(lens *Lens, path string) *LensCookiePolicy {
+	p := &LensCookiePolicy{Path: strings.TrimSuffix(path, "/")}
+	if lens != nil {
+		p.Allow = lens.Cookies
+	}
+	return p
+}
+
+func (p *LensCookiePolicy) allows(name string) bool {
+	if strings.HasPrefix(name, SubstrateCookiePrefix) {
+		return false
+	}
+	for _, allowed := range p.Allow {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterRequest removes every cookie the lens isn't allowed from req.
+func (p *LensCookiePolicy) FilterRequest(req *http.Request) {
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, cookie := range cookies {
+		if p.allows(cookie.Name) {
+			req.AddCookie(&http.Cookie{Name: cookie.Name, Value: cookie.Value})
+		}
+	}
+}
+
+// FilterResponse drops the cookies res sets that the lens isn't allowed, and
+// confines the rest to p.Path. It can be used as a ModifyResponse hook.
+func (p *LensCookiePolicy) FilterResponse(res *http.Response) error {
+	cookies := res.Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+
+	res.Header.Del("Set-Cookie")
+	for _, cookie := range cookies {
+		if !p.allows(cookie.Name) {
+			continue
+		}
+
+		// The backend sees paths with p.Path stripped off, so put it back.
+		if !strings.HasPrefix(cookie.Path, "/") {
+			cookie.Path = "/"
+		}
+		cookie.Path = p.Path + cookie.Path
+		cookie.Domain = ""
+
+		if v := cookie.String(); v != "" {
+			res.Header.Add("Set-Cookie", v)
+		}
+	}
+	return nil
+}
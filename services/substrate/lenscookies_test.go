@@ -0,0 +1,130 @@
+package substrate
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// proxyToBackend proxies requests to backend the way the gateway does, with
+// cookies filtered by policy.
+func proxyToBackend(backend *httptest.Server, policy *LensCookiePolicy) http.Handler {
+	target, _ := url.Parse(backend.URL)
+	provision := func(ctx context.Context) (AuthenticatedURLJoinerFunc, bool, func(error), error) {
+		joiner := func(u *url.URL, mode ProvisionerAuthenticationMode) (*url.URL, http.Header) {
+			return target.ResolveReference(&url.URL{Path: u.Path, RawQuery: u.RawQuery}), nil
+		}
+		return joiner, false, func(error) {}, nil
+	}
+	proxy := provisioningReverseProxy(provision, 1, DefaultMaxReplayBodyBytes, policy.FilterResponse, nil)
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		policy.FilterRequest(req)
+		req.URL.Path = strings.TrimPrefix(req.URL.Path, policy.Path)
+		proxy.ServeHTTP(rw, req)
+	})
+}
+
+func TestLensCookiesNeverSeeSession(t *testing.T) {
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		seen = nil
+		for _, cookie := range req.Cookies() {
+			seen = append(seen, cookie.Name+"="+cookie.Value)
+		}
+		sort.Strings(seen)
+	}))
+	defer backend.Close()
+
+	// Even a lens that asks for substrate's cookies doesn't get them.
+	policy := &LensCookiePolicy{
+		Allow: []string{"ds_csrftoken", "substrate-github-app"},
+		Path:  "/gw/datasette[data=sp-1]",
+	}
+	proxy := proxyToBackend(backend, policy)
+
+	req := httptest.NewRequest("GET", "/gw/datasette[data=sp-1]/db", nil)
+	req.AddCookie(&http.Cookie{Name: "substrate-github-app", Value: "session"})
+	req.AddCookie(&http.Cookie{Name: "substrate-login-state", Value: "state"})
+	req.AddCookie(&http.Cookie{Name: "ds_csrftoken", Value: "csrf"})
+	req.AddCookie(&http.Cookie{Name: "_xsrf", Value: "other-lens"})
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(seen) != 1 || seen[0] != "ds_csrftoken=csrf" {
+		t.Fatalf("expected the backend to only see ds_csrftoken, got %v", seen)
+	}
+
+	// A lens with no allow-list sees no cookies at all.
+	proxy = proxyToBackend(backend, &LensCookiePolicy{Path: "/gw/files[data=sp-1]"})
+	req = httptest.NewRequest("GET", "/gw/files[data=sp-1]/", nil)
+	req.AddCookie(&http.Cookie{Name: "substrate-github-app", Value: "session"})
+	req.AddCookie(&http.Cookie{Name: "ds_csrftoken", Value: "csrf"})
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	if len(seen) != 0 {
+		t.Fatalf("expected the backend to see no cookies, got %v", seen)
+	}
+}
+
+func TestLensCookiesAreScopedToViewspec(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.SetCookie(rw, &http.Cookie{Name: "ds_csrftoken", Value: "csrf"})
+		http.SetCookie(rw, &http.Cookie{Name: "ds_messages", Value: "hi", Path: "/db", Domain: "example.com"})
+		http.SetCookie(rw, &http.Cookie{Name: "substrate-github-app", Value: "fixed", Path: "/"})
+		http.SetCookie(rw, &http.Cookie{Name: "tracker", Value: "1"})
+	}))
+	defer backend.Close()
+
+	policy := &LensCookiePolicy{
+		Allow: []string{"ds_csrftoken", "ds_messages", "substrate-github-app"},
+		Path:  "/gw/datasette%5Bdata=sp-1%5D",
+	}
+	rec := httptest.NewRecorder()
+	proxyToBackend(backend, policy).ServeHTTP(rec, httptest.NewRequest("GET", "/gw/datasette%5Bdata=sp-1%5D/", nil))
+
+	got := map[string]*http.Cookie{}
+	for _, cookie := range rec.Result().Cookies() {
+		got[cookie.Name] = cookie
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected only the allowed lens cookies to be set, got %v", rec.Header()["Set-Cookie"])
+	}
+	if c := got["ds_csrftoken"]; c == nil || c.Path != "/gw/datasette%5Bdata=sp-1%5D/" {
+		t.Fatalf("expected ds_csrftoken to be confined to the viewspec, got %v", c)
+	}
+	if c := got["ds_messages"]; c == nil || c.Path != "/gw/datasette%5Bdata=sp-1%5D/db" || c.Domain != "" {
+		t.Fatalf("expected ds_messages to be confined to the viewspec and host, got %v", c)
+	}
+}
+
+func TestUILensCookiesNeverSeeSession(t *testing.T) {
+	var seen []string
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		seen = nil
+		for _, cookie := range req.Cookies() {
+			seen = append(seen, cookie.Name+"="+cookie.Value)
+		}
+		http.SetCookie(rw, &http.Cookie{Name: "ui_theme", Value: "dark", Path: "/ui/"})
+		http.SetCookie(rw, &http.Cookie{Name: "substrate-github-app", Value: "fixed", Path: "/"})
+	}))
+	defer backend.Close()
+
+	// The UI is served under /ui without it being stripped, as cmd's UI
+	// handler does.
+	policy := NewLensCookiePolicy(&Lens{Cookies: []string{"ui_theme"}}, "")
+	req := httptest.NewRequest("GET", "/ui/spaces", nil)
+	req.AddCookie(&http.Cookie{Name: "substrate-github-app", Value: "session"})
+	req.AddCookie(&http.Cookie{Name: "ui_theme", Value: "light"})
+	rec := httptest.NewRecorder()
+	proxyToBackend(backend, policy).ServeHTTP(rec, req)
+
+	if len(seen) != 1 || seen[0] != "ui_theme=light" {
+		t.Fatalf("expected the UI backend to only see ui_theme, got %v", seen)
+	}
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "ui_theme" || cookies[0].Path != "/ui/" {
+		t.Fatalf("expected only ui_theme to be set, under /ui/, got %v", rec.Header()["Set-Cookie"])
+	}
+}
@@ -0,0 +1,173 @@
+package substrate
+
+import (
+	"context"
+	"time"
+)
+
+// maxSpaceLineageDepth bounds how far a lineage query recurses in either
+// direction, even when the caller doesn't ask for a limit.
+const maxSpaceLineageDepth = 1000
+
+type SpaceLineageRequest struct {
+	SpaceID string
+
+	// User only sees the spaces they may read. The graph still goes through
+	// the others; they're just left out of it.
+	User string
+
+	// AncestorDepth and DescendantDepth limit how many generations to follow
+	// in each direction. Nil means as far as maxSpaceLineageDepth.
+	AncestorDepth   *int
+	DescendantDepth *int
+}
+
+// SpaceLineageNode is one space in a lineage graph. Depth is negative for
+// ancestors, zero for the requested space and positive for descendants.
+type SpaceLineageNode struct {
+	ID            string     `json:"space"`
+	Owner         string     `json:"owner"`
+	Alias         string     `json:"alias"`
+	CreatedAt     time.Time  `json:"created_at"`
+	DeletedAt     *time.Time `json:"deleted_at,omitempty"`
+	ForkedFromID  *string    `json:"forked_from_id,omitempty"`
+	ForkedFromRef *string    `json:"forked_from_ref,omitempty"`
+	Depth         int        `json:"depth"`
+}
+
+// SpaceLineageEdge links a space to a fork of it. Ref is the checkpoint the
+// fork was made from.
+type SpaceLineageEdge struct {
+	From string  `json:"from"`
+	To   string  `json:"to"`
+	Ref  *string `json:"ref,omitempty"`
+}
+
+// SpaceLineage is the ancestor chain and descendant tree of a space. Spaces in
+// the trash are included so the graph stays connected. Truncated is set if a
+// depth limit cut off any part of the graph.
+type SpaceLineage struct {
+	Space     string              `json:"space"`
+	Nodes     []*SpaceLineageNode `json:"nodes"`
+	Edges     []*SpaceLineageEdge `json:"edges"`
+	Truncated bool                `json:"truncated"`
+}
+
+func clampLineageDepth(depth *int) int {
+	if depth == nil || *depth > maxSpaceLineageDepth {
+		return maxSpaceLineageDepth
+	}
+	if *depth < 0 {
+		return 0
+	}
+	return *depth
+}
+
+// The requested space comes from the descendants half, at depth zero. Both
+// halves stop at their depth limit; has_forks tells us whether the
+// descendants half stopped early.
+const spaceLineageQuery = `WITH RECURSIVE
+  ancestors(id, depth) AS (
+    SELECT forked_from_id, 1 FROM "spaces" WHERE id = ? AND forked_from_id IS NOT NULL AND ? > 0
+    UNION ALL
+    SELECT s.forked_from_id, a.depth + 1 FROM "spaces" s JOIN ancestors a ON s.id = a.id
+      WHERE s.forked_from_id IS NOT NULL AND a.depth < ?
+  ),
+  descendants(id, depth) AS (
+    SELECT id, 0 FROM "spaces" WHERE id = ?
+    UNION ALL
+    SELECT s.id, d.depth + 1 FROM "spaces" s JOIN descendants d ON s.forked_from_id = d.id
+      WHERE d.depth < ?
+  ),
+  lineage(id, depth) AS (
+    SELECT id, -depth FROM ancestors
+    UNION ALL
+    SELECT id, depth FROM descendants
+  )
+SELECT spaces.id, spaces.owner, spaces.alias, spaces.created_at_us, spaces.deleted_at_us,
+  spaces.forked_from_id, spaces.forked_from_ref, lineage.depth,
+  EXISTS (SELECT 1 FROM "spaces" f WHERE f.forked_from_id = spaces.id) AS has_forks,
+  ` + spaceVisibleTo + ` AS visible
+FROM lineage JOIN "spaces" ON spaces.id = lineage.id
+ORDER BY lineage.depth, spaces.created_at_us, spaces.id`
+
+// SpaceLineage returns the lineage of a space, or nil if there's no such space.
+func (s *Substrate) SpaceLineage(ctx context.Context, request *SpaceLineageRequest) (*SpaceLineage, error) {
+	ancestorDepth := clampLineageDepth(request.AncestorDepth)
+	descendantDepth := clampLineageDepth(request.DescendantDepth)
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, spaceLineageQuery,
+		request.SpaceID, ancestorDepth, ancestorDepth,
+		request.SpaceID, descendantDepth,
+		request.User, request.User)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lineage := &SpaceLineage{
+		Space: request.SpaceID,
+		Nodes: []*SpaceLineageNode{},
+		Edges: []*SpaceLineageEdge{},
+	}
+	found := false
+	for rows.Next() {
+		var n SpaceLineageNode
+		var createdAt int64
+		var deletedAt *int64
+		var hasForks, visible bool
+		err := rows.Scan(&n.ID, &n.Owner, &n.Alias, &createdAt, &deletedAt, &n.ForkedFromID, &n.ForkedFromRef, &n.Depth, &hasForks, &visible)
+		if err != nil {
+			return nil, err
+		}
+		if !visible {
+			continue
+		}
+		n.CreatedAt = time.UnixMicro(createdAt)
+		if deletedAt != nil {
+			t := time.UnixMicro(*deletedAt)
+			n.DeletedAt = &t
+		}
+
+		if n.Depth == 0 {
+			found = true
+		}
+		// A depth limit cut the graph short if the farthest node in either
+		// direction has more beyond it.
+		if n.Depth <= 0 && n.Depth == -ancestorDepth && n.ForkedFromID != nil {
+			lineage.Truncated = true
+		}
+		if n.Depth >= 0 && n.Depth == descendantDepth && hasForks {
+			lineage.Truncated = true
+		}
+
+		lineage.Nodes = append(lineage.Nodes, &n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	// Link each space to the one it was forked from, when that's in the graph.
+	// The parent of the oldest ancestor may be past the limit or purged.
+	ids := map[string]bool{}
+	for _, n := range lineage.Nodes {
+		ids[n.ID] = true
+	}
+	for _, n := range lineage.Nodes {
+		if n.ForkedFromID != nil && ids[*n.ForkedFromID] {
+			lineage.Edges = append(lineage.Edges, &SpaceLineageEdge{
+				From: *n.ForkedFromID,
+				To:   n.ID,
+				Ref:  n.ForkedFromRef,
+			})
+		}
+	}
+
+	return lineage, nil
+}
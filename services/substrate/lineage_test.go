@@ -0,0 +1,124 @@
+package substrate
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestFork writes a space forked from parent's tip.
+func writeTestFork(t *testing.T, s *Substrate, id, owner string, private bool, parent string, offset time.Duration) {
+	t.Helper()
+
+	ref := parent + ":tip"
+	sp := &Space{
+		ID:            id,
+		Owner:         owner,
+		Alias:         id,
+		CreatedAt:     time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC).Add(offset),
+		IsPrivate:     private,
+		ForkedFromID:  &parent,
+		ForkedFromRef: &ref,
+	}
+	if err := s.WriteSpace(context.Background(), sp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// lineageGraph summarizes a lineage as "id@depth" nodes and "from>to" edges.
+func lineageGraph(t *testing.T, s *Substrate, request *SpaceLineageRequest) (string, string, bool) {
+	t.Helper()
+
+	lineage, err := s.SpaceLineage(context.Background(), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineage == nil {
+		return "", "", false
+	}
+
+	nodes := []string{}
+	for _, n := range lineage.Nodes {
+		nodes = append(nodes, n.ID+"@"+strconv.Itoa(n.Depth))
+	}
+	edges := []string{}
+	for _, e := range lineage.Edges {
+		edges = append(edges, e.From+">"+e.To)
+	}
+	sort.Strings(edges)
+	return strings.Join(nodes, " "), strings.Join(edges, " "), lineage.Truncated
+}
+
+// writeTestLineage writes this tree of spaces, all alice's but sp-secret:
+//
+//	sp-root
+//	├── sp-a
+//	│   ├── sp-a1 (in the trash)
+//	│   └── sp-secret (bob's, private)
+//	└── sp-b
+func writeTestLineage(t *testing.T, s *Substrate) {
+	t.Helper()
+
+	writeTestSpace(t, s, "sp-root", "alice", false, 0)
+	writeTestFork(t, s, "sp-a", "alice", false, "sp-root", time.Second)
+	writeTestFork(t, s, "sp-b", "alice", false, "sp-root", 2*time.Second)
+	writeTestFork(t, s, "sp-a1", "alice", false, "sp-a", 3*time.Second)
+	writeTestFork(t, s, "sp-secret", "bob", true, "sp-a", 4*time.Second)
+
+	id := "sp-a1"
+	if err := s.DeleteSpace(context.Background(), &SpaceWhere{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpaceLineage(t *testing.T) {
+	s := newTestSubstrate(t)
+	writeTestLineage(t, s)
+
+	// Siblings aren't part of a lineage, but trashed spaces are.
+	nodes, edges, truncated := lineageGraph(t, s, &SpaceLineageRequest{SpaceID: "sp-a", User: "alice"})
+	if nodes != "sp-root@-1 sp-a@0 sp-a1@1" || edges != "sp-a>sp-a1 sp-root>sp-a" || truncated {
+		t.Fatalf("unexpected lineage %q %q truncated=%t", nodes, edges, truncated)
+	}
+
+	// Bob sees his private fork too.
+	nodes, edges, _ = lineageGraph(t, s, &SpaceLineageRequest{SpaceID: "sp-a", User: "bob"})
+	if nodes != "sp-root@-1 sp-a@0 sp-a1@1 sp-secret@1" || edges != "sp-a>sp-a1 sp-a>sp-secret sp-root>sp-a" {
+		t.Fatalf("unexpected lineage for bob %q %q", nodes, edges)
+	}
+
+	// Alice can't see sp-secret at all.
+	if nodes, _, _ := lineageGraph(t, s, &SpaceLineageRequest{SpaceID: "sp-secret", User: "alice"}); nodes != "" {
+		t.Fatalf("expected no lineage for a space alice can't read, got %q", nodes)
+	}
+	if nodes, _, _ := lineageGraph(t, s, &SpaceLineageRequest{SpaceID: "sp-nope", User: "alice"}); nodes != "" {
+		t.Fatalf("expected no lineage for a missing space, got %q", nodes)
+	}
+}
+
+func TestSpaceLineageDepthLimits(t *testing.T) {
+	s := newTestSubstrate(t)
+	writeTestLineage(t, s)
+
+	zero, one := 0, 1
+	for _, c := range []struct {
+		request   SpaceLineageRequest
+		nodes     string
+		truncated bool
+	}{
+		{SpaceLineageRequest{SpaceID: "sp-a1", AncestorDepth: &one}, "sp-a@-1 sp-a1@0", true},
+		{SpaceLineageRequest{SpaceID: "sp-a1"}, "sp-root@-2 sp-a@-1 sp-a1@0", false},
+		{SpaceLineageRequest{SpaceID: "sp-root", DescendantDepth: &one}, "sp-root@0 sp-a@1 sp-b@1", true},
+		{SpaceLineageRequest{SpaceID: "sp-b", DescendantDepth: &zero}, "sp-root@-1 sp-b@0", false},
+		{SpaceLineageRequest{SpaceID: "sp-a", DescendantDepth: &zero, AncestorDepth: &zero}, "sp-a@0", true},
+	} {
+		c.request.User = "alice"
+		nodes, _, truncated := lineageGraph(t, s, &c.request)
+		if nodes != c.nodes || truncated != c.truncated {
+			t.Errorf("expected %s's lineage to be %q truncated=%t, got %q truncated=%t", c.request.SpaceID, c.nodes, c.truncated, nodes, truncated)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package substrate
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migrations live in migrations/ as NNNN_description.sql and are applied in
+// order of NNNN. Once a migration has shipped, don't edit it; add a new one.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+const createSchemaMigrationsTable = `CREATE TABLE IF NOT EXISTS "schema_migrations" (version INTEGER, name TEXT, applied_at_us INTEGER, PRIMARY KEY (version));`
+
+// Migrations returns the embedded migrations, ordered by version.
+func Migrations() ([]*Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := []*Migration{}
+	seen := map[int]string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".sql") {
+			continue
+		}
+
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %q must be named NNNN_description.sql", name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %q must be named NNNN_description.sql: %w", name, err)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %q and %q have the same version", other, name)
+		}
+		seen[version] = name
+
+		b, err := migrationFiles.ReadFile(path.Join("migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, &Migration{
+			Version: version,
+			Name:    strings.TrimSuffix(name, ".sql"),
+			SQL:     string(b),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// appliedMigrations returns the versions recorded in schema_migrations. A
+// database without that table has had nothing applied.
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]bool, error) {
+	applied := map[int]bool{}
+
+	var n int
+	q := `SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_migrations'`
+	err := db.QueryRowContext(ctx, q).Scan(&n)
+	if err != nil {
+		return nil, wrapSQLError(err, q)
+	}
+	if n == 0 {
+		return applied, nil
+	}
+
+	q = `SELECT version FROM "schema_migrations"`
+	rows, err := db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, wrapSQLError(err, q)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		if err := rows.Scan(&version); err != nil {
+			return nil, err
+		}
+		applied[version] = true
+	}
+	return applied, rows.Err()
+}
+
+// PendingMigrations returns the migrations that haven't been applied to db yet.
+func PendingMigrations(ctx context.Context, db *sql.DB) ([]*Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []*Migration{}
+	for _, m := range migrations {
+		if !applied[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// Migrate applies any pending migrations to db. Each migration runs in its own
+// transaction along with its schema_migrations row, so a failed migration
+// leaves the database as it was before that migration.
+func Migrate(ctx context.Context, db *sql.DB, logf func(fmt string, values ...any)) error {
+	_, err := db.ExecContext(ctx, createSchemaMigrationsTable)
+	if err != nil {
+		return wrapSQLError(err, createSchemaMigrationsTable)
+	}
+
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		logf("applying migration %s", m.Name)
+		err := applyMigration(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("error applying migration %s: %w", m.Name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m *Migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, m.SQL)
+	if err != nil {
+		return wrapSQLError(err, m.SQL)
+	}
+
+	q := `INSERT INTO "schema_migrations" (version, name, applied_at_us) VALUES (?, ?, ?)`
+	_, err = tx.ExecContext(ctx, q, m.Version, m.Name, time.Now().UnixMicro())
+	if err != nil {
+		return wrapSQLError(err, q, m.Version, m.Name)
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,124 @@
+package substrate
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMigrationsAreNumberedInOrder(t *testing.T) {
+	migrations, err := Migrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("expected embedded migrations")
+	}
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("expected migration %s to be version %d", m.Name, i+1)
+		}
+	}
+}
+
+// baselineSchema is what CreateTables made before there were migrations.
+const baselineSchema = `
+CREATE TABLE IF NOT EXISTS "activities" (activityspec TEXT, owner TEXT, created_at_us INTEGER, lens TEXT, PRIMARY KEY (activityspec));
+CREATE TABLE IF NOT EXISTS "events" (id TEXT, viewspec TEXT, ts TEXT, type TEXT, user TEXT, lens TEXT, event TEXT, PRIMARY KEY (id));
+CREATE TABLE IF NOT EXISTS "spaces" (id TEXT, owner TEXT, alias TEXT, created_at_us INTEGER, deleted_at_us TEXT, initial_lens TEXT, forked_from_id TEXT, forked_from_ref TEXT, PRIMARY KEY (id), FOREIGN KEY (forked_from_id) REFERENCES spaces(id));
+CREATE TABLE IF NOT EXISTS "collection_memberships" (collection_owner TEXT, collection_name TEXT, space_id TEXT, lensspec TEXT, created_at_us INTEGER, updated_at_us INTEGER, deleted_at_us INTEGER, membership TEXT, is_public INTEGER, PRIMARY KEY (collection_owner, collection_name, space_id, lensspec), FOREIGN KEY (space_id) REFERENCES space(id));
+`
+
+func TestMigrateKeepsBaselineData(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+
+	created := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	deleted := created.Add(time.Hour)
+	_, err := db.Exec(baselineSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(`
+INSERT INTO "spaces" (id, owner, alias, created_at_us, deleted_at_us) VALUES
+  ('sp-kept', 'alice', 'kept', ?, ''),
+  ('sp-binned', 'alice', 'binned', ?, ?);
+INSERT INTO "activities" (activityspec, owner, created_at_us, lens) VALUES ('files[data=sp-kept]', 'alice', ?, 'files');
+INSERT INTO "collection_memberships" (collection_owner, collection_name, space_id, lensspec, created_at_us, membership, is_public) VALUES
+  ('alice', 'faves', 'sp-kept', '', ?, '{"owner":"alice","name":"faves","space":"sp-kept","created_at":"2023-06-01T00:00:00Z","public":true}', 1);
+`, created.UnixMicro(), created.UnixMicro(), deleted.UnixMicro(), created.UnixMicro(), created.UnixMicro())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := PendingMigrations(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, _ := Migrations()
+	if len(pending) != len(migrations) {
+		t.Fatalf("expected all %d migrations to be pending, got %d", len(migrations), len(pending))
+	}
+
+	if err := Migrate(ctx, db, func(string, ...any) {}); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := PendingMigrations(ctx, db); len(pending) != 0 {
+		t.Fatalf("expected no pending migrations, got %d", len(pending))
+	}
+	// Migrating again is a no-op.
+	if err := Migrate(ctx, db, func(string, ...any) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	// deleted_at_us is a number now, with '' meaning not deleted.
+	var kept, binned *int64
+	if err := db.QueryRow(`SELECT (SELECT deleted_at_us FROM "spaces" WHERE id = 'sp-kept'), (SELECT deleted_at_us FROM "spaces" WHERE id = 'sp-binned')`).Scan(&kept, &binned); err != nil {
+		t.Fatal(err)
+	}
+	if kept != nil || binned == nil || *binned != deleted.UnixMicro() {
+		t.Fatalf("expected deleted_at_us to be converted, got %v and %v", kept, binned)
+	}
+
+	s := &Substrate{DB: db, Mu: &sync.RWMutex{}, Lenses: map[string]*Lens{}}
+	spaces, err := s.ListSpaces(ctx, &SpaceListQuery{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spaces) != 2 {
+		t.Fatalf("expected both spaces to survive, got %d", len(spaces))
+	}
+	for _, sp := range spaces {
+		if !sp.CreatedAt.Equal(created) || (sp.ID == "sp-binned") != (sp.DeletedAt != nil) {
+			t.Errorf("unexpected space after migrating %#v", sp)
+		}
+	}
+
+	activities, err := s.ListActivities(ctx, &ActivityListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 1 || activities[0].ActivitySpec != "files[data=sp-kept]" {
+		t.Fatalf("expected the activity to survive, got %v", activities)
+	}
+
+	owner, faves := "alice", "faves"
+	members, err := s.ListCollectionMembers(ctx, &CollectionMemberListQuery{
+		CollectionMembershipWhere: CollectionMembershipWhere{Owner: &owner, Name: &faves},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].SpaceID != "sp-kept" {
+		t.Fatalf("expected the collection membership to survive, got %v", members)
+	}
+
+	// Existing rows are searchable, except what's in the trash.
+	if keys := searchKeys(t, s, "alice", "kept"); !keys["sp-kept"] {
+		t.Fatalf("expected sp-kept to be indexed, got %v", keys)
+	}
+	if keys := searchKeys(t, s, "alice", "binned"); keys["sp-binned"] {
+		t.Fatalf("expected sp-binned, in the trash, not to be indexed")
+	}
+}
@@ -0,0 +1 @@
+CREATE TABLE IF NOT EXISTS "backend_tokens" (backend TEXT, bearer_token TEXT, PRIMARY KEY (backend));
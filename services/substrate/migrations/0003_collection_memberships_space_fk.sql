@@ -0,0 +1,7 @@
+-- The foreign key on collection_memberships referenced a table named "space"
+-- instead of "spaces". SQLite can't alter constraints, so rebuild the table.
+CREATE TABLE "collection_memberships_new" (collection_owner TEXT, collection_name TEXT, space_id TEXT, lensspec TEXT, created_at_us INTEGER, updated_at_us INTEGER, deleted_at_us INTEGER, membership TEXT, is_public INTEGER, PRIMARY KEY (collection_owner, collection_name, space_id, lensspec), FOREIGN KEY (space_id) REFERENCES spaces(id));
+INSERT INTO "collection_memberships_new" (collection_owner, collection_name, space_id, lensspec, created_at_us, updated_at_us, deleted_at_us, membership, is_public)
+  SELECT collection_owner, collection_name, space_id, lensspec, created_at_us, updated_at_us, deleted_at_us, membership, is_public FROM "collection_memberships";
+DROP TABLE "collection_memberships";
+ALTER TABLE "collection_memberships_new" RENAME TO "collection_memberships";
@@ -0,0 +1,9 @@
+-- spaces.deleted_at_us was declared TEXT but holds a timestamp in
+-- microseconds, like every other *_us column. Rebuild the table so it sorts
+-- and compares as a number.
+CREATE TABLE "spaces_new" (id TEXT, owner TEXT, alias TEXT, created_at_us INTEGER, deleted_at_us INTEGER, initial_lens TEXT, forked_from_id TEXT, forked_from_ref TEXT, PRIMARY KEY (id), FOREIGN KEY (forked_from_id) REFERENCES spaces(id));
+INSERT INTO "spaces_new" (id, owner, alias, created_at_us, deleted_at_us, initial_lens, forked_from_id, forked_from_ref)
+  SELECT id, owner, alias, created_at_us, CASE WHEN deleted_at_us IS NULL OR deleted_at_us = '' THEN NULL ELSE CAST(deleted_at_us AS INTEGER) END, initial_lens, forked_from_id, forked_from_ref FROM "spaces";
+DROP TABLE "spaces";
+ALTER TABLE "spaces_new" RENAME TO "spaces";
+CREATE INDEX "spaces_deleted_at_us" ON "spaces" (deleted_at_us);
@@ -0,0 +1,71 @@
+-- Full-text search over spaces, collections and activities. This needs
+-- go-sqlite3 built with the sqlite_fts5 tag.
+--
+-- Each row is one searchable document. Triggers keep the index in sync with
+-- the tables it covers, so writers don't need to know it exists.
+CREATE VIRTUAL TABLE "search_index" USING fts5(kind UNINDEXED, key UNINDEXED, owner UNINDEXED, is_public UNINDEXED, title, body);
+
+CREATE VIEW "search_space_documents" AS
+  SELECT 'space' AS kind, id AS key, owner, 1 AS is_public, alias AS title,
+    id || ' ' || coalesce(owner, '') || ' ' || coalesce(forked_from_id, '') AS body
+  FROM "spaces"
+  WHERE deleted_at_us IS NULL;
+
+CREATE VIEW "search_activity_documents" AS
+  SELECT 'activity' AS kind, activityspec AS key, owner, 1 AS is_public, lens AS title, activityspec AS body
+  FROM "activities";
+
+-- A collection's label, visibility and attributes live on its root membership,
+-- the one with no space and no lensspec.
+CREATE VIEW "search_collection_documents" AS
+  SELECT 'collection' AS kind,
+    c.collection_owner || '/' || c.collection_name AS key,
+    c.collection_owner AS owner,
+    coalesce(root.is_public, 0) AS is_public,
+    coalesce(json_extract(root.membership, '$.attributes."system:ui:label"'), c.collection_name) AS title,
+    c.collection_name || ' ' || coalesce((SELECT group_concat(t.key || ' ' || t.value, ' ') FROM json_tree(root.membership, '$.attributes') AS t WHERE t.atom IS NOT NULL), '') AS body
+  FROM (SELECT DISTINCT collection_owner, collection_name FROM "collection_memberships") AS c
+  LEFT JOIN "collection_memberships" AS root
+    ON root.collection_owner = c.collection_owner
+    AND root.collection_name = c.collection_name
+    AND coalesce(root.space_id, '') = ''
+    AND coalesce(root.lensspec, '') = '';
+
+CREATE TRIGGER "search_spaces_insert" AFTER INSERT ON "spaces" BEGIN
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_space_documents" WHERE key = NEW.id;
+END;
+CREATE TRIGGER "search_spaces_update" AFTER UPDATE ON "spaces" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'space' AND key = OLD.id;
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_space_documents" WHERE key = NEW.id;
+END;
+CREATE TRIGGER "search_spaces_delete" AFTER DELETE ON "spaces" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'space' AND key = OLD.id;
+END;
+
+CREATE TRIGGER "search_activities_insert" AFTER INSERT ON "activities" BEGIN
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_activity_documents" WHERE key = NEW.activityspec;
+END;
+CREATE TRIGGER "search_activities_update" AFTER UPDATE ON "activities" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'activity' AND key = OLD.activityspec;
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_activity_documents" WHERE key = NEW.activityspec;
+END;
+CREATE TRIGGER "search_activities_delete" AFTER DELETE ON "activities" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'activity' AND key = OLD.activityspec;
+END;
+
+CREATE TRIGGER "search_collection_memberships_insert" AFTER INSERT ON "collection_memberships" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'collection' AND key = NEW.collection_owner || '/' || NEW.collection_name;
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_collection_documents" WHERE key = NEW.collection_owner || '/' || NEW.collection_name;
+END;
+CREATE TRIGGER "search_collection_memberships_update" AFTER UPDATE ON "collection_memberships" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'collection' AND key IN (OLD.collection_owner || '/' || OLD.collection_name, NEW.collection_owner || '/' || NEW.collection_name);
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_collection_documents" WHERE key IN (OLD.collection_owner || '/' || OLD.collection_name, NEW.collection_owner || '/' || NEW.collection_name);
+END;
+CREATE TRIGGER "search_collection_memberships_delete" AFTER DELETE ON "collection_memberships" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'collection' AND key = OLD.collection_owner || '/' || OLD.collection_name;
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_collection_documents" WHERE key = OLD.collection_owner || '/' || OLD.collection_name;
+END;
+
+INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_space_documents";
+INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_activity_documents";
+INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_collection_documents";
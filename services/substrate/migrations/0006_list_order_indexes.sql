@@ -0,0 +1,4 @@
+-- Indexes matching the stable order used to page through each list.
+CREATE INDEX "events_ts_id" ON "events" (ts, id);
+CREATE INDEX "spaces_created_at_us_id" ON "spaces" (created_at_us, id);
+CREATE INDEX "activities_created_at_us_activityspec" ON "activities" (created_at_us, activityspec);
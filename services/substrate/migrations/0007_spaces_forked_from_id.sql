@@ -0,0 +1,2 @@
+-- Lets lineage queries find the forks of a space without a table scan.
+CREATE INDEX "spaces_forked_from_id" ON "spaces" (forked_from_id);
@@ -0,0 +1,12 @@
+-- Notifications tell a user when someone else does something with their spaces.
+CREATE TABLE "notifications" (
+  id TEXT PRIMARY KEY,
+  user TEXT NOT NULL,
+  type TEXT NOT NULL,
+  actor TEXT NOT NULL,
+  space_id TEXT NOT NULL,
+  created_at_us INTEGER NOT NULL,
+  read_at_us INTEGER,
+  notification TEXT NOT NULL
+);
+CREATE INDEX "notifications_user_created_at_us_id" ON "notifications" (user, created_at_us, id);
@@ -0,0 +1,45 @@
+-- Reactions and comments are on either a space or an activity, never both.
+CREATE TABLE "reactions" (
+  space_id TEXT,
+  activityspec TEXT,
+  author TEXT NOT NULL,
+  reaction TEXT NOT NULL,
+  created_at_us INTEGER NOT NULL,
+  CHECK ((space_id IS NULL) != (activityspec IS NULL))
+);
+CREATE UNIQUE INDEX "reactions_target_author_reaction" ON "reactions" (coalesce(space_id, ''), coalesce(activityspec, ''), author, reaction);
+CREATE INDEX "reactions_space_id" ON "reactions" (space_id);
+CREATE INDEX "reactions_activityspec" ON "reactions" (activityspec);
+
+CREATE TABLE "comments" (
+  id TEXT PRIMARY KEY,
+  space_id TEXT,
+  activityspec TEXT,
+  author TEXT NOT NULL,
+  parent_id TEXT REFERENCES comments(id),
+  body TEXT NOT NULL,
+  created_at_us INTEGER NOT NULL,
+  edited_at_us INTEGER,
+  CHECK ((space_id IS NULL) != (activityspec IS NULL))
+);
+CREATE INDEX "comments_space_id" ON "comments" (space_id);
+CREATE INDEX "comments_activityspec" ON "comments" (activityspec);
+CREATE INDEX "comments_created_at_us_id" ON "comments" (created_at_us, id);
+
+-- Every edit keeps the body it replaced.
+CREATE TABLE "comment_revisions" (
+  comment_id TEXT NOT NULL REFERENCES comments(id),
+  body TEXT NOT NULL,
+  written_at_us INTEGER NOT NULL,
+  replaced_at_us INTEGER NOT NULL
+);
+CREATE INDEX "comment_revisions_comment_id" ON "comment_revisions" (comment_id);
+
+CREATE TRIGGER "comments_revise" BEFORE UPDATE OF body ON "comments" WHEN old.body != new.body BEGIN
+  INSERT INTO "comment_revisions" (comment_id, body, written_at_us, replaced_at_us)
+  VALUES (old.id, old.body, coalesce(old.edited_at_us, old.created_at_us), coalesce(new.edited_at_us, old.created_at_us));
+END;
+
+CREATE TRIGGER "comments_delete_revisions" BEFORE DELETE ON "comments" BEGIN
+  DELETE FROM "comment_revisions" WHERE comment_id = old.id;
+END;
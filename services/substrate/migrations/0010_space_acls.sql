@@ -0,0 +1,11 @@
+-- Spaces are public unless made private. Collaborators get a role on a space
+-- other than its owner: editors can change it, viewers can only read it.
+ALTER TABLE "spaces" ADD COLUMN is_private INTEGER NOT NULL DEFAULT 0;
+CREATE TABLE "space_collaborators" (
+  space_id TEXT NOT NULL,
+  user TEXT NOT NULL,
+  role TEXT NOT NULL CHECK (role IN ('editor', 'viewer')),
+  created_at_us INTEGER NOT NULL,
+  PRIMARY KEY (space_id, user)
+);
+CREATE INDEX "space_collaborators_user" ON "space_collaborators" (user);
@@ -0,0 +1,12 @@
+-- Personal API tokens. Only a hash of each token is kept.
+CREATE TABLE "api_tokens" (
+  id TEXT PRIMARY KEY,
+  user TEXT NOT NULL,
+  name TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  scopes TEXT NOT NULL,
+  created_at_us INTEGER NOT NULL,
+  expires_at_us INTEGER,
+  last_used_at_us INTEGER
+);
+CREATE INDEX "api_tokens_user" ON "api_tokens" (user);
@@ -0,0 +1,5 @@
+-- Tokens minted for a single spawn, limited to the spaces it uses. spaces is
+-- a JSON array, or NULL for tokens that may use any space; activityspec is
+-- set only for spawn tokens.
+ALTER TABLE "api_tokens" ADD COLUMN spaces TEXT;
+ALTER TABLE "api_tokens" ADD COLUMN activityspec TEXT;
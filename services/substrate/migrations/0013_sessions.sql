@@ -0,0 +1,15 @@
+-- Browser sessions. Only hashes of a session's current and previous tokens
+-- are kept.
+CREATE TABLE "sessions" (
+  id TEXT PRIMARY KEY,
+  user TEXT NOT NULL,
+  token_hash TEXT NOT NULL UNIQUE,
+  previous_token_hash TEXT UNIQUE,
+  created_at_us INTEGER NOT NULL,
+  expires_at_us INTEGER NOT NULL,
+  rotated_at_us INTEGER NOT NULL,
+  last_seen_at_us INTEGER NOT NULL,
+  user_agent TEXT NOT NULL DEFAULT '',
+  remote_addr TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX "sessions_user" ON "sessions" (user);
@@ -0,0 +1,29 @@
+-- An append-only record of privileged actions. Each row's hash covers its
+-- contents and the previous row's hash, so changing, removing or reordering
+-- rows breaks the chain.
+CREATE TABLE "audit_log" (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  id TEXT NOT NULL UNIQUE,
+  ts_us INTEGER NOT NULL,
+  actor TEXT NOT NULL,
+  action TEXT NOT NULL,
+  target TEXT NOT NULL,
+  details TEXT NOT NULL,
+  remote_addr TEXT NOT NULL,
+  user_agent TEXT NOT NULL,
+  request_id TEXT NOT NULL,
+  prev_hash TEXT NOT NULL,
+  hash TEXT NOT NULL UNIQUE
+);
+CREATE INDEX "audit_log_actor" ON "audit_log" (actor, seq);
+CREATE INDEX "audit_log_action" ON "audit_log" (action, seq);
+CREATE INDEX "audit_log_target" ON "audit_log" (target, seq);
+
+CREATE TRIGGER "audit_log_no_update" BEFORE UPDATE ON "audit_log"
+BEGIN
+  SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
+CREATE TRIGGER "audit_log_no_delete" BEFORE DELETE ON "audit_log"
+BEGIN
+  SELECT RAISE(ABORT, 'the audit log is append-only');
+END;
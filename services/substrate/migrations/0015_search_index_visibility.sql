@@ -0,0 +1,33 @@
+-- Spaces and activities were indexed as public whatever their spaces'
+-- visibility. A space is public unless it's private, and an activity is public
+-- only if none of the spaces in its activityspec are private. A private
+-- activity is filed under the owner of one of those spaces.
+DROP VIEW "search_space_documents";
+CREATE VIEW "search_space_documents" AS
+  SELECT 'space' AS kind, id AS key, owner, is_private = 0 AS is_public, alias AS title,
+    id || ' ' || coalesce(owner, '') || ' ' || coalesce(forked_from_id, '') AS body
+  FROM "spaces"
+  WHERE deleted_at_us IS NULL;
+
+DROP VIEW "search_activity_documents";
+CREATE VIEW "search_activity_documents" AS
+  SELECT 'activity' AS kind, activityspec AS key,
+    coalesce(owner, (SELECT spaces.owner FROM "spaces" WHERE spaces.is_private AND instr(activities.activityspec, spaces.id) > 0 LIMIT 1)) AS owner,
+    NOT EXISTS (SELECT 1 FROM "spaces" WHERE spaces.is_private AND instr(activities.activityspec, spaces.id) > 0) AS is_public,
+    lens AS title, activityspec AS body
+  FROM "activities";
+
+-- The spaces triggers already reindex the space itself; these reindex the
+-- activities that use it.
+CREATE TRIGGER "search_spaces_activities_insert" AFTER INSERT ON "spaces" WHEN NEW.is_private BEGIN
+  DELETE FROM "search_index" WHERE kind = 'activity' AND instr(key, NEW.id) > 0;
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_activity_documents" WHERE instr(key, NEW.id) > 0;
+END;
+CREATE TRIGGER "search_spaces_activities_update" AFTER UPDATE OF is_private ON "spaces" BEGIN
+  DELETE FROM "search_index" WHERE kind = 'activity' AND instr(key, NEW.id) > 0;
+  INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_activity_documents" WHERE instr(key, NEW.id) > 0;
+END;
+
+DELETE FROM "search_index" WHERE kind IN ('space', 'activity');
+INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_space_documents";
+INSERT INTO "search_index" (kind, key, owner, is_public, title, body) SELECT * FROM "search_activity_documents";
@@ -0,0 +1,8 @@
+-- Backend bearer tokens were stored as is. Only keep their hashes; substrate
+-- hands the token to the gateway when it spawns, and never needs it again.
+DROP TABLE "backend_tokens";
+CREATE TABLE "backend_tokens" (
+  backend TEXT NOT NULL,
+  token_hash TEXT NOT NULL,
+  PRIMARY KEY (backend)
+);
@@ -0,0 +1,47 @@
+package substrate
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSEventTransport carries events over a NATS subject.
+type NATSEventTransport struct {
+	conn    *nats.Conn
+	subject string
+}
+
+func NewNATSEventTransport(conn *nats.Conn, subject string) *NATSEventTransport {
+	return &NATSEventTransport{conn: conn, subject: subject}
+}
+
+func (t *NATSEventTransport) Publish(event *Event) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return t.conn.Publish(t.subject, b)
+}
+
+func (t *NATSEventTransport) Subscribe(deliver func(*Event)) (func(), error) {
+	sub, err := t.conn.Subscribe(t.subject, func(msg *nats.Msg) {
+		var event Event
+		err := json.Unmarshal(msg.Data, &event)
+		if err != nil {
+			log.Printf("error decoding event from nats subject %s: %s", t.subject, err)
+			return
+		}
+		deliver(&event)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return func() { sub.Unsubscribe() }, nil
+}
+
+func (t *NATSEventTransport) Close() error {
+	t.conn.Close()
+	return nil
+}
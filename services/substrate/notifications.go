@@ -0,0 +1,194 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+)
+
+const NotificationTypeSpaceForked = "space-forked"
+const NotificationTypeSpaceCollected = "space-collected"
+const NotificationTypeSpaceSpawned = "space-spawned"
+
+// Notification tells User that Actor did something with one of their spaces.
+type Notification struct {
+	ID        string     `json:"id"`
+	User      string     `json:"user"`
+	Type      string     `json:"type"`
+	Actor     string     `json:"actor"`
+	SpaceID   string     `json:"space"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at,omitempty"`
+
+	// ForkID is the new space, for space-forked.
+	ForkID string `json:"fork,omitempty"`
+	// CollectionOwner and CollectionName are the collection the space was
+	// added to, for space-collected.
+	CollectionOwner string `json:"collection_owner,omitempty"`
+	CollectionName  string `json:"collection_name,omitempty"`
+	// ActivitySpec is what was spawned, for space-spawned.
+	ActivitySpec string `json:"viewspec,omitempty"`
+
+	cursor *Cursor
+}
+
+// Cursor returns the position of this notification in the list it came from.
+func (n *Notification) Cursor() *Cursor {
+	return n.cursor
+}
+
+type NotificationWhere struct {
+	User *string
+	IDs  []string
+
+	// Unread selects notifications that haven't (or have) been read.
+	Unread *bool
+}
+
+type NotificationListRequest struct {
+	NotificationWhere
+	Limit   *Limit
+	OrderBy *OrderBy
+	Cursor  *Cursor
+}
+
+const notificationsTable = "notifications"
+
+func (w *NotificationWhere) AppendWhere(query *Query) bool {
+	modified := false
+	if w.User != nil {
+		query.Where = append(query.Where, notificationsTable+".user = ?")
+		query.WhereValues = append(query.WhereValues, *w.User)
+		modified = true
+	}
+	if w.IDs != nil {
+		if len(w.IDs) == 0 {
+			query.Where = append(query.Where, "0")
+		} else {
+			placeholders := make([]string, 0, len(w.IDs))
+			for _, id := range w.IDs {
+				placeholders = append(placeholders, "?")
+				query.WhereValues = append(query.WhereValues, id)
+			}
+			query.Where = append(query.Where, notificationsTable+".id IN ("+strings.Join(placeholders, ", ")+")")
+		}
+		modified = true
+	}
+	if w.Unread != nil {
+		if *w.Unread {
+			query.Where = append(query.Where, notificationsTable+".read_at_us IS NULL")
+		} else {
+			query.Where = append(query.Where, notificationsTable+".read_at_us IS NOT NULL")
+		}
+		modified = true
+	}
+	return modified
+}
+
+func (s *Substrate) WriteNotification(ctx context.Context, n *Notification) error {
+	b, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	return s.dbExecContext(ctx, `INSERT INTO "notifications" (id, user, type, actor, space_id, created_at_us, notification) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		n.ID, n.User, n.Type, n.Actor, n.SpaceID, n.CreatedAt.UnixMicro(), string(b))
+}
+
+func (s *Substrate) ListNotifications(ctx context.Context, request *NotificationListRequest) ([]*Notification, error) {
+	query := &Query{
+		Select:          []string{"notification", "created_at_us", "read_at_us", "id"},
+		FromTablesNamed: map[string]string{notificationsTable: notificationsTable},
+		WherePredicates: map[string]bool{},
+		Limit:           request.Limit,
+		OrderBy:         request.OrderBy,
+		OrderByColumns:  []string{notificationsTable + ".created_at_us", notificationsTable + ".id"},
+		After:           request.Cursor,
+	}
+	if err := query.validate(); err != nil {
+		return nil, err
+	}
+	request.AppendWhere(query)
+
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	q, values := query.Render()
+	rows, err := s.dbQueryContext(ctx, q, values...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*Notification{}
+	for rows.Next() {
+		var b []byte
+		var createdAt int64
+		var readAt *int64
+		var id string
+		err := rows.Scan(&b, &createdAt, &readAt, &id)
+		if err != nil {
+			return nil, err
+		}
+		var n Notification
+		err = json.Unmarshal(b, &n)
+		if err != nil {
+			return nil, err
+		}
+		if readAt != nil {
+			t := time.UnixMicro(*readAt)
+			n.ReadAt = &t
+		}
+		n.cursor = newCursor(createdAt, id)
+		results = append(results, &n)
+	}
+
+	return results, rows.Err()
+}
+
+// MarkNotificationsRead marks the matching unread notifications as read. It
+// must be limited to a single user.
+func (s *Substrate) MarkNotificationsRead(ctx context.Context, request *NotificationWhere) error {
+	if request.User == nil {
+		return fmt.Errorf("can't mark notifications read without a user")
+	}
+
+	query := &Query{
+		Preamble:        []string{`UPDATE "notifications" SET read_at_us = ?`},
+		WherePredicates: map[string]bool{notificationsTable + ".read_at_us IS NULL": true},
+	}
+	request.AppendWhere(query)
+
+	q, values := query.Render()
+	return s.dbExecContext(ctx, q, append([]any{time.Now().UnixMicro()}, values...)...)
+}
+
+// notifySpaceOwner sends n to the owner of spaceID, unless they did it
+// themselves. Notifications are a side effect, so failures are only logged.
+func (s *Substrate) notifySpaceOwner(ctx context.Context, spaceID string, n *Notification) {
+	spaces, err := s.ListSpaces(ctx, &SpaceListQuery{
+		SpaceWhere:     SpaceWhere{ID: &spaceID},
+		IncludeDeleted: true,
+		Limit:          &Limit{1},
+	})
+	if err != nil {
+		LogFromContext(ctx).WithError(err).Warnf("error looking up owner of %s for %s notification", spaceID, n.Type)
+		return
+	}
+	if len(spaces) == 0 || spaces[0].Owner == "" || spaces[0].Owner == n.Actor {
+		return
+	}
+
+	n.ID = "ntf-" + ulid.Make().String()
+	n.User = spaces[0].Owner
+	n.SpaceID = spaceID
+	n.CreatedAt = time.Now()
+	err = s.WriteNotification(ctx, n)
+	if err != nil {
+		LogFromContext(ctx).WithError(err).Warnf("error writing %s notification", n.Type)
+	}
+}
@@ -0,0 +1,128 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func listTestNotifications(t *testing.T, s *Substrate, w NotificationWhere) []*Notification {
+	t.Helper()
+
+	notifications, err := s.ListNotifications(context.Background(), &NotificationListRequest{NotificationWhere: w})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return notifications
+}
+
+func TestSpaceOwnersAreNotified(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	alice, bob := "alice", "bob"
+
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+
+	// Only what others do with a space is worth telling its owner about.
+	writeTestFork(t, s, "sp-mine", "alice", false, "sp-a", time.Second)
+	writeTestFork(t, s, "sp-bobs", "bob", false, "sp-a", 2*time.Second)
+	for _, m := range []*CollectionMembership{
+		{Owner: "bob", Name: "faves", SpaceID: "sp-a", CreatedAt: time.Now()},
+		{Owner: "alice", Name: "mine", SpaceID: "sp-a", CreatedAt: time.Now()},
+		{Owner: "system", Name: "spawn", SpaceID: "sp-a", CreatedAt: time.Now()},
+	} {
+		if err := s.WriteCollectionMembership(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	notifications := listTestNotifications(t, s, NotificationWhere{User: &alice})
+	if len(notifications) != 2 {
+		t.Fatalf("expected 2 notifications, got %d", len(notifications))
+	}
+	forked, collected := notifications[0], notifications[1]
+	if forked.Type != NotificationTypeSpaceForked || forked.Actor != "bob" || forked.SpaceID != "sp-a" || forked.ForkID != "sp-bobs" {
+		t.Errorf("unexpected fork notification %#v", forked)
+	}
+	if collected.Type != NotificationTypeSpaceCollected || collected.Actor != "bob" || collected.CollectionOwner != "bob" || collected.CollectionName != "faves" {
+		t.Errorf("unexpected collection notification %#v", collected)
+	}
+	if n := listTestNotifications(t, s, NotificationWhere{User: &bob}); len(n) != 0 {
+		t.Errorf("expected bob to have no notifications, got %d", len(n))
+	}
+}
+
+func TestMarkNotificationsRead(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	alice, bob := "alice", "bob"
+	unread, read := true, false
+
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+	writeTestFork(t, s, "sp-b1", "bob", false, "sp-a", time.Second)
+	writeTestFork(t, s, "sp-b2", "bob", false, "sp-a", 2*time.Second)
+	notifications := listTestNotifications(t, s, NotificationWhere{User: &alice, Unread: &unread})
+	if len(notifications) != 2 {
+		t.Fatalf("expected 2 unread notifications, got %d", len(notifications))
+	}
+
+	if err := s.MarkNotificationsRead(ctx, &NotificationWhere{IDs: []string{notifications[0].ID}}); err == nil {
+		t.Fatalf("expected marking notifications read without a user to fail")
+	}
+
+	// Bob can't mark alice's notifications read.
+	if err := s.MarkNotificationsRead(ctx, &NotificationWhere{User: &bob, IDs: []string{notifications[0].ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := listTestNotifications(t, s, NotificationWhere{User: &alice, Unread: &unread}); len(n) != 2 {
+		t.Fatalf("expected bob to leave alice's notifications unread, got %d unread", len(n))
+	}
+
+	if err := s.MarkNotificationsRead(ctx, &NotificationWhere{User: &alice, IDs: []string{notifications[0].ID}}); err != nil {
+		t.Fatal(err)
+	}
+	if n := listTestNotifications(t, s, NotificationWhere{User: &alice, Unread: &unread}); len(n) != 1 || n[0].ID != notifications[1].ID {
+		t.Fatalf("expected only the second notification to be unread, got %v", n)
+	}
+	if n := listTestNotifications(t, s, NotificationWhere{User: &alice, Unread: &read}); len(n) != 1 || n[0].ReadAt == nil {
+		t.Fatalf("expected the first notification to be read, got %v", n)
+	}
+
+	// Marking everything read leaves nothing unread.
+	if err := s.MarkNotificationsRead(ctx, &NotificationWhere{User: &alice}); err != nil {
+		t.Fatal(err)
+	}
+	if n := listTestNotifications(t, s, NotificationWhere{User: &alice, Unread: &unread}); len(n) != 0 {
+		t.Fatalf("expected no unread notifications, got %d", len(n))
+	}
+}
+
+func TestNotificationsPageWithCursor(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	alice := "alice"
+
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+	for i, id := range []string{"sp-b1", "sp-b2", "sp-b3"} {
+		writeTestFork(t, s, id, "bob", false, "sp-a", time.Duration(i+1)*time.Second)
+	}
+
+	forks := []string{}
+	request := &NotificationListRequest{NotificationWhere: NotificationWhere{User: &alice}, Limit: &Limit{2}}
+	for {
+		page, err := s.ListNotifications(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range page {
+			forks = append(forks, n.ForkID)
+		}
+		if len(page) < 2 {
+			break
+		}
+		request.Cursor = page[len(page)-1].Cursor()
+	}
+	if len(forks) != 3 || forks[0] != "sp-b1" || forks[1] != "sp-b2" || forks[2] != "sp-b3" {
+		t.Fatalf("expected the forks' notifications in order, got %v", forks)
+	}
+}
@@ -0,0 +1,181 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const SearchKindSpace = "space"
+const SearchKindCollection = "collection"
+const SearchKindActivity = "activity"
+
+type SearchRequest struct {
+	// Query is matched against aliases, collection labels and attributes,
+	// activityspecs and lens names. Each word matches as a prefix.
+	Query string
+
+	// User sees public results, their own private collections and the
+	// private spaces they may read.
+	User string
+
+	// Kinds limits results to the given kinds. Empty means all kinds.
+	Kinds []string
+
+	Limit  *Limit
+	Cursor *Cursor
+}
+
+type SearchResult struct {
+	Kind    string  `json:"kind"`
+	Snippet string  `json:"snippet"`
+	Rank    float64 `json:"rank"`
+
+	Space      *Space      `json:"space,omitempty"`
+	Collection *Collection `json:"collection,omitempty"`
+	Activity   *Activity   `json:"activity,omitempty"`
+}
+
+type SearchResults struct {
+	Results    []*SearchResult `json:"results"`
+	NextCursor *Cursor         `json:"next_cursor,omitempty"`
+}
+
+// searchMatchExpression turns free text into an FTS5 query. Every word must
+// match, as a prefix, so that a few characters of a ULID are enough to find it.
+// Words are quoted so FTS5 operators and punctuation are taken literally.
+func searchMatchExpression(q string) string {
+	terms := []string{}
+	for _, word := range strings.Fields(q) {
+		word = strings.ReplaceAll(word, `"`, `""`)
+		terms = append(terms, `"`+word+`"*`)
+	}
+	return strings.Join(terms, " ")
+}
+
+func (s *Substrate) Search(ctx context.Context, request *SearchRequest) (*SearchResults, error) {
+	match := searchMatchExpression(request.Query)
+	if match == "" {
+		return nil, fmt.Errorf("search query must not be empty")
+	}
+
+	limit := request.Limit
+	if limit == nil {
+		limit = &Limit{20}
+	}
+
+	// Ranks shift as the index changes, so search cursors are just offsets.
+	var offset int64
+	if request.Cursor != nil {
+		var ok bool
+		if len(request.Cursor.values) == 1 {
+			offset, ok = request.Cursor.values[0].(int64)
+		}
+		if !ok || offset < 0 {
+			return nil, fmt.Errorf("invalid cursor for search")
+		}
+	}
+
+	// Collaborators may also read private spaces, and the activities that use
+	// them. Every hit is checked again as it's looked up below.
+	where := []string{`search_index MATCH ?`, `(search_index.is_public OR search_index.owner = ? OR EXISTS (SELECT 1 FROM "space_collaborators" WHERE space_collaborators.user = ? AND ` +
+		`((search_index.kind = 'space' AND space_collaborators.space_id = search_index.key) OR (search_index.kind = 'activity' AND instr(search_index.key, space_collaborators.space_id) > 0))))`}
+	values := []any{match, request.User, request.User}
+	if len(request.Kinds) > 0 {
+		where = append(where, `search_index.kind IN (`+strings.TrimSuffix(strings.Repeat("?, ", len(request.Kinds)), ", ")+`)`)
+		for _, kind := range request.Kinds {
+			values = append(values, kind)
+		}
+	}
+
+	// Fetch one extra row to know whether there's another page.
+	q := `SELECT kind, key, snippet(search_index, -1, '[', ']', '…', 12), rank FROM search_index WHERE ` +
+		strings.Join(where, " AND ") + ` ORDER BY rank LIMIT ? OFFSET ?`
+	values = append(values, limit.Limit+1, offset)
+
+	type hit struct {
+		kind, key string
+		result    *SearchResult
+	}
+	hits := []*hit{}
+
+	err := func() error {
+		s.Mu.RLock()
+		defer s.Mu.RUnlock()
+
+		rows, err := s.dbQueryContext(ctx, q, values...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			h := &hit{result: &SearchResult{}}
+			err := rows.Scan(&h.kind, &h.key, &h.result.Snippet, &h.result.Rank)
+			if err != nil {
+				return err
+			}
+			h.result.Kind = h.kind
+			hits = append(hits, h)
+		}
+		return rows.Err()
+	}()
+	if err != nil {
+		return nil, err
+	}
+
+	results := &SearchResults{Results: []*SearchResult{}}
+	if len(hits) > limit.Limit {
+		hits = hits[:limit.Limit]
+		results.NextCursor = newCursor(offset + int64(limit.Limit))
+	}
+
+	// Look up each hit so results carry the same objects the list endpoints return.
+	for _, h := range hits {
+		key := h.key
+		switch h.kind {
+		case SearchKindSpace:
+			spaces, err := s.ListSpaces(ctx, &SpaceListQuery{
+				SpaceWhere: SpaceWhere{ID: &key, VisibleTo: &request.User},
+				Limit:      &Limit{1},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(spaces) == 0 {
+				continue
+			}
+			h.result.Space = spaces[0]
+		case SearchKindCollection:
+			owner, name, _ := strings.Cut(key, "/")
+			collections, err := s.ListCollections(ctx, &CollectionListQuery{
+				CollectionMembershipWhere: CollectionMembershipWhere{Owner: &owner, Name: &name},
+				Limit:                     &Limit{1},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(collections) == 0 {
+				continue
+			}
+			h.result.Collection = collections[0]
+		case SearchKindActivity:
+			activities, err := s.ListActivities(ctx, &ActivityListRequest{
+				ActivityWhere: ActivityWhere{ActivitySpec: &key, VisibleTo: &request.User},
+				Limit:         &Limit{1},
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(activities) == 0 {
+				continue
+			}
+			h.result.Activity = activities[0]
+		default:
+			continue
+		}
+		results.Results = append(results.Results, h.result)
+	}
+
+	return results, nil
+}
@@ -0,0 +1,198 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func searchKeys(t *testing.T, s *Substrate, user, query string) map[string]bool {
+	t.Helper()
+
+	results, err := s.Search(context.Background(), &SearchRequest{Query: query, User: user})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string]bool{}
+	for _, r := range results.Results {
+		switch {
+		case r.Space != nil:
+			keys[r.Space.ID] = true
+		case r.Activity != nil:
+			keys[r.Activity.ActivitySpec] = true
+		case r.Collection != nil:
+			keys[r.Collection.Owner+"/"+r.Collection.Name] = true
+		}
+	}
+	return keys
+}
+
+func TestSearchHidesPrivateSpacesAndTheirActivities(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+
+	writeTestSpace(t, s, "sp-secretspace", "alice", true, 0)
+	writeTestSpace(t, s, "sp-openspace", "alice", false, time.Second)
+	for _, spec := range []string{"files[data=sp-secretspace]", "files[data=sp-openspace]"} {
+		if err := s.WriteActivity(ctx, &Activity{ActivitySpec: spec, Lens: "files", CreatedAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for user, expect := range map[string]map[string]bool{
+		"alice": {"sp-secretspace": true, "files[data=sp-secretspace]": true},
+		"carol": {"sp-secretspace": true, "files[data=sp-secretspace]": true},
+		"bob":   {},
+	} {
+		if user == "carol" {
+			if err := s.SetSpaceCollaborator(ctx, &SpaceCollaborator{SpaceID: "sp-secretspace", User: "carol", Role: SpaceRoleViewer}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := searchKeys(t, s, user, "secretspace")
+		if len(got) != len(expect) {
+			t.Fatalf("expected %s to find %v, got %v", user, expect, got)
+		}
+		for key := range expect {
+			if !got[key] {
+				t.Fatalf("expected %s to find %s, got %v", user, key, got)
+			}
+		}
+	}
+
+	if got := searchKeys(t, s, "bob", "openspace"); !got["sp-openspace"] || !got["files[data=sp-openspace]"] {
+		t.Fatalf("expected bob to find the public space and its activity, got %v", got)
+	}
+
+	// Making a space private hides the activities that use it too.
+	private := true
+	if err := s.PatchSpace(ctx, &SpaceListingPatch{ID: "sp-openspace", IsPrivate: &private}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchKeys(t, s, "bob", "openspace"); len(got) != 0 {
+		t.Fatalf("expected bob to find nothing once the space is private, got %v", got)
+	}
+
+	activities, err := s.ListActivities(ctx, &ActivityListRequest{ActivityWhere: ActivityWhere{VisibleTo: stringPtr("bob")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(activities) != 0 {
+		t.Fatalf("expected bob to see no activities, got %d", len(activities))
+	}
+}
+
+func TestSearchMatchExpression(t *testing.T) {
+	for q, expect := range map[string]string{
+		"":                "",
+		"01H3":            `"01H3"*`,
+		"  quarterly  re": `"quarterly"* "re"*`,
+		`say "hi" OR -x`:  `"say"* """hi"""* "OR"* "-x"*`,
+	} {
+		if got := searchMatchExpression(q); got != expect {
+			t.Errorf("expected %q to be %s, got %s", q, expect, got)
+		}
+	}
+}
+
+func TestSearchFollowsChangesToWhatItIndexes(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+
+	writeTestSpace(t, s, "sp-01h3abc", "alice", false, 0)
+	if err := s.WriteActivity(ctx, &Activity{ActivitySpec: "notebook[data=sp-01h3abc]", Lens: "notebook", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "reports", Label: "Quarterly Reports", IsPublic: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A few characters of an ID are enough, and so are the lens name and
+	// any word of a collection's label.
+	if got := searchKeys(t, s, "bob", "01h3"); !got["sp-01h3abc"] || !got["notebook[data=sp-01h3abc]"] {
+		t.Fatalf("expected the space and its activity to match a prefix of its ID, got %v", got)
+	}
+	if got := searchKeys(t, s, "bob", "noteb"); !got["notebook[data=sp-01h3abc]"] {
+		t.Fatalf("expected the activity to match its lens, got %v", got)
+	}
+	if got := searchKeys(t, s, "bob", "quart"); !got["alice/reports"] {
+		t.Fatalf("expected the collection to match its label, got %v", got)
+	}
+
+	results, err := s.Search(ctx, &SearchRequest{Query: "01h3", User: "bob", Kinds: []string{SearchKindActivity}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results) != 1 || results.Results[0].Kind != SearchKindActivity {
+		t.Fatalf("expected only the activity, got %d results", len(results.Results))
+	}
+
+	// Renaming the space reindexes it.
+	alias := "budget"
+	if err := s.PatchSpace(ctx, &SpaceListingPatch{ID: "sp-01h3abc", Alias: &alias}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchKeys(t, s, "bob", "budget"); !got["sp-01h3abc"] {
+		t.Fatalf("expected the space to match its new alias, got %v", got)
+	}
+
+	// Trashed spaces drop out of results, and come back when restored.
+	id := "sp-01h3abc"
+	if err := s.DeleteSpace(ctx, &SpaceWhere{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchKeys(t, s, "bob", "budget"); len(got) != 0 {
+		t.Fatalf("expected the trashed space not to match, got %v", got)
+	}
+	if err := s.RestoreSpace(ctx, &SpaceWhere{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+	if got := searchKeys(t, s, "bob", "budget"); !got["sp-01h3abc"] {
+		t.Fatalf("expected the restored space to match, got %v", got)
+	}
+
+	if _, err := s.Search(ctx, &SearchRequest{Query: "  ", User: "bob"}); err == nil {
+		t.Fatalf("expected an empty query to be an error")
+	}
+}
+
+func TestSearchPagesWithCursor(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+
+	for i := 0; i < 5; i++ {
+		writeTestSpace(t, s, fmt.Sprintf("sp-page%d", i), "alice", false, time.Duration(i)*time.Second)
+	}
+
+	seen := map[string]bool{}
+	request := &SearchRequest{Query: "page", User: "alice", Limit: &Limit{2}}
+	for pages := 1; ; pages++ {
+		results, err := s.Search(ctx, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range results.Results {
+			if seen[r.Space.ID] {
+				t.Fatalf("expected each space once, got %s again on page %d", r.Space.ID, pages)
+			}
+			seen[r.Space.ID] = true
+		}
+		if results.NextCursor == nil {
+			if pages != 3 {
+				t.Fatalf("expected 3 pages, got %d", pages)
+			}
+			break
+		}
+
+		// Cursors survive the trip through a URL.
+		cursor, err := ParseCursor(results.NextCursor.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Cursor = cursor
+	}
+	if len(seen) != 5 {
+		t.Fatalf("expected all 5 spaces, got %v", seen)
+	}
+}
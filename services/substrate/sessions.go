@@ -0,0 +1,157 @@
+package substrate
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+)
+
+// Session is a browser login. Its token lives in the browser's cookie and
+// changes every so often; only hashes of the current and previous tokens are
+// kept here.
+type Session struct {
+	ID         string    `json:"id"`
+	User       string    `json:"user"`
+	CreatedAt  time.Time `json:"created_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	RotatedAt  time.Time `json:"rotated_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+}
+
+const sessionColumns = `id, user, created_at_us, expires_at_us, rotated_at_us, last_seen_at_us, user_agent, remote_addr`
+
+func scanSession(scan func(dest ...any) error, extra ...any) (*Session, error) {
+	var o Session
+	var createdAt, expiresAt, rotatedAt, lastSeenAt int64
+	dest := append([]any{&o.ID, &o.User, &createdAt, &expiresAt, &rotatedAt, &lastSeenAt, &o.UserAgent, &o.RemoteAddr}, extra...)
+	if err := scan(dest...); err != nil {
+		return nil, err
+	}
+	o.CreatedAt = time.UnixMicro(createdAt)
+	o.ExpiresAt = time.UnixMicro(expiresAt)
+	o.RotatedAt = time.UnixMicro(rotatedAt)
+	o.LastSeenAt = time.UnixMicro(lastSeenAt)
+	return &o, nil
+}
+
+// CreateSession stores a new session with the given token and sets its ID.
+// Expired sessions are cleaned up as it goes.
+func (s *Substrate) CreateSession(ctx context.Context, o *Session, token string) error {
+	if o.User == "" {
+		return fmt.Errorf("a session must belong to a user")
+	}
+	if !o.ExpiresAt.After(o.CreatedAt) {
+		return fmt.Errorf("a session must expire after it's created")
+	}
+
+	err := s.dbExecContext(ctx, `DELETE FROM "sessions" WHERE expires_at_us <= ?`, o.CreatedAt.UnixMicro())
+	if err != nil {
+		return err
+	}
+
+	o.ID = "ses-" + ulid.Make().String()
+	return s.dbExecContext(ctx, `INSERT INTO "sessions" (id, user, token_hash, created_at_us, expires_at_us, rotated_at_us, last_seen_at_us, user_agent, remote_addr) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		o.ID, o.User, hashAPIToken(token), o.CreatedAt.UnixMicro(), o.ExpiresAt.UnixMicro(), o.RotatedAt.UnixMicro(), o.LastSeenAt.UnixMicro(), o.UserAgent, o.RemoteAddr)
+}
+
+// FindSession returns the session with the given token, or nil if there's
+// none. previous is set if the token is the one the session was last rotated
+// away from. Expired sessions are returned as-is; it's up to the caller to
+// refuse them.
+func (s *Substrate) FindSession(ctx context.Context, token string) (o *Session, previous bool, err error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	hash := hashAPIToken(token)
+	rows, err := s.dbQueryContext(ctx, `SELECT `+sessionColumns+`, token_hash = ? FROM "sessions" WHERE token_hash = ? OR previous_token_hash = ?`, hash, hash, hash)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return nil, false, rows.Err()
+	}
+	var current bool
+	o, err = scanSession(rows.Scan, &current)
+	if err != nil {
+		return nil, false, err
+	}
+	return o, !current, nil
+}
+
+// RotateSession gives a session newToken in place of token. token is kept as
+// its previous token, and the one before that stops working. If token isn't
+// the session's current token any more, because another request rotated it
+// first, nothing changes and rotated is false.
+func (s *Substrate) RotateSession(ctx context.Context, id, token, newToken string, now time.Time) (rotated bool, err error) {
+	s.Mu.Lock()
+	defer s.Mu.Unlock()
+
+	q := `UPDATE "sessions" SET previous_token_hash = token_hash, token_hash = ?, rotated_at_us = ?, last_seen_at_us = ? WHERE id = ? AND token_hash = ?`
+	values := []any{hashAPIToken(newToken), now.UnixMicro(), now.UnixMicro(), id, hashAPIToken(token)}
+	res, err := s.DB.ExecContext(ctx, q, values...)
+	if err != nil {
+		return false, wrapSQLError(err, q, values...)
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// TouchSession notes that a session was used.
+func (s *Substrate) TouchSession(ctx context.Context, id string, now time.Time) error {
+	return s.dbExecContext(ctx, `UPDATE "sessions" SET last_seen_at_us = ? WHERE id = ?`, now.UnixMicro(), id)
+}
+
+// DeleteSession revokes a session, whoever it belongs to.
+func (s *Substrate) DeleteSession(ctx context.Context, id string) error {
+	return s.dbExecContext(ctx, `DELETE FROM "sessions" WHERE id = ?`, id)
+}
+
+// ListSessions returns a user's unexpired sessions, most recently used first.
+func (s *Substrate) ListSessions(ctx context.Context, user string, now time.Time) ([]*Session, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT `+sessionColumns+` FROM "sessions" WHERE user = ? AND expires_at_us > ? ORDER BY last_seen_at_us DESC, id`, user, now.UnixMicro())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*Session{}
+	for rows.Next() {
+		o, err := scanSession(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, o)
+	}
+
+	return results, rows.Err()
+}
+
+// RevokeSession deletes one of a user's sessions. It returns false if the user
+// has no such session.
+func (s *Substrate) RevokeSession(ctx context.Context, user, id string) (bool, error) {
+	found, err := func() (bool, error) {
+		s.Mu.RLock()
+		defer s.Mu.RUnlock()
+
+		rows, err := s.dbQueryContext(ctx, `SELECT 1 FROM "sessions" WHERE id = ? AND user = ?`, id, user)
+		if err != nil {
+			return false, err
+		}
+		defer rows.Close()
+
+		return rows.Next(), rows.Err()
+	}()
+	if err != nil || !found {
+		return false, err
+	}
+	return true, s.dbExecContext(ctx, `DELETE FROM "sessions" WHERE id = ? AND user = ?`, id, user)
+}
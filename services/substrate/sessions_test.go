@@ -0,0 +1,38 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRotateSessionOnlyOnce(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	o := &Session{User: "alice", CreatedAt: now, ExpiresAt: now.Add(time.Hour), RotatedAt: now, LastSeenAt: now}
+	if err := s.CreateSession(ctx, o, "first"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two requests with the same token both try to rotate it.
+	if rotated, err := s.RotateSession(ctx, o.ID, "first", "second", now); err != nil || !rotated {
+		t.Fatalf("expected the first rotation to win, got %v, %v", rotated, err)
+	}
+	if rotated, err := s.RotateSession(ctx, o.ID, "first", "third", now); err != nil || rotated {
+		t.Fatalf("expected the second rotation to lose, got %v, %v", rotated, err)
+	}
+
+	for token, previous := range map[string]bool{"first": true, "second": false} {
+		found, p, err := s.FindSession(ctx, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found == nil || found.ID != o.ID || p != previous {
+			t.Errorf("expected %s to find the session with previous=%v, got %v, %v", token, previous, found, p)
+		}
+	}
+	if found, _, err := s.FindSession(ctx, "third"); err != nil || found != nil {
+		t.Errorf("expected the losing token not to work, got %v, %v", found, err)
+	}
+}
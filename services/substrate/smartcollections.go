@@ -0,0 +1,202 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Smart collections have a saved query on their root membership, under
+// CollectionQueryAttribute. Their members are whatever spaces the query
+// matches when they're listed, so they can't be added to or reordered.
+
+const CollectionQueryAttribute = "system:query"
+
+// maxSmartCollectionMembers bounds how many spaces a smart collection lists.
+const maxSmartCollectionMembers = 1000
+
+type ReadOnlyCollectionError struct {
+	Owner string
+	Name  string
+}
+
+func (e *ReadOnlyCollectionError) Error() string {
+	return fmt.Sprintf("collection %s/%s is defined by a query; its members can't be changed", e.Owner, e.Name)
+}
+
+// SpaceQuery selects the spaces in a smart collection. Every field that's set
+// must match.
+type SpaceQuery struct {
+	Owner        *string `json:"owner,omitempty"`
+	ForkedFromID *string `json:"forked_from_id,omitempty"`
+
+	// Lens selects spaces that have been spawned with the lens.
+	Lens *string `json:"lens,omitempty"`
+
+	// CreatedWithin selects spaces created within this long before now, as a
+	// Go duration or a number of days, e.g. "36h" or "7d".
+	CreatedWithin string `json:"created_within,omitempty"`
+
+	// Attributes selects spaces with these attributes in a collection the
+	// smart collection's owner can see.
+	Attributes map[string]any `json:"attributes,omitempty"`
+}
+
+func parseSpaceQuery(v any) (*SpaceQuery, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	q := &SpaceQuery{}
+	err = json.Unmarshal(b, q)
+	if err != nil {
+		return nil, err
+	}
+	return q, q.validate()
+}
+
+func parseCreatedWithin(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid created_within %q: %w", s, err)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid created_within %q: %w", s, err)
+	}
+	return d, nil
+}
+
+func (q *SpaceQuery) validate() error {
+	if q.CreatedWithin != "" {
+		if _, err := parseCreatedWithin(q.CreatedWithin); err != nil {
+			return err
+		}
+	}
+	for k, v := range q.Attributes {
+		if k == "" || strings.Contains(k, `"`) {
+			return fmt.Errorf("invalid attribute name %q", k)
+		}
+		switch v.(type) {
+		case string, float64, bool:
+		default:
+			return fmt.Errorf("attribute %q must be a string, number or boolean", k)
+		}
+	}
+	return nil
+}
+
+// SpaceWhere turns the query into a SpaceWhere for a smart collection owned by
+// owner, evaluated at now.
+func (q *SpaceQuery) SpaceWhere(owner string, now time.Time) (*SpaceWhere, error) {
+	where := &SpaceWhere{
+		Owner:        q.Owner,
+		ForkedFromID: q.ForkedFromID,
+	}
+
+	if q.CreatedWithin != "" {
+		d, err := parseCreatedWithin(q.CreatedWithin)
+		if err != nil {
+			return nil, err
+		}
+		after := now.Add(-d)
+		where.CreatedAfter = &after
+	}
+
+	if q.Lens != nil {
+		where.HasMemberships = append(where.HasMemberships, &CollectionMembershipWhere{
+			Owner: stringPtr("system"),
+			Name:  stringPtr("spawn"),
+			Lens:  q.Lens,
+		})
+	}
+
+	if len(q.Attributes) > 0 {
+		where.HasMemberships = append(where.HasMemberships, &CollectionMembershipWhere{
+			Attributes: q.Attributes,
+			VisibleTo:  &owner,
+		})
+	}
+
+	return where, nil
+}
+
+// smartCollectionSpaceWhere returns the spaces smart collection c has as
+// members. It never matches more than the collection's owner could see, nor
+// private spaces in a public collection.
+func smartCollectionSpaceWhere(c *Collection) (*SpaceWhere, error) {
+	where, err := c.Query.SpaceWhere(c.Owner, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	where.VisibleTo = &c.Owner
+	if c.IsPublic {
+		where.IsPrivate = boolPtr(false)
+	}
+	return where, nil
+}
+
+// listSmartCollectionMembers returns the members of smart collection c, the
+// spaces its query matches, oldest first.
+func (s *Substrate) listSmartCollectionMembers(ctx context.Context, c *Collection, limit *Limit, orderBy *OrderBy, cursor *Cursor) ([]*CollectionMember, error) {
+	where, err := smartCollectionSpaceWhere(c)
+	if err != nil {
+		return nil, err
+	}
+	spaces, err := s.ListSpaces(ctx, &SpaceListQuery{
+		SpaceWhere: *where,
+		Limit:      limit,
+		OrderBy:    orderBy,
+		Cursor:     cursor,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]*CollectionMember, 0, len(spaces))
+	for _, space := range spaces {
+		members = append(members, &CollectionMember{
+			SpaceID:   space.ID,
+			CreatedAt: space.CreatedAt,
+			IsPublic:  c.IsPublic,
+			cursor:    space.Cursor(),
+		})
+	}
+	return members, nil
+}
+
+// resolveSmartCollection fills in the members of c if it's a smart collection.
+func (s *Substrate) resolveSmartCollection(ctx context.Context, c *Collection) error {
+	if c.Query == nil {
+		return nil
+	}
+
+	members, err := s.listSmartCollectionMembers(ctx, c, &Limit{maxSmartCollectionMembers}, nil, nil)
+	if err != nil {
+		return err
+	}
+	c.Members = members
+	return nil
+}
+
+// CheckCollectionMembersWritable returns a ReadOnlyCollectionError if the
+// collection is a smart collection.
+func (s *Substrate) CheckCollectionMembersWritable(ctx context.Context, owner, name string) error {
+	collections, err := s.listCollections(ctx, &CollectionListQuery{
+		CollectionMembershipWhere: CollectionMembershipWhere{Owner: &owner, Name: &name},
+		Limit:                     &Limit{1},
+	})
+	if err != nil {
+		return err
+	}
+	if len(collections) > 0 && collections[0].Query != nil {
+		return &ReadOnlyCollectionError{Owner: owner, Name: name}
+	}
+	return nil
+}
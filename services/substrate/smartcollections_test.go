@@ -0,0 +1,133 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// smartCollectionMembers creates a smart collection with q and returns the
+// IDs of its members.
+func smartCollectionMembers(t *testing.T, s *Substrate, owner, name string, public bool, q *SpaceQuery) []string {
+	t.Helper()
+
+	ctx := context.Background()
+	if err := s.CreateCollection(ctx, &Collection{Owner: owner, Name: name, IsPublic: public, Query: q}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.getCollection(ctx, owner, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{}
+	for _, m := range c.Members {
+		ids = append(ids, m.SpaceID)
+	}
+	return ids
+}
+
+func TestSmartCollectionQueries(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+
+	// sp-old was made long ago; the rest were made within the last hour.
+	writeTestSpace(t, s, "sp-old", "alice", false, 0)
+	recent := func(id, owner string, private bool, forkedFrom *string, ago time.Duration) {
+		err := s.WriteSpace(ctx, &Space{ID: id, Owner: owner, Alias: id, CreatedAt: time.Now().Add(-ago), IsPrivate: private, ForkedFromID: forkedFrom})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recent("sp-paper", "alice", false, nil, 50*time.Minute)
+	recent("sp-fork", "bob", false, stringPtr("sp-paper"), 40*time.Minute)
+	recent("sp-secret", "alice", true, stringPtr("sp-paper"), 30*time.Minute)
+
+	for _, m := range []*CollectionMembership{
+		{Owner: "system", Name: "spawn", SpaceID: "sp-fork", LensSpec: "jupyverse"},
+		{Owner: "system", Name: "spawn", SpaceID: "sp-old", LensSpec: "files"},
+		{Owner: "alice", Name: "reading", SpaceID: "sp-paper", Attributes: map[string]any{"tag": "paper"}},
+		{Owner: "alice", Name: "reading", SpaceID: "sp-old", Attributes: map[string]any{"tag": "draft"}},
+	} {
+		m.CreatedAt = time.Now()
+		if err := s.WriteCollectionMembership(ctx, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		owner, name string
+		public      bool
+		query       *SpaceQuery
+		want        []string
+	}{
+		{"alice", "forks", false, &SpaceQuery{ForkedFromID: stringPtr("sp-paper")}, []string{"sp-fork", "sp-secret"}},
+		// A public smart collection never lists private spaces.
+		{"alice", "public-forks", true, &SpaceQuery{ForkedFromID: stringPtr("sp-paper")}, []string{"sp-fork"}},
+		// Nor does it list spaces its owner can't see.
+		{"bob", "forks", false, &SpaceQuery{ForkedFromID: stringPtr("sp-paper")}, []string{"sp-fork"}},
+		{"alice", "jupyverse", false, &SpaceQuery{Lens: stringPtr("jupyverse")}, []string{"sp-fork"}},
+		{"alice", "this-week", false, &SpaceQuery{Owner: stringPtr("alice"), CreatedWithin: "7d"}, []string{"sp-paper", "sp-secret"}},
+		{"alice", "last-45m", false, &SpaceQuery{CreatedWithin: "45m"}, []string{"sp-fork", "sp-secret"}},
+		{"alice", "papers", false, &SpaceQuery{Attributes: map[string]any{"tag": "paper"}}, []string{"sp-paper"}},
+		// Bob can't see alice's private collection, so its attributes don't count.
+		{"bob", "papers", false, &SpaceQuery{Attributes: map[string]any{"tag": "paper"}}, []string{}},
+	} {
+		got := smartCollectionMembers(t, s, tc.owner, tc.name, tc.public, tc.query)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("expected %s/%s to have %v, got %v", tc.owner, tc.name, tc.want, got)
+		}
+	}
+}
+
+func TestSmartCollectionsAreReadOnly(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "mine", Query: &SpaceQuery{Owner: stringPtr("alice")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var readOnly *ReadOnlyCollectionError
+	if err := s.CheckCollectionMembersWritable(ctx, "alice", "mine"); !errors.As(err, &readOnly) {
+		t.Fatalf("expected a smart collection's members to be read-only, got %v", err)
+	}
+	if err := s.ReorderCollection(ctx, "alice", "mine", []*CollectionMemberRef{{SpaceID: "sp-a"}}); !errors.As(err, &readOnly) {
+		t.Fatalf("expected reordering a smart collection to fail, got %v", err)
+	}
+
+	// Its query can still change.
+	if err := s.PatchCollection(ctx, &CollectionPatch{Owner: "alice", Name: "mine", Query: &SpaceQuery{Owner: stringPtr("bob")}}); err != nil {
+		t.Fatal(err)
+	}
+	c, err := s.getCollection(ctx, "alice", "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Query == nil || *c.Query.Owner != "bob" || len(c.Members) != 0 {
+		t.Fatalf("expected the new query to apply, got %#v", c)
+	}
+
+	// Ordinary collections with members can't become smart ones.
+	if err := s.WriteCollectionMembership(ctx, &CollectionMembership{Owner: "alice", Name: "faves", SpaceID: "sp-a", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.CheckCollectionMembersWritable(ctx, "alice", "faves"); err != nil {
+		t.Fatalf("expected an ordinary collection to be writable, got %v", err)
+	}
+	if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "faves", Query: &SpaceQuery{}}); err == nil {
+		t.Fatalf("expected giving a collection with members a query to fail")
+	}
+
+	for _, q := range []*SpaceQuery{
+		{CreatedWithin: "soon"},
+		{Attributes: map[string]any{"tag": []any{"a", "b"}}},
+		{Attributes: map[string]any{`"`: "x"}},
+	} {
+		if err := s.CreateCollection(ctx, &Collection{Owner: "alice", Name: "bad", Query: q}); err == nil {
+			t.Errorf("expected query %#v to be refused", q)
+		}
+	}
+}
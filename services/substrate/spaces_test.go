@@ -0,0 +1,114 @@
+package substrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTrashAndRestoreSpace(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+	id := "sp-a"
+
+	if err := s.DeleteSpace(ctx, &SpaceWhere{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+	spaces, err := s.ListSpaces(ctx, &SpaceListQuery{SpaceWhere: SpaceWhere{ID: &id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spaces) != 0 {
+		t.Error("expected a space in the trash to be left out of listings")
+	}
+	trash, err := s.ListSpaces(ctx, &SpaceListQuery{SpaceWhere: SpaceWhere{ID: &id, Deleted: boolPtr(true)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trash) != 1 || trash[0].DeletedAt == nil {
+		t.Fatalf("expected the space in the trash, got %v", trash)
+	}
+	var trashed *SpaceTrashedError
+	if err := s.CheckSpaceViewRequest(ctx, &SpaceViewRequest{SpaceID: id}); !errors.As(err, &trashed) {
+		t.Errorf("expected opening a trashed space to fail with SpaceTrashedError, got %v", err)
+	}
+
+	if err := s.RestoreSpace(ctx, &SpaceWhere{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+	spaces, err = s.ListSpaces(ctx, &SpaceListQuery{SpaceWhere: SpaceWhere{ID: &id}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spaces) != 1 || spaces[0].DeletedAt != nil {
+		t.Errorf("expected the space to be restored, got %v", spaces)
+	}
+	if err := s.CheckSpaceViewRequest(ctx, &SpaceViewRequest{SpaceID: id}); err != nil {
+		t.Errorf("expected a restored space to open, got %v", err)
+	}
+}
+
+func TestPurgeSpaceRemovesWhatRefersToIt(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	writeTestSpace(t, s, "sp-a", "alice", false, 0)
+	id := "sp-a"
+
+	fork := &Space{ID: "sp-fork", Owner: "bob", Alias: "fork", CreatedAt: time.Date(2023, 6, 2, 0, 0, 0, 0, time.UTC), ForkedFromID: &id}
+	if err := s.WriteSpace(ctx, fork); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteReaction(ctx, &Reaction{SpaceID: id, Author: "bob", Reaction: "👍", CreatedAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetSpaceCollaborator(ctx, &SpaceCollaborator{SpaceID: id, User: "carol", Role: SpaceRoleViewer}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteCollectionMembership(ctx, &CollectionMembership{Owner: "bob", Name: "stuff", SpaceID: id}); err != nil {
+		t.Fatal(err)
+	}
+	notifications, err := s.ListNotifications(ctx, &NotificationListRequest{NotificationWhere: NotificationWhere{User: stringPtr("alice")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) == 0 {
+		t.Fatal("expected alice to be notified about her space")
+	}
+
+	if err := s.PurgeSpace(ctx, &SpaceWhere{ID: &id}); err != nil {
+		t.Fatal(err)
+	}
+
+	notifications, err = s.ListNotifications(ctx, &NotificationListRequest{NotificationWhere: NotificationWhere{User: stringPtr("alice")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(notifications) != 0 {
+		t.Errorf("expected notifications about the purged space to go, got %d", len(notifications))
+	}
+	collaborators, err := s.ListSpaceCollaborators(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collaborators) != 0 {
+		t.Errorf("expected collaborators to go, got %d", len(collaborators))
+	}
+	reactions, err := s.ListReactions(ctx, &ReactionWhere{SpaceID: &id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reactions) != 0 {
+		t.Errorf("expected reactions to go, got %d", len(reactions))
+	}
+
+	// The fork survives, and its lineage starts with it.
+	lineage, err := s.SpaceLineage(ctx, &SpaceLineageRequest{SpaceID: "sp-fork", User: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lineage == nil || len(lineage.Nodes) != 1 || len(lineage.Edges) != 0 || lineage.Nodes[0].ForkedFromID != nil {
+		t.Errorf("expected the fork to stand alone, got %#v", lineage)
+	}
+}
@@ -0,0 +1,183 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ajbouh/substrate/pkg/jamsocket"
+)
+
+// fakePlane stands in for plane's spawn API. Each spawn gets a backend of its
+// own, with a bearer token if the request asks for one.
+type fakePlane struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	spawns []*jamsocket.SpawnRequest
+}
+
+func newFakePlane(t *testing.T) *fakePlane {
+	p := &fakePlane{}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" || !strings.HasSuffix(req.URL.Path, "/spawn") {
+			http.NotFound(rw, req)
+			return
+		}
+		var sreq jamsocket.SpawnRequest
+		if err := json.NewDecoder(req.Body).Decode(&sreq); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p.mu.Lock()
+		p.spawns = append(p.spawns, &sreq)
+		name := fmt.Sprintf("backend-%d", len(p.spawns))
+		p.mu.Unlock()
+
+		res := &jamsocket.SpawnResponse{
+			Name: name,
+			URL:  "http://" + name + ".plane.test",
+		}
+		if sreq.RequireBearerToken {
+			token := name + "-secret"
+			res.BearerToken = &token
+		}
+		json.NewEncoder(rw).Encode(res)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+// client returns a jamsocket client for p.
+func (p *fakePlane) client() *jamsocket.Client {
+	return &jamsocket.Client{
+		Client:             p.Client(),
+		URL:                p.URL,
+		HackDroneProxyPort: 80,
+	}
+}
+
+func TestSpawnKeepsBearerTokenOutOfEvents(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	plane := newFakePlane(t)
+	s.JamsocketClient = plane.client()
+	s.Lenses["echo"] = &Lens{
+		Name: "echo",
+		Spawn: LensSpawnOptions{
+			Jamsocket: &LensJamsocketOptions{Service: "echo", RequireBearerToken: true},
+		},
+	}
+
+	sres, err := s.Spawn(ctx, &SpawnRequest{
+		ActivitySpec: ActivitySpecRequest{LensName: "echo", Path: "/ws"},
+		User:         "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plane.spawns) != 1 || !plane.spawns[0].RequireBearerToken {
+		t.Fatalf("expected plane to be asked for a bearer token, got %#v", plane.spawns)
+	}
+	const secret = "backend-1-secret"
+
+	// The gateway sends the token as a header.
+	u, header := sres.URL(ProvisionerHeaderAuthenticationMode)
+	if u.String() != "http://backend-1.plane.test/ws" || header.Get("Authorization") != "Bearer "+secret {
+		t.Fatalf("expected the backend URL with the token in a header, got %s %v", u, header)
+	}
+
+	// Browsers are sent to the gateway, never to the backend.
+	activitySpec, path, err := sres.GatewayPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(activitySpec, "echo") || path != "/gw/"+activitySpec+"/ws" {
+		t.Fatalf("expected a gateway path for echo's /ws, got %s", path)
+	}
+
+	b, _ := json.Marshal(sres)
+	if strings.Contains(string(b), secret) {
+		t.Fatalf("expected the spawn result's JSON to leave out the token, got %s", b)
+	}
+
+	events, err := s.ListEvents(ctx, &EventListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var spawn *Event
+	for _, event := range events {
+		b, _ := json.Marshal(event)
+		if strings.Contains(string(b), secret) {
+			t.Fatalf("expected %s event to leave out the token, got %s", event.Type, b)
+		}
+		if event.Type == "spawn" {
+			spawn = event
+		}
+	}
+	if spawn == nil {
+		t.Fatalf("expected a spawn event, got %d events", len(events))
+	}
+
+	// Only the token's hash is kept, to note that the backend needs one.
+	var stored string
+	if err := s.DB.QueryRowContext(ctx, `SELECT token_hash FROM "backend_tokens" WHERE backend = ?`, sres.Name).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == secret || stored != hashAPIToken(secret) {
+		t.Fatalf("expected the backend's token to be stored hashed, got %q", stored)
+	}
+	if requires, err := s.BackendRequiresBearerToken(ctx, sres.Name); err != nil || !requires {
+		t.Fatalf("expected the backend to require a token, got %v, %v", requires, err)
+	}
+	restored, err := spawn.SpawnResult()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, header := restored.URL(ProvisionerHeaderAuthenticationMode); header != nil {
+		t.Fatalf("expected the restored spawn to have no token, got %v", header)
+	}
+
+	if err := s.DeleteBackendBearerToken(ctx, sres.Name); err != nil {
+		t.Fatal(err)
+	}
+	if requires, err := s.BackendRequiresBearerToken(ctx, sres.Name); err != nil || requires {
+		t.Fatalf("expected the backend's token to be forgotten, got %v, %v", requires, err)
+	}
+}
+
+func TestSpawnWithoutBearerToken(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	plane := newFakePlane(t)
+	s.JamsocketClient = plane.client()
+	s.Lenses["echo"] = &Lens{
+		Name: "echo",
+		Spawn: LensSpawnOptions{
+			Jamsocket: &LensJamsocketOptions{Service: "echo"},
+		},
+	}
+
+	sres, err := s.Spawn(ctx, &SpawnRequest{
+		ActivitySpec: ActivitySpecRequest{LensName: "echo"},
+		User:         "alice",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plane.spawns[0].RequireBearerToken {
+		t.Fatalf("expected no bearer token to be asked for")
+	}
+	if _, header := sres.URL(ProvisionerHeaderAuthenticationMode); header != nil {
+		t.Fatalf("expected no credentials for the backend, got %v", header)
+	}
+	if requires, err := s.BackendRequiresBearerToken(ctx, sres.Name); err != nil || requires {
+		t.Fatalf("expected no stored token, got %v, %v", requires, err)
+	}
+}
@@ -26,6 +26,23 @@ type Substrate struct {
 	Origin         string
 	OriginResolver string
 
+	// Admission limits concurrent spawns. If nil, spawns are not limited.
+	Admission *SpawnAdmission
+
+	// Bus publishes events as they're written. If nil, nothing is published.
+	Bus *EventBus
+
+	// SpawnTokenTTL is how long the token each spawned backend gets in
+	// JAMSOCKET_SUBSTRATE_TOKEN lasts. If zero, backends get no token.
+	SpawnTokenTTL time.Duration
+
+	// Auditors may read everyone's entries in the audit log. Everyone else
+	// only sees their own.
+	Auditors []string
+
+	// Admins may inspect and flush the gateway's cache of backends.
+	Admins []string
+
 	Mu *sync.RWMutex
 	DB *sql.DB
 }
@@ -57,6 +74,11 @@ type LensJamsocketOptions struct {
 	Service string            `json:"service"`
 	Image   string            `json:"image"`
 	Env     map[string]string `json:"env,omitempty"`
+
+	// RequireBearerToken makes plane reject requests that lack the backend's
+	// bearer token. The gateway injects it, so such backends should only be
+	// reached via /gw/.
+	RequireBearerToken bool `json:"require_bearer_token,omitempty"`
 }
 
 type LensActivityResponse struct {
@@ -85,6 +107,10 @@ type Lens struct {
 	Spawn      LensSpawnOptions        `json:"spawn"`
 	Space      LensSpaceOptions        `json:"space"`
 	Activities map[string]LensActivity `json:"activities"`
+
+	// Cookies is the names of the cookies the lens's backend may set and be
+	// sent. See LensCookiePolicy.
+	Cookies []string `json:"cookies,omitempty"`
 }
 
 type ResolvedLensActivity struct {
@@ -106,7 +132,7 @@ type SpawnResult struct {
 
 	BackendURL  string
 	Path        string
-	BearerToken *string
+	BearerToken *string `json:"-"`
 
 	urlJoiner AuthenticatedURLJoinerFunc
 	pathURL   *url.URL
@@ -219,12 +245,9 @@ func (s *Substrate) newSpawnRequest(ctx context.Context, req *SpawnRequest) (*ja
 	}
 
 	spawnRequest := &jamsocket.SpawnRequest{
-		Service: lens.Spawn.Jamsocket.Service,
-		Env:     map[string]string{},
-		// TODO need to add to preview, ui, and gateway first
-		// TODO need to add headers to return value of provision func (gateway, ui)
-		// TODO need to allow provisionfun to return a URL that will redirect (preview)
-		RequireBearerToken: false,
+		Service:            lens.Spawn.Jamsocket.Service,
+		Env:                map[string]string{},
+		RequireBearerToken: lens.Spawn.Jamsocket.RequireBearerToken,
 	}
 
 	if lens.Spawn.Jamsocket.Env != nil {
@@ -257,6 +280,10 @@ func (s *Substrate) newSpawnRequest(ctx context.Context, req *SpawnRequest) (*ja
 	views := LensSpawnParameters{}
 
 	includeView := func(viewName string, includeSpaceIDInTarget bool, viewOpt *SpaceViewRequest) (*substratefs.SpaceView, error) {
+		if err := s.CheckSpaceViewRequest(ctx, viewOpt); err != nil {
+			return nil, err
+		}
+
 		view, err := s.ResolveSpaceView(viewOpt, req.User, "")
 		if err != nil {
 			return nil, err
@@ -344,7 +371,26 @@ func (s *Substrate) newSpawnRequest(ctx context.Context, req *SpawnRequest) (*ja
 	}, nil
 }
 
-func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (*SpawnResult, error) {
+func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (result *SpawnResult, err error) {
+	ctx, span := StartSpan(ctx, "substrate.spawn")
+	span.SetAttribute("lens", req.ActivitySpec.LensName)
+	span.SetAttribute("user", req.User)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	authorized, forceReadOnly, err := s.AuthorizeActivitySpecRequest(ctx, req.User, &req.ActivitySpec)
+	if err != nil {
+		return nil, err
+	}
+	if forceReadOnly {
+		r := *req
+		r.ActivitySpec = *authorized
+		r.ForceReadOnly = true
+		req = &r
+	}
+
 	jsr, views, err := s.newSpawnRequest(ctx, req)
 	if err != nil {
 		return nil, err
@@ -352,12 +398,37 @@ func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (*SpawnResult,
 	if s.JamsocketClient == nil {
 		return nil, fmt.Errorf("no jamsocket client")
 	}
+
+	release, err := s.admitSpawn(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var spawnToken *APIToken
+	if s.SpawnTokenTTL > 0 && req.User != "" {
+		var token string
+		spawnToken, token, err = s.mintSpawnToken(ctx, req.User, views, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		jsr.Env["JAMSOCKET_SUBSTRATE_TOKEN"] = token
+	}
+
 	r, err := s.JamsocketClient.Spawn(ctx, jsr)
 	if err != nil {
+		if spawnToken != nil {
+			if _, err := s.RevokeAPIToken(ctx, spawnToken.User, spawnToken.ID); err != nil {
+				LogFromContext(ctx).WithError(err).Warnf("error revoking token %s", spawnToken.ID)
+			}
+		}
 		return nil, err
 	}
+	span.SetAttribute("backend", r.Name)
 
 	var spaces = []*Space{}
+	// Existing spaces this spawn uses, whose owners get notified.
+	var usedSpaceIDs = map[string]bool{}
 	entropy := ulid.DefaultEntropy()
 	now := time.Now()
 	nowTs := ulid.Timestamp(now)
@@ -388,6 +459,8 @@ func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (*SpawnResult,
 				// 	Multi: multi,
 				// },
 			})
+		} else {
+			usedSpaceIDs[spaceID] = true
 		}
 
 		err := s.WriteCollectionMembership(ctx, &CollectionMembership{
@@ -419,6 +492,26 @@ func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (*SpawnResult,
 		}
 	}
 
+	if r.BearerToken != nil {
+		err = s.WriteBackendBearerToken(ctx, r.Name, *r.BearerToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Keep the bearer token and our own token out of the event, which is
+	// visible via the API.
+	redacted := *r
+	redacted.BearerToken = nil
+	redactedRequest := *jsr
+	if spawnToken != nil {
+		redactedRequest.Env = map[string]string{}
+		for k, v := range jsr.Env {
+			redactedRequest.Env[k] = v
+		}
+		delete(redactedRequest.Env, "JAMSOCKET_SUBSTRATE_TOKEN")
+	}
+
 	eventULID := ulid.MustNew(nowTs, entropy)
 	eventID := "ev-" + eventULID.String()
 	viewspecReq, _ := req.ActivitySpec.ActivitySpec()
@@ -426,19 +519,52 @@ func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (*SpawnResult,
 		ID:        eventID,
 		Type:      "spawn",
 		Timestamp: now,
+		RequestID: RequestIDFromContext(ctx),
 		// Parameters:       req.ActivitySpec.Parameters,
 		ActivitySpec: viewspecReq,
 		User:         req.User,
 		Lens:         req.ActivitySpec.LensName,
 		JamsocketSpawn: &JamsocketSpawnEvent{
-			Request:  jsr,
-			Response: r,
+			Request:  &redactedRequest,
+			Response: &redacted,
 		},
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	mounts := map[string][]map[string]any{}
+	for name, p := range views.Parameters {
+		var vs []substratefs.SpaceView
+		switch {
+		case p.Space != nil:
+			vs = []substratefs.SpaceView{*p.Space}
+		case p.Spaces != nil:
+			vs = *p.Spaces
+		}
+		for _, v := range vs {
+			mounts[name] = append(mounts[name], map[string]any{
+				"space":     v.Tip.SpaceID.String(),
+				"read_only": v.IsReadOnly,
+				"created":   v.Creation != nil,
+			})
+		}
+	}
+	details := map[string]any{
+		"backend": r.Name,
+		"lens":    req.ActivitySpec.LensName,
+		"mounts":  mounts,
+	}
+	if spawnToken != nil {
+		details["token"] = spawnToken.ID
+	}
+	s.Audit(ctx, &AuditEntry{
+		Actor:   req.User,
+		Action:  AuditActionSpawn,
+		Target:  viewspecReq,
+		Details: details,
+	})
+
 	for _, sp := range spaces {
 		err = s.WriteSpace(ctx, sp)
 		if err != nil {
@@ -446,6 +572,14 @@ func (s *Substrate) Spawn(ctx context.Context, req *SpawnRequest) (*SpawnResult,
 		}
 	}
 
+	for spaceID := range usedSpaceIDs {
+		s.notifySpaceOwner(ctx, spaceID, &Notification{
+			Type:         NotificationTypeSpaceSpawned,
+			Actor:        req.User,
+			ActivitySpec: viewspecReq,
+		})
+	}
+
 	viewspec, _ := views.ActivitySpec()
 
 	if !req.Ephemeral {
@@ -487,6 +621,54 @@ func (s *SpawnResult) URL(mode ProvisionerAuthenticationMode) (*url.URL, http.He
 	return s.urlJoiner(s.pathURL, mode)
 }
 
+// GatewayPath returns the activityspec the gateway knows this backend by and
+// the path, relative to the substrate origin, that proxies to it. Backends that
+// require a bearer token must be reached this way so the token never reaches
+// the browser.
+func (s *SpawnResult) GatewayPath() (string, string, error) {
+	asr, err := ParseActivitySpecRequest(s.ActivitySpec, false)
+	if err != nil {
+		return "", "", err
+	}
+
+	path := asr.Path
+	asr.Path = ""
+	activitySpec, _ := asr.ActivitySpec()
+
+	return activitySpec, "/gw/" + activitySpec + path, nil
+}
+
+// awaitBackendReady consumes status events until the backend is ready, or
+// returns an error if it never will be.
+func awaitBackendReady(ctx context.Context, backend string, ch <-chan *jamsocket.StatusEvent) (err error) {
+	_, span := StartSpan(ctx, "backend.await_ready")
+	span.SetAttribute("backend", backend)
+	defer func() {
+		span.SetError(err)
+		span.Finish()
+	}()
+
+	for event := range ch {
+		if event.Error != nil {
+			return fmt.Errorf("backend will never be ready; err=%w", event.Error)
+		}
+
+		if event.State.IsPending() {
+			continue
+		}
+
+		if event.State.IsReady() {
+			return nil
+		}
+
+		if event.State.IsGone() {
+			return fmt.Errorf("backend will never be ready; status=%s time=%q", event.State, event.Time)
+		}
+	}
+
+	return fmt.Errorf("status stream ended without ready")
+}
+
 func MakeJoiner(target *url.URL, token *string) AuthenticatedURLJoinerFunc {
 	return func(rest *url.URL, mode ProvisionerAuthenticationMode) (*url.URL, http.Header) {
 		var u url.URL
@@ -539,7 +721,28 @@ func MakeJoiner(target *url.URL, token *string) AuthenticatedURLJoinerFunc {
 }
 
 // TODO either use AuthorizationHeader OR redirection
-func (s *Substrate) MakeProvisioner(logf func(fmt string, values ...any), req *SpawnRequest) ProvisionFunc {
+func (s *Substrate) MakeProvisioner(logf func(fmt string, values ...any), req *SpawnRequest) ProvisionerFactory {
+	return func(entryCtx context.Context, invalidate func(error)) ProvisionFunc {
+		return s.makeProvisioner(entryCtx, invalidate, logf, req, nil)
+	}
+}
+
+// MakeProvisionerFromSpawn is like MakeProvisioner, but starts out with an
+// already spawned backend. It only spawns again once that backend is gone,
+// as user.
+func (s *Substrate) MakeProvisionerFromSpawn(logf func(fmt string, values ...any), sres *SpawnResult, user string, forceReadOnly bool) (ProvisionerFactory, error) {
+	asr, err := ParseActivitySpecRequest(sres.ActivitySpec, false)
+	if err != nil {
+		return nil, err
+	}
+	req := &SpawnRequest{ActivitySpec: *asr, User: user, ForceReadOnly: forceReadOnly}
+
+	return func(entryCtx context.Context, invalidate func(error)) ProvisionFunc {
+		return s.makeProvisioner(entryCtx, invalidate, logf, req, sres)
+	}, nil
+}
+
+func (s *Substrate) makeProvisioner(entryCtx context.Context, invalidate func(error), logf func(fmt string, values ...any), req *SpawnRequest, initial *SpawnResult) ProvisionFunc {
 	mu := &sync.Mutex{}
 	var gen = 0
 	var cached *url.URL
@@ -576,6 +779,43 @@ func (s *Substrate) MakeProvisioner(logf func(fmt string, values ...any), req *S
 		}
 	}
 
+	// watch stays subscribed to the backend's status and cleans up once it's gone.
+	watch := func(backend string, ch <-chan *jamsocket.StatusEvent, streamCancel context.CancelFunc, cleanup func(error)) {
+		defer streamCancel()
+		for event := range ch {
+			if event.Error != nil || event.State.IsGone() {
+				// Do this before invalidating, which cancels entryCtx.
+				if event.State.IsGone() {
+					if err := s.DeleteBackendBearerToken(entryCtx, backend); err != nil {
+						logf("action=token:delete backend=%s err=%s", backend, err)
+					}
+				}
+				reason := fmt.Errorf("backend error or gone; status=%s err=%v", event.State, event.Error)
+				cleanup(reason)
+				invalidate(reason)
+				return
+			}
+		}
+		// The stream ended without the backend going away, most likely
+		// because the cache entry was evicted.
+		cleanup(fmt.Errorf("status stream ended"))
+	}
+
+	if initial != nil && s.JamsocketClient != nil {
+		parsed, err := url.Parse(initial.BackendURL)
+		if err == nil {
+			streamCtx, streamCancel := context.WithCancel(entryCtx)
+			ch, err := s.JamsocketClient.StatusStream(streamCtx, initial.Name)
+			if err != nil {
+				streamCancel()
+				logf("action=cache:seed err=%s", err)
+			} else {
+				set(parsed, initial.BearerToken, initial.urlJoiner)
+				go watch(initial.Name, ch, streamCancel, makeCleanup())
+			}
+		}
+	}
+
 	return func(ctx context.Context) (AuthenticatedURLJoinerFunc, bool, func(error), error) {
 		mu.Lock()
 		defer mu.Unlock()
@@ -584,9 +824,8 @@ func (s *Substrate) MakeProvisioner(logf func(fmt string, values ...any), req *S
 			return joiner, false, makeCleanup(), nil
 		}
 
-		spawnCtx, _ := context.WithCancel(context.Background())
-
-		sres, err := s.Spawn(spawnCtx, req)
+		// Don't tie the spawn to any one request, but keep its trace.
+		sres, err := s.Spawn(detach(ctx), req)
 		if err != nil {
 			return nil, false, nil, err
 		}
@@ -601,58 +840,28 @@ func (s *Substrate) MakeProvisioner(logf func(fmt string, values ...any), req *S
 			return nil, false, nil, err
 		}
 
-		streamCtx, streamCancel := context.WithCancel(context.Background())
-
 		if s.JamsocketClient == nil {
 			return nil, false, nil, fmt.Errorf("no jamsocket client")
 		}
+
+		// The status stream lives as long as the gateway cache entry.
+		streamCtx, streamCancel := context.WithCancel(entryCtx)
 		ch, err := s.JamsocketClient.StatusStream(streamCtx, sres.Name)
 		if err != nil {
 			streamCancel()
 			return nil, false, nil, err
 		}
 
-		ready := false
-
-		for event := range ch {
-			if event.Error != nil {
-				streamCancel()
-				return nil, false, nil, fmt.Errorf("backend will never be ready; err=%w", event.Error)
-			}
-
-			if event.State.IsPending() {
-				continue
-			}
-
-			if event.State.IsReady() {
-				ready = true
-				break
-			}
-
-			if event.State.IsGone() {
-				streamCancel()
-				return nil, false, nil, fmt.Errorf("backend will never be ready; status=%s time=%q", event.State, event.Time)
-			}
-		}
-
-		if !ready {
+		err = awaitBackendReady(ctx, sres.Name, ch)
+		if err != nil {
 			streamCancel()
-			return nil, false, nil, fmt.Errorf("status stream ended without ready")
+			return nil, false, nil, err
 		}
 
 		set(parsed, parsedToken, sres.urlJoiner)
 		// Do this AFTER we've loaded the cache.
 		cleanup := makeCleanup()
-		go func() {
-			// Stay subscribed and cleanup once it's gone.
-			defer cleanup(fmt.Errorf("backend error or gone"))
-			defer streamCancel()
-			for event := range ch {
-				if event.Error != nil || event.State.IsGone() {
-					break
-				}
-			}
-		}()
+		go watch(sres.Name, ch, streamCancel, cleanup)
 
 		return sres.urlJoiner, true, cleanup, nil
 	}
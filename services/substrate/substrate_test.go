@@ -0,0 +1,59 @@
+package substrate
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB returns a fresh, empty database.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := sql.Open("sqlite3", t.TempDir()+"/substrate.sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// newTestSubstrate returns a Substrate backed by a fresh, fully migrated
+// database.
+func newTestSubstrate(t *testing.T) *Substrate {
+	t.Helper()
+
+	db := newTestDB(t)
+	if err := Migrate(context.Background(), db, func(string, ...any) {}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &Substrate{
+		DB:     db,
+		Mu:     &sync.RWMutex{},
+		Lenses: map[string]*Lens{},
+	}
+}
+
+// writeTestSpace writes a space owned by owner, created at the given offset
+// from a fixed time so ordering is predictable.
+func writeTestSpace(t *testing.T, s *Substrate, id, owner string, private bool, offset time.Duration) *Space {
+	t.Helper()
+
+	sp := &Space{
+		ID:        id,
+		Owner:     owner,
+		Alias:     id,
+		CreatedAt: time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC).Add(offset),
+		IsPrivate: private,
+	}
+	if err := s.WriteSpace(context.Background(), sp); err != nil {
+		t.Fatal(err)
+	}
+	return sp
+}
@@ -0,0 +1,308 @@
+package substrate
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+)
+
+// Scopes a personal API token can be given. A request made with a token may
+// only do what its scopes allow; a browser session may do anything.
+const (
+	// TokenScopeReadSpaces allows reading anything the user can read:
+	// spaces, collections, activities and events.
+	TokenScopeReadSpaces = "read:spaces"
+	// TokenScopeSpawn allows creating spaces and spawning activities.
+	TokenScopeSpawn = "spawn"
+	// TokenScopeWriteCollections allows creating, changing and deleting
+	// collections and their members.
+	TokenScopeWriteCollections = "write:collections"
+)
+
+var TokenScopes = []string{TokenScopeReadSpaces, TokenScopeSpawn, TokenScopeWriteCollections}
+
+// SpawnTokenScopes are the scopes of the token each spawned backend gets, so
+// a lens can checkpoint its spaces and add them to collections. The token is
+// limited to the spaces the backend was spawned with, and only acts for the
+// user it was spawned for, with their access.
+var SpawnTokenScopes = []string{TokenScopeReadSpaces, TokenScopeSpawn, TokenScopeWriteCollections}
+
+// apiTokenPrefix starts every token, so they're easy to spot in logs and
+// secret scanners.
+const apiTokenPrefix = "sbt_"
+
+// lastUsedResolution is how stale an API token's LastUsedAt may get, so using
+// a token doesn't mean a write on every request.
+const lastUsedResolution = time.Minute
+
+// InvalidAPITokenError is returned for tokens that don't exist, were revoked
+// or have expired.
+type InvalidAPITokenError struct{}
+
+func (e *InvalidAPITokenError) Error() string {
+	return "invalid or expired token"
+}
+
+type APIToken struct {
+	ID         string     `json:"id"`
+	User       string     `json:"user"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+
+	// Spaces, if not nil, are the only spaces the token may be used with.
+	Spaces []string `json:"spaces,omitempty"`
+	// ActivitySpec is set on tokens minted for a spawned backend.
+	ActivitySpec string `json:"activityspec,omitempty"`
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateTokenScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("a token needs at least one scope (one of %s)", strings.Join(TokenScopes, ", "))
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range TokenScopes {
+			known = known || s == scope
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q (must be one of %s)", scope, strings.Join(TokenScopes, ", "))
+		}
+	}
+	return nil
+}
+
+// CreateAPIToken stores a new token for t.User and returns it. This is the only
+// time the token itself is available; just its hash is kept.
+func (s *Substrate) CreateAPIToken(ctx context.Context, t *APIToken) (string, error) {
+	if t.User == "" {
+		return "", fmt.Errorf("a token must belong to a user")
+	}
+	if err := validateTokenScopes(t.Scopes); err != nil {
+		return "", err
+	}
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(t.CreatedAt) {
+		return "", fmt.Errorf("a token must expire after it's created")
+	}
+	t.Spaces = nil
+	t.ActivitySpec = ""
+
+	return s.writeAPIToken(ctx, t)
+}
+
+func (s *Substrate) writeAPIToken(ctx context.Context, t *APIToken) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	token := apiTokenPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	scopes, err := json.Marshal(t.Scopes)
+	if err != nil {
+		return "", err
+	}
+
+	var expiresAt *int64
+	if t.ExpiresAt != nil {
+		us := t.ExpiresAt.UnixMicro()
+		expiresAt = &us
+	}
+
+	var spaces *string
+	if t.Spaces != nil {
+		b, err := json.Marshal(t.Spaces)
+		if err != nil {
+			return "", err
+		}
+		spaces = stringPtr(string(b))
+	}
+
+	var activitySpec *string
+	if t.ActivitySpec != "" {
+		activitySpec = &t.ActivitySpec
+	}
+
+	t.ID = "tok-" + ulid.Make().String()
+	err = s.dbExecContext(ctx, `INSERT INTO "api_tokens" (id, user, name, token_hash, scopes, created_at_us, expires_at_us, spaces, activityspec) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		t.ID, t.User, t.Name, hashAPIToken(token), string(scopes), t.CreatedAt.UnixMicro(), expiresAt, spaces, activitySpec)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func scanAPIToken(scan func(dest ...any) error) (*APIToken, error) {
+	var o APIToken
+	var scopes string
+	var createdAt int64
+	var expiresAt, lastUsedAt *int64
+	var spaces, activitySpec *string
+	err := scan(&o.ID, &o.User, &o.Name, &scopes, &createdAt, &expiresAt, &lastUsedAt, &spaces, &activitySpec)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(scopes), &o.Scopes); err != nil {
+		return nil, err
+	}
+	if spaces != nil {
+		if err := json.Unmarshal([]byte(*spaces), &o.Spaces); err != nil {
+			return nil, err
+		}
+	}
+	if activitySpec != nil {
+		o.ActivitySpec = *activitySpec
+	}
+	o.CreatedAt = time.UnixMicro(createdAt)
+	if expiresAt != nil {
+		t := time.UnixMicro(*expiresAt)
+		o.ExpiresAt = &t
+	}
+	if lastUsedAt != nil {
+		t := time.UnixMicro(*lastUsedAt)
+		o.LastUsedAt = &t
+	}
+	return &o, nil
+}
+
+const apiTokenColumns = `id, user, name, scopes, created_at_us, expires_at_us, last_used_at_us, spaces, activityspec`
+
+// ListAPITokens returns a user's personal tokens, oldest first, including
+// expired ones. Tokens minted for spawns aren't included.
+func (s *Substrate) ListAPITokens(ctx context.Context, user string) ([]*APIToken, error) {
+	s.Mu.RLock()
+	defer s.Mu.RUnlock()
+
+	rows, err := s.dbQueryContext(ctx, `SELECT `+apiTokenColumns+` FROM "api_tokens" WHERE user = ? AND activityspec IS NULL ORDER BY created_at_us, id`, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []*APIToken{}
+	for rows.Next() {
+		o, err := scanAPIToken(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, o)
+	}
+
+	return results, rows.Err()
+}
+
+// RevokeAPIToken deletes one of a user's tokens. It returns false if the user
+// has no such token.
+func (s *Substrate) RevokeAPIToken(ctx context.Context, user, id string) (bool, error) {
+	found, err := func() (bool, error) {
+		s.Mu.RLock()
+		defer s.Mu.RUnlock()
+
+		rows, err := s.dbQueryContext(ctx, `SELECT 1 FROM "api_tokens" WHERE id = ? AND user = ?`, id, user)
+		if err != nil {
+			return false, err
+		}
+		defer rows.Close()
+
+		return rows.Next(), rows.Err()
+	}()
+	if err != nil || !found {
+		return false, err
+	}
+	return true, s.dbExecContext(ctx, `DELETE FROM "api_tokens" WHERE id = ? AND user = ?`, id, user)
+}
+
+// mintSpawnToken makes a token for a backend spawned by user, good for
+// SpawnTokenTTL, that can only read the spaces in spec. Expired spawn
+// tokens are cleaned up as it goes.
+func (s *Substrate) mintSpawnToken(ctx context.Context, user string, spec *ActivitySpec, now time.Time) (*APIToken, string, error) {
+	err := s.dbExecContext(ctx, `DELETE FROM "api_tokens" WHERE activityspec IS NOT NULL AND expires_at_us <= ?`, now.UnixMicro())
+	if err != nil {
+		return nil, "", err
+	}
+
+	spaces := []string{}
+	for _, p := range spec.Parameters {
+		switch {
+		case p.Space != nil:
+			spaces = append(spaces, p.Space.Tip.SpaceID.String())
+		case p.Spaces != nil:
+			for _, v := range *p.Spaces {
+				spaces = append(spaces, v.Tip.SpaceID.String())
+			}
+		}
+	}
+
+	activitySpec, _ := spec.ActivitySpec()
+	expiresAt := now.Add(s.SpawnTokenTTL)
+	t := &APIToken{
+		User:         user,
+		Name:         "spawn",
+		Scopes:       SpawnTokenScopes,
+		CreatedAt:    now,
+		ExpiresAt:    &expiresAt,
+		Spaces:       spaces,
+		ActivitySpec: activitySpec,
+	}
+	token, err := s.writeAPIToken(ctx, t)
+	if err != nil {
+		return nil, "", err
+	}
+	return t, token, nil
+}
+
+// AuthenticateAPIToken returns the token with the given value, and notes that
+// it was used. It returns an InvalidAPITokenError if there's no such token or
+// it has expired.
+func (s *Substrate) AuthenticateAPIToken(ctx context.Context, token string, now time.Time) (*APIToken, error) {
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, &InvalidAPITokenError{}
+	}
+
+	t, err := func() (*APIToken, error) {
+		s.Mu.RLock()
+		defer s.Mu.RUnlock()
+
+		rows, err := s.dbQueryContext(ctx, `SELECT `+apiTokenColumns+` FROM "api_tokens" WHERE token_hash = ?`, hashAPIToken(token))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		if !rows.Next() {
+			return nil, rows.Err()
+		}
+		return scanAPIToken(rows.Scan)
+	}()
+	if err != nil {
+		return nil, err
+	}
+	if t == nil || (t.ExpiresAt != nil && !now.Before(*t.ExpiresAt)) {
+		return nil, &InvalidAPITokenError{}
+	}
+
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) >= lastUsedResolution {
+		err := s.dbExecContext(ctx, `UPDATE "api_tokens" SET last_used_at_us = ? WHERE id = ?`, now.UnixMicro(), t.ID)
+		if err != nil {
+			LogFromContext(ctx).WithError(err).Warnf("error noting use of token %s", t.ID)
+		} else {
+			t.LastUsedAt = &now
+		}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,52 @@
+package substrate
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ajbouh/substrate/pkg/substratefs"
+)
+
+func TestSpawnTokenOnlyUsesItsSpaces(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSubstrate(t)
+	s.SpawnTokenTTL = time.Hour
+	writeTestSpace(t, s, "sp-spawned", "alice", true, 0)
+	writeTestSpace(t, s, "sp-other", "alice", true, time.Second)
+
+	spec := &ActivitySpec{
+		LensName: "notebook",
+		Parameters: LensSpawnParameters{
+			"data": {Space: &substratefs.SpaceView{Tip: &substratefs.TipRef{SpaceID: "sp-spawned"}}},
+		},
+	}
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	_, token, err := s.mintSpawnToken(ctx, "alice", spec, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.AuthenticateAPIToken(ctx, token, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Scopes) != len(SpawnTokenScopes) {
+		t.Errorf("spawn token scopes = %v, want %v", got.Scopes, SpawnTokenScopes)
+	}
+	if len(got.Spaces) != 1 || got.Spaces[0] != "sp-spawned" {
+		t.Errorf("spawn token spaces = %v, want [sp-spawned]", got.Spaces)
+	}
+
+	tokens, err := s.ListAPITokens(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 0 {
+		t.Errorf("ListAPITokens included %d spawn tokens", len(tokens))
+	}
+
+	if _, err := s.AuthenticateAPIToken(ctx, token, now.Add(2*time.Hour)); err == nil {
+		t.Error("spawn token still valid after SpawnTokenTTL")
+	}
+}
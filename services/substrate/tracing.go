@@ -0,0 +1,466 @@
+package substrate
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ulid "github.com/oklog/ulid/v2"
+	"github.com/sirupsen/logrus"
+)
+
+const RequestIDHeader = "X-Request-Id"
+const TraceParentHeader = "traceparent"
+
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+func (s SpanID) IsValid() bool  { return s != SpanID{} }
+
+func NewRequestID() string {
+	return "req-" + ulid.Make().String()
+}
+
+type requestIDContextKey struct{}
+type spanContextKey struct{}
+
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+func RequestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// LogFromContext returns a logger annotated with the request ID and trace ID in ctx, if any.
+func LogFromContext(ctx context.Context) *logrus.Entry {
+	fields := logrus.Fields{}
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if span := SpanFromContext(ctx); span != nil {
+		fields["trace_id"] = span.TraceID.String()
+	}
+	return logrus.WithFields(fields)
+}
+
+// Span records the timing of one step in handling a request, such as a spawn
+// or waiting for a backend to become ready.
+type Span struct {
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	Name         string
+	Start        time.Time
+	End          time.Time
+	Err          error
+
+	mu         *sync.Mutex
+	attributes map[string]any
+	tracer     *Tracer
+	server     bool
+}
+
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Err = err
+}
+
+// Finish ends the span, logs it and hands it to the tracer's exporter.
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.End = time.Now()
+	fields := logrus.Fields{
+		"span":     s.Name,
+		"trace_id": s.TraceID.String(),
+		"span_id":  s.SpanID.String(),
+		"duration": s.End.Sub(s.Start).String(),
+	}
+	for k, v := range s.attributes {
+		fields[k] = v
+	}
+	if s.Err != nil {
+		fields["err"] = s.Err.Error()
+	}
+	s.mu.Unlock()
+
+	logrus.WithFields(fields).Debug("span")
+
+	s.tracer.export(s)
+}
+
+// TraceParent formats the span as a W3C traceparent header value.
+func (s *Span) TraceParent() string {
+	return "00-" + s.TraceID.String() + "-" + s.SpanID.String() + "-01"
+}
+
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+func randomID(b []byte) {
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+}
+
+// parseTraceParent parses a W3C traceparent header value.
+func parseTraceParent(v string) (TraceID, SpanID, bool) {
+	var traceID TraceID
+	var spanID SpanID
+	parts := strings.Split(v, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, traceID.IsValid() && spanID.IsValid()
+}
+
+// StartSpan starts a child of the span in ctx. If ctx has no span, the new span
+// starts a new trace and is only logged.
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+
+	span := &Span{
+		Name:       name,
+		Start:      time.Now(),
+		mu:         &sync.Mutex{},
+		attributes: map[string]any{},
+	}
+	randomID(span.SpanID[:])
+	if parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+		span.tracer = parent.tracer
+	} else {
+		randomID(span.TraceID[:])
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// StartRequestSpan starts the root span for an incoming request, continuing
+// the caller's trace if req carries a traceparent header.
+func (t *Tracer) StartRequestSpan(ctx context.Context, name string, req *http.Request) (context.Context, *Span) {
+	ctx, span := StartSpan(ctx, name)
+	span.tracer = t
+	span.server = true
+	if traceID, parentSpanID, ok := parseTraceParent(req.Header.Get(TraceParentHeader)); ok {
+		span.TraceID = traceID
+		span.ParentSpanID = parentSpanID
+	}
+	return ctx, span
+}
+
+// InjectTraceHeaders adds the request ID and traceparent for ctx to h so that
+// backends can correlate their logs with ours.
+func InjectTraceHeaders(ctx context.Context, h http.Header) {
+	if requestID := RequestIDFromContext(ctx); requestID != "" {
+		h.Set(RequestIDHeader, requestID)
+	}
+	if span := SpanFromContext(ctx); span != nil {
+		h.Set(TraceParentHeader, span.TraceParent())
+	}
+}
+
+// detachedContext keeps the values of its parent but not its deadline or
+// cancellation, so work that outlives a request still carries its trace.
+type detachedContext struct {
+	context.Context
+	parent context.Context
+}
+
+func (d detachedContext) Value(key any) any {
+	return d.parent.Value(key)
+}
+
+func detach(ctx context.Context) context.Context {
+	return detachedContext{Context: context.Background(), parent: ctx}
+}
+
+// Tracer batches finished spans and sends them to an OTLP/HTTP collector.
+// A Tracer with no Endpoint only logs spans.
+type Tracer struct {
+	ServiceName string
+
+	// Endpoint is the OTLP/HTTP traces URL, e.g. http://localhost:4318/v1/traces
+	Endpoint string
+	Client   *http.Client
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	spans chan *Span
+	once  sync.Once
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func (t *Tracer) start() {
+	t.once.Do(func() {
+		if t.Client == nil {
+			t.Client = &http.Client{Timeout: 10 * time.Second}
+		}
+		if t.BatchSize <= 0 {
+			t.BatchSize = 256
+		}
+		if t.FlushInterval <= 0 {
+			t.FlushInterval = 5 * time.Second
+		}
+		t.spans = make(chan *Span, t.BatchSize*4)
+		t.stop = make(chan struct{})
+		t.done = make(chan struct{})
+		go t.loop()
+	})
+}
+
+func (t *Tracer) export(span *Span) {
+	if t == nil || t.Endpoint == "" {
+		return
+	}
+	t.start()
+
+	select {
+	case <-t.stop:
+		return
+	default:
+	}
+
+	select {
+	case t.spans <- span:
+	default:
+		logrus.WithField("span", span.Name).Warn("dropping span; export queue is full")
+	}
+}
+
+func (t *Tracer) loop() {
+	ticker := time.NewTicker(t.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, t.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.post(batch); err != nil {
+			logrus.WithError(err).WithField("spans", len(batch)).Warn("error exporting spans")
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= t.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-t.stop:
+			defer close(t.done)
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+					if len(batch) >= t.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// Shutdown sends every span still queued and stops the tracer, or gives up
+// when ctx is done. Spans finished after Shutdown are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil || t.Endpoint == "" {
+		return nil
+	}
+	t.start()
+	t.stopOnce.Do(func() { close(t.stop) })
+
+	select {
+	case <-t.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+func otlpAttribute(key string, value any) otlpKeyValue {
+	var v otlpAnyValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+// OTLP span kinds and status codes.
+const otlpSpanKindServer = 2
+const otlpSpanKindInternal = 1
+const otlpStatusCodeOk = 1
+const otlpStatusCodeError = 2
+
+func newOTLPTracesRequest(serviceName string, spans []*Span) *otlpTracesRequest {
+	scope := otlpScopeSpans{}
+	scope.Scope.Name = "substrate"
+	for _, span := range spans {
+		span.mu.Lock()
+		o := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusCodeOk},
+		}
+		if span.ParentSpanID.IsValid() {
+			o.ParentSpanID = span.ParentSpanID.String()
+		}
+		if span.server {
+			o.Kind = otlpSpanKindServer
+		}
+		for k, v := range span.attributes {
+			o.Attributes = append(o.Attributes, otlpAttribute(k, v))
+		}
+		if span.Err != nil {
+			o.Status = otlpStatus{Code: otlpStatusCodeError, Message: span.Err.Error()}
+		}
+		span.mu.Unlock()
+
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	rs := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scope}}
+	rs.Resource.Attributes = []otlpKeyValue{otlpAttribute("service.name", serviceName)}
+
+	return &otlpTracesRequest{ResourceSpans: []otlpResourceSpans{rs}}
+}
+
+func (t *Tracer) post(spans []*Span) error {
+	serviceName := t.ServiceName
+	if serviceName == "" {
+		serviceName = "substrate"
+	}
+
+	b, err := json.Marshal(newOTLPTracesRequest(serviceName, spans))
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.Client.Post(t.Endpoint, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector returned status=%d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package substrate
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTracerExportsToCollector(t *testing.T) {
+	received := make(chan *otlpTracesRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body otlpTracesRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding export: %s", err)
+		}
+		received <- &body
+	}))
+	defer collector.Close()
+
+	tracer := &Tracer{
+		ServiceName:   "substrate-test",
+		Endpoint:      collector.URL + "/v1/traces",
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	}
+
+	incoming := httptest.NewRequest("GET", "/gw/foo[]", nil)
+	incoming.Header.Set(TraceParentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	ctx, root := tracer.StartRequestSpan(context.Background(), "GET /gw/foo[]", incoming)
+	_, child := StartSpan(ctx, "substrate.spawn")
+	child.Finish()
+	root.Finish()
+
+	h := http.Header{}
+	InjectTraceHeaders(WithRequestID(ctx, "req-1"), h)
+	if got, want := h.Get(TraceParentHeader), root.TraceParent(); got != want {
+		t.Errorf("traceparent = %q, want %q", got, want)
+	}
+	if got := h.Get(RequestIDHeader); got != "req-1" {
+		t.Errorf("request id = %q, want %q", got, "req-1")
+	}
+
+	var body *otlpTracesRequest
+	select {
+	case body = <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("collector did not receive spans")
+	}
+
+	spans := body.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	if spans[0].TraceID != "0af7651916cd43dd8448eb211c80319c" || spans[1].TraceID != spans[0].TraceID {
+		t.Errorf("spans not part of the incoming trace: %#v", spans)
+	}
+	if spans[0].ParentSpanID != spans[1].SpanID {
+		t.Errorf("child parent = %q, want %q", spans[0].ParentSpanID, spans[1].SpanID)
+	}
+	if spans[1].ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("root parent = %q, want incoming span", spans[1].ParentSpanID)
+	}
+}
+
+func TestTracerShutdownSendsQueuedSpans(t *testing.T) {
+	received := make(chan int, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var body otlpTracesRequest
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			t.Errorf("error decoding export: %s", err)
+		}
+		received <- len(body.ResourceSpans[0].ScopeSpans[0].Spans)
+	}))
+	defer collector.Close()
+
+	// Neither a full batch nor the flush interval would send these.
+	tracer := &Tracer{
+		Endpoint:      collector.URL + "/v1/traces",
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+	}
+	incoming := httptest.NewRequest("GET", "/", nil)
+	for i := 0; i < 3; i++ {
+		_, span := tracer.StartRequestSpan(context.Background(), "GET /", incoming)
+		span.Finish()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case n := <-received:
+		if n != 3 {
+			t.Errorf("got %d spans, want 3", n)
+		}
+	default:
+		t.Fatal("collector did not receive spans before Shutdown returned")
+	}
+
+	// Once shut down, spans go nowhere, and shutting down again is fine.
+	_, span := tracer.StartRequestSpan(context.Background(), "GET /", incoming)
+	span.Finish()
+	if err := tracer.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -185,6 +185,13 @@ export async function fetchJSON<T=any> (fetch: any, url: string, options?: any):
   return body
 }
 
+// fetchList fetches the first page of a list endpoint, whose body has the
+// items in results and the cursor for the next page in next_cursor.
+export async function fetchList<T=any> (fetch: any, url: string, options?: any): Promise<T[]> {
+  const { results } = await fetchJSON<{results: T[], next_cursor?: string}>(fetch, url, options)
+  return results
+}
+
 export function processSpaces(spaces: any[]) {
   return spaces.map(space => ({...space, created_at: new Date(Date.parse(space.created_at))}))
 }
@@ -799,7 +806,7 @@ export function getCommandSet(lenses: Record<string, Lens>, { user, space, lens,
               {
                 type: "spaces",
                 value: async ({fetch}: RunContext) => {
-                  const spaces = await fetchJSON(fetch, urls.api.collectionSpaceMembership({ owner: collection.owner, name: collection.name }))
+                  const spaces = await fetchList(fetch, urls.api.collectionSpaceMembership({ owner: collection.owner, name: collection.name }))
                   return ["", ...processSpaces(spaces).map(space => space.space)].join(",")
                 }
               },
@@ -954,7 +961,7 @@ export function getCommandSet(lenses: Record<string, Lens>, { user, space, lens,
             lensParameters: {
               ...Object.fromEntries(Object.entries(lensParameters!).map(([k, v]) => [k, async (rc: RunContext) => v])),
               [freeKey!]: async ({fetch}: RunContext) => {
-                const r = await fetchJSON(fetch, urls.api.collectionSpaceMembership({name: c.name, owner: c.name}))
+                const r = await fetchList(fetch, urls.api.collectionSpaceMembership({name: c.name, owner: c.name}))
                 console.log({ r, c })
                 // collection.join(",")
                 return ","
@@ -3,6 +3,7 @@ import { error } from '@sveltejs/kit'
 import {
   urls,
   fetchJSON,
+  fetchList,
   processLenses,
   processLensSpecs,
   processSpaces,
@@ -70,20 +71,20 @@ export async function load({ params, url, fetch }) {
     switch (type) {
       case "collections": {
         if (id) {
-          const spaces = await fetchJSON(fetch, urls.api.collectionSpaceMembership({ owner, name: id }))
+          const spaces = await fetchList(fetch, urls.api.collectionSpaceMembership({ owner, name: id }))
           selections.push({
             entityType: "space",
             entities: processSpaces(spaces),
             label: `${owner}/${id} Spaces`,
           })
-          const lenses = await fetchJSON(fetch, urls.api.collectionLensMembership({ owner, name: id }))
+          const lenses = await fetchList(fetch, urls.api.collectionLensMembership({ owner, name: id }))
           selections.push({
             entityType: "lens",
             entities: processLensSpecs(lenses),
             label: `${owner}/${id} Lenses`,
           })
         } else {
-          const collections = await fetchJSON(fetch, urls.api.collections({ owner }))
+          const collections = await fetchList(fetch, urls.api.collections({ owner }))
           selections.push({
             entityType: "collection",
             entities: collections,
@@ -93,7 +94,7 @@ export async function load({ params, url, fetch }) {
         break
       }
       case "spaces": {
-        const spaces = await fetchJSON(fetch, urls.api.spaces({ owner }))
+        const spaces = await fetchList(fetch, urls.api.spaces({ owner }))
         selections.push({
           entityType: "space",
           entities: processSpaces(spaces),
@@ -102,7 +103,7 @@ export async function load({ params, url, fetch }) {
         break
       }
       case undefined: {
-        const spaces = await fetchJSON(fetch, urls.api.spaces({ owner }))
+        const spaces = await fetchList(fetch, urls.api.spaces({ owner }))
         selections.push({
           entityType: "space",
           entities: processSpaces(spaces),
@@ -114,7 +115,7 @@ export async function load({ params, url, fetch }) {
           },
         })
 
-        const collections = await fetchJSON(fetch, urls.api.collections({ owner }))
+        const collections = await fetchList(fetch, urls.api.collections({ owner }))
         selections.push({
           entityType: "collection",
           entities: collections,
@@ -142,7 +143,7 @@ export async function load({ params, url, fetch }) {
         break
       }
       case "spaces": {
-        const spaces = await fetchJSON(fetch, urls.api.spaces({}))
+        const spaces = await fetchList(fetch, urls.api.spaces({}))
         selections.push({
           entityType: "space",
           entities: processSpaces(spaces),
@@ -151,7 +152,7 @@ export async function load({ params, url, fetch }) {
         break
       }
       case "activities": {
-        const activities = await fetchJSON(fetch, urls.api.activities({}))
+        const activities = await fetchList(fetch, urls.api.activities({}))
         selections.push({
           entityType: "activity",
           // HACK we should exclude these "system" activities in a more principled way
@@ -161,7 +162,7 @@ export async function load({ params, url, fetch }) {
         break
       }
       case "events": {
-        const events = await fetchJSON(fetch, urls.api.events({}))
+        const events = await fetchList(fetch, urls.api.events({}))
         selections.push({
           entityType: "event",
           entities: processEvents(events),